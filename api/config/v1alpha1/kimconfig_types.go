@@ -0,0 +1,279 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cfg "sigs.k8s.io/controller-runtime/pkg/config/v1alpha1"
+)
+
+// FeaturesConfig enables or disables the optional features of KIM.
+// A feature not set is enabled when configured, e.g. home namespaces are
+// enabled if a name template is set.
+type FeaturesConfig struct {
+	// SelfService enables the self-service API
+	//+optional
+	SelfService *bool `json:"selfService,omitempty"`
+	// HomeNamespaces enables the provisioning of Users' home namespaces
+	//+optional
+	HomeNamespaces *bool `json:"homeNamespaces,omitempty"`
+	// Invitations enables the Invitation controller, enabled if not set
+	//+optional
+	Invitations *bool `json:"invitations,omitempty"`
+	// InactivitySuspension enables the suspension of inactive Users
+	//+optional
+	InactivitySuspension *bool `json:"inactivitySuspension,omitempty"`
+	// Audit enables the audit log
+	//+optional
+	Audit *bool `json:"audit,omitempty"`
+	// Webhooks enables the admission, conversion and authentication webhooks, enabled if not set
+	//+optional
+	Webhooks *bool `json:"webhooks,omitempty"`
+	// OrphanSweeper enables the periodic sweep of orphaned ServiceAccounts and Secrets
+	//+optional
+	OrphanSweeper *bool `json:"orphanSweeper,omitempty"`
+}
+
+// SelfServiceConfig configures the self-service API
+type SelfServiceConfig struct {
+	// BindAddress is the address the self-service API binds to
+	//+optional
+	BindAddress string `json:"bindAddress,omitempty"`
+	// CertDir is the directory containing the tls.crt and tls.key files the
+	// self-service API is served with. Required unless Insecure is set.
+	//+optional
+	CertDir string `json:"certDir,omitempty"`
+	// Insecure serves the self-service API over plain HTTP when CertDir is
+	// not set, exposing the tokens and codes it handles. Only for development.
+	//+optional
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// ServiceAccountsConfig configures the ServiceAccount and token Secret provisioned for each User
+type ServiceAccountsConfig struct {
+	// NameTemplate is the Go template of the name of the ServiceAccounts and
+	// token Secrets (e.g. 'kim-{{ .Name }}'), executed with the Name, Namespace
+	// and Username of the User
+	//+optional
+	NameTemplate string `json:"nameTemplate,omitempty"`
+	// SecretType is the type of the token Secrets. Kubernetes only populates
+	// the kubernetes.io/service-account-token ones, Secrets of other types
+	// must be populated by another controller.
+	//+optional
+	SecretType string `json:"secretType,omitempty"`
+}
+
+// PersonalAccessTokensConfig configures the PersonalAccessTokens created through the self-service API
+type PersonalAccessTokensConfig struct {
+	// DefaultLifetime is the lifetime of PersonalAccessTokens without an explicit one
+	//+optional
+	DefaultLifetime metav1.Duration `json:"defaultLifetime,omitempty"`
+	// MaxLifetime is the maximum lifetime of PersonalAccessTokens, 0 for no limit
+	//+optional
+	MaxLifetime metav1.Duration `json:"maxLifetime,omitempty"`
+}
+
+// HomeNamespacesConfig configures the home namespaces provisioned for Users
+type HomeNamespacesConfig struct {
+	// NameTemplate is the Go template of the home namespaces' name (e.g. 'home-{{ .Name }}')
+	//+optional
+	NameTemplate string `json:"nameTemplate,omitempty"`
+	// ClusterRole is granted to Users in their home namespace
+	//+optional
+	ClusterRole string `json:"clusterRole,omitempty"`
+	// ResourcesFile is the path to a YAML file containing the ResourceQuota and/or LimitRange of home namespaces
+	//+optional
+	ResourcesFile string `json:"resourcesFile,omitempty"`
+	// RetentionPolicy is what happens to the home namespace when its User is suspended, banned or deleted: Retain or Delete
+	//+optional
+	RetentionPolicy string `json:"retentionPolicy,omitempty"`
+}
+
+// QuotasConfig configures the maximum number of resources each User can hold, 0 for no limit
+type QuotasConfig struct {
+	//+optional
+	MaxPersonalAccessTokens int32 `json:"maxPersonalAccessTokens,omitempty"`
+	//+optional
+	MaxAccessGrants int32 `json:"maxAccessGrants,omitempty"`
+	//+optional
+	MaxNamespaces int32 `json:"maxNamespaces,omitempty"`
+}
+
+// AccessGrantsConfig restricts the roles AccessGrants can grant and where
+type AccessGrantsConfig struct {
+	// GrantableRoles are the only roles AccessGrants can grant, none if empty
+	//+optional
+	GrantableRoles []GrantableRole `json:"grantableRoles,omitempty"`
+	// AllowClusterScope allows ClusterRoles to be granted cluster-wide, by
+	// AccessGrants with an empty scope
+	//+optional
+	AllowClusterScope bool `json:"allowClusterScope,omitempty"`
+}
+
+// GrantableRole is a role AccessGrants can grant
+type GrantableRole struct {
+	// Kind of the role, Role or ClusterRole
+	Kind string `json:"kind"`
+	// Name of the role
+	Name string `json:"name"`
+}
+
+// InvitationsConfig configures the Invitations
+type InvitationsConfig struct {
+	// Lifetime is the lifetime of Invitations without an explicit expiration
+	//+optional
+	Lifetime metav1.Duration `json:"lifetime,omitempty"`
+	// AutoApprove activates the Users created by redeeming an Invitation
+	//+optional
+	AutoApprove bool `json:"autoApprove,omitempty"`
+}
+
+// InactivityConfig configures the suspension of inactive Users
+type InactivityConfig struct {
+	// SuspendAfter is the inactivity period Active Users are suspended after.
+	// The use of the ServiceAccount tokens is only seen, with a daily granularity,
+	// with the LegacyServiceAccountTokenTracking feature of Kubernetes enabled.
+	//+optional
+	SuspendAfter metav1.Duration `json:"suspendAfter,omitempty"`
+	// WarningPeriod is how long before being suspended Users are warned
+	//+optional
+	WarningPeriod metav1.Duration `json:"warningPeriod,omitempty"`
+	// ActivityGranularity is the minimum time between two updates of a User's last activity
+	//+optional
+	ActivityGranularity metav1.Duration `json:"activityGranularity,omitempty"`
+}
+
+// AuditConfig configures the audit log
+type AuditConfig struct {
+	// Sink is where audit records are written: 'stdout', 'file://<path>' or an HTTP(S) URL
+	//+optional
+	Sink string `json:"sink,omitempty"`
+	// FileMaxSize is the size in bytes the audit file is rotated at
+	//+optional
+	FileMaxSize int64 `json:"fileMaxSize,omitempty"`
+	// FileMaxBackups is the number of rotated audit files retained
+	//+optional
+	FileMaxBackups int `json:"fileMaxBackups,omitempty"`
+}
+
+// OrphanSweeperConfig configures the sweep of the ServiceAccounts and token
+// Secrets provisioned for Users that are gone or not Active
+type OrphanSweeperConfig struct {
+	// Interval is the time between two sweeps
+	//+optional
+	Interval metav1.Duration `json:"interval,omitempty"`
+	// DryRun reports the orphaned objects without deleting them, true if not
+	// set by the configuration file nor the flags
+	//+optional
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// KIMConfig is the Schema for the configuration file of the KIM manager
+type KIMConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// ControllerManagerConfigurationSpec configures the manager: leader
+	// election, sync period, metrics, health probes and webhook server
+	cfg.ControllerManagerConfigurationSpec `json:",inline"`
+
+	// WatchNamespaces are the namespaces watched by KIM, all if empty.
+	// The WATCH_NAMESPACE environment variable, if not empty, takes precedence.
+	//+optional
+	WatchNamespaces []string `json:"watchNamespaces,omitempty"`
+
+	// Plan makes KIM report the actions it would perform in the status and
+	// Events of Users, AccessGrants, PersonalAccessTokens and Invitations
+	// instead of performing them
+	//+optional
+	Plan bool `json:"plan,omitempty"`
+
+	//+optional
+	Features FeaturesConfig `json:"features,omitempty"`
+	//+optional
+	SelfService SelfServiceConfig `json:"selfService,omitempty"`
+	//+optional
+	ServiceAccounts ServiceAccountsConfig `json:"serviceAccounts,omitempty"`
+	//+optional
+	PersonalAccessTokens PersonalAccessTokensConfig `json:"personalAccessTokens,omitempty"`
+	//+optional
+	HomeNamespaces HomeNamespacesConfig `json:"homeNamespaces,omitempty"`
+	//+optional
+	Quotas QuotasConfig `json:"quotas,omitempty"`
+	//+optional
+	AccessGrants AccessGrantsConfig `json:"accessGrants,omitempty"`
+	//+optional
+	Invitations InvitationsConfig `json:"invitations,omitempty"`
+	//+optional
+	Inactivity InactivityConfig `json:"inactivity,omitempty"`
+	//+optional
+	Audit AuditConfig `json:"audit,omitempty"`
+	//+optional
+	OrphanSweeper OrphanSweeperConfig `json:"orphanSweeper,omitempty"`
+}
+
+// Complete returns the configuration of the manager
+func (c *KIMConfig) Complete() (cfg.ControllerManagerConfigurationSpec, error) {
+	return c.ControllerManagerConfigurationSpec, nil
+}
+
+// SelfServiceEnabled returns true if the self-service API is enabled, by default when a bind address is set
+func (c *KIMConfig) SelfServiceEnabled() bool {
+	return enabled(c.Features.SelfService, c.SelfService.BindAddress != "" && c.SelfService.BindAddress != "0")
+}
+
+// HomeNamespacesEnabled returns true if home namespaces are provisioned, by default when a name template is set
+func (c *KIMConfig) HomeNamespacesEnabled() bool {
+	return enabled(c.Features.HomeNamespaces, c.HomeNamespaces.NameTemplate != "")
+}
+
+// InvitationsEnabled returns true if the Invitation controller is enabled, by default it is
+func (c *KIMConfig) InvitationsEnabled() bool {
+	return enabled(c.Features.Invitations, true)
+}
+
+// InactivitySuspensionEnabled returns true if inactive Users are suspended, by default when a period is set
+func (c *KIMConfig) InactivitySuspensionEnabled() bool {
+	return enabled(c.Features.InactivitySuspension, c.Inactivity.SuspendAfter.Duration > 0)
+}
+
+// AuditEnabled returns true if the audit log is enabled, by default when a sink is set
+func (c *KIMConfig) AuditEnabled() bool {
+	return enabled(c.Features.Audit, c.Audit.Sink != "")
+}
+
+// WebhooksEnabled returns true if the webhooks are enabled, by default they are
+func (c *KIMConfig) WebhooksEnabled() bool {
+	return enabled(c.Features.Webhooks, true)
+}
+
+// OrphanSweeperEnabled returns true if orphaned objects are swept, by default when an interval is set
+func (c *KIMConfig) OrphanSweeperEnabled() bool {
+	return enabled(c.Features.OrphanSweeper, c.OrphanSweeper.Interval.Duration > 0)
+}
+
+func enabled(feature *bool, byDefault bool) bool {
+	if feature == nil {
+		return byDefault
+	}
+	return *feature
+}
+
+func init() {
+	SchemeBuilder.Register(&KIMConfig{})
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+)
+
+// Kind is the kind of the configuration file
+const Kind = "KIMConfig"
+
+// Load reads the configuration file at path into c. Fields not set in the
+// file keep their value in c, unknown fields are an error.
+func Load(path string, c *KIMConfig) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading configuration file: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return fmt.Errorf("error decoding configuration file %s: %w", path, err)
+	}
+	if c.APIVersion != GroupVersion.String() || c.Kind != Kind {
+		return fmt.Errorf("invalid configuration file %s: expected apiVersion %s and kind %s, got %q and %q",
+			path, GroupVersion, Kind, c.APIVersion, c.Kind)
+	}
+	return nil
+}
+
+// Validate checks the configuration is consistent, returning all the errors found
+func (c *KIMConfig) Validate() error {
+	var ee field.ErrorList
+
+	if c.SyncPeriod != nil && c.SyncPeriod.Duration <= 0 {
+		ee = append(ee, field.Invalid(field.NewPath("syncPeriod"), c.SyncPeriod.Duration.String(), "must be positive"))
+	}
+	for i, n := range c.WatchNamespaces {
+		for _, msg := range validation.IsDNS1123Label(n) {
+			ee = append(ee, field.Invalid(field.NewPath("watchNamespaces").Index(i), n, msg))
+		}
+	}
+
+	if c.SelfServiceEnabled() && (c.SelfService.BindAddress == "" || c.SelfService.BindAddress == "0") {
+		ee = append(ee, field.Required(field.NewPath("selfService", "bindAddress"), "required when the self-service API is enabled"))
+	}
+	if c.SelfServiceEnabled() && c.SelfService.CertDir == "" && !c.SelfService.Insecure {
+		ee = append(ee, field.Required(field.NewPath("selfService", "certDir"),
+			"required when the self-service API is enabled, unless insecure is set"))
+	}
+
+	ee = append(ee, validateServiceAccounts(field.NewPath("serviceAccounts"), c.ServiceAccounts)...)
+
+	p := field.NewPath("personalAccessTokens")
+	pat := c.PersonalAccessTokens
+	ee = append(ee, positive(p.Child("defaultLifetime"), pat.DefaultLifetime)...)
+	ee = append(ee, notNegative(p.Child("maxLifetime"), pat.MaxLifetime)...)
+	if pat.MaxLifetime.Duration > 0 && pat.DefaultLifetime.Duration > pat.MaxLifetime.Duration {
+		ee = append(ee, field.Invalid(p.Child("defaultLifetime"), pat.DefaultLifetime.Duration.String(),
+			fmt.Sprintf("must not exceed maxLifetime (%s)", pat.MaxLifetime.Duration)))
+	}
+
+	if c.HomeNamespacesEnabled() {
+		p := field.NewPath("homeNamespaces")
+		if c.HomeNamespaces.NameTemplate == "" {
+			ee = append(ee, field.Required(p.Child("nameTemplate"), "required when home namespaces are enabled"))
+		}
+		if c.HomeNamespaces.ClusterRole == "" {
+			ee = append(ee, field.Required(p.Child("clusterRole"), "required when home namespaces are enabled"))
+		}
+		if rp := c.HomeNamespaces.RetentionPolicy; rp != "Retain" && rp != "Delete" {
+			ee = append(ee, field.NotSupported(p.Child("retentionPolicy"), rp, []string{"Retain", "Delete"}))
+		}
+	}
+
+	p = field.NewPath("quotas")
+	for _, q := range []struct {
+		name  string
+		value int32
+	}{
+		{"maxPersonalAccessTokens", c.Quotas.MaxPersonalAccessTokens},
+		{"maxAccessGrants", c.Quotas.MaxAccessGrants},
+		{"maxNamespaces", c.Quotas.MaxNamespaces},
+	} {
+		if q.value < 0 {
+			ee = append(ee, field.Invalid(p.Child(q.name), q.value, "must not be negative"))
+		}
+	}
+
+	p = field.NewPath("accessGrants", "grantableRoles")
+	for i, r := range c.AccessGrants.GrantableRoles {
+		if r.Kind != "Role" && r.Kind != "ClusterRole" {
+			ee = append(ee, field.NotSupported(p.Index(i).Child("kind"), r.Kind, []string{"Role", "ClusterRole"}))
+		}
+		if r.Name == "" {
+			ee = append(ee, field.Required(p.Index(i).Child("name"), ""))
+		}
+	}
+
+	ee = append(ee, positive(field.NewPath("invitations", "lifetime"), c.Invitations.Lifetime)...)
+
+	p = field.NewPath("inactivity")
+	in := c.Inactivity
+	ee = append(ee, positive(p.Child("activityGranularity"), in.ActivityGranularity)...)
+	ee = append(ee, notNegative(p.Child("warningPeriod"), in.WarningPeriod)...)
+	if c.InactivitySuspensionEnabled() {
+		ee = append(ee, positive(p.Child("suspendAfter"), in.SuspendAfter)...)
+		if in.WarningPeriod.Duration >= in.SuspendAfter.Duration {
+			ee = append(ee, field.Invalid(p.Child("warningPeriod"), in.WarningPeriod.Duration.String(),
+				fmt.Sprintf("must be shorter than suspendAfter (%s)", in.SuspendAfter.Duration)))
+		}
+	}
+
+	if c.AuditEnabled() {
+		p := field.NewPath("audit")
+		if c.Audit.Sink == "" {
+			ee = append(ee, field.Required(p.Child("sink"), "required when the audit log is enabled"))
+		}
+		if c.Audit.FileMaxSize <= 0 {
+			ee = append(ee, field.Invalid(p.Child("fileMaxSize"), c.Audit.FileMaxSize, "must be positive"))
+		}
+		if c.Audit.FileMaxBackups < 0 {
+			ee = append(ee, field.Invalid(p.Child("fileMaxBackups"), c.Audit.FileMaxBackups, "must not be negative"))
+		}
+	}
+
+	if c.OrphanSweeperEnabled() {
+		ee = append(ee, positive(field.NewPath("orphanSweeper", "interval"), c.OrphanSweeper.Interval)...)
+	}
+
+	return ee.ToAggregate()
+}
+
+// serviceAccountTokenSecretType is the type of the Secrets populated by the token controller of Kubernetes
+const serviceAccountTokenSecretType = "kubernetes.io/service-account-token"
+
+func validateServiceAccounts(p *field.Path, c ServiceAccountsConfig) field.ErrorList {
+	var ee field.ErrorList
+
+	// the template is checked against a sample User
+	t, err := template.New("service-account").Option("missingkey=error").Parse(c.NameTemplate)
+	var b bytes.Buffer
+	if err == nil {
+		err = t.Execute(&b, struct{ Name, Namespace, Username string }{"user", "tenant", "user"})
+	}
+	switch {
+	case c.NameTemplate == "":
+		ee = append(ee, field.Required(p.Child("nameTemplate"), ""))
+	case err != nil:
+		ee = append(ee, field.Invalid(p.Child("nameTemplate"), c.NameTemplate, err.Error()))
+	default:
+		for _, msg := range validation.IsDNS1123Subdomain(b.String()) {
+			ee = append(ee, field.Invalid(p.Child("nameTemplate"), c.NameTemplate, "must build valid names: "+msg))
+		}
+	}
+
+	switch st := c.SecretType; {
+	case st == "":
+		ee = append(ee, field.Required(p.Child("secretType"), ""))
+	case st == serviceAccountTokenSecretType:
+	case strings.HasPrefix(st, "kubernetes.io/"):
+		ee = append(ee, field.Invalid(p.Child("secretType"), st, "must be "+serviceAccountTokenSecretType+" or a type not defined by Kubernetes"))
+	default:
+		for _, msg := range validation.IsQualifiedName(st) {
+			ee = append(ee, field.Invalid(p.Child("secretType"), st, msg))
+		}
+	}
+	return ee
+}
+
+func positive(p *field.Path, d metav1.Duration) field.ErrorList {
+	if d.Duration <= 0 {
+		return field.ErrorList{field.Invalid(p, d.Duration.String(), "must be positive")}
+	}
+	return nil
+}
+
+func notNegative(p *field.Path, d metav1.Duration) field.ErrorList {
+	if d.Duration < 0 {
+		return field.ErrorList{field.Invalid(p, d.Duration.String(), "must not be negative")}
+	}
+	return nil
+}
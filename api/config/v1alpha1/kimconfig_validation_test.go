@@ -0,0 +1,172 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func validConfig() KIMConfig {
+	return KIMConfig{
+		ServiceAccounts: ServiceAccountsConfig{NameTemplate: "{{ .Name }}", SecretType: "kubernetes.io/service-account-token"},
+		PersonalAccessTokens: PersonalAccessTokensConfig{
+			DefaultLifetime: metav1.Duration{Duration: 24 * time.Hour},
+			MaxLifetime:     metav1.Duration{Duration: 48 * time.Hour},
+		},
+		HomeNamespaces: HomeNamespacesConfig{ClusterRole: "admin", RetentionPolicy: "Retain"},
+		Invitations:    InvitationsConfig{Lifetime: metav1.Duration{Duration: time.Hour}},
+		Inactivity: InactivityConfig{
+			WarningPeriod:       metav1.Duration{Duration: time.Hour},
+			ActivityGranularity: metav1.Duration{Duration: time.Hour},
+		},
+		Audit: AuditConfig{FileMaxSize: 1 << 20},
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoad(t *testing.T) {
+	c := validConfig()
+	p := writeConfig(t, `apiVersion: config.kim.io/v1alpha1
+kind: KIMConfig
+leaderElection:
+  leaderElect: true
+  resourceName: kim.io
+watchNamespaces: [tenant]
+features:
+  selfService: true
+selfService:
+  bindAddress: ":8082"
+  certDir: /tmp/k8s-self-service/serving-certs
+personalAccessTokens:
+  maxLifetime: 72h
+`)
+	if err := Load(p, &c); err != nil {
+		t.Fatal(err)
+	}
+	if !*c.LeaderElection.LeaderElect || c.WatchNamespaces[0] != "tenant" || !c.SelfServiceEnabled() {
+		t.Errorf("expected the file to be loaded, got %+v", c)
+	}
+	// fields not in the file are kept
+	if c.PersonalAccessTokens.MaxLifetime.Duration != 72*time.Hour || c.PersonalAccessTokens.DefaultLifetime.Duration != 24*time.Hour {
+		t.Errorf("expected the file to be merged, got %+v", c.PersonalAccessTokens)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("unexpected validation error: %v", err)
+	}
+
+	for _, content := range []string{
+		"apiVersion: config.kim.io/v1alpha1\nkind: KIMConfig\nunknown: true\n",
+		"apiVersion: kim.io/v1beta1\nkind: User\n",
+	} {
+		c := validConfig()
+		if err := Load(writeConfig(t, content), &c); err == nil {
+			t.Errorf("expected an error loading %q", content)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	enabled := true
+	for name, tc := range map[string]struct {
+		mutate func(*KIMConfig)
+		field  string
+	}{
+		"default exceeding max lifetime": {
+			mutate: func(c *KIMConfig) { c.PersonalAccessTokens.DefaultLifetime.Duration = 72 * time.Hour },
+			field:  "personalAccessTokens.defaultLifetime",
+		},
+		"home namespaces without template": {
+			mutate: func(c *KIMConfig) { c.Features.HomeNamespaces = &enabled },
+			field:  "homeNamespaces.nameTemplate",
+		},
+		"unknown retention policy": {
+			mutate: func(c *KIMConfig) {
+				c.HomeNamespaces.NameTemplate = "home-{{ .Name }}"
+				c.HomeNamespaces.RetentionPolicy = "Archive"
+			},
+			field: "homeNamespaces.retentionPolicy",
+		},
+		"self-service without address": {
+			mutate: func(c *KIMConfig) { c.Features.SelfService = &enabled },
+			field:  "selfService.bindAddress",
+		},
+		"self-service without certificate": {
+			mutate: func(c *KIMConfig) { c.SelfService.BindAddress = ":8082" },
+			field:  "selfService.certDir",
+		},
+		"negative quota": {
+			mutate: func(c *KIMConfig) { c.Quotas.MaxAccessGrants = -1 },
+			field:  "quotas.maxAccessGrants",
+		},
+		"warning longer than suspension": {
+			mutate: func(c *KIMConfig) { c.Inactivity.SuspendAfter.Duration = time.Minute },
+			field:  "inactivity.warningPeriod",
+		},
+		"orphan sweeper without interval": {
+			mutate: func(c *KIMConfig) { c.Features.OrphanSweeper = &enabled },
+			field:  "orphanSweeper.interval",
+		},
+		"grantable role of unknown kind": {
+			mutate: func(c *KIMConfig) {
+				c.AccessGrants.GrantableRoles = []GrantableRole{{Kind: "ClusterRole", Name: "view"}, {Kind: "Group", Name: "admins"}}
+			},
+			field: "accessGrants.grantableRoles[1].kind",
+		},
+		"service account name template not parsing": {
+			mutate: func(c *KIMConfig) { c.ServiceAccounts.NameTemplate = "kim-{{ .Name" },
+			field:  "serviceAccounts.nameTemplate",
+		},
+		"service account name template building invalid names": {
+			mutate: func(c *KIMConfig) { c.ServiceAccounts.NameTemplate = "KIM_{{ .Name }}" },
+			field:  "serviceAccounts.nameTemplate",
+		},
+		"service account name template with unknown field": {
+			mutate: func(c *KIMConfig) { c.ServiceAccounts.NameTemplate = "{{ .Email }}" },
+			field:  "serviceAccounts.nameTemplate",
+		},
+		"secret type defined by Kubernetes": {
+			mutate: func(c *KIMConfig) { c.ServiceAccounts.SecretType = "kubernetes.io/tls" },
+			field:  "serviceAccounts.secretType",
+		},
+		"invalid namespace": {
+			mutate: func(c *KIMConfig) { c.WatchNamespaces = []string{"Tenant"} },
+			field:  "watchNamespaces[0]",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := validConfig()
+			tc.mutate(&c)
+			err := c.Validate()
+			if err == nil || !strings.Contains(err.Error(), tc.field) {
+				t.Fatalf("expected an error on %s, got %v", tc.field, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+//go:build !ignore_autogenerated
+// +build !ignore_autogenerated
+
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Code generated by controller-gen. DO NOT EDIT.
+
+package v1alpha1
+
+import (
+	runtime "k8s.io/apimachinery/pkg/runtime"
+)
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AccessGrantsConfig) DeepCopyInto(out *AccessGrantsConfig) {
+	*out = *in
+	if in.GrantableRoles != nil {
+		in, out := &in.GrantableRoles, &out.GrantableRoles
+		*out = make([]GrantableRole, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AccessGrantsConfig.
+func (in *AccessGrantsConfig) DeepCopy() *AccessGrantsConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(AccessGrantsConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AuditConfig) DeepCopyInto(out *AuditConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AuditConfig.
+func (in *AuditConfig) DeepCopy() *AuditConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(AuditConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FeaturesConfig) DeepCopyInto(out *FeaturesConfig) {
+	*out = *in
+	if in.SelfService != nil {
+		in, out := &in.SelfService, &out.SelfService
+		*out = new(bool)
+		**out = **in
+	}
+	if in.HomeNamespaces != nil {
+		in, out := &in.HomeNamespaces, &out.HomeNamespaces
+		*out = new(bool)
+		**out = **in
+	}
+	if in.Invitations != nil {
+		in, out := &in.Invitations, &out.Invitations
+		*out = new(bool)
+		**out = **in
+	}
+	if in.InactivitySuspension != nil {
+		in, out := &in.InactivitySuspension, &out.InactivitySuspension
+		*out = new(bool)
+		**out = **in
+	}
+	if in.Audit != nil {
+		in, out := &in.Audit, &out.Audit
+		*out = new(bool)
+		**out = **in
+	}
+	if in.Webhooks != nil {
+		in, out := &in.Webhooks, &out.Webhooks
+		*out = new(bool)
+		**out = **in
+	}
+	if in.OrphanSweeper != nil {
+		in, out := &in.OrphanSweeper, &out.OrphanSweeper
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FeaturesConfig.
+func (in *FeaturesConfig) DeepCopy() *FeaturesConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(FeaturesConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GrantableRole) DeepCopyInto(out *GrantableRole) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GrantableRole.
+func (in *GrantableRole) DeepCopy() *GrantableRole {
+	if in == nil {
+		return nil
+	}
+	out := new(GrantableRole)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HomeNamespacesConfig) DeepCopyInto(out *HomeNamespacesConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HomeNamespacesConfig.
+func (in *HomeNamespacesConfig) DeepCopy() *HomeNamespacesConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(HomeNamespacesConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InactivityConfig) DeepCopyInto(out *InactivityConfig) {
+	*out = *in
+	out.SuspendAfter = in.SuspendAfter
+	out.WarningPeriod = in.WarningPeriod
+	out.ActivityGranularity = in.ActivityGranularity
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InactivityConfig.
+func (in *InactivityConfig) DeepCopy() *InactivityConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(InactivityConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InvitationsConfig) DeepCopyInto(out *InvitationsConfig) {
+	*out = *in
+	out.Lifetime = in.Lifetime
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InvitationsConfig.
+func (in *InvitationsConfig) DeepCopy() *InvitationsConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(InvitationsConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KIMConfig) DeepCopyInto(out *KIMConfig) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ControllerManagerConfigurationSpec.DeepCopyInto(&out.ControllerManagerConfigurationSpec)
+	if in.WatchNamespaces != nil {
+		in, out := &in.WatchNamespaces, &out.WatchNamespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	in.Features.DeepCopyInto(&out.Features)
+	out.SelfService = in.SelfService
+	out.ServiceAccounts = in.ServiceAccounts
+	out.PersonalAccessTokens = in.PersonalAccessTokens
+	out.HomeNamespaces = in.HomeNamespaces
+	out.Quotas = in.Quotas
+	in.AccessGrants.DeepCopyInto(&out.AccessGrants)
+	out.Invitations = in.Invitations
+	out.Inactivity = in.Inactivity
+	out.Audit = in.Audit
+	out.OrphanSweeper = in.OrphanSweeper
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KIMConfig.
+func (in *KIMConfig) DeepCopy() *KIMConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(KIMConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *KIMConfig) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OrphanSweeperConfig) DeepCopyInto(out *OrphanSweeperConfig) {
+	*out = *in
+	out.Interval = in.Interval
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OrphanSweeperConfig.
+func (in *OrphanSweeperConfig) DeepCopy() *OrphanSweeperConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(OrphanSweeperConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PersonalAccessTokensConfig) DeepCopyInto(out *PersonalAccessTokensConfig) {
+	*out = *in
+	out.DefaultLifetime = in.DefaultLifetime
+	out.MaxLifetime = in.MaxLifetime
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PersonalAccessTokensConfig.
+func (in *PersonalAccessTokensConfig) DeepCopy() *PersonalAccessTokensConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(PersonalAccessTokensConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *QuotasConfig) DeepCopyInto(out *QuotasConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new QuotasConfig.
+func (in *QuotasConfig) DeepCopy() *QuotasConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(QuotasConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SelfServiceConfig) DeepCopyInto(out *SelfServiceConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SelfServiceConfig.
+func (in *SelfServiceConfig) DeepCopy() *SelfServiceConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(SelfServiceConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceAccountsConfig) DeepCopyInto(out *ServiceAccountsConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceAccountsConfig.
+func (in *ServiceAccountsConfig) DeepCopy() *ServiceAccountsConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceAccountsConfig)
+	in.DeepCopyInto(out)
+	return out
+}
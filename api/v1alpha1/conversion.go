@@ -0,0 +1,70 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConversionDataAnnotation holds the spec fields of the hub version that can not be
+// represented in v1alpha1, so that they survive a round trip through this version.
+// The status is not preserved: it is written by KIM through the hub version and
+// updates of the main resource ignore it.
+const ConversionDataAnnotation = "kim.io/conversion-data"
+
+// marshalConversionData stores data in the ConversionDataAnnotation of obj.
+// The annotation is not set when data has no fields to preserve.
+func marshalConversionData(obj metav1.Object, data interface{}) error {
+	d, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if string(d) == "{}" {
+		return nil
+	}
+
+	aa := obj.GetAnnotations()
+	if aa == nil {
+		aa = map[string]string{}
+	}
+	aa[ConversionDataAnnotation] = string(d)
+	obj.SetAnnotations(aa)
+	return nil
+}
+
+// unmarshalConversionData loads into data the content of the
+// ConversionDataAnnotation of obj, if any, and removes the annotation.
+func unmarshalConversionData(obj metav1.Object, data interface{}) (bool, error) {
+	aa := obj.GetAnnotations()
+	d, ok := aa[ConversionDataAnnotation]
+	if !ok {
+		return false, nil
+	}
+
+	if err := json.Unmarshal([]byte(d), data); err != nil {
+		return false, err
+	}
+
+	delete(aa, ConversionDataAnnotation)
+	if len(aa) == 0 {
+		aa = nil
+	}
+	obj.SetAnnotations(aa)
+	return true, nil
+}
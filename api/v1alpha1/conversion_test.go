@@ -0,0 +1,149 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/filariow/kim/api/v1beta1"
+)
+
+func TestUserConversionRoundTrip(t *testing.T) {
+	ig := int64(1)
+	exp := metav1.NewTime(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	hub := v1beta1.User{
+		ObjectMeta: metav1.ObjectMeta{Name: "user", Namespace: "ns", Generation: 2},
+		Spec: v1beta1.UserSpec{
+			Email:          "user@kim.io",
+			Username:       "user",
+			State:          v1beta1.SuspendedUserState,
+			Expiration:     &exp,
+			SuspendedUntil: &exp,
+			ReasonCode:     "Vacation",
+			Profiles:       []v1beta1.AccessProfileReference{{Name: "developers"}},
+		},
+		Status: v1beta1.UserStatus{
+			InitialGeneration: &ig,
+			State:             v1beta1.SuspendedUserState,
+		},
+	}
+
+	var spoke User
+	if err := spoke.ConvertFrom(hub.DeepCopy()); err != nil {
+		t.Fatalf("error converting from hub: %v", err)
+	}
+	if _, ok := spoke.Annotations[ConversionDataAnnotation]; !ok {
+		t.Fatalf("expected annotation %s to be set", ConversionDataAnnotation)
+	}
+	if spoke.Spec.State != SuspendedUserState || spoke.Spec.Email != hub.Spec.Email {
+		t.Fatalf("unexpected spec after conversion: %+v", spoke.Spec)
+	}
+
+	var got v1beta1.User
+	if err := spoke.ConvertTo(&got); err != nil {
+		t.Fatalf("error converting to hub: %v", err)
+	}
+	if !equality.Semantic.DeepEqual(hub, got) {
+		t.Fatalf("round trip mismatch:\nwant %+v\ngot  %+v", hub, got)
+	}
+}
+
+func TestUserConversionDataHoldsOnlyMissingFields(t *testing.T) {
+	exp := metav1.NewTime(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	hub := v1beta1.User{
+		ObjectMeta: metav1.ObjectMeta{Name: "user", Namespace: "ns"},
+		Spec: v1beta1.UserSpec{
+			Email:    "user@kim.io",
+			Username: "user",
+			State:    v1beta1.ActiveUserState,
+		},
+		Status: v1beta1.UserStatus{
+			State: v1beta1.ActiveUserState,
+			Conditions: []metav1.Condition{
+				{Type: "Ready", Status: metav1.ConditionTrue, Reason: "Provisioned", LastTransitionTime: exp},
+			},
+			History: []v1beta1.UserStateTransition{
+				{To: v1beta1.ActiveUserState, Timestamp: exp},
+			},
+		},
+	}
+
+	var spoke User
+	if err := spoke.ConvertFrom(hub.DeepCopy()); err != nil {
+		t.Fatalf("error converting from hub: %v", err)
+	}
+	if d, ok := spoke.Annotations[ConversionDataAnnotation]; ok {
+		t.Fatalf("expected no annotation %s, got %q", ConversionDataAnnotation, d)
+	}
+
+	hub.Spec.Profiles = []v1beta1.AccessProfileReference{{Name: "developers"}}
+	spoke = User{}
+	if err := spoke.ConvertFrom(hub.DeepCopy()); err != nil {
+		t.Fatalf("error converting from hub: %v", err)
+	}
+	if d, want := spoke.Annotations[ConversionDataAnnotation], `{"profiles":[{"name":"developers"}]}`; d != want {
+		t.Fatalf("expected annotation %s to be %q, got %q", ConversionDataAnnotation, want, d)
+	}
+}
+
+func TestPersonalAccessTokenConversionRoundTrip(t *testing.T) {
+	exp := metav1.NewTime(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	hub := v1beta1.PersonalAccessToken{
+		ObjectMeta: metav1.ObjectMeta{Name: "pat", Namespace: "ns"},
+		Spec: v1beta1.PersonalAccessTokenSpec{
+			User:       v1beta1.UserReference{Name: "user"},
+			Expiration: &exp,
+		},
+	}
+
+	var spoke PersonalAccessToken
+	if err := spoke.ConvertFrom(hub.DeepCopy()); err != nil {
+		t.Fatalf("error converting from hub: %v", err)
+	}
+	if spoke.Spec.Deadline == nil || spoke.Spec.Deadline.Seconds != exp.Unix() {
+		t.Fatalf("expected deadline %d, got %v", exp.Unix(), spoke.Spec.Deadline)
+	}
+
+	var got v1beta1.PersonalAccessToken
+	if err := spoke.ConvertTo(&got); err != nil {
+		t.Fatalf("error converting to hub: %v", err)
+	}
+	if !equality.Semantic.DeepEqual(hub, got) {
+		t.Fatalf("round trip mismatch:\nwant %+v\ngot  %+v", hub, got)
+	}
+}
+
+func TestPersonalAccessTokenConvertToWithoutConversionData(t *testing.T) {
+	spoke := PersonalAccessToken{
+		ObjectMeta: metav1.ObjectMeta{Name: "pat", Namespace: "ns"},
+		Spec: PersonalAccessTokenSpec{
+			Deadline: &metav1.Timestamp{Seconds: 1893456000},
+		},
+	}
+
+	var got v1beta1.PersonalAccessToken
+	if err := spoke.ConvertTo(&got); err != nil {
+		t.Fatalf("error converting to hub: %v", err)
+	}
+	if got.Spec.Expiration == nil || !got.Spec.Expiration.Time.Equal(time.Unix(1893456000, 0)) {
+		t.Fatalf("unexpected expiration: %v", got.Spec.Expiration)
+	}
+}
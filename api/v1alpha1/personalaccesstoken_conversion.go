@@ -0,0 +1,74 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/filariow/kim/api/v1beta1"
+)
+
+// personalAccessTokenConversionData holds the fields of the v1beta1
+// PersonalAccessTokenSpec missing in v1alpha1
+type personalAccessTokenConversionData struct {
+	User *v1beta1.UserReference `json:"user,omitempty"`
+}
+
+// ConvertTo converts this PersonalAccessToken to the Hub version (v1beta1).
+func (src *PersonalAccessToken) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1beta1.PersonalAccessToken)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+
+	// restore the fields v1alpha1 can not represent
+	var d personalAccessTokenConversionData
+	if _, err := unmarshalConversionData(dst, &d); err != nil {
+		return err
+	}
+	dst.Spec.User = v1beta1.UserReference{}
+	if d.User != nil {
+		dst.Spec.User = *d.User
+	}
+
+	dst.Spec.Expiration = nil
+	if src.Spec.Deadline != nil {
+		t := metav1.Unix(src.Spec.Deadline.Seconds, int64(src.Spec.Deadline.Nanos))
+		dst.Spec.Expiration = &t
+	}
+	return nil
+}
+
+// ConvertFrom converts from the Hub version (v1beta1) to this version.
+func (dst *PersonalAccessToken) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1beta1.PersonalAccessToken)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+
+	dst.Spec.Deadline = nil
+	if src.Spec.Expiration != nil {
+		dst.Spec.Deadline = src.Spec.Expiration.ProtoTime()
+	}
+
+	// preserve the fields v1alpha1 can not represent
+	d := personalAccessTokenConversionData{}
+	if src.Spec.User.Name != "" {
+		u := src.Spec.User
+		d.User = &u
+	}
+	return marshalConversionData(dst, &d)
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/filariow/kim/api/v1beta1"
+)
+
+// userConversionData holds the fields of the v1beta1 UserSpec missing in v1alpha1
+type userConversionData struct {
+	SuspendedUntil *metav1.Time                     `json:"suspendedUntil,omitempty"`
+	BannedUntil    *metav1.Time                     `json:"bannedUntil,omitempty"`
+	ReasonCode     string                           `json:"reasonCode,omitempty"`
+	Profiles       []v1beta1.AccessProfileReference `json:"profiles,omitempty"`
+}
+
+// ConvertTo converts this User to the Hub version (v1beta1).
+func (src *User) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1beta1.User)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+
+	// restore the fields v1alpha1 can not represent
+	var d userConversionData
+	if _, err := unmarshalConversionData(dst, &d); err != nil {
+		return err
+	}
+	dst.Spec.SuspendedUntil = d.SuspendedUntil
+	dst.Spec.BannedUntil = d.BannedUntil
+	dst.Spec.ReasonCode = d.ReasonCode
+	dst.Spec.Profiles = d.Profiles
+
+	dst.Spec.Email = src.Spec.Email
+	dst.Spec.Username = src.Spec.Username
+	dst.Spec.State = v1beta1.UserState(src.Spec.State)
+	dst.Spec.Expiration = src.Spec.Expiration.DeepCopy()
+	dst.Spec.DisplayName = copyString(src.Spec.DisplayName)
+	dst.Spec.GivenName = copyString(src.Spec.GivenName)
+	dst.Spec.FamilyName = copyString(src.Spec.FamilyName)
+	dst.Spec.Company = copyString(src.Spec.Company)
+	dst.Spec.SecondaryMail = copyString(src.Spec.SecondaryMail)
+
+	dst.Status.InitialGeneration = copyInt64(src.Status.InitialGeneration)
+	dst.Status.State = v1beta1.UserState(src.Status.State)
+	return nil
+}
+
+// ConvertFrom converts from the Hub version (v1beta1) to this version.
+func (dst *User) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1beta1.User)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+
+	dst.Spec.Email = src.Spec.Email
+	dst.Spec.Username = src.Spec.Username
+	dst.Spec.State = UserState(src.Spec.State)
+	dst.Spec.Expiration = src.Spec.Expiration.DeepCopy()
+	dst.Spec.DisplayName = copyString(src.Spec.DisplayName)
+	dst.Spec.GivenName = copyString(src.Spec.GivenName)
+	dst.Spec.FamilyName = copyString(src.Spec.FamilyName)
+	dst.Spec.Company = copyString(src.Spec.Company)
+	dst.Spec.SecondaryMail = copyString(src.Spec.SecondaryMail)
+
+	dst.Status.InitialGeneration = copyInt64(src.Status.InitialGeneration)
+	dst.Status.State = UserState(src.Status.State)
+
+	// preserve the fields v1alpha1 can not represent
+	d := userConversionData{
+		SuspendedUntil: src.Spec.SuspendedUntil.DeepCopy(),
+		BannedUntil:    src.Spec.BannedUntil.DeepCopy(),
+		ReasonCode:     src.Spec.ReasonCode,
+		Profiles:       append([]v1beta1.AccessProfileReference(nil), src.Spec.Profiles...),
+	}
+	return marshalConversionData(dst, &d)
+}
+
+func copyString(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	return &c
+}
+
+func copyInt64(i *int64) *int64 {
+	if i == nil {
+		return nil
+	}
+	c := *i
+	return &c
+}
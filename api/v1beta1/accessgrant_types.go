@@ -0,0 +1,127 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// AccessGrantRequestedByAnnotation records the user who requested the AccessGrant
+	AccessGrantRequestedByAnnotation = "kim.io/requested-by"
+	// AccessGrantApprovedByAnnotation records the user who approved the AccessGrant
+	AccessGrantApprovedByAnnotation = "kim.io/approved-by"
+	// AccessGrantApprovedAtAnnotation records when the AccessGrant has been approved, in RFC3339 format
+	AccessGrantApprovedAtAnnotation = "kim.io/approved-at"
+)
+
+type AccessGrantPhase string
+
+const (
+	// PendingAccessGrantPhase is the phase of AccessGrants waiting for approval or for their User to be Active
+	PendingAccessGrantPhase AccessGrantPhase = "Pending"
+	// ActiveAccessGrantPhase is the phase of AccessGrants whose role is bound to the User
+	ActiveAccessGrantPhase AccessGrantPhase = "Active"
+	// ExpiredAccessGrantPhase is the terminal phase of AccessGrants past their expiration
+	ExpiredAccessGrantPhase AccessGrantPhase = "Expired"
+)
+
+// AccessGrantScope defines where the role of an AccessGrant is granted
+type AccessGrantScope struct {
+	// Namespace in which the role is granted. If empty, the ClusterRole is granted cluster-wide.
+	//+optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// AccessGrantSpec defines the desired state of AccessGrant
+type AccessGrantSpec struct {
+	// User the role is granted to
+	//+required
+	User UserReference `json:"user"`
+	// Role granted to the User
+	//+required
+	Role AccessProfileRoleRef `json:"role"`
+	// Scope of the grant
+	//+optional
+	Scope AccessGrantScope `json:"scope,omitempty"`
+	// Duration of the grant, starting from its approval
+	//+required
+	Duration metav1.Duration `json:"duration"`
+	// Reason the access is requested for
+	//+optional
+	Reason string `json:"reason,omitempty"`
+	// Approved is set to grant the access
+	//+optional
+	Approved bool `json:"approved,omitempty"`
+}
+
+// AccessGrantStatus defines the observed state of AccessGrant
+type AccessGrantStatus struct {
+	// ObservedGeneration is the last generation processed by the controller
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Phase is the actual phase of the AccessGrant
+	Phase AccessGrantPhase `json:"phase,omitempty"`
+	// Reason explains the actual phase
+	Reason string `json:"reason,omitempty"`
+	// RequestedBy is the user who requested the AccessGrant
+	RequestedBy string `json:"requestedBy,omitempty"`
+	// ApprovedBy is the user who approved the AccessGrant
+	ApprovedBy string `json:"approvedBy,omitempty"`
+	// ApprovedAt is the time the AccessGrant has been approved
+	ApprovedAt *metav1.Time `json:"approvedAt,omitempty"`
+	// ExpiresAt is the time the access is revoked
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+	// Plan lists the actions KIM would perform for the AccessGrant, set only in plan mode
+	//+optional
+	Plan *Plan `json:"plan,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="User",type=string,JSONPath=`.spec.user.name`
+//+kubebuilder:printcolumn:name="Role",type=string,JSONPath=`.spec.role.name`
+//+kubebuilder:printcolumn:name="Namespace",type=string,JSONPath=`.spec.scope.namespace`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Expires",type=date,JSONPath=`.status.expiresAt`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// AccessGrant is the Schema for the accessgrants API
+type AccessGrant struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AccessGrantSpec   `json:"spec,omitempty"`
+	Status AccessGrantStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// AccessGrantList contains a list of AccessGrant
+type AccessGrantList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []AccessGrant `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&AccessGrant{}, &AccessGrantList{})
+}
+
+// IsExpired returns true if the AccessGrant expired
+func (g *AccessGrant) IsExpired() bool {
+	return g.Status.Phase == ExpiredAccessGrantPhase
+}
@@ -0,0 +1,290 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// SetupWebhookWithManager registers the webhooks for AccessGrant in the
+// manager. AccessGrants are validated against the policy.
+func (r *AccessGrant) SetupWebhookWithManager(mgr ctrl.Manager, policy AccessGrantPolicy) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithDefaulter(&accessGrantDefaulter{}).
+		WithValidator(&accessGrantValidator{Client: mgr.GetClient(), Policy: policy}).
+		Complete()
+}
+
+// AccessGrantPolicy restricts the roles AccessGrants can grant and where
+type AccessGrantPolicy struct {
+	// GrantableRoles are the only roles AccessGrants can grant
+	GrantableRoles []AccessProfileRoleRef
+	// AllowClusterScope allows ClusterRoles to be granted cluster-wide,
+	// with an empty scope
+	AllowClusterScope bool
+}
+
+// Validate returns the reasons the policy refuses the AccessGrant, if any
+func (p AccessGrantPolicy) Validate(g *AccessGrant) field.ErrorList {
+	ee := field.ErrorList{}
+	if !p.grantable(g.Spec.Role) {
+		ee = append(ee, field.Forbidden(field.NewPath("spec", "role"),
+			fmt.Sprintf("%s %s is not grantable", g.Spec.Role.Kind, g.Spec.Role.Name)))
+	}
+	if g.Spec.Scope.Namespace == "" && !p.AllowClusterScope {
+		ee = append(ee, field.Required(field.NewPath("spec", "scope", "namespace"), "roles can only be granted in a namespace"))
+	}
+	return ee
+}
+
+func (p AccessGrantPolicy) grantable(r AccessProfileRoleRef) bool {
+	for _, g := range p.GrantableRoles {
+		if g == r {
+			return true
+		}
+	}
+	return false
+}
+
+//+kubebuilder:webhook:path=/mutate-kim-io-v1beta1-accessgrant,mutating=true,failurePolicy=fail,sideEffects=None,groups=kim.io,resources=accessgrants,verbs=create;update,versions=v1beta1,name=maccessgrant.kim.io,admissionReviewVersions=v1
+
+// accessGrantDefaulter records who requested and who approved an AccessGrant
+type accessGrantDefaulter struct{}
+
+var _ admission.CustomDefaulter = &accessGrantDefaulter{}
+
+// Default records the requester on creation and the approver when the
+// AccessGrant is approved. Records can't be written or changed by users.
+func (d *accessGrantDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	g, ok := obj.(*AccessGrant)
+	if !ok {
+		return fmt.Errorf("expected an AccessGrant, got %T", obj)
+	}
+
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	var old *AccessGrant
+	if req.Operation == admissionv1.Update {
+		old = &AccessGrant{}
+		if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+			return err
+		}
+	}
+
+	recordRequesterAndApprover(g, old, req.UserInfo.Username, time.Now())
+	return nil
+}
+
+func recordRequesterAndApprover(g, old *AccessGrant, username string, now time.Time) {
+	if g.Annotations == nil {
+		g.Annotations = map[string]string{}
+	}
+
+	for _, a := range []string{
+		AccessGrantRequestedByAnnotation,
+		AccessGrantApprovedByAnnotation,
+		AccessGrantApprovedAtAnnotation,
+	} {
+		delete(g.Annotations, a)
+		if old == nil {
+			continue
+		}
+		if v, ok := old.Annotations[a]; ok {
+			g.Annotations[a] = v
+		}
+	}
+
+	if old == nil {
+		g.Annotations[AccessGrantRequestedByAnnotation] = username
+	}
+	if g.Spec.Approved && (old == nil || !old.Spec.Approved) {
+		g.Annotations[AccessGrantApprovedByAnnotation] = username
+		g.Annotations[AccessGrantApprovedAtAnnotation] = now.UTC().Format(time.RFC3339)
+	}
+}
+
+//+kubebuilder:webhook:path=/validate-kim-io-v1beta1-accessgrant,mutating=false,failurePolicy=fail,sideEffects=None,groups=kim.io,resources=accessgrants,verbs=create;update,versions=v1beta1,name=vaccessgrant.kim.io,admissionReviewVersions=v1
+
+//+kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+
+// accessGrantValidator validates AccessGrants
+type accessGrantValidator struct {
+	// Client creates the SubjectAccessReviews checking the approvers
+	Client client.Client
+	// Policy restricts the roles AccessGrants can grant and where
+	Policy AccessGrantPolicy
+}
+
+var _ admission.CustomValidator = &accessGrantValidator{}
+
+// ValidateCreate validates the role and the scope of the AccessGrant, that
+// has to be approved once created
+func (v *accessGrantValidator) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+	g, ok := obj.(*AccessGrant)
+	if !ok {
+		return fmt.Errorf("expected an AccessGrant, got %T", obj)
+	}
+
+	ee := validateAccessGrant(g)
+	ee = append(ee, v.Policy.Validate(g)...)
+	if g.Spec.Approved {
+		ee = append(ee, field.Forbidden(field.NewPath("spec", "approved"), "an AccessGrant can only be approved once created"))
+	}
+	return toInvalid(g, ee)
+}
+
+// ValidateUpdate validates the role and the scope of the AccessGrant, that
+// the AccessGrant is not changed after its approval and that the approver is
+// not the requester and is allowed to bind the role in the scope
+func (v *accessGrantValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) error {
+	old, ok := oldObj.(*AccessGrant)
+	if !ok {
+		return fmt.Errorf("expected an AccessGrant, got %T", oldObj)
+	}
+	g, ok := newObj.(*AccessGrant)
+	if !ok {
+		return fmt.Errorf("expected an AccessGrant, got %T", newObj)
+	}
+
+	ee := validateAccessGrant(g)
+	if g.Spec.User != old.Spec.User {
+		ee = append(ee, field.Forbidden(field.NewPath("spec", "user"), "user is immutable"))
+	}
+	if old.Spec.Approved && !apiequality.Semantic.DeepEqual(g.Spec, old.Spec) {
+		ee = append(ee, field.Forbidden(field.NewPath("spec"), "spec is immutable once approved"))
+	}
+	// the policy may have changed since the approval of unchanged AccessGrants
+	if !apiequality.Semantic.DeepEqual(g.Spec, old.Spec) {
+		ee = append(ee, v.Policy.Validate(g)...)
+	}
+	if len(ee) == 0 && g.Spec.Approved && !old.Spec.Approved {
+		req, err := admission.RequestFromContext(ctx)
+		if err != nil {
+			return err
+		}
+		e, err := v.validateApprover(ctx, old, g, req.UserInfo)
+		if err != nil {
+			return err
+		}
+		if e != nil {
+			ee = append(ee, e)
+		}
+	}
+	return toInvalid(g, ee)
+}
+
+// validateApprover checks the approver is not the requester of the
+// AccessGrant and is allowed to bind its role in its scope, so that
+// AccessGrants can't be used to escalate privileges
+func (v *accessGrantValidator) validateApprover(ctx context.Context, old, g *AccessGrant, u authenticationv1.UserInfo) (*field.Error, error) {
+	p := field.NewPath("spec", "approved")
+	r, ok := old.Annotations[AccessGrantRequestedByAnnotation]
+	if !ok {
+		return field.Forbidden(p, "the requester of the AccessGrant is unknown"), nil
+	}
+	if r == u.Username {
+		return field.Forbidden(p, "an AccessGrant can not be approved by its requester"), nil
+	}
+
+	allowed, err := canBind(ctx, v.Client, u, g.Spec.Role, g.Spec.Scope.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error checking the approver is allowed to bind the role: %w", err)
+	}
+	if !allowed {
+		scope := "cluster-wide"
+		if ns := g.Spec.Scope.Namespace; ns != "" {
+			scope = "in namespace " + ns
+		}
+		return field.Forbidden(p, fmt.Sprintf("%s is not allowed to bind %s %s %s",
+			u.Username, g.Spec.Role.Kind, g.Spec.Role.Name, scope)), nil
+	}
+	return nil, nil
+}
+
+// canBind returns true if the user is allowed to bind the role in the
+// namespace, or cluster-wide if the namespace is empty
+func canBind(ctx context.Context, c client.Client, u authenticationv1.UserInfo, role AccessProfileRoleRef, namespace string) (bool, error) {
+	extra := make(map[string]authorizationv1.ExtraValue, len(u.Extra))
+	for k, v := range u.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	resource := "clusterroles"
+	if role.Kind == "Role" {
+		resource = "roles"
+	}
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   u.Username,
+			UID:    u.UID,
+			Groups: u.Groups,
+			Extra:  extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      "bind",
+				Group:     rbacv1.GroupName,
+				Resource:  resource,
+				Name:      role.Name,
+			},
+		},
+	}
+	if err := c.Create(ctx, sar); err != nil {
+		return false, err
+	}
+	return sar.Status.Allowed, nil
+}
+
+// ValidateDelete allows AccessGrants to be deleted, revoking them
+func (v *accessGrantValidator) ValidateDelete(ctx context.Context, obj runtime.Object) error {
+	return nil
+}
+
+func validateAccessGrant(g *AccessGrant) field.ErrorList {
+	ee := field.ErrorList{}
+	if g.Spec.Role.Kind == "Role" && g.Spec.Scope.Namespace == "" {
+		ee = append(ee, field.Required(field.NewPath("spec", "scope", "namespace"), "a Role can only be granted in a namespace"))
+	}
+	if g.Spec.Duration.Duration <= 0 {
+		ee = append(ee, field.Invalid(field.NewPath("spec", "duration"), g.Spec.Duration.String(), "duration must be positive"))
+	}
+	return ee
+}
+
+func toInvalid(g *AccessGrant, ee field.ErrorList) error {
+	if len(ee) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("AccessGrant").GroupKind(), g.Name, ee)
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newAccessGrant() *AccessGrant {
+	return &AccessGrant{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: "incident"},
+		Spec: AccessGrantSpec{
+			User:     UserReference{Name: "alice"},
+			Role:     AccessProfileRoleRef{Kind: "ClusterRole", Name: "edit"},
+			Scope:    AccessGrantScope{Namespace: "prod"},
+			Duration: metav1.Duration{Duration: time.Hour},
+		},
+	}
+}
+
+func TestAccessGrantDefaulterRecordsRequesterAndApprover(t *testing.T) {
+	d := &accessGrantDefaulter{}
+
+	// requester can not forge the records
+	g := newAccessGrant()
+	g.Annotations = map[string]string{
+		AccessGrantApprovedByAnnotation: "mallory",
+		AccessGrantApprovedAtAnnotation: "2000-01-01T00:00:00Z",
+	}
+	if err := d.Default(admissionContext(t, admissionv1.Create, authenticationv1.UserInfo{Username: "alice"}, nil), g); err != nil {
+		t.Fatal(err)
+	}
+	if v := g.Annotations[AccessGrantRequestedByAnnotation]; v != "alice" {
+		t.Fatalf("expected requester alice, got %q", v)
+	}
+	if _, ok := g.Annotations[AccessGrantApprovedByAnnotation]; ok {
+		t.Fatal("expected approver not to be recorded")
+	}
+	if _, ok := g.Annotations[AccessGrantApprovedAtAnnotation]; ok {
+		t.Fatal("expected approval time not to be recorded")
+	}
+
+	// approval
+	old := g.DeepCopy()
+	g.Spec.Approved = true
+	g.Annotations[AccessGrantRequestedByAnnotation] = "mallory"
+	if err := d.Default(admissionContext(t, admissionv1.Update, authenticationv1.UserInfo{Username: "bob"}, old), g); err != nil {
+		t.Fatal(err)
+	}
+	if v := g.Annotations[AccessGrantRequestedByAnnotation]; v != "alice" {
+		t.Fatalf("expected requester alice, got %q", v)
+	}
+	if v := g.Annotations[AccessGrantApprovedByAnnotation]; v != "bob" {
+		t.Fatalf("expected approver bob, got %q", v)
+	}
+	if _, err := time.Parse(time.RFC3339, g.Annotations[AccessGrantApprovedAtAnnotation]); err != nil {
+		t.Fatalf("expected approval time to be recorded: %v", err)
+	}
+
+	// later updates don't change the records
+	old = g.DeepCopy()
+	g.Annotations[AccessGrantApprovedByAnnotation] = "mallory"
+	if err := d.Default(admissionContext(t, admissionv1.Update, authenticationv1.UserInfo{Username: "mallory"}, old), g); err != nil {
+		t.Fatal(err)
+	}
+	if v := g.Annotations[AccessGrantApprovedByAnnotation]; v != "bob" {
+		t.Fatalf("expected approver bob, got %q", v)
+	}
+}
+
+// sarClient reviews the access of the subjects with allowed, recording the
+// SubjectAccessReviews created
+type sarClient struct {
+	client.Client
+
+	allowed func(authorizationv1.SubjectAccessReviewSpec) bool
+	reviews []authorizationv1.SubjectAccessReviewSpec
+}
+
+func (c *sarClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	sar := obj.(*authorizationv1.SubjectAccessReview)
+	c.reviews = append(c.reviews, sar.Spec)
+	sar.Status.Allowed = c.allowed(sar.Spec)
+	return nil
+}
+
+func newAccessGrantValidator(allowed func(authorizationv1.SubjectAccessReviewSpec) bool) (*accessGrantValidator, *sarClient) {
+	c := &sarClient{allowed: allowed}
+	return &accessGrantValidator{
+		Client: c,
+		Policy: AccessGrantPolicy{GrantableRoles: []AccessProfileRoleRef{
+			{Kind: "ClusterRole", Name: "edit"},
+			{Kind: "Role", Name: "deployer"},
+		}},
+	}, c
+}
+
+func TestAccessGrantValidator(t *testing.T) {
+	v, _ := newAccessGrantValidator(nil)
+	ctx := admissionContext(t, admissionv1.Update, authenticationv1.UserInfo{Username: "alice"}, nil)
+
+	if err := v.ValidateCreate(ctx, newAccessGrant()); err != nil {
+		t.Fatalf("expected valid access grant: %v", err)
+	}
+
+	g := newAccessGrant()
+	g.Spec.Role = AccessProfileRoleRef{Kind: "Role", Name: "deployer"}
+	g.Spec.Scope.Namespace = ""
+	v.Policy.AllowClusterScope = true
+	if err := v.ValidateCreate(ctx, g); err == nil {
+		t.Fatal("expected a cluster-wide Role to be refused")
+	}
+	v.Policy.AllowClusterScope = false
+
+	g = newAccessGrant()
+	g.Spec.Duration.Duration = 0
+	if err := v.ValidateCreate(ctx, g); err == nil {
+		t.Fatal("expected a non-positive duration to be refused")
+	}
+
+	old := newAccessGrant()
+	g = newAccessGrant()
+	g.Spec.User.Name = "bob"
+	if err := v.ValidateUpdate(ctx, old, g); err == nil {
+		t.Fatal("expected user to be immutable")
+	}
+
+	g = newAccessGrant()
+	g.Spec.Duration.Duration = 2 * time.Hour
+	if err := v.ValidateUpdate(ctx, old, g); err != nil {
+		t.Fatalf("expected pending access grant to be changed: %v", err)
+	}
+
+	old.Spec.Approved = true
+	g = old.DeepCopy()
+	g.Spec.Duration.Duration = 2 * time.Hour
+	if err := v.ValidateUpdate(ctx, old, g); err == nil {
+		t.Fatal("expected approved access grant to be immutable")
+	}
+}
+
+func TestAccessGrantValidatorEnforcesPolicy(t *testing.T) {
+	v, _ := newAccessGrantValidator(nil)
+	ctx := admissionContext(t, admissionv1.Create, authenticationv1.UserInfo{Username: "alice"}, nil)
+
+	g := newAccessGrant()
+	g.Spec.Role.Name = "cluster-admin"
+	if err := v.ValidateCreate(ctx, g); err == nil {
+		t.Fatal("expected a role not grantable to be refused")
+	}
+
+	g = newAccessGrant()
+	g.Spec.Scope.Namespace = ""
+	if err := v.ValidateCreate(ctx, g); err == nil {
+		t.Fatal("expected a cluster-wide access grant to be refused")
+	}
+	v.Policy.AllowClusterScope = true
+	if err := v.ValidateCreate(ctx, g); err != nil {
+		t.Fatalf("expected a cluster-wide access grant to be allowed: %v", err)
+	}
+
+	g = newAccessGrant()
+	g.Spec.Approved = true
+	if err := v.ValidateCreate(ctx, g); err == nil {
+		t.Fatal("expected an access grant approved on creation to be refused")
+	}
+
+	// a grantable role removed from the policy doesn't block unrelated updates
+	old := newAccessGrant()
+	old.Spec.Approved = true
+	v.Policy.GrantableRoles = nil
+	g = old.DeepCopy()
+	g.Finalizers = []string{"kim.io/access-grant"}
+	if err := v.ValidateUpdate(ctx, old, g); err != nil {
+		t.Fatalf("expected an unchanged spec to be allowed: %v", err)
+	}
+}
+
+func TestAccessGrantValidatorChecksApprover(t *testing.T) {
+	bob := authenticationv1.UserInfo{Username: "bob", Groups: []string{"leads"}}
+	v, c := newAccessGrantValidator(func(s authorizationv1.SubjectAccessReviewSpec) bool {
+		return s.User == "bob"
+	})
+
+	old := newAccessGrant()
+	old.Annotations = map[string]string{AccessGrantRequestedByAnnotation: "alice"}
+	g := old.DeepCopy()
+	g.Spec.Approved = true
+
+	// requester
+	ctx := admissionContext(t, admissionv1.Update, authenticationv1.UserInfo{Username: "alice"}, old)
+	if err := v.ValidateUpdate(ctx, old, g); err == nil {
+		t.Fatal("expected the requester not to approve the access grant")
+	}
+	if len(c.reviews) != 0 {
+		t.Fatalf("expected no access review, got %+v", c.reviews)
+	}
+
+	// approver not allowed to bind the role
+	ctx = admissionContext(t, admissionv1.Update, authenticationv1.UserInfo{Username: "mallory"}, old)
+	if err := v.ValidateUpdate(ctx, old, g); err == nil {
+		t.Fatal("expected an approver not allowed to bind the role to be refused")
+	}
+
+	// approver allowed to bind the role
+	c.reviews = nil
+	ctx = admissionContext(t, admissionv1.Update, bob, old)
+	if err := v.ValidateUpdate(ctx, old, g); err != nil {
+		t.Fatalf("expected bob to approve the access grant: %v", err)
+	}
+	if len(c.reviews) != 1 {
+		t.Fatalf("expected an access review, got %+v", c.reviews)
+	}
+	s := c.reviews[0]
+	if s.User != "bob" || len(s.Groups) != 1 || s.Groups[0] != "leads" {
+		t.Fatalf("expected the access of bob to be reviewed, got %+v", s)
+	}
+	if a := s.ResourceAttributes; a == nil || a.Verb != "bind" || a.Resource != "clusterroles" ||
+		a.Name != "edit" || a.Namespace != "prod" || a.Group != "rbac.authorization.k8s.io" {
+		t.Fatalf("expected the binding of the role in the scope to be reviewed, got %+v", a)
+	}
+
+	// unknown requester
+	delete(old.Annotations, AccessGrantRequestedByAnnotation)
+	ctx = admissionContext(t, admissionv1.Update, bob, old)
+	if err := v.ValidateUpdate(ctx, old, g); err == nil {
+		t.Fatal("expected an access grant with an unknown requester not to be approved")
+	}
+}
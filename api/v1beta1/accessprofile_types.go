@@ -0,0 +1,69 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AccessProfileRoleRef references the Role or ClusterRole granted by an AccessProfile
+type AccessProfileRoleRef struct {
+	// Kind of the referenced role
+	//+required
+	//+kubebuilder:validation:Enum:=Role;ClusterRole
+	Kind string `json:"kind"`
+	// Name of the referenced role
+	//+required
+	//+kubebuilder:validation:MinLength:=1
+	Name string `json:"name"`
+}
+
+// AccessProfileSpec defines the desired state of AccessProfile
+type AccessProfileSpec struct {
+	// Roles granted to the Users in each of the target Namespaces
+	//+required
+	//+kubebuilder:validation:MinItems:=1
+	Roles []AccessProfileRoleRef `json:"roles"`
+	// Namespaces in which the Roles are granted
+	//+required
+	//+kubebuilder:validation:MinItems:=1
+	Namespaces []string `json:"namespaces"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+
+// AccessProfile is the Schema for the accessprofiles API
+type AccessProfile struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec AccessProfileSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// AccessProfileList contains a list of AccessProfile
+type AccessProfileList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []AccessProfile `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&AccessProfile{}, &AccessProfileList{})
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// InvitationSecretType is the type of the Secrets holding the code of an Invitation
+	InvitationSecretType corev1.SecretType = "kim.io/invitation"
+	// InvitationSecretCodeKey is the key of the code in an InvitationSecretType Secret
+	InvitationSecretCodeKey = "code"
+	// InvitationCreatedByAnnotation records the user who created the Invitation
+	InvitationCreatedByAnnotation = "kim.io/created-by"
+)
+
+type InvitationPhase string
+
+const (
+	// PendingInvitationPhase is the phase of Invitations whose code is not issued yet
+	PendingInvitationPhase InvitationPhase = "Pending"
+	// IssuedInvitationPhase is the phase of Invitations whose code can be redeemed
+	IssuedInvitationPhase InvitationPhase = "Issued"
+	// RedeemedInvitationPhase is the terminal phase of redeemed Invitations
+	RedeemedInvitationPhase InvitationPhase = "Redeemed"
+	// ExpiredInvitationPhase is the terminal phase of Invitations past their expiration
+	ExpiredInvitationPhase InvitationPhase = "Expired"
+)
+
+// InvitationSpec defines the desired state of Invitation
+type InvitationSpec struct {
+	// Inviter is the Active User inviting the collaborator. When a User
+	// creates the Invitation with its ServiceAccount, it is the inviter.
+	//+required
+	Inviter UserReference `json:"inviter"`
+	// Email of the invited collaborator
+	//+required
+	//+kubebuilder:validation:MinLength:=1
+	Email string `json:"email"`
+	// Profiles granted to the User created on redemption
+	//+optional
+	Profiles []AccessProfileReference `json:"profiles,omitempty"`
+	// Expiration is the time after which the Invitation can no more be redeemed.
+	// If not set, the controller's default lifetime is applied.
+	//+optional
+	Expiration *metav1.Time `json:"expiration,omitempty"`
+}
+
+// InvitationStatus defines the observed state of Invitation
+type InvitationStatus struct {
+	// ObservedGeneration is the last generation processed by the controller
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Phase is the actual phase of the Invitation
+	Phase InvitationPhase `json:"phase,omitempty"`
+	// Reason explains the actual phase
+	Reason string `json:"reason,omitempty"`
+	// CodeHash is the SHA-256 digest of the invitation code, hex encoded
+	CodeHash string `json:"codeHash,omitempty"`
+	// ExpiresAt is the time after which the Invitation can no more be redeemed
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+	// RedeemedAt is the time the Invitation has been redeemed
+	RedeemedAt *metav1.Time `json:"redeemedAt,omitempty"`
+	// User is the User created redeeming the Invitation
+	User *UserReference `json:"user,omitempty"`
+	// Plan lists the actions KIM would perform for the Invitation, set only in plan mode
+	//+optional
+	Plan *Plan `json:"plan,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Inviter",type=string,JSONPath=`.spec.inviter.name`
+//+kubebuilder:printcolumn:name="Email",type=string,JSONPath=`.spec.email`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Expires",type=date,JSONPath=`.status.expiresAt`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// Invitation is the Schema for the invitations API
+type Invitation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   InvitationSpec   `json:"spec,omitempty"`
+	Status InvitationStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// InvitationList contains a list of Invitation
+type InvitationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Invitation `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Invitation{}, &InvitationList{})
+}
+
+// IsTerminated returns true if the Invitation can no more be redeemed
+func (i *Invitation) IsTerminated() bool {
+	return i.Status.Phase == RedeemedInvitationPhase || i.Status.Phase == ExpiredInvitationPhase
+}
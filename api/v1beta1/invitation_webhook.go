@@ -0,0 +1,205 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const serviceAccountUsernamePrefix = "system:serviceaccount:"
+
+// SetupWebhookWithManager registers the webhooks for Invitation in the manager.
+func (r *Invitation) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithDefaulter(&invitationDefaulter{Client: mgr.GetClient()}).
+		WithValidator(&invitationValidator{Client: mgr.GetClient()}).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-kim-io-v1beta1-invitation,mutating=true,failurePolicy=fail,sideEffects=None,groups=kim.io,resources=invitations,verbs=create;update,versions=v1beta1,name=minvitation.kim.io,admissionReviewVersions=v1
+
+// invitationDefaulter records who created an Invitation
+type invitationDefaulter struct {
+	// Client fetches the User creating the Invitation
+	Client client.Client
+}
+
+var _ admission.CustomDefaulter = &invitationDefaulter{}
+
+// Default records who created the Invitation. When it is created by the
+// ServiceAccount provisioned for a User of its namespace, the User is the inviter,
+// whatever the inviter in the spec. Records can't be written or changed by
+// users.
+func (d *invitationDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	i, ok := obj.(*Invitation)
+	if !ok {
+		return fmt.Errorf("expected an Invitation, got %T", obj)
+	}
+
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if i.Annotations == nil {
+		i.Annotations = map[string]string{}
+	}
+	if req.Operation == admissionv1.Update {
+		old := &Invitation{}
+		if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+			return err
+		}
+		delete(i.Annotations, InvitationCreatedByAnnotation)
+		if v, ok := old.Annotations[InvitationCreatedByAnnotation]; ok {
+			i.Annotations[InvitationCreatedByAnnotation] = v
+		}
+		return nil
+	}
+
+	i.Annotations[InvitationCreatedByAnnotation] = req.UserInfo.Username
+	k, ok := serviceAccountKeyFromUsername(req.UserInfo.Username)
+	if !ok || k.Namespace != req.Namespace {
+		return nil
+	}
+	u, err := d.userOfServiceAccount(ctx, k)
+	if err != nil || u == nil {
+		return err
+	}
+	i.Spec.Inviter = UserReference{Name: u.Name}
+	return nil
+}
+
+// userOfServiceAccount returns the User controlling the ServiceAccount, that
+// is the User it is provisioned for, or nil if there is none
+func (d *invitationDefaulter) userOfServiceAccount(ctx context.Context, k types.NamespacedName) (*User, error) {
+	var sa corev1.ServiceAccount
+	if err := d.Client.Get(ctx, k, &sa); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	ref := metav1.GetControllerOf(&sa)
+	if ref == nil || ref.APIVersion != GroupVersion.String() || ref.Kind != "User" {
+		return nil, nil
+	}
+
+	var u User
+	if err := d.Client.Get(ctx, types.NamespacedName{Namespace: sa.Namespace, Name: ref.Name}, &u); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	if u.UID != ref.UID {
+		return nil, nil
+	}
+	return &u, nil
+}
+
+// serviceAccountKeyFromUsername returns the key of the ServiceAccount
+// identified by the username
+func serviceAccountKeyFromUsername(username string) (types.NamespacedName, bool) {
+	if !strings.HasPrefix(username, serviceAccountUsernamePrefix) {
+		return types.NamespacedName{}, false
+	}
+	nn := strings.Split(strings.TrimPrefix(username, serviceAccountUsernamePrefix), ":")
+	if len(nn) != 2 || nn[0] == "" || nn[1] == "" {
+		return types.NamespacedName{}, false
+	}
+	return types.NamespacedName{Namespace: nn[0], Name: nn[1]}, true
+}
+
+//+kubebuilder:webhook:path=/validate-kim-io-v1beta1-invitation,mutating=false,failurePolicy=fail,sideEffects=None,groups=kim.io,resources=invitations,verbs=create;update,versions=v1beta1,name=vinvitation.kim.io,admissionReviewVersions=v1
+
+// invitationValidator validates Invitations
+type invitationValidator struct {
+	// Client fetches the inviters
+	Client client.Client
+}
+
+var _ admission.CustomValidator = &invitationValidator{}
+
+// ValidateCreate checks the inviter is Active and holds the profiles the
+// Invitation grants, as inviters can only share the profiles they hold
+func (v *invitationValidator) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+	i, ok := obj.(*Invitation)
+	if !ok {
+		return fmt.Errorf("expected an Invitation, got %T", obj)
+	}
+
+	var u User
+	if err := v.Client.Get(ctx, types.NamespacedName{Namespace: i.Namespace, Name: i.Spec.Inviter.Name}, &u); err != nil {
+		if apierrors.IsNotFound(err) {
+			return invitationForbidden(i, fmt.Errorf("inviter %s does not exist", i.Spec.Inviter.Name))
+		}
+		return err
+	}
+	if u.Status.State != ActiveUserState {
+		return invitationForbidden(i, fmt.Errorf("inviter %s is not Active", u.Name))
+	}
+	for _, p := range i.Spec.Profiles {
+		if !u.HasProfile(p.Name) {
+			return invitationForbidden(i, fmt.Errorf("profile %s is not granted to %s", p.Name, u.Name))
+		}
+	}
+	return nil
+}
+
+// ValidateUpdate checks the inviter and the profiles are not changed, as
+// they are only checked on creation
+func (v *invitationValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) error {
+	old, ok := oldObj.(*Invitation)
+	if !ok {
+		return fmt.Errorf("expected an Invitation, got %T", oldObj)
+	}
+	i, ok := newObj.(*Invitation)
+	if !ok {
+		return fmt.Errorf("expected an Invitation, got %T", newObj)
+	}
+
+	ee := field.ErrorList{}
+	if i.Spec.Inviter != old.Spec.Inviter {
+		ee = append(ee, field.Forbidden(field.NewPath("spec", "inviter"), "inviter is immutable"))
+	}
+	if !apiequality.Semantic.DeepEqual(i.Spec.Profiles, old.Spec.Profiles) {
+		ee = append(ee, field.Forbidden(field.NewPath("spec", "profiles"), "profiles are immutable"))
+	}
+	if len(ee) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("Invitation").GroupKind(), i.Name, ee)
+}
+
+// ValidateDelete allows Invitations to be deleted, revoking them
+func (v *invitationValidator) ValidateDelete(ctx context.Context, obj runtime.Object) error {
+	return nil
+}
+
+func invitationForbidden(i *Invitation, err error) error {
+	return apierrors.NewForbidden(GroupVersion.WithResource("invitations").GroupResource(), i.Name, err)
+}
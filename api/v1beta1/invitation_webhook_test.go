@@ -0,0 +1,160 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func newInvitationTestClient(t *testing.T, objs ...client.Object) client.Client {
+	t.Helper()
+
+	s := runtime.NewScheme()
+	if err := AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := corev1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	return fake.NewClientBuilder().WithScheme(s).WithObjects(objs...).Build()
+}
+
+func newInviter(name string, state UserState, profiles ...string) *User {
+	u := &User{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: name, UID: types.UID(name)},
+		Status:     UserStatus{State: state},
+	}
+	for _, p := range profiles {
+		u.Spec.Profiles = append(u.Spec.Profiles, AccessProfileReference{Name: p})
+	}
+	return u
+}
+
+func newTestInvitation(inviter string, profiles ...string) *Invitation {
+	i := &Invitation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: "carol"},
+		Spec: InvitationSpec{
+			Inviter: UserReference{Name: inviter},
+			Email:   "carol@kim.io",
+		},
+	}
+	for _, p := range profiles {
+		i.Spec.Profiles = append(i.Spec.Profiles, AccessProfileReference{Name: p})
+	}
+	return i
+}
+
+func createContext(username string) context.Context {
+	return admission.NewContextWithRequest(context.TODO(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		Namespace: "tenant",
+		UserInfo:  authenticationv1.UserInfo{Username: username},
+	}})
+}
+
+func TestInvitationDefaulterRecordsInviter(t *testing.T) {
+	alice := newInviter("alice", ActiveUserState)
+	d := &invitationDefaulter{Client: newInvitationTestClient(t,
+		alice,
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "tenant",
+			Name:            "kim-alice",
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(alice, GroupVersion.WithKind("User"))},
+		}},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: "alice"}},
+	)}
+
+	// a User invites on its own behalf
+	i := newTestInvitation("bob")
+	i.Annotations = map[string]string{InvitationCreatedByAnnotation: "mallory"}
+	if err := d.Default(createContext("system:serviceaccount:tenant:kim-alice"), i); err != nil {
+		t.Fatal(err)
+	}
+	if i.Spec.Inviter.Name != "alice" {
+		t.Fatalf("expected inviter alice, got %q", i.Spec.Inviter.Name)
+	}
+	if v := i.Annotations[InvitationCreatedByAnnotation]; v != "system:serviceaccount:tenant:kim-alice" {
+		t.Fatalf("expected creator alice, got %q", v)
+	}
+
+	// ServiceAccounts of other namespaces and not provisioned for a User don't change the inviter
+	for _, username := range []string{"system:serviceaccount:other:kim-alice", "system:serviceaccount:tenant:alice", "system:serviceaccount:tenant:dave", "admin"} {
+		i := newTestInvitation("bob")
+		if err := d.Default(createContext(username), i); err != nil {
+			t.Fatal(err)
+		}
+		if i.Spec.Inviter.Name != "bob" || i.Annotations[InvitationCreatedByAnnotation] != username {
+			t.Fatalf("expected inviter bob created by %s, got %+v", username, i)
+		}
+	}
+
+	// updates don't change the records
+	old := newTestInvitation("alice")
+	old.Annotations = map[string]string{InvitationCreatedByAnnotation: "admin"}
+	i = old.DeepCopy()
+	i.Annotations[InvitationCreatedByAnnotation] = "mallory"
+	if err := d.Default(admissionContext(t, admissionv1.Update, authenticationv1.UserInfo{Username: "mallory"}, old), i); err != nil {
+		t.Fatal(err)
+	}
+	if v := i.Annotations[InvitationCreatedByAnnotation]; v != "admin" {
+		t.Fatalf("expected creator admin, got %q", v)
+	}
+}
+
+func TestInvitationValidator(t *testing.T) {
+	v := &invitationValidator{Client: newInvitationTestClient(t,
+		newInviter("alice", ActiveUserState, "developer"),
+		newInviter("bob", SuspendedUserState, "developer"),
+	)}
+	ctx := createContext("admin")
+
+	if err := v.ValidateCreate(ctx, newTestInvitation("alice", "developer")); err != nil {
+		t.Fatalf("expected valid invitation: %v", err)
+	}
+	for name, i := range map[string]*Invitation{
+		"inviter not found":   newTestInvitation("dave"),
+		"inviter not Active":  newTestInvitation("bob", "developer"),
+		"profile not granted": newTestInvitation("alice", "developer", "admin"),
+	} {
+		if err := v.ValidateCreate(ctx, i); err == nil {
+			t.Errorf("expected invitation to be refused: %s", name)
+		}
+	}
+
+	old := newTestInvitation("alice", "developer")
+	i := old.DeepCopy()
+	i.Spec.Inviter.Name = "bob"
+	if err := v.ValidateUpdate(ctx, old, i); err == nil {
+		t.Fatal("expected inviter to be immutable")
+	}
+	i = old.DeepCopy()
+	i.Spec.Profiles = append(i.Spec.Profiles, AccessProfileReference{Name: "admin"})
+	if err := v.ValidateUpdate(ctx, old, i); err == nil {
+		t.Fatal("expected profiles to be immutable")
+	}
+}
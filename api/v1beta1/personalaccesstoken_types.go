@@ -0,0 +1,118 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// PersonalAccessTokenSecretType is the type of the Secrets holding the token of a PersonalAccessToken
+	PersonalAccessTokenSecretType corev1.SecretType = "kim.io/personal-access-token"
+	// PersonalAccessTokenSecretTokenKey is the key of the token in a PersonalAccessTokenSecretType Secret
+	PersonalAccessTokenSecretTokenKey = "token"
+)
+
+type PersonalAccessTokenPhase string
+
+const (
+	// PendingPersonalAccessTokenPhase is the phase of PersonalAccessTokens whose User is not active yet
+	PendingPersonalAccessTokenPhase PersonalAccessTokenPhase = "Pending"
+	// ActivePersonalAccessTokenPhase is the phase of PersonalAccessTokens that can be used
+	ActivePersonalAccessTokenPhase PersonalAccessTokenPhase = "Active"
+	// SuspendedPersonalAccessTokenPhase is the phase of PersonalAccessTokens whose User is suspended
+	SuspendedPersonalAccessTokenPhase PersonalAccessTokenPhase = "Suspended"
+	// ExpiredPersonalAccessTokenPhase is the phase of PersonalAccessTokens past their expiration
+	ExpiredPersonalAccessTokenPhase PersonalAccessTokenPhase = "Expired"
+	// RevokedPersonalAccessTokenPhase is the terminal phase of revoked PersonalAccessTokens
+	RevokedPersonalAccessTokenPhase PersonalAccessTokenPhase = "Revoked"
+)
+
+// UserReference identifies a User in the same namespace
+type UserReference struct {
+	// Name of the referenced User
+	//+required
+	Name string `json:"name"`
+}
+
+// PersonalAccessTokenSpec defines the desired state of PersonalAccessToken
+type PersonalAccessTokenSpec struct {
+	// User owning the PersonalAccessToken
+	//+required
+	User UserReference `json:"user"`
+	// Expiration is the time after which the PersonalAccessToken is no more valid
+	//+optional
+	Expiration *metav1.Time `json:"expiration,omitempty"`
+}
+
+// PersonalAccessTokenStatus defines the observed state of PersonalAccessToken
+type PersonalAccessTokenStatus struct {
+	// ObservedGeneration is the last generation processed by the controller
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Phase is the actual phase of the PersonalAccessToken
+	Phase PersonalAccessTokenPhase `json:"phase,omitempty"`
+	// Reason is a brief CamelCase explanation of the actual phase
+	Reason string `json:"reason,omitempty"`
+	// TokenHash is the SHA-256 digest of the issued token
+	TokenHash string `json:"tokenHash,omitempty"`
+	// Plan lists the actions KIM would perform for the PersonalAccessToken, set only in plan mode
+	//+optional
+	Plan *Plan `json:"plan,omitempty"`
+
+	// Conditions represent the latest available observations of the PersonalAccessToken's state
+	//+optional
+	//+listType=map
+	//+listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:storageversion
+//+kubebuilder:printcolumn:name="User",type=string,JSONPath=`.spec.user.name`
+//+kubebuilder:printcolumn:name="Expiration",type=date,JSONPath=`.spec.expiration`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.status.reason`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// PersonalAccessToken is the Schema for the personalaccesstokens API
+type PersonalAccessToken struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PersonalAccessTokenSpec   `json:"spec,omitempty"`
+	Status PersonalAccessTokenStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// PersonalAccessTokenList contains a list of PersonalAccessToken
+type PersonalAccessTokenList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PersonalAccessToken `json:"items"`
+}
+
+// IsRevoked returns true if the PersonalAccessToken has been permanently revoked
+func (p PersonalAccessToken) IsRevoked() bool {
+	return p.Status.Phase == RevokedPersonalAccessTokenPhase
+}
+
+func init() {
+	SchemeBuilder.Register(&PersonalAccessToken{}, &PersonalAccessTokenList{})
+}
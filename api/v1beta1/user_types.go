@@ -0,0 +1,285 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// UserInvitedByAnnotation records the User who invited the User
+	UserInvitedByAnnotation = "kim.io/invited-by"
+	// UserInvitationAnnotation records the Invitation redeemed to create the User
+	UserInvitationAnnotation = "kim.io/invitation"
+
+	// UserStateChangedByAnnotation records who requested the last change of spec.state
+	UserStateChangedByAnnotation = "kim.io/state-changed-by"
+	// UserStateChangedByGroupsAnnotation records the groups, comma separated, of who requested the last change of spec.state
+	UserStateChangedByGroupsAnnotation = "kim.io/state-changed-by-groups"
+	// UserStateChangedAtAnnotation records when spec.state was last changed, in RFC 3339 format
+	UserStateChangedAtAnnotation = "kim.io/state-changed-at"
+	// UserStateChangeReasonAnnotation is the reason of the last change of spec.state,
+	// optionally provided by the requester together with the change
+	UserStateChangeReasonAnnotation = "kim.io/state-change-reason"
+
+	// PlanAnnotation, set to "true", makes KIM plan the reconciliation of the
+	// User instead of performing it, reporting the planned actions in status
+	PlanAnnotation = "kim.io/plan"
+)
+
+type UserState string
+
+const (
+	WaitingForApprovalUserState UserState = "WaitingForApproval"
+	ActiveUserState             UserState = "Active"
+	SuspendedUserState          UserState = "Suspended"
+	BannedUserState             UserState = "Banned"
+)
+
+// AccessProfileReference identifies a cluster-scoped AccessProfile
+type AccessProfileReference struct {
+	// Name of the referenced AccessProfile
+	//+required
+	Name string `json:"name"`
+}
+
+// UserSpec defines the desired state of User
+type UserSpec struct {
+	//+required
+	Email string `json:"email"`
+	//+required
+	Username string `json:"username"`
+
+	//+optional
+	//+kubebuilder:default:="WaitingForApproval"
+	//+kubebuilder:validation:Enum:=WaitingForApproval;Active;Suspended;Banned
+	State UserState `json:"state,omitempty"`
+	//+optional
+	Expiration *metav1.Time `json:"expiration,omitempty"`
+
+	// SuspendedUntil makes a suspension temporary: once passed, the User is restored to Active
+	//+optional
+	SuspendedUntil *metav1.Time `json:"suspendedUntil,omitempty"`
+	// BannedUntil makes a ban temporary: once passed, the User is restored to Active.
+	// Personal Access Tokens revoked by the ban are not restored.
+	//+optional
+	BannedUntil *metav1.Time `json:"bannedUntil,omitempty"`
+	// ReasonCode classifies the reason of the current state (e.g. PolicyViolation)
+	//+optional
+	//+kubebuilder:validation:MaxLength=63
+	//+kubebuilder:validation:Pattern=`^[A-Za-z][A-Za-z0-9]*$`
+	ReasonCode string `json:"reasonCode,omitempty"`
+
+	//+optional
+	DisplayName *string `json:"displayName,omitempty"`
+	//+optional
+	GivenName *string `json:"givenName,omitempty"`
+	//+optional
+	FamilyName *string `json:"familyName,omitempty"`
+
+	//+optional
+	Company *string `json:"company,omitempty"`
+	//+optional
+	SecondaryMail *string `json:"secondaryMail,omitempty"`
+
+	// Profiles granted to the User while Active
+	//+optional
+	//+listType=map
+	//+listMapKey=name
+	Profiles []AccessProfileReference `json:"profiles,omitempty"`
+}
+
+// QuotaStatus reports the usage of a quota
+type QuotaStatus struct {
+	// Used is the number of resources held by the User
+	Used int32 `json:"used"`
+	// Limit is the maximum number of resources the User can hold, unlimited if not set
+	//+optional
+	Limit *int32 `json:"limit,omitempty"`
+}
+
+// UserQuotasStatus reports the usage of the quotas of a User
+type UserQuotasStatus struct {
+	// PersonalAccessTokens counts the PersonalAccessTokens not expired nor revoked
+	PersonalAccessTokens QuotaStatus `json:"personalAccessTokens"`
+	// AccessGrants counts the AccessGrants not expired
+	AccessGrants QuotaStatus `json:"accessGrants"`
+	// Namespaces counts the namespaces provisioned for the User
+	Namespaces QuotaStatus `json:"namespaces"`
+}
+
+// UserStateHistoryLimit is the number of state transitions kept in a User's status
+const UserStateHistoryLimit = 16
+
+// UserStateTransition is a change of state applied to a User
+type UserStateTransition struct {
+	// From is the state before the transition, empty for new Users
+	//+optional
+	From UserState `json:"from,omitempty"`
+	// To is the state after the transition
+	To UserState `json:"to"`
+	// Timestamp is when the transition was requested
+	Timestamp metav1.Time `json:"timestamp"`
+	// Reason is the reason provided by who requested the transition
+	//+optional
+	Reason string `json:"reason,omitempty"`
+	// Actor is who requested the transition
+	//+optional
+	Actor string `json:"actor,omitempty"`
+}
+
+// PlannedAction is an action KIM would perform on an object
+type PlannedAction struct {
+	// Action is the operation that would be performed: Create, Update or Delete
+	//+kubebuilder:validation:Enum=Create;Update;Delete
+	Action string `json:"action"`
+	// Kind is the kind of the object
+	Kind string `json:"kind"`
+	// Namespace is the namespace of the object, empty for cluster scoped objects
+	//+optional
+	Namespace string `json:"namespace,omitempty"`
+	// Name is the name of the object
+	Name string `json:"name"`
+}
+
+// Plan lists the actions KIM would perform to reconcile an object in plan mode
+type Plan struct {
+	// Actions are the planned actions, in the order they would be performed
+	//+optional
+	Actions []PlannedAction `json:"actions,omitempty"`
+}
+
+// UserStatus defines the observed state of User
+type UserStatus struct {
+	// InitialGeneration is the first observed resource generation
+	InitialGeneration *int64 `json:"initialGeneration,omitempty"`
+	// ObservedGeneration is the last generation processed by the controller
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// State is the actual state of the object
+	State UserState `json:"state,omitempty"`
+	// HomeNamespace is the namespace provisioned for the User
+	//+optional
+	HomeNamespace string `json:"homeNamespace,omitempty"`
+	// CredentialsSecretRef references the Secret, in the User's namespace, holding the
+	// token and CA certificate of the User's ServiceAccount, set once they are issued
+	//+optional
+	CredentialsSecretRef *corev1.LocalObjectReference `json:"credentialsSecretRef,omitempty"`
+	// Quotas reports the usage of the User's quotas
+	//+optional
+	Quotas *UserQuotasStatus `json:"quotas,omitempty"`
+	// LastActivity is the last time the User was observed authenticating to KIM
+	//+optional
+	LastActivity *metav1.Time `json:"lastActivity,omitempty"`
+	// History lists the last state transitions of the User, oldest first
+	//+optional
+	//+kubebuilder:validation:MaxItems=16
+	History []UserStateTransition `json:"history,omitempty"`
+	// Plan lists the actions KIM would perform for the User, set only in plan mode
+	//+optional
+	Plan *Plan `json:"plan,omitempty"`
+
+	// Conditions represent the latest available observations of the User's state
+	//+optional
+	//+listType=map
+	//+listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:storageversion
+//+kubebuilder:printcolumn:name="Username",type=string,JSONPath=`.spec.username`
+//+kubebuilder:printcolumn:name="State",type=string,JSONPath=`.status.state`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// User is the Schema for the users API
+type User struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   UserSpec   `json:"spec,omitempty"`
+	Status UserStatus `json:"status,omitempty"`
+}
+
+// UserStateChange describes the last change of a User's spec.state
+type UserStateChange struct {
+	By     string
+	Groups []string
+	At     *metav1.Time
+	Reason string
+}
+
+// LastStateChange returns the last change of spec.state, as recorded by the admission webhook
+func (u *User) LastStateChange() UserStateChange {
+	c := UserStateChange{
+		By:     u.Annotations[UserStateChangedByAnnotation],
+		Reason: u.Annotations[UserStateChangeReasonAnnotation],
+	}
+	if g := u.Annotations[UserStateChangedByGroupsAnnotation]; g != "" {
+		c.Groups = strings.Split(g, ",")
+	}
+	if t, err := time.Parse(time.RFC3339, u.Annotations[UserStateChangedAtAnnotation]); err == nil {
+		at := metav1.NewTime(t)
+		c.At = &at
+	}
+	return c
+}
+
+// RestrictedUntil returns the end of the User's suspension or ban, if temporary
+func (u *User) RestrictedUntil() *metav1.Time {
+	switch u.Spec.State {
+	case SuspendedUserState:
+		return u.Spec.SuspendedUntil
+	case BannedUserState:
+		return u.Spec.BannedUntil
+	default:
+		return nil
+	}
+}
+
+// HasProfile returns true if the profile is granted to the User
+func (u *User) HasProfile(name string) bool {
+	for _, p := range u.Spec.Profiles {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (u User) IsNewUser() bool {
+	return u.Status.InitialGeneration == nil ||
+		*u.Status.InitialGeneration == u.ObjectMeta.Generation
+}
+
+//+kubebuilder:object:root=true
+
+// UserList contains a list of User
+type UserList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []User `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&User{}, &UserList{})
+}
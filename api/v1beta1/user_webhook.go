@@ -0,0 +1,211 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// SetupWebhookWithManager registers the webhooks for User in the manager.
+func (r *User) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithDefaulter(&userDefaulter{}).
+		WithValidator(&userValidator{Client: mgr.GetClient()}).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-kim-io-v1beta1-user,mutating=true,failurePolicy=fail,sideEffects=None,groups=kim.io,resources=users,verbs=create;update,versions=v1beta1,name=muser.kim.io,admissionReviewVersions=v1
+
+// userDefaulter records who changed the state of a User
+type userDefaulter struct{}
+
+var _ admission.CustomDefaulter = &userDefaulter{}
+
+// Default records who requested the change of spec.state, when and why.
+// Records can't be written or changed by users, except for the reason that
+// is provided together with the change.
+func (d *userDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	u, ok := obj.(*User)
+	if !ok {
+		return fmt.Errorf("expected a User, got %T", obj)
+	}
+
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	var old *User
+	if req.Operation == admissionv1.Update {
+		old = &User{}
+		if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+			return err
+		}
+	}
+
+	recordStateChange(u, old, req.UserInfo, time.Now())
+	return nil
+}
+
+func recordStateChange(u, old *User, userInfo authenticationv1.UserInfo, now time.Time) {
+	if u.Annotations == nil {
+		u.Annotations = map[string]string{}
+	}
+
+	reason, hasReason := u.Annotations[UserStateChangeReasonAnnotation]
+	for _, a := range []string{
+		UserStateChangedByAnnotation,
+		UserStateChangedByGroupsAnnotation,
+		UserStateChangedAtAnnotation,
+		UserStateChangeReasonAnnotation,
+	} {
+		delete(u.Annotations, a)
+		if old == nil {
+			continue
+		}
+		if v, ok := old.Annotations[a]; ok {
+			u.Annotations[a] = v
+		}
+	}
+
+	if old != nil && old.Spec.State == u.Spec.State {
+		return
+	}
+
+	u.Annotations[UserStateChangedByAnnotation] = userInfo.Username
+	u.Annotations[UserStateChangedAtAnnotation] = now.UTC().Format(time.RFC3339)
+	delete(u.Annotations, UserStateChangedByGroupsAnnotation)
+	if len(userInfo.Groups) > 0 {
+		u.Annotations[UserStateChangedByGroupsAnnotation] = strings.Join(userInfo.Groups, ",")
+	}
+
+	// the reason of a previous change is not carried over
+	delete(u.Annotations, UserStateChangeReasonAnnotation)
+	if hasReason && (old == nil || old.Annotations[UserStateChangeReasonAnnotation] != reason) && reason != "" {
+		u.Annotations[UserStateChangeReasonAnnotation] = reason
+	}
+}
+
+//+kubebuilder:webhook:path=/validate-kim-io-v1beta1-user,mutating=false,failurePolicy=fail,sideEffects=None,groups=kim.io,resources=users,verbs=create;update,versions=v1beta1,name=vuser.kim.io,admissionReviewVersions=v1
+
+// userValidator validates Users
+type userValidator struct {
+	// Client fetches the AccessProfiles and creates the SubjectAccessReviews
+	// checking who grants them
+	Client client.Client
+}
+
+var _ admission.CustomValidator = &userValidator{}
+
+// ValidateCreate checks the requester is allowed to grant the profiles of the User
+func (v *userValidator) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+	u, ok := obj.(*User)
+	if !ok {
+		return fmt.Errorf("expected a User, got %T", obj)
+	}
+	return v.validateProfiles(ctx, u, nil)
+}
+
+// ValidateUpdate checks the requester is allowed to grant the profiles added
+// to the User
+func (v *userValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) error {
+	old, ok := oldObj.(*User)
+	if !ok {
+		return fmt.Errorf("expected a User, got %T", oldObj)
+	}
+	u, ok := newObj.(*User)
+	if !ok {
+		return fmt.Errorf("expected a User, got %T", newObj)
+	}
+	return v.validateProfiles(ctx, u, old)
+}
+
+// ValidateDelete allows Users to be deleted
+func (v *userValidator) ValidateDelete(ctx context.Context, obj runtime.Object) error {
+	return nil
+}
+
+// validateProfiles checks the requester is allowed to bind each role of each
+// profile added to the User in each of the profile's namespaces, so that
+// profiles can't be used to escalate privileges
+func (v *userValidator) validateProfiles(ctx context.Context, u, old *User) error {
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	ee := field.ErrorList{}
+	for i, pr := range u.Spec.Profiles {
+		if old != nil && old.HasProfile(pr.Name) {
+			continue
+		}
+
+		fp := field.NewPath("spec", "profiles").Index(i)
+		var p AccessProfile
+		if err := v.Client.Get(ctx, types.NamespacedName{Name: pr.Name}, &p); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return err
+			}
+			ee = append(ee, field.NotFound(fp.Child("name"), pr.Name))
+			continue
+		}
+		e, err := v.validateProfile(ctx, &p, fp, req.UserInfo)
+		if err != nil {
+			return err
+		}
+		if e != nil {
+			ee = append(ee, e)
+		}
+	}
+	if len(ee) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("User").GroupKind(), u.Name, ee)
+}
+
+// validateProfile checks the user is allowed to bind every role of the
+// profile in every namespace of the profile
+func (v *userValidator) validateProfile(ctx context.Context, p *AccessProfile, fp *field.Path, u authenticationv1.UserInfo) (*field.Error, error) {
+	for _, ns := range p.Spec.Namespaces {
+		for _, r := range p.Spec.Roles {
+			allowed, err := canBind(ctx, v.Client, u, r, ns)
+			if err != nil {
+				return nil, fmt.Errorf("error checking the requester is allowed to bind the roles of profile %s: %w", p.Name, err)
+			}
+			if !allowed {
+				return field.Forbidden(fp, fmt.Sprintf("%s is not allowed to bind %s %s in namespace %s granted by profile %s",
+					u.Username, r.Kind, r.Name, ns, p.Name)), nil
+			}
+		}
+	}
+	return nil, nil
+}
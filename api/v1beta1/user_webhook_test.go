@@ -0,0 +1,187 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func newUser(state UserState, annotations map[string]string) *User {
+	return &User{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: "alice", Annotations: annotations},
+		Spec:       UserSpec{Email: "alice@kim.io", Username: "alice", State: state},
+	}
+}
+
+func admissionContext(t *testing.T, op admissionv1.Operation, userInfo authenticationv1.UserInfo, old runtime.Object) context.Context {
+	t.Helper()
+
+	req := admissionv1.AdmissionRequest{Operation: op, UserInfo: userInfo}
+	if old != nil {
+		b, err := json.Marshal(old)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.OldObject = runtime.RawExtension{Raw: b}
+	}
+	return admission.NewContextWithRequest(context.TODO(), admission.Request{AdmissionRequest: req})
+}
+
+func TestUserDefaulterRecordsStateChange(t *testing.T) {
+	d := &userDefaulter{}
+	admin := authenticationv1.UserInfo{Username: "admin", Groups: []string{"system:masters", "system:authenticated"}}
+
+	// requester can not forge the records
+	u := newUser(WaitingForApprovalUserState, map[string]string{UserStateChangedByAnnotation: "mallory"})
+	if err := d.Default(admissionContext(t, admissionv1.Create, authenticationv1.UserInfo{Username: "alice"}, nil), u); err != nil {
+		t.Fatal(err)
+	}
+	c := u.LastStateChange()
+	if c.By != "alice" || c.At == nil || len(c.Groups) != 0 || c.Reason != "" {
+		t.Fatalf("expected creation to be recorded, got %+v", c)
+	}
+
+	// changes not involving the state keep the records
+	old := u.DeepCopy()
+	u.Spec.Email = "alice@example.com"
+	u.Annotations[UserStateChangedByAnnotation] = "mallory"
+	u.Annotations[UserStateChangeReasonAnnotation] = "forged"
+	if err := d.Default(admissionContext(t, admissionv1.Update, admin, old), u); err != nil {
+		t.Fatal(err)
+	}
+	if c := u.LastStateChange(); c.By != "alice" || c.Reason != "" {
+		t.Fatalf("expected records to be kept, got %+v", c)
+	}
+
+	// state changes are recorded with the provided reason
+	old = u.DeepCopy()
+	u.Spec.State = BannedUserState
+	u.Annotations[UserStateChangeReasonAnnotation] = "abuse"
+	now := time.Now()
+	if err := d.Default(admissionContext(t, admissionv1.Update, admin, old), u); err != nil {
+		t.Fatal(err)
+	}
+	c = u.LastStateChange()
+	if c.By != "admin" || c.Reason != "abuse" || len(c.Groups) != 2 || c.Groups[0] != "system:masters" {
+		t.Fatalf("expected state change to be recorded, got %+v", c)
+	}
+	if c.At == nil || c.At.Time.Before(now.Truncate(time.Second)) {
+		t.Fatalf("expected change time to be recorded, got %v", c.At)
+	}
+
+	// the reason of a previous change is not carried over
+	old = u.DeepCopy()
+	u.Spec.State = ActiveUserState
+	if err := d.Default(admissionContext(t, admissionv1.Update, admin, old), u); err != nil {
+		t.Fatal(err)
+	}
+	if c := u.LastStateChange(); c.Reason != "" {
+		t.Fatalf("expected no reason, got %q", c.Reason)
+	}
+}
+
+var _ = Describe("User validating webhook", func() {
+	var (
+		tenant  string
+		profile *AccessProfile
+	)
+
+	// allow grants the ClusterRole to the user in the tenant namespace
+	allow := func(username string, rules ...rbacv1.PolicyRule) {
+		cr := &rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{GenerateName: "kim-test-"}, Rules: rules}
+		Expect(k8sClient.Create(ctx, cr)).To(Succeed())
+		Expect(k8sClient.Create(ctx, &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Namespace: tenant, GenerateName: "kim-test-"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: cr.Name},
+			Subjects:   []rbacv1.Subject{{APIGroup: rbacv1.GroupName, Kind: rbacv1.UserKind, Name: username}},
+		})).To(Succeed())
+	}
+
+	newProfiledUser := func(name string, profiles ...string) *User {
+		u := &User{
+			ObjectMeta: metav1.ObjectMeta{Namespace: tenant, Name: name},
+			Spec:       UserSpec{Email: name + "@kim.io", Username: name, State: ActiveUserState},
+		}
+		for _, p := range profiles {
+			u.Spec.Profiles = append(u.Spec.Profiles, AccessProfileReference{Name: p})
+		}
+		return u
+	}
+
+	BeforeEach(func() {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "test-"}}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+		tenant = ns.Name
+
+		profile = &AccessProfile{
+			ObjectMeta: metav1.ObjectMeta{GenerateName: "developer-"},
+			Spec: AccessProfileSpec{
+				Roles:      []AccessProfileRoleRef{{Kind: "ClusterRole", Name: "view"}},
+				Namespaces: []string{tenant},
+			},
+		}
+		Expect(k8sClient.Create(ctx, profile)).To(Succeed())
+
+		usersEditor := rbacv1.PolicyRule{APIGroups: []string{GroupVersion.Group}, Resources: []string{"users"}, Verbs: []string{"get", "create", "update"}}
+		allow("mallory", usersEditor)
+		allow("carol", usersEditor, rbacv1.PolicyRule{
+			APIGroups: []string{rbacv1.GroupName}, Resources: []string{"clusterroles"}, ResourceNames: []string{"view"}, Verbs: []string{"bind"},
+		})
+	})
+
+	It("refuses the profiles the requester is not allowed to bind", func() {
+		err := clientFor("mallory").Create(ctx, newProfiledUser("alice", profile.Name))
+		Expect(apierrors.IsInvalid(err)).To(BeTrue(), "expected the User to be invalid, got %v", err)
+		Expect(err.Error()).To(ContainSubstring("mallory is not allowed to bind ClusterRole view in namespace " + tenant))
+
+		By("adding them to an existing User")
+		u := newProfiledUser("alice")
+		Expect(clientFor("mallory").Create(ctx, u)).To(Succeed())
+		u.Spec.Profiles = []AccessProfileReference{{Name: profile.Name}}
+		err = clientFor("mallory").Update(ctx, u)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue(), "expected the User to be invalid, got %v", err)
+	})
+
+	It("accepts the profiles the requester is allowed to bind", func() {
+		u := newProfiledUser("alice", profile.Name)
+		Expect(clientFor("carol").Create(ctx, u)).To(Succeed())
+
+		By("keeping them on updates by others")
+		u.Spec.Email = "alice@example.com"
+		Expect(clientFor("mallory").Update(ctx, u)).To(Succeed())
+	})
+
+	It("refuses unknown profiles", func() {
+		err := clientFor("carol").Create(ctx, newProfiledUser("alice", "unknown"))
+		Expect(apierrors.IsInvalid(err)).To(BeTrue(), "expected the User to be invalid, got %v", err)
+	})
+})
@@ -0,0 +1,228 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kim exports and imports the Users of a namespace as CSV, YAML or JSON documents.
+//
+//	kim [--kubeconfig path] [--context name] export [-n namespace] [-o csv|yaml|json] [-f file]
+//	kim [--kubeconfig path] [--context name] import -f file [-n namespace] [--format csv|yaml|json] [--dry-run]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/pkg/bulk"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(kimiov1beta1.AddToScheme(scheme))
+}
+
+const usage = `Usage: kim [--kubeconfig path] [--context name] <command> [flags]
+
+Commands:
+  export  write the Users of a namespace and the metadata of their Personal Access Tokens
+  import  create or update the Users of a namespace from a document
+
+Run 'kim <command> -h' for the flags of a command.
+`
+
+func main() {
+	// controller-runtime registers its own flags in the default FlagSet
+	fs := flag.NewFlagSet("kim", flag.ExitOnError)
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	overrides := clientcmd.ConfigOverrides{}
+	fs.StringVar(&rules.ExplicitPath, "kubeconfig", "", "Path to the kubeconfig file to use.")
+	fs.StringVar(&overrides.CurrentContext, "context", "", "The kubeconfig context to use.")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:]) //nolint:errcheck
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	kc := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &overrides)
+	var err error
+	switch cmd, args := fs.Arg(0), fs.Args()[1:]; cmd {
+	case "export":
+		err = export(context.Background(), kc, args)
+	case "import":
+		err = importUsers(context.Background(), kc, args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", cmd)
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// newClient returns a client for the cluster and the namespace to use,
+// defaulting to the one of the kubeconfig context
+func newClient(kc clientcmd.ClientConfig, namespace string) (client.Client, string, error) {
+	if namespace == "" {
+		ns, _, err := kc.Namespace()
+		if err != nil {
+			return nil, "", err
+		}
+		namespace = ns
+	}
+
+	cfg, err := kc.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, "", err
+	}
+	return c, namespace, nil
+}
+
+func export(ctx context.Context, kc clientcmd.ClientConfig, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	namespace := fs.String("n", "", "The namespace of the Users. Defaults to the one of the kubeconfig context.")
+	output := fs.String("o", string(bulk.CSVFormat), "The output format: csv, yaml or json.")
+	file := fs.String("f", "", "The file to write. Defaults to the standard output.")
+	fs.Parse(args) //nolint:errcheck
+
+	c, ns, err := newClient(kc, *namespace)
+	if err != nil {
+		return err
+	}
+	rr, err := bulk.Export(ctx, c, ns)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *file != "" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return bulk.Write(w, bulk.Format(*output), rr)
+}
+
+func importUsers(ctx context.Context, kc clientcmd.ClientConfig, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	namespace := fs.String("n", "", "The namespace of the Users. Defaults to the one of the kubeconfig context.")
+	file := fs.String("f", "", "The file to read, '-' for the standard input.")
+	format := fs.String("format", "", "The format of the file: csv, yaml or json. Defaults to the file extension.")
+	dryRun := fs.Bool("dry-run", false, "Print the changes without applying them.")
+	fs.Parse(args) //nolint:errcheck
+
+	if *file == "" {
+		return fmt.Errorf("the file to import is required, use -f")
+	}
+	f := bulk.Format(*format)
+	if f == "" {
+		f = formatFromExtension(*file)
+	}
+
+	var r io.Reader = os.Stdin
+	if *file != "-" {
+		fd, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		r = fd
+	}
+	rr, ee, err := bulk.Read(r, f)
+	if err != nil {
+		return err
+	}
+
+	c, ns, err := newClient(kc, *namespace)
+	if err != nil {
+		return err
+	}
+	res := bulk.Import(ctx, c, ns, rr, *dryRun)
+	for _, e := range ee {
+		res = append(res, bulk.Result{Row: e.Row, Action: bulk.ErrorAction, Err: e.Err})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Row < res[j].Row })
+
+	if err := printResults(os.Stdout, res, *dryRun); err != nil {
+		return err
+	}
+	for _, r := range res {
+		if r.Err != nil {
+			return fmt.Errorf("some rows could not be imported")
+		}
+	}
+	return nil
+}
+
+func formatFromExtension(file string) bulk.Format {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return bulk.YAMLFormat
+	case ".json":
+		return bulk.JSONFormat
+	default:
+		return bulk.CSVFormat
+	}
+}
+
+// printResults prints a row per record, followed by its error or its changes
+func printResults(w io.Writer, res []bulk.Result, dryRun bool) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROW\tNAME\tACTION")
+	for _, r := range res {
+		a := string(r.Action)
+		if dryRun && r.Err == nil && r.Action != bulk.UnchangedAction {
+			a += " (dry run)"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", r.Row, r.Name, a)
+		if r.Err != nil {
+			fmt.Fprintf(tw, "\t\t  error: %v\n", r.Err)
+			continue
+		}
+		for _, d := range r.Diff {
+			fmt.Fprintf(tw, "\t\t  %s\n", d)
+		}
+	}
+	return tw.Flush()
+}
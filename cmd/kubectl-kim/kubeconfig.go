@@ -0,0 +1,115 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/controllers"
+)
+
+func kubeconfigCommand(fs *flag.FlagSet) runFunc {
+	output := fs.String("o", "", "The file to write the kubeconfig to. Defaults to the standard output.")
+	server := fs.String("server", "", "The address of the API server. Defaults to the one of the kubeconfig context.")
+
+	return func(ctx context.Context, p *plugin, args []string) error {
+		if err := requireArgs(args, 1, 1, "user"); err != nil {
+			return err
+		}
+		if err := p.requireNamespace(); err != nil {
+			return err
+		}
+
+		var u kimiov1beta1.User
+		if err := p.Client.Get(ctx, types.NamespacedName{Namespace: p.Namespace, Name: args[0]}, &u); err != nil {
+			return err
+		}
+		if u.Status.State != kimiov1beta1.ActiveUserState {
+			return fmt.Errorf("user %s is %s, only Active users have credentials", u.Name, orNone(string(u.Status.State)))
+		}
+
+		if c := meta.FindStatusCondition(u.Status.Conditions, controllers.ConflictCondition); c != nil && c.Status == metav1.ConditionTrue {
+			return fmt.Errorf("credentials of user %s are not managed by KIM: %s", u.Name, c.Message)
+		}
+
+		// the credentials are referenced once the token controller issued them
+		ref := u.Status.CredentialsSecretRef
+		if ref == nil {
+			return fmt.Errorf("credentials of user %s are not issued yet, retry later", u.Name)
+		}
+		var s corev1.Secret
+		if err := p.Client.Get(ctx, types.NamespacedName{Namespace: u.Namespace, Name: ref.Name}, &s); err != nil {
+			return fmt.Errorf("error fetching credentials of user %s: %w", u.Name, err)
+		}
+		if len(s.Data[corev1.ServiceAccountTokenKey]) == 0 ||
+			len(s.Data[corev1.ServiceAccountRootCAKey]) == 0 {
+			return fmt.Errorf("credentials of user %s are not issued yet, retry later", u.Name)
+		}
+
+		addr := *server
+		if addr == "" {
+			addr = p.Config.Host
+		}
+		b, err := clientcmd.Write(newKubeconfig(&u, addr, &s))
+		if err != nil {
+			return err
+		}
+
+		if *output == "" {
+			_, err = p.Out.Write(b)
+			return err
+		}
+		return os.WriteFile(*output, b, 0o600)
+	}
+}
+
+// newKubeconfig returns a kubeconfig authenticating as the User with the
+// token of its ServiceAccount, defaulting to its home namespace if any
+func newKubeconfig(u *kimiov1beta1.User, server string, s *corev1.Secret) clientcmdapi.Config {
+	ns := u.Status.HomeNamespace
+	if ns == "" {
+		ns = u.Namespace
+	}
+
+	const cluster = "kim"
+	return clientcmdapi.Config{
+		Clusters: map[string]*clientcmdapi.Cluster{
+			cluster: {
+				Server:                   server,
+				CertificateAuthorityData: s.Data[corev1.ServiceAccountRootCAKey],
+			},
+		},
+		AuthInfos: map[string]*clientcmdapi.AuthInfo{
+			u.Spec.Username: {Token: string(s.Data[corev1.ServiceAccountTokenKey])},
+		},
+		Contexts: map[string]*clientcmdapi.Context{
+			u.Spec.Username: {Cluster: cluster, AuthInfo: u.Spec.Username, Namespace: ns},
+		},
+		CurrentContext: u.Spec.Username,
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-kim is a kubectl plugin for the day-to-day administration of KIM
+// Users and their Personal Access Tokens. Once in the PATH, it is run as
+// 'kubectl kim <command>'.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/duration"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(corev1.AddToScheme(scheme))
+	utilruntime.Must(kimiov1beta1.AddToScheme(scheme))
+}
+
+// plugin is the environment the commands run in
+type plugin struct {
+	Client client.Client
+	// Config is the configuration of the client, used to build kubeconfigs
+	Config *rest.Config
+	// Namespace is the namespace of the Users, empty for all namespaces
+	Namespace string
+	Out       io.Writer
+}
+
+// runFunc runs a command with the positional arguments
+type runFunc func(ctx context.Context, p *plugin, args []string) error
+
+// command is a kubectl-kim command
+type command struct {
+	Name  string
+	Args  string
+	Short string
+	// AllNamespaces enables the --all-namespaces flag
+	AllNamespaces bool
+	// Setup registers the flags of the command and returns its implementation
+	Setup func(fs *flag.FlagSet) runFunc
+}
+
+var commands = []command{
+	{Name: "pending", Short: "List the Users waiting for approval", AllNamespaces: true, Setup: pendingCommand},
+	{Name: "approve", Args: "<user>...", Short: "Approve Users waiting for approval", Setup: approveCommand},
+	{Name: "suspend", Args: "<user>... --reason <reason>", Short: "Suspend Users, optionally until a given time", Setup: suspendCommand},
+	{Name: "ban", Args: "<user>... --reason <reason>", Short: "Ban Users and revoke their Personal Access Tokens", Setup: banCommand},
+	{Name: "reactivate", Args: "<user>...", Short: "Reactivate suspended or banned Users", Setup: reactivateCommand},
+	{Name: "pat create", Args: "<user>", Short: "Create a Personal Access Token and print its token", Setup: patCreateCommand},
+	{Name: "pat list", Args: "[<user>]", Short: "List Personal Access Tokens", AllNamespaces: true, Setup: patListCommand},
+	{Name: "pat revoke", Args: "<token>...", Short: "Revoke Personal Access Tokens", Setup: patRevokeCommand},
+	{Name: "kubeconfig", Args: "<user>", Short: "Print a kubeconfig authenticating as an active User", Setup: kubeconfigCommand},
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: kubectl kim <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.Name, c.Short)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'kubectl kim <command> -h' for the flags of a command.")
+}
+
+// findCommand returns the command named by the first arguments, and the remaining arguments
+func findCommand(args []string) (*command, []string) {
+	for i := range commands {
+		n := strings.Fields(commands[i].Name)
+		if len(args) >= len(n) && strings.Join(args[:len(n)], " ") == commands[i].Name {
+			return &commands[i], args[len(n):]
+		}
+	}
+	return nil, nil
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage(os.Stdout)
+		return
+	}
+
+	c, args := findCommand(args)
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", strings.Join(os.Args[1:], " "))
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+
+	// controller-runtime registers its own flags in the default FlagSet
+	fs := flag.NewFlagSet("kubectl kim "+c.Name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: kubectl kim %s %s [flags]\n\n%s.\n\nFlags:\n", c.Name, c.Args, c.Short)
+		fs.PrintDefaults()
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	overrides := clientcmd.ConfigOverrides{}
+	fs.StringVar(&rules.ExplicitPath, "kubeconfig", "", "Path to the kubeconfig file to use.")
+	fs.StringVar(&overrides.CurrentContext, "context", "", "The kubeconfig context to use.")
+	fs.StringVar(&overrides.Context.Namespace, "namespace", "", "The namespace of the Users. Defaults to the one of the kubeconfig context.")
+	fs.StringVar(&overrides.Context.Namespace, "n", "", "Shorthand for --namespace.")
+	var all bool
+	if c.AllNamespaces {
+		fs.BoolVar(&all, "all-namespaces", false, "List the objects across all namespaces.")
+		fs.BoolVar(&all, "A", false, "Shorthand for --all-namespaces.")
+	}
+	run := c.Setup(fs)
+
+	args, err := parse(fs, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+
+	kc := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &overrides)
+	p, err := newPlugin(kc, all)
+	if err == nil {
+		err = run(context.Background(), p, args)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// parse parses the flags in args, also when following the positional
+// arguments as common for kubectl commands, and returns the positional ones
+func parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return pos, nil
+		}
+		pos = append(pos, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func newPlugin(kc clientcmd.ClientConfig, allNamespaces bool) (*plugin, error) {
+	cfg, err := kc.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &plugin{Client: c, Config: cfg, Out: os.Stdout}
+	if !allNamespaces {
+		if p.Namespace, _, err = kc.Namespace(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// requireNamespace returns an error if the command is run across all namespaces
+func (p *plugin) requireNamespace() error {
+	if p.Namespace == "" {
+		return errors.New("a namespace is required")
+	}
+	return nil
+}
+
+// requireArgs returns an error if the number of arguments is not between min and max, max < 0 is unlimited
+func requireArgs(args []string, min, max int, what string) error {
+	switch {
+	case len(args) < min:
+		return fmt.Errorf("expected at least %d %s", min, what)
+	case max >= 0 && len(args) > max:
+		return fmt.Errorf("expected at most %d %s, got %d", max, what, len(args))
+	}
+	return nil
+}
+
+func newTable(w io.Writer, allNamespaces bool, columns ...string) *tabwriter.Writer {
+	tw := tabwriter.NewWriter(w, 0, 4, 3, ' ', 0)
+	if allNamespaces {
+		columns = append([]string{"NAMESPACE"}, columns...)
+	}
+	fmt.Fprintln(tw, strings.Join(columns, "\t"))
+	return tw
+}
+
+func printRow(tw io.Writer, allNamespaces bool, namespace string, values ...string) {
+	if allNamespaces {
+		values = append([]string{namespace}, values...)
+	}
+	fmt.Fprintln(tw, strings.Join(values, "\t"))
+}
+
+// age formats the time since t as kubectl does
+func age(t metav1.Time) string {
+	if t.IsZero() {
+		return "<unknown>"
+	}
+	return duration.HumanDuration(time.Since(t.Time))
+}
+
+// orNone formats empty values as kubectl does
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
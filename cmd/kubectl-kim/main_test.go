@@ -0,0 +1,296 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/controllers"
+)
+
+func newPluginForTest(oo ...client.Object) *plugin {
+	return &plugin{
+		Client:    fake.NewClientBuilder().WithScheme(scheme).WithObjects(oo...).Build(),
+		Config:    &rest.Config{Host: "https://kim.example.com:6443"},
+		Namespace: "tenant",
+	}
+}
+
+// runCommand runs the command as main does, returning its output
+func runCommand(p *plugin, args ...string) (string, error) {
+	c, args := findCommand(args)
+	if c == nil {
+		return "", flag.ErrHelp
+	}
+	fs := flag.NewFlagSet(c.Name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	run := c.Setup(fs)
+	args, err := parse(fs, args)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	p.Out = &out
+	err = run(context.TODO(), p, args)
+	return out.String(), err
+}
+
+func newUser(name string, state kimiov1beta1.UserState) *kimiov1beta1.User {
+	return &kimiov1beta1.User{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: name},
+		Spec: kimiov1beta1.UserSpec{
+			Username: name,
+			Email:    name + "@example.com",
+			State:    state,
+		},
+		Status: kimiov1beta1.UserStatus{State: state},
+	}
+}
+
+func getUser(t *testing.T, p *plugin, name string) *kimiov1beta1.User {
+	var u kimiov1beta1.User
+	if err := p.Client.Get(context.TODO(), types.NamespacedName{Namespace: "tenant", Name: name}, &u); err != nil {
+		t.Fatal(err)
+	}
+	return &u
+}
+
+func TestPending(t *testing.T) {
+	p := newPluginForTest(
+		newUser("alice", kimiov1beta1.ActiveUserState),
+		newUser("bob", kimiov1beta1.WaitingForApprovalUserState),
+	)
+
+	out, err := runCommand(p, "pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ll := strings.Split(strings.TrimSpace(out), "\n")
+	if len(ll) != 2 || !strings.HasPrefix(ll[0], "NAME") || !strings.HasPrefix(ll[1], "bob ") {
+		t.Fatalf("expected only bob to be listed, got:\n%s", out)
+	}
+
+	p.Namespace = ""
+	out, err = runCommand(p, "pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "NAMESPACE") || !strings.Contains(out, "tenant") {
+		t.Fatalf("expected the namespace column, got:\n%s", out)
+	}
+}
+
+func TestChangeState(t *testing.T) {
+	p := newPluginForTest(
+		newUser("alice", kimiov1beta1.ActiveUserState),
+		newUser("bob", kimiov1beta1.WaitingForApprovalUserState),
+	)
+
+	if _, err := runCommand(p, "approve", "bob", "--reason", "onboarding"); err != nil {
+		t.Fatal(err)
+	}
+	u := getUser(t, p, "bob")
+	if u.Spec.State != kimiov1beta1.ActiveUserState || u.Annotations[kimiov1beta1.UserStateChangeReasonAnnotation] != "onboarding" {
+		t.Fatalf("expected bob to be approved with a reason, got %s %v", u.Spec.State, u.Annotations)
+	}
+
+	// a reason is required to suspend
+	if _, err := runCommand(p, "suspend", "alice"); err == nil {
+		t.Fatal("expected an error suspending without reason")
+	}
+	if _, err := runCommand(p, "suspend", "alice", "--reason", "abuse", "--reason-code", "PolicyViolation", "--until", "24h"); err != nil {
+		t.Fatal(err)
+	}
+	u = getUser(t, p, "alice")
+	if u.Spec.State != kimiov1beta1.SuspendedUserState || u.Spec.ReasonCode != "PolicyViolation" || u.Spec.SuspendedUntil == nil {
+		t.Fatalf("expected alice to be temporarily suspended, got %+v", u.Spec)
+	}
+
+	// failing users are reported and do not stop the others
+	out, err := runCommand(p, "ban", "alice", "carol", "--reason", "abuse")
+	if err == nil || !strings.Contains(out, "user.kim.io/alice banned") || !strings.Contains(out, "user.kim.io/carol not banned") {
+		t.Fatalf("expected alice to be banned and carol to fail, got %v:\n%s", err, out)
+	}
+
+	if _, err := runCommand(p, "reactivate", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	u = getUser(t, p, "alice")
+	if u.Spec.State != kimiov1beta1.ActiveUserState || u.Spec.ReasonCode != "" || u.Spec.SuspendedUntil != nil {
+		t.Fatalf("expected alice to be reactivated, got %+v", u.Spec)
+	}
+	if _, ok := u.Annotations[kimiov1beta1.UserStateChangeReasonAnnotation]; ok {
+		t.Fatalf("expected the reason of the ban not to be carried over, got %v", u.Annotations)
+	}
+
+	if _, err := runCommand(p, "reactivate", "bob"); err == nil {
+		t.Fatal("expected an error reactivating an active user")
+	}
+}
+
+func TestParseUntil(t *testing.T) {
+	now := time.Date(2023, 5, 4, 10, 0, 0, 0, time.UTC)
+	for v, exp := range map[string]time.Time{
+		"72h":                  now.Add(72 * time.Hour),
+		"2023-06-01T00:00:00Z": time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		got, err := parseUntil(v, now)
+		if err != nil || !got.Time.Equal(exp) {
+			t.Errorf("expected %s to be parsed as %s, got %v, %v", v, exp, got, err)
+		}
+	}
+	for _, v := range []string{"-1h", "2023-01-01T00:00:00Z", "tomorrow"} {
+		if _, err := parseUntil(v, now); err == nil {
+			t.Errorf("expected an error parsing %s", v)
+		}
+	}
+}
+
+func TestPersonalAccessTokens(t *testing.T) {
+	newToken := func(name, user string) *kimiov1beta1.PersonalAccessToken {
+		return &kimiov1beta1.PersonalAccessToken{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: name},
+			Spec:       kimiov1beta1.PersonalAccessTokenSpec{User: kimiov1beta1.UserReference{Name: user}},
+			Status:     kimiov1beta1.PersonalAccessTokenStatus{Phase: kimiov1beta1.ActivePersonalAccessTokenPhase},
+		}
+	}
+	p := newPluginForTest(
+		newUser("alice", kimiov1beta1.ActiveUserState),
+		newUser("bob", kimiov1beta1.SuspendedUserState),
+		newToken("alice-ci", "alice"),
+		newToken("bob-ci", "bob"),
+	)
+
+	out, err := runCommand(p, "pat", "list", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "alice-ci") || strings.Contains(out, "bob-ci") {
+		t.Fatalf("expected only alice's tokens, got:\n%s", out)
+	}
+
+	if _, err := runCommand(p, "pat", "revoke", "bob-ci"); err != nil {
+		t.Fatal(err)
+	}
+	err = p.Client.Get(context.TODO(), types.NamespacedName{Namespace: "tenant", Name: "bob-ci"}, &kimiov1beta1.PersonalAccessToken{})
+	if !kerrors.IsNotFound(err) {
+		t.Fatalf("expected bob-ci to be revoked, got %v", err)
+	}
+
+	if _, err := runCommand(p, "pat", "create", "bob"); err == nil {
+		t.Fatal("expected an error creating a token for a suspended user")
+	}
+
+	// tokens not issued in time are deleted
+	if _, err := runCommand(p, "pat", "create", "alice", "--name", "alice-cd", "--timeout", "1ms"); err == nil {
+		t.Fatal("expected an error waiting for the token")
+	}
+	err = p.Client.Get(context.TODO(), types.NamespacedName{Namespace: "tenant", Name: "alice-cd"}, &kimiov1beta1.PersonalAccessToken{})
+	if !kerrors.IsNotFound(err) {
+		t.Fatalf("expected alice-cd to be deleted, got %v", err)
+	}
+}
+
+func TestKubeconfig(t *testing.T) {
+	u := newUser("alice", kimiov1beta1.ActiveUserState)
+	u.Status.HomeNamespace = "kim-alice"
+	u.Status.CredentialsSecretRef = &corev1.LocalObjectReference{Name: "alice"}
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: "alice"},
+		Type:       corev1.SecretTypeServiceAccountToken,
+		Data: map[string][]byte{
+			corev1.ServiceAccountTokenKey:  []byte("alice-sa-token"),
+			corev1.ServiceAccountRootCAKey: []byte("ca"),
+		},
+	}
+	p := newPluginForTest(u, s, newUser("bob", kimiov1beta1.SuspendedUserState))
+
+	out, err := runCommand(p, "kubeconfig", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := clientcmd.Load([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cfg.Contexts[cfg.CurrentContext]
+	if c == nil || c.Namespace != "kim-alice" ||
+		cfg.AuthInfos[c.AuthInfo].Token != "alice-sa-token" ||
+		cfg.Clusters[c.Cluster].Server != "https://kim.example.com:6443" {
+		t.Fatalf("unexpected kubeconfig:\n%s", out)
+	}
+
+	if _, err := runCommand(p, "kubeconfig", "bob"); err == nil {
+		t.Fatal("expected an error for a suspended user")
+	}
+
+	// the credentials are not issued until they are referenced in the status
+	u = getUser(t, p, "alice")
+	u.Status.CredentialsSecretRef = nil
+	if err := p.Client.Update(context.TODO(), u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runCommand(p, "kubeconfig", "alice"); err == nil || !strings.Contains(err.Error(), "not issued yet") {
+		t.Fatalf("expected an error for credentials not issued yet, got %v", err)
+	}
+
+	// the Secret of a User in conflict is not the User's one
+	u = getUser(t, p, "alice")
+	u.Status.CredentialsSecretRef = &corev1.LocalObjectReference{Name: "alice"}
+	u.Status.Conditions = []metav1.Condition{{
+		Type:               controllers.ConflictCondition,
+		Status:             metav1.ConditionTrue,
+		Reason:             controllers.SecretNotOwnedReason,
+		Message:            "Secret tenant/alice already exists and is not managed by KIM",
+		LastTransitionTime: metav1.Now(),
+	}}
+	if err := p.Client.Update(context.TODO(), u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runCommand(p, "kubeconfig", "alice"); err == nil {
+		t.Fatal("expected an error for a user in conflict")
+	}
+}
+
+func TestParse(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	reason := fs.String("reason", "", "")
+	args, err := parse(fs, []string{"alice", "--reason", "abuse", "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *reason != "abuse" || strings.Join(args, ",") != "alice,bob" {
+		t.Fatalf("unexpected parsing: %q, %v", *reason, args)
+	}
+}
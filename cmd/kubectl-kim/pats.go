@@ -0,0 +1,178 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+const tokenPollInterval = 500 * time.Millisecond
+
+func patCreateCommand(fs *flag.FlagSet) runFunc {
+	name := fs.String("name", "", "The name of the Personal Access Token. Defaults to a name generated from the User's.")
+	lifetime := fs.Duration("lifetime", 0, "The lifetime of the Personal Access Token. If not set, it does not expire.")
+	timeout := fs.Duration("timeout", 30*time.Second, "How long to wait for the token to be issued.")
+
+	return func(ctx context.Context, p *plugin, args []string) error {
+		if err := requireArgs(args, 1, 1, "user"); err != nil {
+			return err
+		}
+		if err := p.requireNamespace(); err != nil {
+			return err
+		}
+		if *lifetime < 0 {
+			return fmt.Errorf("invalid --lifetime %s, expected a positive duration", *lifetime)
+		}
+
+		var u kimiov1beta1.User
+		if err := p.Client.Get(ctx, types.NamespacedName{Namespace: p.Namespace, Name: args[0]}, &u); err != nil {
+			return err
+		}
+		if u.Status.State != kimiov1beta1.ActiveUserState {
+			return fmt.Errorf("user %s is %s, tokens are only issued to Active users", u.Name, orNone(string(u.Status.State)))
+		}
+
+		pat := kimiov1beta1.PersonalAccessToken{
+			ObjectMeta: metav1.ObjectMeta{Namespace: u.Namespace, Name: *name},
+			Spec:       kimiov1beta1.PersonalAccessTokenSpec{User: kimiov1beta1.UserReference{Name: u.Name}},
+		}
+		if *name == "" {
+			pat.GenerateName = u.Name + "-"
+		}
+		if *lifetime > 0 {
+			exp := metav1.NewTime(time.Now().Add(*lifetime))
+			pat.Spec.Expiration = &exp
+		}
+		if err := controllerutil.SetOwnerReference(&u, &pat, p.Client.Scheme()); err != nil {
+			return err
+		}
+		if err := p.Client.Create(ctx, &pat); err != nil {
+			return err
+		}
+
+		t, err := p.waitForToken(ctx, &pat, *timeout)
+		if err != nil {
+			// do not leave behind a token nobody knows of
+			if err := p.Client.Delete(context.Background(), &pat); err != nil && !kerrors.IsNotFound(err) {
+				fmt.Fprintf(p.Out, "error deleting personalaccesstoken.kim.io/%s: %v\n", pat.Name, err)
+			}
+			return fmt.Errorf("token of personalaccesstoken.kim.io/%s not issued: %w", pat.Name, err)
+		}
+
+		fmt.Fprintf(p.Out, "personalaccesstoken.kim.io/%s created\n", pat.Name)
+		fmt.Fprintln(p.Out, t)
+		return nil
+	}
+}
+
+// waitForToken waits for the Secret of the PersonalAccessToken to contain the token
+func (p *plugin) waitForToken(ctx context.Context, pat *kimiov1beta1.PersonalAccessToken, timeout time.Duration) (string, error) {
+	var t string
+	err := wait.PollImmediateWithContext(ctx, tokenPollInterval, timeout, func(ctx context.Context) (bool, error) {
+		var s corev1.Secret
+		if err := p.Client.Get(ctx, types.NamespacedName{Namespace: pat.Namespace, Name: pat.Name}, &s); err != nil {
+			return false, client.IgnoreNotFound(err)
+		}
+		if !metav1.IsControlledBy(&s, pat) {
+			return false, fmt.Errorf("secret %s is not controlled by the personal access token", s.Name)
+		}
+		t = string(s.Data[kimiov1beta1.PersonalAccessTokenSecretTokenKey])
+		return t != "", nil
+	})
+	return t, err
+}
+
+func patListCommand(fs *flag.FlagSet) runFunc {
+	return func(ctx context.Context, p *plugin, args []string) error {
+		if err := requireArgs(args, 0, 1, "user"); err != nil {
+			return err
+		}
+
+		var pp kimiov1beta1.PersonalAccessTokenList
+		if err := p.Client.List(ctx, &pp, client.InNamespace(p.Namespace)); err != nil {
+			return err
+		}
+		var tt []kimiov1beta1.PersonalAccessToken
+		for _, t := range pp.Items {
+			if len(args) == 0 || t.Spec.User.Name == args[0] {
+				tt = append(tt, t)
+			}
+		}
+		if len(tt) == 0 {
+			fmt.Fprintln(p.Out, "No Personal Access Tokens found.")
+			return nil
+		}
+		sort.Slice(tt, func(i, j int) bool {
+			if tt[i].Namespace != tt[j].Namespace {
+				return tt[i].Namespace < tt[j].Namespace
+			}
+			return tt[i].Name < tt[j].Name
+		})
+
+		all := p.Namespace == ""
+		tw := newTable(p.Out, all, "NAME", "USER", "PHASE", "REASON", "EXPIRATION", "AGE")
+		for _, t := range tt {
+			exp := "<none>"
+			if t.Spec.Expiration != nil {
+				exp = t.Spec.Expiration.UTC().Format(time.RFC3339)
+			}
+			printRow(tw, all, t.Namespace, t.Name, t.Spec.User.Name,
+				orNone(string(t.Status.Phase)), orNone(t.Status.Reason), exp, age(t.CreationTimestamp))
+		}
+		return tw.Flush()
+	}
+}
+
+func patRevokeCommand(fs *flag.FlagSet) runFunc {
+	return func(ctx context.Context, p *plugin, args []string) error {
+		if err := requireArgs(args, 1, -1, "tokens"); err != nil {
+			return err
+		}
+		if err := p.requireNamespace(); err != nil {
+			return err
+		}
+
+		failed := 0
+		for _, n := range args {
+			t := kimiov1beta1.PersonalAccessToken{ObjectMeta: metav1.ObjectMeta{Namespace: p.Namespace, Name: n}}
+			if err := p.Client.Delete(ctx, &t); err != nil {
+				fmt.Fprintf(p.Out, "personalaccesstoken.kim.io/%s not revoked: %v\n", n, err)
+				failed++
+				continue
+			}
+			fmt.Fprintf(p.Out, "personalaccesstoken.kim.io/%s revoked\n", n)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d tokens not revoked", failed, len(args))
+		}
+		return nil
+	}
+}
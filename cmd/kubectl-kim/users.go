@@ -0,0 +1,215 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+func pendingCommand(fs *flag.FlagSet) runFunc {
+	return func(ctx context.Context, p *plugin, args []string) error {
+		if err := requireArgs(args, 0, 0, "arguments"); err != nil {
+			return err
+		}
+
+		var uu kimiov1beta1.UserList
+		if err := p.Client.List(ctx, &uu, client.InNamespace(p.Namespace)); err != nil {
+			return err
+		}
+		var pending []kimiov1beta1.User
+		for _, u := range uu.Items {
+			if u.Spec.State == kimiov1beta1.WaitingForApprovalUserState {
+				pending = append(pending, u)
+			}
+		}
+		if len(pending) == 0 {
+			fmt.Fprintln(p.Out, "No Users waiting for approval found.")
+			return nil
+		}
+		sort.Slice(pending, func(i, j int) bool {
+			if pending[i].Namespace != pending[j].Namespace {
+				return pending[i].Namespace < pending[j].Namespace
+			}
+			return pending[i].Name < pending[j].Name
+		})
+
+		all := p.Namespace == ""
+		tw := newTable(p.Out, all, "NAME", "USERNAME", "EMAIL", "INVITED-BY", "AGE")
+		for _, u := range pending {
+			printRow(tw, all, u.Namespace, u.Name, u.Spec.Username, u.Spec.Email,
+				orNone(u.Annotations[kimiov1beta1.UserInvitedByAnnotation]), age(u.CreationTimestamp))
+		}
+		return tw.Flush()
+	}
+}
+
+func approveCommand(fs *flag.FlagSet) runFunc {
+	reason := fs.String("reason", "", "The reason of the approval, recorded in the User's history.")
+
+	return func(ctx context.Context, p *plugin, args []string) error {
+		return p.changeState(ctx, args, "approved", func(u *kimiov1beta1.User) error {
+			if u.Spec.State != kimiov1beta1.WaitingForApprovalUserState {
+				return fmt.Errorf("user is %s, not waiting for approval", u.Spec.State)
+			}
+			setState(u, kimiov1beta1.ActiveUserState, *reason)
+			return nil
+		})
+	}
+}
+
+func suspendCommand(fs *flag.FlagSet) runFunc {
+	return restrictCommand(fs, kimiov1beta1.SuspendedUserState, "suspended", func(u *kimiov1beta1.User, until *metav1.Time) {
+		u.Spec.SuspendedUntil = until
+	})
+}
+
+func banCommand(fs *flag.FlagSet) runFunc {
+	return restrictCommand(fs, kimiov1beta1.BannedUserState, "banned", func(u *kimiov1beta1.User, until *metav1.Time) {
+		u.Spec.BannedUntil = until
+	})
+}
+
+// restrictCommand moves Users to a suspended or banned state, optionally until a given time
+func restrictCommand(fs *flag.FlagSet, state kimiov1beta1.UserState, done string, setUntil func(*kimiov1beta1.User, *metav1.Time)) runFunc {
+	reason := fs.String("reason", "", "The reason, recorded in the User's history. Required.")
+	reasonCode := fs.String("reason-code", "", "The code classifying the reason (e.g. PolicyViolation).")
+	until := fs.String("until", "", "Restore the Users to Active at the given time, either in RFC 3339 format or as a duration from now (e.g. 72h).")
+
+	return func(ctx context.Context, p *plugin, args []string) error {
+		if *reason == "" {
+			return errors.New("a reason is required, use --reason")
+		}
+		t, err := parseUntil(*until, time.Now())
+		if err != nil {
+			return err
+		}
+
+		return p.changeState(ctx, args, done, func(u *kimiov1beta1.User) error {
+			if u.Spec.State == state {
+				return fmt.Errorf("user is already %s", state)
+			}
+			setState(u, state, *reason)
+			u.Spec.SuspendedUntil, u.Spec.BannedUntil = nil, nil
+			setUntil(u, t)
+			u.Spec.ReasonCode = *reasonCode
+			return nil
+		})
+	}
+}
+
+func reactivateCommand(fs *flag.FlagSet) runFunc {
+	reason := fs.String("reason", "", "The reason of the reactivation, recorded in the User's history.")
+
+	return func(ctx context.Context, p *plugin, args []string) error {
+		return p.changeState(ctx, args, "reactivated", func(u *kimiov1beta1.User) error {
+			if u.Spec.State != kimiov1beta1.SuspendedUserState && u.Spec.State != kimiov1beta1.BannedUserState {
+				return fmt.Errorf("user is %s, not suspended nor banned", u.Spec.State)
+			}
+			setState(u, kimiov1beta1.ActiveUserState, *reason)
+			u.Spec.SuspendedUntil = nil
+			u.Spec.BannedUntil = nil
+			u.Spec.ReasonCode = ""
+			return nil
+		})
+	}
+}
+
+// changeState patches each User with mutate. Users failing are reported
+// and do not stop the others.
+func (p *plugin) changeState(ctx context.Context, names []string, done string, mutate func(*kimiov1beta1.User) error) error {
+	if err := requireArgs(names, 1, -1, "users"); err != nil {
+		return err
+	}
+	if err := p.requireNamespace(); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, n := range names {
+		if err := p.patchUser(ctx, n, mutate); err != nil {
+			fmt.Fprintf(p.Out, "user.kim.io/%s not %s: %v\n", n, done, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(p.Out, "user.kim.io/%s %s\n", n, done)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d users not %s", failed, len(names), done)
+	}
+	return nil
+}
+
+func (p *plugin) patchUser(ctx context.Context, name string, mutate func(*kimiov1beta1.User) error) error {
+	var u kimiov1beta1.User
+	if err := p.Client.Get(ctx, types.NamespacedName{Namespace: p.Namespace, Name: name}, &u); err != nil {
+		return err
+	}
+
+	o := u.DeepCopy()
+	if err := mutate(&u); err != nil {
+		return err
+	}
+	return p.Client.Patch(ctx, &u, client.MergeFromWithOptions(o, client.MergeFromWithOptimisticLock{}))
+}
+
+// setState sets the state of the User and the reason of the change, that the
+// admission webhook records together with the requester
+func setState(u *kimiov1beta1.User, s kimiov1beta1.UserState, reason string) {
+	u.Spec.State = s
+	if reason == "" {
+		delete(u.Annotations, kimiov1beta1.UserStateChangeReasonAnnotation)
+		return
+	}
+	if u.Annotations == nil {
+		u.Annotations = map[string]string{}
+	}
+	u.Annotations[kimiov1beta1.UserStateChangeReasonAnnotation] = reason
+}
+
+// parseUntil parses a time in RFC 3339 format or a duration from now
+func parseUntil(v string, now time.Time) (*metav1.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid --until %s, expected a positive duration", v)
+		}
+		t := metav1.NewTime(now.Add(d))
+		return &t, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --until %s, expected a time in RFC 3339 format or a duration", v)
+	}
+	if !t.After(now) {
+		return nil, fmt.Errorf("invalid --until %s, expected a time in the future", v)
+	}
+	mt := metav1.NewTime(t)
+	return &mt, nil
+}
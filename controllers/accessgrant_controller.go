@@ -0,0 +1,428 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/pkg/audit"
+)
+
+const (
+	WaitingForApprovalAccessGrantReason = "WaitingForApproval"
+	UserNotFoundAccessGrantReason       = "UserNotFound"
+	UserNotActiveAccessGrantReason      = "UserNotActive"
+	NotGrantableAccessGrantReason       = "NotGrantable"
+	OutOfScopeAccessGrantReason         = "OutOfScope"
+	GrantedAccessGrantReason            = "Granted"
+	ExpiredAccessGrantReason            = "Expired"
+
+	// AccessGrantFinalizer ensures the binding of an AccessGrant is removed when the AccessGrant is deleted
+	AccessGrantFinalizer = "kim.io/access-grant"
+)
+
+// AccessGrantReconciler reconciles an AccessGrant object
+type AccessGrantReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Auditor records the phase changes of AccessGrants. If nil, they are not audited.
+	Auditor audit.Logger
+
+	// Bindings caches the bindings provisioned for Users in any namespace,
+	// to restore them when modified or deleted. If nil, they are not watched.
+	Bindings cache.Cache
+
+	// ServiceAccount configures the ServiceAccounts provisioned for Users, the
+	// roles are bound to. If nil, they are named as the User.
+	ServiceAccount *ServiceAccountConfig
+
+	// Policy restricts the roles AccessGrants can grant and where. It is
+	// enforced by the admission webhook too, the AccessGrants it refuses are
+	// never granted. If nil, any role can be granted anywhere.
+	Policy *kimiov1beta1.AccessGrantPolicy
+
+	// Scope is the set of namespaces KIM is granted access to: the
+	// AccessGrants scoped outside of it are never granted
+	Scope Scope
+
+	// Plan makes the reconciliation of every AccessGrant report the actions it
+	// would perform in the AccessGrant's status and Events instead of
+	// performing them. The AccessGrants of the Users annotated with the
+	// PlanAnnotation are planned regardless.
+	Plan bool
+}
+
+//+kubebuilder:rbac:groups=kim.io,resources=accessgrants,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=kim.io,resources=accessgrants/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=kim.io,resources=accessgrants/finalizers,verbs=update
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterrolebindings,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile binds the role of an approved AccessGrant to the ServiceAccount of
+// its User while the User is Active. The expiration is computed on approval
+// and persisted in the status, so that the binding is removed exactly at
+// expiration, even across restarts. Once expired, an AccessGrant is never
+// granted again.
+//
+// For more details, check Reconcile and its Result here:
+// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
+func (r *AccessGrantReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx).WithValues("namespace", req.Namespace, "accessgrant", req.Name)
+	ctx = withCorrelationID(ctx)
+
+	// fetch access grant
+	var g kimiov1beta1.AccessGrant
+	if err := r.Get(ctx, req.NamespacedName, &g); err != nil {
+		if errors.IsNotFound(err) {
+			l.Info("access grant has been deleted")
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	if err := r.recordApproval(ctx, &g); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	planned, err := r.planned(ctx, &g)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if planned {
+		return r.plan(ctx, &g)
+	}
+	return r.enforce(ctx, &g)
+}
+
+// planned returns true if the reconciliation of the AccessGrant is to be
+// planned, because of the plan mode or of the annotation of its User
+func (r *AccessGrantReconciler) planned(ctx context.Context, g *kimiov1beta1.AccessGrant) (bool, error) {
+	if r.Plan {
+		return true, nil
+	}
+
+	var u kimiov1beta1.User
+	if err := r.Get(ctx, types.NamespacedName{Namespace: g.Namespace, Name: g.Spec.User.Name}, &u); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	return isPlanned(&u), nil
+}
+
+// recordApproval persists in the status when the AccessGrant has been approved
+// and when it expires, the first time it is reconciled once approved. When
+// the approval time is not recorded by the admission webhook, the current
+// time is recorded instead, once, so that the expiration doesn't move.
+func (r *AccessGrantReconciler) recordApproval(ctx context.Context, g *kimiov1beta1.AccessGrant) error {
+	if !g.Spec.Approved || g.Status.ExpiresAt != nil {
+		return nil
+	}
+	a := approvalTime(g)
+	g.Status.ApprovedAt = &a
+	g.Status.ExpiresAt = &metav1.Time{Time: a.Add(g.Spec.Duration.Duration)}
+	return r.Status().Update(ctx, g)
+}
+
+// plan computes the actions the reconciliation of the AccessGrant would
+// perform and, when they change, reports them in its status and in an Event.
+// Nothing else is written but the approval, recorded beforehand: the
+// reconciliation runs against a planClient, without Events nor audit records.
+func (r *AccessGrantReconciler) plan(ctx context.Context, g *kimiov1beta1.AccessGrant) (ctrl.Result, error) {
+	c := newPlanClient(r.Client)
+	p := *r
+	p.Client = c
+	p.Recorder = discardRecorder{}
+	p.Auditor = nil
+	res, err := p.enforce(ctx, g.DeepCopy())
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if pl := c.plan(); !equality.Semantic.DeepEqual(g.Status.Plan, pl) {
+		r.Recorder.Event(g, corev1.EventTypeNormal, PlannedReason, planMessage(pl))
+		g.Status.Plan = pl
+		if err := r.Status().Update(ctx, g); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	// the plan changes at expiration
+	return res, nil
+}
+
+// enforce reconciles the AccessGrant, performing the actions it needs
+func (r *AccessGrantReconciler) enforce(ctx context.Context, g *kimiov1beta1.AccessGrant) (ctrl.Result, error) {
+	l := log.FromContext(ctx).WithValues("namespace", g.Namespace, "accessgrant", g.Name)
+
+	// the binding is not in the namespace of the AccessGrant, so it is not garbage collected
+	if !g.DeletionTimestamp.IsZero() {
+		l.Info("access grant is being deleted, ensure binding doesn't exist")
+		if err := r.ensureBindingDoesntExist(ctx, g); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, r.updateFinalizers(ctx, g, func() bool {
+			return controllerutil.RemoveFinalizer(g, AccessGrantFinalizer)
+		})
+	}
+
+	// the records are written by the admission webhook
+	g.Status.RequestedBy = g.Annotations[kimiov1beta1.AccessGrantRequestedByAnnotation]
+	g.Status.ApprovedBy = g.Annotations[kimiov1beta1.AccessGrantApprovedByAnnotation]
+
+	phase, reason, requeueAfter, err := r.computePhase(ctx, g)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	switch phase {
+	case kimiov1beta1.ActiveAccessGrantPhase:
+		l.Info("access grant is active, ensure binding exists", "expires-at", g.Status.ExpiresAt)
+		if err := r.updateFinalizers(ctx, g, func() bool {
+			return controllerutil.AddFinalizer(g, AccessGrantFinalizer)
+		}); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.ensureBindingExists(ctx, g); err != nil {
+			l.Error(err, "error ensuring binding exists")
+			return ctrl.Result{}, err
+		}
+
+	default:
+		l.Info("access grant is not active, ensure binding doesn't exist", "phase", phase, "reason", reason)
+		if err := r.ensureBindingDoesntExist(ctx, g); err != nil {
+			l.Error(err, "error ensuring binding doesn't exist")
+			return ctrl.Result{}, err
+		}
+	}
+
+	if g.Status.Phase != phase || g.Status.Reason != reason {
+		r.Recorder.Eventf(g, corev1.EventTypeNormal, reason, "AccessGrant moved from phase '%s' to '%s'", g.Status.Phase, phase)
+		auditLog(audit.WithRequester(ctx, grantRequester(g, reason)), r.Auditor, audit.StateChangedAction, auditObject("AccessGrant", g), string(g.Status.Phase), string(phase), reason)
+	}
+
+	g.Status.Phase = phase
+	g.Status.Reason = reason
+	g.Status.ObservedGeneration = g.Generation
+	g.Status.Plan = nil
+	if err := r.Status().Update(ctx, g); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// grantRequester returns who requested the change of the AccessGrant to the
+// phase of the given reason: the approver grants it, the requester asks for
+// it. The other changes are KIM's.
+func grantRequester(g *kimiov1beta1.AccessGrant, reason string) string {
+	switch reason {
+	case GrantedAccessGrantReason:
+		return g.Status.ApprovedBy
+	case WaitingForApprovalAccessGrantReason:
+		return g.Status.RequestedBy
+	default:
+		return ""
+	}
+}
+
+// computePhase calculates the phase of the AccessGrant from its approval,
+// its expiration and the observed state of its User
+func (r *AccessGrantReconciler) computePhase(ctx context.Context, g *kimiov1beta1.AccessGrant) (kimiov1beta1.AccessGrantPhase, string, time.Duration, error) {
+	if g.IsExpired() {
+		return kimiov1beta1.ExpiredAccessGrantPhase, ExpiredAccessGrantReason, 0, nil
+	}
+
+	if r.Policy != nil && len(r.Policy.Validate(g)) > 0 {
+		return kimiov1beta1.PendingAccessGrantPhase, NotGrantableAccessGrantReason, 0, nil
+	}
+
+	if !r.Scope.Includes(g.Spec.Scope.Namespace) {
+		return kimiov1beta1.PendingAccessGrantPhase, OutOfScopeAccessGrantReason, 0, nil
+	}
+
+	if !g.Spec.Approved {
+		return kimiov1beta1.PendingAccessGrantPhase, WaitingForApprovalAccessGrantReason, 0, nil
+	}
+
+	d := time.Until(g.Status.ExpiresAt.Time)
+	if d <= 0 {
+		return kimiov1beta1.ExpiredAccessGrantPhase, ExpiredAccessGrantReason, 0, nil
+	}
+
+	var u kimiov1beta1.User
+	if err := r.Get(ctx, types.NamespacedName{Namespace: g.Namespace, Name: g.Spec.User.Name}, &u); err != nil {
+		if errors.IsNotFound(err) {
+			return kimiov1beta1.PendingAccessGrantPhase, UserNotFoundAccessGrantReason, d, nil
+		}
+		return "", "", 0, err
+	}
+
+	if u.Status.State != kimiov1beta1.ActiveUserState {
+		return kimiov1beta1.PendingAccessGrantPhase, UserNotActiveAccessGrantReason, d, nil
+	}
+	return kimiov1beta1.ActiveAccessGrantPhase, GrantedAccessGrantReason, d, nil
+}
+
+// approvalTime returns the approval time recorded by the admission webhook,
+// or the current time if it is not available
+func approvalTime(g *kimiov1beta1.AccessGrant) metav1.Time {
+	if a, ok := g.Annotations[kimiov1beta1.AccessGrantApprovedAtAnnotation]; ok {
+		if t, err := time.Parse(time.RFC3339, a); err == nil {
+			return metav1.NewTime(t)
+		}
+	}
+	return metav1.Now()
+}
+
+// accessGrantBindingName returns the name of the binding of the AccessGrant.
+// Names can contain dashes, so the namespace and the name are hashed not to
+// collide with the ones of another AccessGrant.
+func accessGrantBindingName(g *kimiov1beta1.AccessGrant) string {
+	h := sha256.Sum256([]byte(g.Namespace + "/" + g.Name))
+	return "kim-grant-" + g.Name + "-" + hex.EncodeToString(h[:])[:10]
+}
+
+func (r *AccessGrantReconciler) ensureBindingExists(ctx context.Context, g *kimiov1beta1.AccessGrant) error {
+	ll := userLabels(g.Namespace, g.Spec.User.Name)
+	ll[AccessGrantLabel] = g.Name
+	rr := rbacv1.RoleRef{
+		APIGroup: rbacv1.GroupName,
+		Kind:     g.Spec.Role.Kind,
+		Name:     g.Spec.Role.Name,
+	}
+	var u kimiov1beta1.User
+	if err := r.Get(ctx, types.NamespacedName{Namespace: g.Namespace, Name: g.Spec.User.Name}, &u); err != nil {
+		return err
+	}
+	sub, err := r.ServiceAccount.Subject(&u)
+	if err != nil {
+		return err
+	}
+	ss := []rbacv1.Subject{sub}
+
+	if g.Spec.Scope.Namespace == "" {
+		return apply(ctx, r.Client, &rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: accessGrantBindingName(g), Labels: ll},
+			RoleRef:    rr,
+			Subjects:   ss,
+		})
+	}
+
+	return apply(ctx, r.Client, &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Namespace: g.Spec.Scope.Namespace, Name: accessGrantBindingName(g), Labels: ll},
+		RoleRef:    rr,
+		Subjects:   ss,
+	})
+}
+
+func (r *AccessGrantReconciler) ensureBindingDoesntExist(ctx context.Context, g *kimiov1beta1.AccessGrant) error {
+	// bindings are never provisioned out of scope
+	if !r.Scope.Includes(g.Spec.Scope.Namespace) {
+		return nil
+	}
+
+	var o client.Object = &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: accessGrantBindingName(g)},
+	}
+	if g.Spec.Scope.Namespace != "" {
+		o = &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Namespace: g.Spec.Scope.Namespace, Name: accessGrantBindingName(g)},
+		}
+	}
+
+	if err := r.Delete(ctx, o); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// updateFinalizers applies the changes performed by mutate to the
+// AccessGrant's finalizers, preserving the in-memory status of the AccessGrant
+func (r *AccessGrantReconciler) updateFinalizers(ctx context.Context, g *kimiov1beta1.AccessGrant, mutate func() bool) error {
+	o := g.DeepCopy()
+	if !mutate() {
+		return nil
+	}
+
+	st := g.Status.DeepCopy()
+	if err := r.Patch(ctx, g, client.MergeFrom(o)); err != nil {
+		return err
+	}
+	g.Status = *st
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *AccessGrantReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&kimiov1beta1.AccessGrant{}).
+		Watches(
+			&source.Kind{Type: &kimiov1beta1.User{}},
+			handler.EnqueueRequestsFromMapFunc(r.mapUserToAccessGrants),
+		)
+	if r.Bindings != nil {
+		b = b.Watches(
+			source.NewKindWithCache(&rbacv1.RoleBinding{}, r.Bindings),
+			handler.EnqueueRequestsFromMapFunc(mapBindingToAccessGrant),
+		)
+		if r.Scope.ClusterWide() {
+			b = b.Watches(
+				source.NewKindWithCache(&rbacv1.ClusterRoleBinding{}, r.Bindings),
+				handler.EnqueueRequestsFromMapFunc(mapBindingToAccessGrant),
+			)
+		}
+	}
+	return b.Complete(r)
+}
+
+// mapUserToAccessGrants enqueues all the AccessGrants of a User
+func (r *AccessGrantReconciler) mapUserToAccessGrants(o client.Object) []reconcile.Request {
+	var gg kimiov1beta1.AccessGrantList
+	if err := r.List(context.Background(), &gg,
+		client.InNamespace(o.GetNamespace()),
+		client.MatchingFields{AccessGrantUserIndex: o.GetName()},
+	); err != nil {
+		log.Log.Error(err, "error listing access grants of user", "namespace", o.GetNamespace(), "user", o.GetName())
+		return nil
+	}
+
+	rr := make([]reconcile.Request, len(gg.Items))
+	for i, g := range gg.Items {
+		rr[i] = reconcile.Request{NamespacedName: types.NamespacedName{Namespace: g.Namespace, Name: g.Name}}
+	}
+	return rr
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+func newAccessGrantReconciler() *AccessGrantReconciler {
+	return &AccessGrantReconciler{
+		Client:   k8sClient,
+		Scheme:   scheme.Scheme,
+		Recorder: record.NewFakeRecorder(100),
+	}
+}
+
+func newActiveUser(namespace string) *kimiov1beta1.User {
+	u := newUser(namespace, kimiov1beta1.ActiveUserState)
+	u.Status.State = kimiov1beta1.ActiveUserState
+	return u
+}
+
+func newAccessGrant(namespace, scope string, approvedAt *time.Time) *kimiov1beta1.AccessGrant {
+	g := &kimiov1beta1.AccessGrant{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      "incident",
+			Annotations: map[string]string{
+				kimiov1beta1.AccessGrantRequestedByAnnotation: "alice",
+			},
+		},
+		Spec: kimiov1beta1.AccessGrantSpec{
+			User:     kimiov1beta1.UserReference{Name: "alice"},
+			Role:     kimiov1beta1.AccessProfileRoleRef{Kind: "ClusterRole", Name: "admin"},
+			Scope:    kimiov1beta1.AccessGrantScope{Namespace: scope},
+			Duration: metav1.Duration{Duration: time.Hour},
+		},
+	}
+	if approvedAt != nil {
+		g.Spec.Approved = true
+		g.Annotations[kimiov1beta1.AccessGrantApprovedByAnnotation] = "bob"
+		g.Annotations[kimiov1beta1.AccessGrantApprovedAtAnnotation] = approvedAt.UTC().Format(time.RFC3339)
+	}
+	return g
+}
+
+// reconcileAccessGrant reconciles the AccessGrant and returns it
+func reconcileAccessGrant(ctx context.Context, r *AccessGrantReconciler, key types.NamespacedName) (*kimiov1beta1.AccessGrant, ctrl.Result) {
+	res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+	var g kimiov1beta1.AccessGrant
+	ExpectWithOffset(1, k8sClient.Get(ctx, key, &g)).To(Succeed())
+	return &g, res
+}
+
+func bindingExists(ctx context.Context, g *kimiov1beta1.AccessGrant) bool {
+	if g.Spec.Scope.Namespace == "" {
+		return exists(ctx, types.NamespacedName{Name: accessGrantBindingName(g)}, &rbacv1.ClusterRoleBinding{})
+	}
+	return exists(ctx, types.NamespacedName{Namespace: g.Spec.Scope.Namespace, Name: accessGrantBindingName(g)}, &rbacv1.RoleBinding{})
+}
+
+var _ = Describe("AccessGrantReconciler", func() {
+	var (
+		ctx    context.Context
+		tenant string
+		prod   string
+		key    types.NamespacedName
+		r      *AccessGrantReconciler
+	)
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+		tenant = createNamespace(ctx)
+		prod = createNamespace(ctx)
+		key = types.NamespacedName{Namespace: tenant, Name: "incident"}
+		r = newAccessGrantReconciler()
+	})
+
+	It("keeps the AccessGrant Pending until approved", func() {
+		create(ctx, newActiveUser(tenant), newAccessGrant(tenant, prod, nil))
+
+		g, _ := reconcileAccessGrant(ctx, r, key)
+		Expect(g.Status.Phase).To(Equal(kimiov1beta1.PendingAccessGrantPhase))
+		Expect(g.Status.Reason).To(Equal(WaitingForApprovalAccessGrantReason))
+		Expect(g.Status.RequestedBy).To(Equal("alice"))
+		Expect(bindingExists(ctx, g)).To(BeFalse(), "expected no binding")
+	})
+
+	for _, clusterWide := range []bool{false, true} {
+		clusterWide := clusterWide
+		where := "in a namespace"
+		if clusterWide {
+			where = "cluster-wide"
+		}
+
+		It("grants the role "+where+" until the expiration", func() {
+			scope := prod
+			if clusterWide {
+				scope = ""
+			}
+			a := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+			create(ctx, newActiveUser(tenant), newAccessGrant(tenant, scope, &a))
+
+			g, res := reconcileAccessGrant(ctx, r, key)
+			Expect(g.Status.Phase).To(Equal(kimiov1beta1.ActiveAccessGrantPhase))
+			Expect(g.Status.ApprovedBy).To(Equal("bob"))
+			Expect(g.Status.ExpiresAt.Time).To(BeTemporally("==", a.Add(time.Hour)))
+			Expect(res.RequeueAfter).To(BeNumerically(">", 49*time.Minute), "requeue at the expiration")
+			Expect(res.RequeueAfter).To(BeNumerically("<=", 50*time.Minute), "requeue at the expiration")
+			Expect(bindingExists(ctx, g)).To(BeTrue(), "expected the binding to exist")
+
+			By("persisting the expiration in the status")
+			exp := metav1.NewTime(time.Now().Add(-time.Second))
+			g.Status.ExpiresAt = &exp
+			Expect(k8sClient.Status().Update(ctx, g)).To(Succeed())
+			g, res = reconcileAccessGrant(ctx, r, key)
+			Expect(g.Status.Phase).To(Equal(kimiov1beta1.ExpiredAccessGrantPhase))
+			Expect(res.RequeueAfter).To(BeZero())
+			Expect(bindingExists(ctx, g)).To(BeFalse(), "expected the binding to be revoked")
+		})
+	}
+
+	It("records the approval time once when the admission webhook didn't", func() {
+		a := time.Now()
+		g := newAccessGrant(tenant, prod, &a)
+		delete(g.Annotations, kimiov1beta1.AccessGrantApprovedAtAnnotation)
+		create(ctx, newActiveUser(tenant), g)
+		// planning writes nothing but the plan and the approval
+		r.Plan = true
+
+		g, _ = reconcileAccessGrant(ctx, r, key)
+		Expect(g.Status.ApprovedAt).NotTo(BeNil(), "expected the approval time to be recorded")
+		exp := g.Status.ExpiresAt
+
+		time.Sleep(time.Second)
+		g, _ = reconcileAccessGrant(ctx, r, key)
+		Expect(g.Status.ExpiresAt).To(Equal(exp), "expected the expiration not to move")
+	})
+
+	It("names the bindings of AccessGrants unambiguously", func() {
+		g := func(namespace, name string) *kimiov1beta1.AccessGrant {
+			return &kimiov1beta1.AccessGrant{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+		}
+		Expect(accessGrantBindingName(g("team-a", "debug"))).NotTo(Equal(accessGrantBindingName(g("team", "a-debug"))))
+	})
+
+	It("revokes the role the policy doesn't allow to grant", func() {
+		a := time.Now()
+		create(ctx, newActiveUser(tenant), newAccessGrant(tenant, prod, &a))
+		r.Policy = &kimiov1beta1.AccessGrantPolicy{
+			GrantableRoles: []kimiov1beta1.AccessProfileRoleRef{{Kind: "ClusterRole", Name: "admin"}},
+		}
+		g, _ := reconcileAccessGrant(ctx, r, key)
+		Expect(bindingExists(ctx, g)).To(BeTrue(), "expected the binding to exist")
+
+		r.Policy.GrantableRoles = []kimiov1beta1.AccessProfileRoleRef{{Kind: "ClusterRole", Name: "view"}}
+		g, res := reconcileAccessGrant(ctx, r, key)
+		Expect(g.Status.Phase).To(Equal(kimiov1beta1.PendingAccessGrantPhase))
+		Expect(g.Status.Reason).To(Equal(NotGrantableAccessGrantReason))
+		Expect(res.RequeueAfter).To(BeZero())
+		Expect(bindingExists(ctx, g)).To(BeFalse(), "expected the binding to be revoked")
+	})
+
+	It("does not grant a role cluster-wide unless the policy allows it", func() {
+		a := time.Now()
+		create(ctx, newActiveUser(tenant), newAccessGrant(tenant, "", &a))
+		r.Policy = &kimiov1beta1.AccessGrantPolicy{
+			GrantableRoles: []kimiov1beta1.AccessProfileRoleRef{{Kind: "ClusterRole", Name: "admin"}},
+		}
+
+		g, _ := reconcileAccessGrant(ctx, r, key)
+		Expect(g.Status.Reason).To(Equal(NotGrantableAccessGrantReason))
+		Expect(bindingExists(ctx, g)).To(BeFalse(), "expected no binding")
+	})
+
+	for _, clusterWide := range []bool{false, true} {
+		clusterWide := clusterWide
+		where := "in a namespace"
+		if clusterWide {
+			where = "cluster-wide"
+		}
+
+		It("does not grant a role "+where+" KIM is not granted access to", func() {
+			scope := prod
+			if clusterWide {
+				scope = ""
+			}
+			a := time.Now()
+			create(ctx, newActiveUser(tenant), newAccessGrant(tenant, scope, &a))
+			r.Client = namespacedClient(ctx, tenant)
+			r.Scope = Scope{Namespaces: []string{tenant}}
+
+			g, _ := reconcileAccessGrant(ctx, r, key)
+			Expect(g.Status.Phase).To(Equal(kimiov1beta1.PendingAccessGrantPhase))
+			Expect(g.Status.Reason).To(Equal(OutOfScopeAccessGrantReason))
+			Expect(bindingExists(ctx, g)).To(BeFalse(), "expected no binding")
+		})
+	}
+
+	It("revokes the role when the User is not Active", func() {
+		a := time.Now()
+		u := newActiveUser(tenant)
+		create(ctx, u, newAccessGrant(tenant, prod, &a))
+		reconcileAccessGrant(ctx, r, key)
+
+		u.Status.State = kimiov1beta1.SuspendedUserState
+		Expect(k8sClient.Status().Update(ctx, u)).To(Succeed())
+		g, res := reconcileAccessGrant(ctx, r, key)
+		Expect(g.Status.Phase).To(Equal(kimiov1beta1.PendingAccessGrantPhase))
+		Expect(g.Status.Reason).To(Equal(UserNotActiveAccessGrantReason))
+		Expect(res.RequeueAfter).To(BeNumerically(">", 0), "requeue at the expiration")
+		Expect(bindingExists(ctx, g)).To(BeFalse(), "expected the binding to be revoked")
+	})
+
+	It("revokes the role when the AccessGrant is deleted", func() {
+		a := time.Now()
+		create(ctx, newActiveUser(tenant), newAccessGrant(tenant, prod, &a))
+		g, _ := reconcileAccessGrant(ctx, r, key)
+		Expect(bindingExists(ctx, g)).To(BeTrue(), "expected the binding to exist")
+
+		Expect(k8sClient.Delete(ctx, g)).To(Succeed())
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bindingExists(ctx, g)).To(BeFalse(), "expected the binding to be revoked")
+		Expect(exists(ctx, key, &kimiov1beta1.AccessGrant{})).To(BeFalse(), "expected the AccessGrant to be deleted")
+	})
+})
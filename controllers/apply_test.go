@@ -0,0 +1,174 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+var _ = Describe("Applied objects", func() {
+	var (
+		ctx    context.Context
+		tenant string
+		key    types.NamespacedName
+		r      *UserReconciler
+	)
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+		tenant = createNamespace(ctx)
+		key = types.NamespacedName{Namespace: tenant, Name: "alice"}
+		r = newUserReconciler()
+	})
+
+	It("keep the metadata set by others", func() {
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+		u := reconcileUser(ctx, r, key)
+
+		By("labelling and annotating the ServiceAccount, dropping KIM's labels")
+		var sa corev1.ServiceAccount
+		Expect(exists(ctx, key, &sa)).To(BeTrue())
+		sa.Labels = map[string]string{"team": "platform"}
+		sa.Annotations = map[string]string{"owner": "admin"}
+		sa.OwnerReferences = append(sa.OwnerReferences, metav1.OwnerReference{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+			Name:       "inventory",
+			UID:        "inventory-uid",
+		})
+		Expect(k8sClient.Update(ctx, &sa)).To(Succeed())
+
+		reconcileUser(ctx, r, key)
+		Expect(exists(ctx, key, &sa)).To(BeTrue())
+		Expect(hasUserLabels(&sa, u)).To(BeTrue(), "expected KIM's labels to be restored")
+		Expect(sa.Labels).To(HaveKeyWithValue("team", "platform"))
+		Expect(sa.Annotations).To(HaveKeyWithValue("owner", "admin"))
+		Expect(sa.OwnerReferences).To(HaveLen(2))
+		Expect(metav1.IsControlledBy(&sa, u)).To(BeTrue())
+	})
+
+	It("are owned by the kim field manager", func() {
+		r = newHomeNamespaceUserReconciler(RetainHomeNamespaceRetentionPolicy)
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+		reconcileUser(ctx, r, key)
+
+		home := "home-" + tenant + "-alice"
+		objects := map[string]client.Object{
+			"ServiceAccount": &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: tenant, Name: "alice"}},
+			"Namespace":      &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: home}},
+			"ResourceQuota":  &corev1.ResourceQuota{ObjectMeta: metav1.ObjectMeta{Namespace: home, Name: homeNamespaceObjectsName}},
+			"LimitRange":     &corev1.LimitRange{ObjectMeta: metav1.ObjectMeta{Namespace: home, Name: homeNamespaceObjectsName}},
+			"RoleBinding":    &rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Namespace: home, Name: homeNamespaceObjectsName}},
+		}
+		for kind, o := range objects {
+			Expect(exists(ctx, client.ObjectKeyFromObject(o), o)).To(BeTrue(), "expected the %s to exist", kind)
+			Expect(appliedFields(o, FieldManager)).To(ContainSubstring(`"f:`+UserNameLabel+`"`),
+				"expected the labels of the %s to be applied by KIM", kind)
+		}
+		Expect(appliedFields(objects["ServiceAccount"], FieldManager)).To(ContainSubstring(`"f:ownerReferences"`))
+		Expect(appliedFields(objects["ResourceQuota"], FieldManager)).To(ContainSubstring(`"f:pods"`))
+
+		By("not owning the labels added by others")
+		sa := objects["ServiceAccount"]
+		sa.SetLabels(map[string]string{"team": "platform", UserNameLabel: "alice", UserNamespaceLabel: tenant})
+		Expect(k8sClient.Update(ctx, sa)).To(Succeed())
+		reconcileUser(ctx, r, key)
+		Expect(exists(ctx, key, sa)).To(BeTrue())
+		Expect(appliedFields(sa, FieldManager)).NotTo(ContainSubstring(`"f:team"`))
+	})
+
+	It("take over the fields changed by others", func() {
+		r = newHomeNamespaceUserReconciler(RetainHomeNamespaceRetentionPolicy)
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+		reconcileUser(ctx, r, key)
+
+		By("applying the ResourceQuota as another manager")
+		k := types.NamespacedName{Namespace: "home-" + tenant + "-alice", Name: homeNamespaceObjectsName}
+		rq := &corev1.ResourceQuota{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ResourceQuota"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: k.Namespace, Name: k.Name},
+			Spec:       corev1.ResourceQuotaSpec{Hard: corev1.ResourceList{corev1.ResourcePods: resource.MustParse("20")}},
+		}
+		Expect(k8sClient.Patch(ctx, rq, client.Apply, client.FieldOwner("admin"), client.ForceOwnership)).To(Succeed())
+		Expect(exists(ctx, k, rq)).To(BeTrue())
+		Expect(appliedFields(rq, "admin")).To(ContainSubstring(`"f:pods"`))
+
+		reconcileUser(ctx, r, key)
+		Expect(exists(ctx, k, rq)).To(BeTrue())
+		q := rq.Spec.Hard[corev1.ResourcePods]
+		Expect(q.String()).To(Equal("10"), "expected KIM's value to be restored")
+		Expect(appliedFields(rq, FieldManager)).To(ContainSubstring(`"f:pods"`))
+		Expect(appliedFields(rq, "admin")).NotTo(ContainSubstring(`"f:pods"`), "expected KIM to take the field over")
+	})
+
+	It("adopt the objects provisioned by previous versions", func() {
+		// previous versions of KIM created the objects with an update operation
+		sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: tenant, Name: "alice"}}
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState), sa)
+		create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:       tenant,
+				Name:            "alice",
+				Annotations:     map[string]string{corev1.ServiceAccountNameKey: "alice"},
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: "v1", Kind: "ServiceAccount", Name: "alice", UID: sa.UID}},
+			},
+			Type: corev1.SecretTypeServiceAccountToken,
+		})
+		uid := sa.UID
+		Expect(appliedFields(sa, FieldManager)).To(BeEmpty())
+
+		u := reconcileUser(ctx, r, key)
+		Expect(exists(ctx, key, sa)).To(BeTrue())
+		Expect(sa.UID).To(Equal(uid), "expected the ServiceAccount to be adopted, not provisioned again")
+		Expect(metav1.IsControlledBy(sa, u)).To(BeTrue())
+		f := appliedFields(sa, FieldManager)
+		Expect(f).To(ContainSubstring(`"f:` + UserNameLabel + `"`))
+		Expect(f).To(ContainSubstring(`"f:ownerReferences"`))
+
+		var s corev1.Secret
+		Expect(exists(ctx, key, &s)).To(BeTrue())
+		Expect(appliedFields(&s, FieldManager)).To(ContainSubstring(`"f:` + UserNameLabel + `"`))
+
+		By("applying them again without conflicts")
+		reconcileUser(ctx, r, key)
+		Expect(exists(ctx, key, sa)).To(BeTrue())
+		Expect(sa.UID).To(Equal(uid))
+	})
+})
+
+// appliedFields returns the fields of the object the manager owns by applying
+// them, serialized as in the managed fields, or an empty string if none
+func appliedFields(o client.Object, manager string) string {
+	for _, f := range o.GetManagedFields() {
+		if f.Manager == manager && f.Operation == metav1.ManagedFieldsOperationApply && f.FieldsV1 != nil {
+			return string(f.FieldsV1.Raw)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+
+	"github.com/filariow/kim/pkg/audit"
+)
+
+// withCorrelationID returns a copy of ctx carrying a new correlation id,
+// shared by the audit records of a reconciliation
+func withCorrelationID(ctx context.Context) context.Context {
+	return audit.WithCorrelationID(ctx, string(uuid.NewUUID()))
+}
+
+// auditLog writes an audit record, if an audit Logger is configured
+func auditLog(ctx context.Context, a audit.Logger, action audit.Action, target audit.Object, old, new, reason string) {
+	if a == nil {
+		return
+	}
+	a.Log(ctx, audit.Record{
+		Action: action,
+		Target: target,
+		Old:    old,
+		New:    new,
+		Reason: reason,
+	})
+}
+
+// auditObject returns the audit representation of an object of the given kind
+func auditObject(kind string, o metav1.Object) audit.Object {
+	return audit.Object{Kind: kind, Namespace: o.GetNamespace(), Name: o.GetName()}
+}
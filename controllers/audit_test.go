@@ -0,0 +1,134 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/pkg/audit"
+)
+
+// recordingAuditor keeps the audit records in memory
+type recordingAuditor struct {
+	records []audit.Record
+}
+
+func (a *recordingAuditor) Log(ctx context.Context, r audit.Record) {
+	r.CorrelationID = audit.CorrelationID(ctx)
+	if r.Actor == "" {
+		r.Actor = audit.Requester(ctx)
+	}
+	a.records = append(a.records, r)
+}
+
+func (a *recordingAuditor) actions() []string {
+	aa := make([]string, len(a.records))
+	for i, r := range a.records {
+		aa[i] = string(r.Action) + " " + r.Target.Kind
+	}
+	return aa
+}
+
+var _ = Describe("Audit", func() {
+	var (
+		ctx    context.Context
+		tenant string
+		key    types.NamespacedName
+	)
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+		tenant = createNamespace(ctx)
+		key = types.NamespacedName{Namespace: tenant, Name: "alice"}
+	})
+
+	It("records the lifecycle of a User", func() {
+		a := &recordingAuditor{}
+		r := newUserReconciler()
+		r.Auditor = a
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+
+		reconcileUser(ctx, r, key)
+		Expect(a.actions()).To(Equal([]string{"Created ServiceAccount", "Created Secret", "StateChanged User"}))
+		for _, rec := range a.records {
+			Expect(rec.CorrelationID).NotTo(BeEmpty())
+			Expect(rec.CorrelationID).To(Equal(a.records[0].CorrelationID), "expected the records to share the correlation id")
+		}
+		Expect(a.records[2].Old).To(BeEmpty())
+		Expect(a.records[2].New).To(Equal(string(kimiov1beta1.ActiveUserState)))
+
+		By("auditing nothing when nothing changes")
+		a.records = nil
+		reconcileUser(ctx, r, key)
+		Expect(a.records).To(BeEmpty())
+
+		By("auditing the ban of the User")
+		u := reconcileUser(ctx, r, key)
+		u.Annotations = map[string]string{
+			kimiov1beta1.UserStateChangedByAnnotation:    "admin",
+			kimiov1beta1.UserStateChangeReasonAnnotation: "abuse",
+		}
+		u.Spec.State = kimiov1beta1.BannedUserState
+		Expect(k8sClient.Update(ctx, u)).To(Succeed())
+		a.records = nil
+		reconcileUser(ctx, r, key)
+		Expect(a.actions()).To(Equal([]string{"Deleted Secret", "Deleted ServiceAccount", "StateChanged User"}))
+		s := a.records[2]
+		Expect(s.Old).To(Equal(string(kimiov1beta1.ActiveUserState)))
+		Expect(s.New).To(Equal(string(kimiov1beta1.BannedUserState)))
+		Expect(s.Reason).To(Equal("abuse"))
+		for _, rec := range a.records {
+			Expect(rec.Actor).To(Equal("admin"), "expected %s to be attributed to who banned the User", rec.Target.Kind)
+		}
+	})
+
+	It("records the revocation of a PersonalAccessToken by its User", func() {
+		a := &recordingAuditor{}
+		r := &PersonalAccessTokenReconciler{Client: k8sClient, Scheme: scheme.Scheme, Recorder: record.NewFakeRecorder(100), Auditor: a}
+		p := &kimiov1beta1.PersonalAccessToken{
+			ObjectMeta: metav1.ObjectMeta{Namespace: tenant, Name: "alice-1"},
+			Spec:       kimiov1beta1.PersonalAccessTokenSpec{User: kimiov1beta1.UserReference{Name: "alice"}},
+			Status: kimiov1beta1.PersonalAccessTokenStatus{
+				Phase:  kimiov1beta1.RevokedPersonalAccessTokenPhase,
+				Reason: RevokedByUserPersonalAccessTokenReason,
+			},
+		}
+		create(ctx,
+			newUser(tenant, kimiov1beta1.ActiveUserState),
+			p,
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: tenant, Name: "alice-1"}},
+		)
+
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: tenant, Name: "alice-1"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exists(ctx, types.NamespacedName{Namespace: tenant, Name: "alice-1"}, &corev1.Secret{})).To(BeFalse(), "expected the token to be deleted")
+		Expect(a.actions()).To(Equal([]string{"TokenRevoked PersonalAccessToken"}))
+		Expect(a.records[0].Actor).To(Equal("alice"), "expected the revocation to be attributed to the User")
+		Expect(a.records[0].Reason).To(Equal(RevokedByUserPersonalAccessTokenReason))
+	})
+})
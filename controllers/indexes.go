@@ -0,0 +1,121 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+const (
+	// PersonalAccessTokenUserIndex indexes PersonalAccessTokens by the name of the owning User
+	PersonalAccessTokenUserIndex = ".spec.user.name"
+	// PersonalAccessTokenTokenHashIndex indexes PersonalAccessTokens by the digest of their token
+	PersonalAccessTokenTokenHashIndex = ".status.tokenHash"
+	// UserAccessProfileIndex indexes Users by the name of the AccessProfiles they reference
+	UserAccessProfileIndex = ".spec.profiles.name"
+	// AccessGrantUserIndex indexes AccessGrants by the name of the User they grant access to
+	AccessGrantUserIndex = ".spec.user.name"
+	// InvitationInviterIndex indexes Invitations by the name of their inviter
+	InvitationInviterIndex = ".spec.inviter.name"
+	// InvitationCodeHashIndex indexes Invitations by the digest of their code
+	InvitationCodeHashIndex = ".status.codeHash"
+)
+
+// SetupFieldIndexes registers in the FieldIndexer, usually the Manager's one,
+// the field indexes used by the controllers.
+func SetupFieldIndexes(ctx context.Context, fi client.FieldIndexer) error {
+	if err := fi.IndexField(ctx, &kimiov1beta1.PersonalAccessToken{}, PersonalAccessTokenUserIndex,
+		indexPersonalAccessTokenByUser); err != nil {
+		return err
+	}
+
+	if err := fi.IndexField(ctx, &kimiov1beta1.PersonalAccessToken{}, PersonalAccessTokenTokenHashIndex,
+		indexPersonalAccessTokenByTokenHash); err != nil {
+		return err
+	}
+
+	if err := fi.IndexField(ctx, &kimiov1beta1.User{}, UserAccessProfileIndex,
+		indexUserByAccessProfile); err != nil {
+		return err
+	}
+
+	if err := fi.IndexField(ctx, &kimiov1beta1.AccessGrant{}, AccessGrantUserIndex,
+		indexAccessGrantByUser); err != nil {
+		return err
+	}
+
+	if err := fi.IndexField(ctx, &kimiov1beta1.Invitation{}, InvitationInviterIndex,
+		indexInvitationByInviter); err != nil {
+		return err
+	}
+
+	return fi.IndexField(ctx, &kimiov1beta1.Invitation{}, InvitationCodeHashIndex,
+		indexInvitationByCodeHash)
+}
+
+func indexPersonalAccessTokenByUser(o client.Object) []string {
+	p := o.(*kimiov1beta1.PersonalAccessToken)
+	if p.Spec.User.Name == "" {
+		return nil
+	}
+	return []string{p.Spec.User.Name}
+}
+
+func indexPersonalAccessTokenByTokenHash(o client.Object) []string {
+	p := o.(*kimiov1beta1.PersonalAccessToken)
+	if p.Status.TokenHash == "" {
+		return nil
+	}
+	return []string{p.Status.TokenHash}
+}
+
+func indexUserByAccessProfile(o client.Object) []string {
+	u := o.(*kimiov1beta1.User)
+	pp := make([]string, 0, len(u.Spec.Profiles))
+	for _, p := range u.Spec.Profiles {
+		pp = append(pp, p.Name)
+	}
+	return pp
+}
+
+func indexAccessGrantByUser(o client.Object) []string {
+	g := o.(*kimiov1beta1.AccessGrant)
+	if g.Spec.User.Name == "" {
+		return nil
+	}
+	return []string{g.Spec.User.Name}
+}
+
+func indexInvitationByInviter(o client.Object) []string {
+	i := o.(*kimiov1beta1.Invitation)
+	if i.Spec.Inviter.Name == "" {
+		return nil
+	}
+	return []string{i.Spec.Inviter.Name}
+}
+
+func indexInvitationByCodeHash(o client.Object) []string {
+	i := o.(*kimiov1beta1.Invitation)
+	if i.Status.CodeHash == "" {
+		return nil
+	}
+	return []string{i.Status.CodeHash}
+}
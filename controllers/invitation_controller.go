@@ -0,0 +1,341 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/pkg/audit"
+	"github.com/filariow/kim/pkg/invitation"
+)
+
+const (
+	InviterNotActiveInvitationReason   = "InviterNotActive"
+	ProfilesNotGrantedInvitationReason = "ProfilesNotGranted"
+	IssuedInvitationReason             = "Issued"
+	RedeemedInvitationReason           = "Redeemed"
+	ExpiredInvitationReason            = "Expired"
+
+	// DefaultInvitationLifetime is the lifetime of Invitations without an explicit expiration
+	DefaultInvitationLifetime = 7 * 24 * time.Hour
+)
+
+// InvitationReconciler reconciles an Invitation object
+type InvitationReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Lifetime is the lifetime of Invitations without an explicit expiration
+	Lifetime time.Duration
+
+	// Auditor records the phase changes of Invitations. If nil, they are not audited.
+	Auditor audit.Logger
+
+	// Plan makes the reconciliation of every Invitation report the actions it
+	// would perform in the Invitation's status and Events instead of
+	// performing them. The Invitations of the inviters annotated with the
+	// PlanAnnotation are planned regardless.
+	Plan bool
+}
+
+//+kubebuilder:rbac:groups=kim.io,resources=invitations,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=kim.io,resources=invitations/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=kim.io,resources=invitations/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=create;update;delete;get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile issues the single-use code of an Invitation while its inviter is
+// Active and it is not expired. The code is stored in a Secret named as the
+// Invitation prefixed by 'kim-invitation-', and only its digest is recorded in
+// the status. The code is deleted once the Invitation is redeemed or expired.
+//
+// For more details, check Reconcile and its Result here:
+// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
+func (r *InvitationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx).WithValues("namespace", req.Namespace, "invitation", req.Name)
+	ctx = withCorrelationID(ctx)
+
+	// fetch invitation
+	var i kimiov1beta1.Invitation
+	if err := r.Get(ctx, req.NamespacedName, &i); err != nil {
+		if errors.IsNotFound(err) {
+			l.Info("invitation has been deleted")
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	planned, err := r.planned(ctx, &i)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if planned {
+		return r.plan(ctx, &i)
+	}
+	return r.enforce(ctx, &i)
+}
+
+// planned returns true if the reconciliation of the Invitation is to be
+// planned, because of the plan mode or of the annotation of its inviter
+func (r *InvitationReconciler) planned(ctx context.Context, i *kimiov1beta1.Invitation) (bool, error) {
+	if r.Plan {
+		return true, nil
+	}
+
+	var u kimiov1beta1.User
+	if err := r.Get(ctx, types.NamespacedName{Namespace: i.Namespace, Name: i.Spec.Inviter.Name}, &u); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	return isPlanned(&u), nil
+}
+
+// plan computes the actions the reconciliation of the Invitation would
+// perform and, when they change, reports them in its status and in an Event.
+// Nothing else is written: the reconciliation runs against a planClient,
+// without Events nor audit records.
+func (r *InvitationReconciler) plan(ctx context.Context, i *kimiov1beta1.Invitation) (ctrl.Result, error) {
+	c := newPlanClient(r.Client)
+	p := *r
+	p.Client = c
+	p.Recorder = discardRecorder{}
+	p.Auditor = nil
+	res, err := p.enforce(ctx, i.DeepCopy())
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if pl := c.plan(); !equality.Semantic.DeepEqual(i.Status.Plan, pl) {
+		r.Recorder.Event(i, corev1.EventTypeNormal, PlannedReason, planMessage(pl))
+		i.Status.Plan = pl
+		if err := r.Status().Update(ctx, i); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	// the plan changes at expiration
+	return res, nil
+}
+
+// enforce reconciles the Invitation, performing the actions it needs
+func (r *InvitationReconciler) enforce(ctx context.Context, i *kimiov1beta1.Invitation) (ctrl.Result, error) {
+	l := log.FromContext(ctx).WithValues("namespace", i.Namespace, "invitation", i.Name)
+
+	if i.Status.ExpiresAt == nil {
+		exp := i.Spec.Expiration
+		if exp == nil {
+			exp = &metav1.Time{Time: i.CreationTimestamp.Add(r.lifetime())}
+		}
+		i.Status.ExpiresAt = exp
+	}
+
+	phase, reason, requeueAfter, err := r.computePhase(ctx, i)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	switch phase {
+	case kimiov1beta1.IssuedInvitationPhase:
+		l.Info("invitation is valid, ensure code is issued")
+		if err := r.ensureCodeIsIssued(ctx, i); err != nil {
+			l.Error(err, "error ensuring code is issued")
+			return ctrl.Result{}, err
+		}
+
+	case kimiov1beta1.RedeemedInvitationPhase, kimiov1beta1.ExpiredInvitationPhase:
+		l.Info("invitation can no more be redeemed, ensure code Secret doesn't exist", "phase", phase)
+		if err := r.ensureCodeSecretDoesntExist(ctx, i); err != nil {
+			l.Error(err, "error ensuring code Secret doesn't exist")
+			return ctrl.Result{}, err
+		}
+		i.Status.CodeHash = ""
+
+	default:
+		l.Info("invitation is not valid", "phase", phase, "reason", reason)
+	}
+
+	if i.Status.Phase != phase || i.Status.Reason != reason {
+		r.Recorder.Eventf(i, corev1.EventTypeNormal, reason, "Invitation moved from phase '%s' to '%s'", i.Status.Phase, phase)
+		auditLog(ctx, r.Auditor, audit.StateChangedAction, auditObject("Invitation", i), string(i.Status.Phase), string(phase), reason)
+	}
+
+	i.Status.Phase = phase
+	i.Status.Reason = reason
+	i.Status.Plan = nil
+	i.Status.ObservedGeneration = i.Generation
+	if err := r.Status().Update(ctx, i); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// computePhase calculates the phase of the Invitation from its redemption,
+// its expiration and the observed state of its inviter
+func (r *InvitationReconciler) computePhase(ctx context.Context, i *kimiov1beta1.Invitation) (kimiov1beta1.InvitationPhase, string, time.Duration, error) {
+	switch i.Status.Phase {
+	case kimiov1beta1.RedeemedInvitationPhase:
+		return kimiov1beta1.RedeemedInvitationPhase, RedeemedInvitationReason, 0, nil
+	case kimiov1beta1.ExpiredInvitationPhase:
+		return kimiov1beta1.ExpiredInvitationPhase, ExpiredInvitationReason, 0, nil
+	}
+
+	d := time.Until(i.Status.ExpiresAt.Time)
+	if d <= 0 {
+		return kimiov1beta1.ExpiredInvitationPhase, ExpiredInvitationReason, 0, nil
+	}
+
+	var u kimiov1beta1.User
+	if err := r.Get(ctx, types.NamespacedName{Namespace: i.Namespace, Name: i.Spec.Inviter.Name}, &u); err != nil {
+		if errors.IsNotFound(err) {
+			return kimiov1beta1.PendingInvitationPhase, InviterNotActiveInvitationReason, d, nil
+		}
+		return "", "", 0, err
+	}
+
+	if u.Status.State != kimiov1beta1.ActiveUserState {
+		return kimiov1beta1.PendingInvitationPhase, InviterNotActiveInvitationReason, d, nil
+	}
+	// inviters can only share the profiles they hold
+	for _, p := range i.Spec.Profiles {
+		if !u.HasProfile(p.Name) {
+			return kimiov1beta1.PendingInvitationPhase, ProfilesNotGrantedInvitationReason, d, nil
+		}
+	}
+	return kimiov1beta1.IssuedInvitationPhase, IssuedInvitationReason, d, nil
+}
+
+// InvitationSecretName returns the name of the Secret holding the code of the Invitation
+func InvitationSecretName(i *kimiov1beta1.Invitation) string {
+	return "kim-invitation-" + i.Name
+}
+
+func (r *InvitationReconciler) lifetime() time.Duration {
+	if r.Lifetime > 0 {
+		return r.Lifetime
+	}
+	return DefaultInvitationLifetime
+}
+
+// ensureCodeIsIssued generates the code, if not already issued, and records
+// its digest in the status of the Invitation
+func (r *InvitationReconciler) ensureCodeIsIssued(ctx context.Context, i *kimiov1beta1.Invitation) error {
+	var s corev1.Secret
+	err := r.Get(ctx, types.NamespacedName{Namespace: i.Namespace, Name: InvitationSecretName(i)}, &s)
+	switch {
+	case err == nil:
+		if !metav1.IsControlledBy(&s, i) {
+			return fmt.Errorf("secret %s/%s is not controlled by the invitation", s.Namespace, s.Name)
+		}
+
+		c := string(s.Data[kimiov1beta1.InvitationSecretCodeKey])
+		if c == "" {
+			return fmt.Errorf("secret %s/%s does not contain a code", s.Namespace, s.Name)
+		}
+		i.Status.CodeHash = invitation.HashCode(c)
+		return ensureUserLabels(ctx, r.Client, &s, i.Namespace, i.Spec.Inviter.Name)
+
+	case errors.IsNotFound(err):
+		c, err := invitation.GenerateCode()
+		if err != nil {
+			return err
+		}
+
+		s = corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: i.Namespace,
+				Name:      InvitationSecretName(i),
+				Labels:    userLabels(i.Namespace, i.Spec.Inviter.Name),
+			},
+			Type: kimiov1beta1.InvitationSecretType,
+			Data: map[string][]byte{
+				kimiov1beta1.InvitationSecretCodeKey: []byte(c),
+			},
+		}
+		if err := controllerutil.SetControllerReference(i, &s, r.Scheme); err != nil {
+			return err
+		}
+		if err := r.Create(ctx, &s, client.FieldOwner(FieldManager)); err != nil {
+			return err
+		}
+		i.Status.CodeHash = invitation.HashCode(c)
+		return nil
+
+	default:
+		return err
+	}
+}
+
+func (r *InvitationReconciler) ensureCodeSecretDoesntExist(ctx context.Context, i *kimiov1beta1.Invitation) error {
+	s := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: i.Namespace,
+			Name:      InvitationSecretName(i),
+		},
+	}
+
+	if err := r.Delete(ctx, &s); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *InvitationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&kimiov1beta1.Invitation{}).
+		Owns(&corev1.Secret{}).
+		Watches(
+			&source.Kind{Type: &kimiov1beta1.User{}},
+			handler.EnqueueRequestsFromMapFunc(r.mapUserToInvitations),
+		).
+		Complete(r)
+}
+
+// mapUserToInvitations enqueues all the Invitations of an inviter
+func (r *InvitationReconciler) mapUserToInvitations(o client.Object) []reconcile.Request {
+	var ii kimiov1beta1.InvitationList
+	if err := r.List(context.Background(), &ii,
+		client.InNamespace(o.GetNamespace()),
+		client.MatchingFields{InvitationInviterIndex: o.GetName()},
+	); err != nil {
+		log.Log.Error(err, "error listing invitations of user", "namespace", o.GetNamespace(), "user", o.GetName())
+		return nil
+	}
+
+	rr := make([]reconcile.Request, len(ii.Items))
+	for j, i := range ii.Items {
+		rr[j] = reconcile.Request{NamespacedName: types.NamespacedName{Namespace: i.Namespace, Name: i.Name}}
+	}
+	return rr
+}
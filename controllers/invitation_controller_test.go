@@ -0,0 +1,131 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/pkg/invitation"
+)
+
+func newInvitationReconciler() *InvitationReconciler {
+	return &InvitationReconciler{
+		Client:   k8sClient,
+		Scheme:   scheme.Scheme,
+		Recorder: record.NewFakeRecorder(100),
+	}
+}
+
+func newInvitation(namespace string) *kimiov1beta1.Invitation {
+	return &kimiov1beta1.Invitation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "carol"},
+		Spec: kimiov1beta1.InvitationSpec{
+			Inviter: kimiov1beta1.UserReference{Name: "alice"},
+			Email:   "carol@kim.io",
+		},
+	}
+}
+
+// reconcileInvitation reconciles the Invitation and returns it
+func reconcileInvitation(ctx context.Context, r *InvitationReconciler, key types.NamespacedName) (*kimiov1beta1.Invitation, ctrl.Result) {
+	res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+	var i kimiov1beta1.Invitation
+	ExpectWithOffset(1, k8sClient.Get(ctx, key, &i)).To(Succeed())
+	return &i, res
+}
+
+var _ = Describe("InvitationReconciler", func() {
+	var (
+		ctx    context.Context
+		tenant string
+		key    types.NamespacedName
+		r      *InvitationReconciler
+	)
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+		tenant = createNamespace(ctx)
+		key = types.NamespacedName{Namespace: tenant, Name: "carol"}
+		r = newInvitationReconciler()
+	})
+
+	It("issues the code", func() {
+		create(ctx, newActiveUser(tenant), newInvitation(tenant))
+
+		i, res := reconcileInvitation(ctx, r, key)
+		Expect(i.Status.Phase).To(Equal(kimiov1beta1.IssuedInvitationPhase))
+		Expect(res.RequeueAfter).To(BeNumerically(">", 0), "requeue at the expiration")
+		Expect(res.RequeueAfter).To(BeNumerically("<=", DefaultInvitationLifetime), "requeue at the expiration")
+
+		var s corev1.Secret
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: tenant, Name: InvitationSecretName(i)}, &s)).To(Succeed())
+		Expect(i.Status.CodeHash).To(Equal(invitation.HashCode(string(s.Data[kimiov1beta1.InvitationSecretCodeKey]))))
+
+		By("not regenerating the code")
+		j, _ := reconcileInvitation(ctx, r, key)
+		Expect(j.Status.CodeHash).To(Equal(i.Status.CodeHash))
+	})
+
+	It("keeps the Invitation Pending while the inviter is not Active", func() {
+		create(ctx, newUser(tenant, kimiov1beta1.WaitingForApprovalUserState), newInvitation(tenant))
+
+		i, _ := reconcileInvitation(ctx, r, key)
+		Expect(i.Status.Phase).To(Equal(kimiov1beta1.PendingInvitationPhase))
+		Expect(i.Status.Reason).To(Equal(InviterNotActiveInvitationReason))
+		Expect(i.Status.CodeHash).To(BeEmpty())
+		Expect(exists(ctx, types.NamespacedName{Namespace: tenant, Name: InvitationSecretName(i)}, &corev1.Secret{})).To(BeFalse(), "expected no code to be issued")
+	})
+
+	It("keeps the Invitation Pending while the inviter doesn't hold its profiles", func() {
+		i := newInvitation(tenant)
+		i.Spec.Profiles = []kimiov1beta1.AccessProfileReference{{Name: "admin"}}
+		create(ctx, newActiveUser(tenant), i)
+
+		i, _ = reconcileInvitation(ctx, r, key)
+		Expect(i.Status.Phase).To(Equal(kimiov1beta1.PendingInvitationPhase))
+		Expect(i.Status.Reason).To(Equal(ProfilesNotGrantedInvitationReason))
+		Expect(exists(ctx, types.NamespacedName{Namespace: tenant, Name: InvitationSecretName(i)}, &corev1.Secret{})).To(BeFalse(), "expected no code to be issued")
+	})
+
+	It("expires the Invitation", func() {
+		create(ctx, newActiveUser(tenant), newInvitation(tenant))
+		i, _ := reconcileInvitation(ctx, r, key)
+
+		exp := metav1.NewTime(time.Now().Add(-time.Second))
+		i.Status.ExpiresAt = &exp
+		Expect(k8sClient.Status().Update(ctx, i)).To(Succeed())
+		i, res := reconcileInvitation(ctx, r, key)
+		Expect(i.Status.Phase).To(Equal(kimiov1beta1.ExpiredInvitationPhase))
+		Expect(res.RequeueAfter).To(BeZero())
+		Expect(i.Status.CodeHash).To(BeEmpty())
+		Expect(exists(ctx, types.NamespacedName{Namespace: tenant, Name: InvitationSecretName(i)}, &corev1.Secret{})).To(BeFalse(), "expected the code to be deleted")
+	})
+})
@@ -0,0 +1,65 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// UserNameLabel is the label holding the name of the User an object is provisioned for
+	UserNameLabel = "kim.io/user"
+	// UserNamespaceLabel is the label holding the namespace of the User an object is provisioned for
+	UserNamespaceLabel = "kim.io/user-namespace"
+	// AccessProfileLabel is the label holding the name of the AccessProfile an object is provisioned for
+	AccessProfileLabel = "kim.io/access-profile"
+	// AccessGrantLabel is the label holding the name of the AccessGrant an object is provisioned for
+	AccessGrantLabel = "kim.io/access-grant"
+	// InactivityExemptLabel exempts the User labelled with "true" from the inactivity policy
+	InactivityExemptLabel = "kim.io/inactivity-exempt"
+)
+
+// userLabels returns the labels identifying the objects provisioned for a User
+func userLabels(namespace, name string) map[string]string {
+	return map[string]string{
+		UserNameLabel:      name,
+		UserNamespaceLabel: namespace,
+	}
+}
+
+// ensureUserLabels labels the object as provisioned for the User, if it is
+// not, e.g. because it was provisioned by a previous version of KIM. Only the
+// labelled objects are watched.
+func ensureUserLabels(ctx context.Context, c client.Client, o client.Object, namespace, name string) error {
+	if k, ok := userOf(o); ok && k == (types.NamespacedName{Namespace: namespace, Name: name}) {
+		return nil
+	}
+
+	p := client.MergeFrom(o.DeepCopyObject().(client.Object))
+	ll := o.GetLabels()
+	if ll == nil {
+		ll = map[string]string{}
+	}
+	for k, v := range userLabels(namespace, name) {
+		ll[k] = v
+	}
+	o.SetLabels(ll)
+	return c.Patch(ctx, o, p)
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/pkg/audit"
+)
+
+// DefaultOrphanSweepInterval is the default time between two sweeps of orphaned objects
+const DefaultOrphanSweepInterval = time.Hour
+
+var (
+	orphanedObjects = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kim_orphaned_objects",
+		Help: "Number of objects provisioned for Users that are gone or not Active, found by the last sweep",
+	}, []string{"kind"})
+	orphanedObjectsDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kim_orphaned_objects_deleted_total",
+		Help: "Number of orphaned objects deleted",
+	}, []string{"kind"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(orphanedObjects, orphanedObjectsDeleted)
+}
+
+// OrphanSweeper periodically looks for the ServiceAccounts and token Secrets
+// provisioned for a User that is gone or not Active, e.g. left behind by a
+// previous version of KIM, or named after a previous name template, reports them as metrics and Events and deletes
+// them. Besides the labelled objects, it looks for the ones previous versions
+// of KIM provisioned without labels: a ServiceAccount not controlled by any
+// object with a token Secret named as it and owned by it, provisioned for the
+// User named as them. Nothing marks them as provisioned by KIM, so they are
+// only reported and never deleted. The objects of the Users annotated with the
+// PlanAnnotation are never deleted.
+type OrphanSweeper struct {
+	Client   client.Client
+	Recorder record.EventRecorder
+	Log      logr.Logger
+
+	// Auditor records the deletion of orphaned objects. If nil, they are not audited.
+	Auditor audit.Logger
+
+	// Interval is the time between two sweeps, DefaultOrphanSweepInterval if zero
+	Interval time.Duration
+
+	// DryRun reports the orphaned objects without deleting them
+	DryRun bool
+
+	// ServiceAccount configures the ServiceAccounts and token Secrets
+	// provisioned for Users. The ones not named as it requires are orphaned.
+	// If nil, they are named as the User.
+	ServiceAccount *ServiceAccountConfig
+
+	// Scope is the set of namespaces KIM is granted access to: only the
+	// ServiceAccounts and Secrets in it are swept
+	Scope Scope
+}
+
+// Start sweeps orphaned objects every Interval, until ctx is done
+func (s *OrphanSweeper) Start(ctx context.Context) error {
+	i := s.Interval
+	if i <= 0 {
+		i = DefaultOrphanSweepInterval
+	}
+	t := time.NewTicker(i)
+	defer t.Stop()
+
+	for {
+		if err := s.Sweep(ctx); err != nil {
+			s.Log.Error(err, "error sweeping orphaned objects")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// NeedLeaderElection returns true as only the leader deletes orphaned objects
+func (s *OrphanSweeper) NeedLeaderElection() bool {
+	return true
+}
+
+// orphanCandidate is an object provisioned for a User
+type orphanCandidate struct {
+	client.Object
+
+	user types.NamespacedName
+	// legacy is true for the objects provisioned without labels by previous versions of KIM
+	legacy bool
+}
+
+// Sweep reports and deletes the orphaned ServiceAccounts and token Secrets
+func (s *OrphanSweeper) Sweep(ctx context.Context) error {
+	ctx = withCorrelationID(ctx)
+
+	var secrets, serviceAccounts []orphanCandidate
+	for _, ns := range s.Scope.listNamespaces() {
+		ss, sas, err := s.candidates(ctx, ns)
+		if err != nil {
+			return err
+		}
+		secrets = append(secrets, ss...)
+		serviceAccounts = append(serviceAccounts, sas...)
+	}
+
+	if err := s.sweep(ctx, "Secret", secrets); err != nil {
+		return err
+	}
+	return s.sweep(ctx, "ServiceAccount", serviceAccounts)
+}
+
+// candidates returns the token Secrets and the ServiceAccounts in the
+// namespace that are provisioned for a User
+func (s *OrphanSweeper) candidates(ctx context.Context, namespace string) ([]orphanCandidate, []orphanCandidate, error) {
+	var ss corev1.SecretList
+	if err := s.Client.List(ctx, &ss, client.InNamespace(namespace), client.HasLabels{UserNameLabel, UserNamespaceLabel}); err != nil {
+		return nil, nil, err
+	}
+	var secrets []orphanCandidate
+	for i := range ss.Items {
+		if k, ok := userOf(&ss.Items[i]); ok && s.isTokenSecret(&ss.Items[i]) {
+			secrets = append(secrets, orphanCandidate{Object: &ss.Items[i], user: k})
+		}
+	}
+
+	// legacy ServiceAccounts are not labelled, all of them are checked
+	var sas corev1.ServiceAccountList
+	if err := s.Client.List(ctx, &sas, client.InNamespace(namespace)); err != nil {
+		return nil, nil, err
+	}
+	var serviceAccounts []orphanCandidate
+	for i := range sas.Items {
+		sa := &sas.Items[i]
+		if k, ok := userOf(sa); ok {
+			serviceAccounts = append(serviceAccounts, orphanCandidate{Object: sa, user: k})
+			continue
+		}
+		if metav1.GetControllerOf(sa) != nil {
+			continue
+		}
+		secret, err := legacyTokenSecret(ctx, s.Client, sa)
+		if err != nil {
+			return nil, nil, err
+		}
+		if secret == nil {
+			continue
+		}
+		k := types.NamespacedName{Namespace: sa.Namespace, Name: sa.Name}
+		serviceAccounts = append(serviceAccounts, orphanCandidate{Object: sa, user: k, legacy: true})
+		secrets = append(secrets, orphanCandidate{Object: secret, user: k, legacy: true})
+	}
+	return secrets, serviceAccounts, nil
+}
+
+// isTokenSecret returns true if the Secret is of the type of the token Secrets
+// provisioned for Users, now or before the type was configured
+func (s *OrphanSweeper) isTokenSecret(secret *corev1.Secret) bool {
+	return secret.Type == s.ServiceAccount.TokenSecretType() || secret.Type == corev1.SecretTypeServiceAccountToken
+}
+
+func (s *OrphanSweeper) sweep(ctx context.Context, kind string, oo []orphanCandidate) error {
+	found := 0
+	for _, c := range oo {
+		o := c.Object
+		if !o.GetDeletionTimestamp().IsZero() {
+			continue
+		}
+		reason, err := s.orphanReason(ctx, c)
+		if err != nil {
+			return err
+		}
+		if reason == "" {
+			continue
+		}
+		found++
+
+		l := s.Log.WithValues("kind", kind, "namespace", o.GetNamespace(), "name", o.GetName(), "reason", reason)
+		// unlabelled objects may not have been provisioned by KIM at all
+		if c.legacy {
+			l.Info("orphaned object found, not deleted as it is not labelled for the User")
+			s.Recorder.Eventf(o, corev1.EventTypeWarning, "Orphaned", "%s %s, not deleted as it is not labelled for the User", kind, reason)
+			continue
+		}
+		if s.DryRun {
+			l.Info("orphaned object found, not deleted in dry-run mode")
+			s.Recorder.Eventf(o, corev1.EventTypeWarning, "Orphaned", "%s %s, not deleted in dry-run mode", kind, reason)
+			continue
+		}
+
+		if err := s.Client.Delete(ctx, o); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		l.Info("orphaned object deleted")
+		s.Recorder.Eventf(o, corev1.EventTypeNormal, "OrphanDeleted", "%s %s, deleted", kind, reason)
+		auditLog(ctx, s.Auditor, audit.DeletedAction, auditObject(kind, o), "", "", "Orphaned")
+		orphanedObjectsDeleted.WithLabelValues(kind).Inc()
+	}
+
+	orphanedObjects.WithLabelValues(kind).Set(float64(found))
+	return nil
+}
+
+// orphanReason returns why the object is orphaned, or an empty string if its
+// User exists, is Active and is provided the object, or is planned
+func (s *OrphanSweeper) orphanReason(ctx context.Context, c orphanCandidate) (string, error) {
+	by := "provisioned"
+	if c.legacy {
+		by = "provisioned by a previous version of KIM"
+	}
+
+	var u kimiov1beta1.User
+	if err := s.Client.Get(ctx, c.user, &u); err != nil {
+		if errors.IsNotFound(err) {
+			return fmt.Sprintf("%s for User %s that does not exist", by, c.user), nil
+		}
+		return "", err
+	}
+	if isPlanned(&u) {
+		return "", nil
+	}
+	if u.Spec.State != kimiov1beta1.ActiveUserState {
+		return fmt.Sprintf("%s for User %s that is %s", by, c.user, u.Spec.State), nil
+	}
+	// the objects named after a previous name template are replaced
+	n, err := s.ServiceAccount.Name(&u)
+	if err != nil {
+		return "", err
+	}
+	if c.GetName() != n {
+		return fmt.Sprintf("%s for User %s whose ServiceAccount is now named %s", by, c.user, n), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+// newIdentity returns the ServiceAccount and token Secret provisioned for a User
+func newIdentity(namespace, user string) []client.Object {
+	meta := metav1.ObjectMeta{Namespace: namespace, Name: user, Labels: userLabels(namespace, user)}
+	s := &corev1.Secret{ObjectMeta: *meta.DeepCopy(), Type: corev1.SecretTypeServiceAccountToken}
+	s.Annotations = map[string]string{corev1.ServiceAccountNameKey: user}
+	return []client.Object{&corev1.ServiceAccount{ObjectMeta: meta}, s}
+}
+
+// createLegacyIdentity creates the ServiceAccount and token Secret previous
+// versions of KIM provisioned for a User, without labels
+func createLegacyIdentity(ctx context.Context, namespace, user string) {
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: user}}
+	ExpectWithOffset(1, k8sClient.Create(ctx, sa)).To(Succeed())
+	ExpectWithOffset(1, k8sClient.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       namespace,
+			Name:            user,
+			Annotations:     map[string]string{corev1.ServiceAccountNameKey: user},
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "v1", Kind: "ServiceAccount", Name: user, UID: sa.UID}},
+		},
+		Type: corev1.SecretTypeServiceAccountToken,
+	})).To(Succeed())
+}
+
+var _ = Describe("OrphanSweeper", func() {
+	var (
+		ctx    context.Context
+		tenant string
+		a      *recordingAuditor
+		s      *OrphanSweeper
+	)
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+		tenant = createNamespace(ctx)
+
+		carol := newUser(tenant, kimiov1beta1.BannedUserState)
+		carol.Name = "carol"
+		create(ctx,
+			newUser(tenant, kimiov1beta1.ActiveUserState),
+			carol,
+			// not provisioned by KIM
+			&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: tenant, Name: "dave"}},
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: tenant, Name: "bob-config", Labels: userLabels(tenant, "bob")}},
+		)
+		for _, u := range []string{"alice", "bob", "carol"} {
+			create(ctx, newIdentity(tenant, u)...)
+		}
+		createLegacyIdentity(ctx, tenant, "erin")
+
+		a = &recordingAuditor{}
+		s = &OrphanSweeper{
+			// the sweeper only sees the objects of this spec
+			Client:   client.NewNamespacedClient(k8sClient, tenant),
+			Recorder: record.NewFakeRecorder(100),
+			Log:      logr.Discard(),
+			Auditor:  a,
+		}
+	})
+
+	It("deletes the labelled orphans", func() {
+		deleted := testutil.ToFloat64(orphanedObjectsDeleted.WithLabelValues("ServiceAccount"))
+		Expect(s.Sweep(ctx)).To(Succeed())
+
+		for name, expected := range map[string]bool{"alice": true, "bob": false, "carol": false, "dave": true, "erin": true} {
+			k := types.NamespacedName{Namespace: tenant, Name: name}
+			Expect(exists(ctx, k, &corev1.ServiceAccount{})).To(Equal(expected), "ServiceAccount %s", name)
+			if name != "dave" {
+				Expect(exists(ctx, k, &corev1.Secret{})).To(Equal(expected), "Secret %s", name)
+			}
+		}
+		Expect(exists(ctx, types.NamespacedName{Namespace: tenant, Name: "bob-config"}, &corev1.Secret{})).
+			To(BeTrue(), "expected Secrets other than ServiceAccount tokens to be kept")
+
+		Expect(testutil.ToFloat64(orphanedObjects.WithLabelValues("ServiceAccount"))).To(BeEquivalentTo(3))
+		Expect(testutil.ToFloat64(orphanedObjectsDeleted.WithLabelValues("ServiceAccount")) - deleted).To(BeEquivalentTo(2))
+		aa := a.actions()
+		Expect(aa).To(HaveLen(4))
+		Expect(aa[0]).To(Equal("Deleted Secret"))
+		Expect(aa[3]).To(Equal("Deleted ServiceAccount"))
+		Expect(s.Recorder.(*record.FakeRecorder).Events).To(HaveLen(6), "expected an Event per orphaned object")
+	})
+
+	It("only reports the unlabelled orphans", func() {
+		Expect(s.Sweep(ctx)).To(Succeed())
+
+		k := types.NamespacedName{Namespace: tenant, Name: "erin"}
+		Expect(exists(ctx, k, &corev1.ServiceAccount{})).To(BeTrue(), "expected the unlabelled ServiceAccount not to be deleted")
+		Expect(exists(ctx, k, &corev1.Secret{})).To(BeTrue(), "expected the unlabelled Secret not to be deleted")
+		ee := s.Recorder.(*record.FakeRecorder).Events
+		close(ee)
+		var events []string
+		for e := range ee {
+			events = append(events, e)
+		}
+		Expect(events).To(ContainElement(HavePrefix("Warning Orphaned ServiceAccount provisioned by a previous version of KIM")))
+	})
+
+	It("keeps the legacy objects of existing Users", func() {
+		erin := newUser(tenant, kimiov1beta1.ActiveUserState)
+		erin.Name = "erin"
+		create(ctx, erin)
+		Expect(s.Sweep(ctx)).To(Succeed())
+
+		k := types.NamespacedName{Namespace: tenant, Name: "erin"}
+		Expect(exists(ctx, k, &corev1.ServiceAccount{})).To(BeTrue())
+		Expect(exists(ctx, k, &corev1.Secret{})).To(BeTrue())
+	})
+
+	It("skips the objects of the Users under plan", func() {
+		k := types.NamespacedName{Namespace: tenant, Name: "carol"}
+		var carol kimiov1beta1.User
+		Expect(k8sClient.Get(ctx, k, &carol)).To(Succeed())
+		carol.Annotations = map[string]string{kimiov1beta1.PlanAnnotation: "true"}
+		Expect(k8sClient.Update(ctx, &carol)).To(Succeed())
+
+		Expect(s.Sweep(ctx)).To(Succeed())
+		Expect(exists(ctx, k, &corev1.ServiceAccount{})).To(BeTrue())
+		Expect(exists(ctx, k, &corev1.Secret{})).To(BeTrue())
+		Expect(testutil.ToFloat64(orphanedObjects.WithLabelValues("ServiceAccount"))).To(BeEquivalentTo(2))
+	})
+
+	It("deletes the objects named after a previous template", func() {
+		var err error
+		s.ServiceAccount, err = NewServiceAccountConfig("kim-{{ .Name }}", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.Sweep(ctx)).To(Succeed())
+
+		k := types.NamespacedName{Namespace: tenant, Name: "alice"}
+		Expect(exists(ctx, k, &corev1.ServiceAccount{})).To(BeFalse(), "expected the ServiceAccount named after the previous template to be deleted")
+		Expect(exists(ctx, k, &corev1.Secret{})).To(BeFalse(), "expected the Secret named after the previous template to be deleted")
+	})
+
+	It("sweeps the namespaces KIM is granted access to only", func() {
+		s.Client = namespacedClient(ctx, tenant)
+		s.Scope = Scope{Namespaces: []string{tenant}}
+		Expect(s.Sweep(ctx)).To(Succeed())
+
+		for name, expected := range map[string]bool{"alice": true, "bob": false, "carol": false} {
+			Expect(exists(ctx, types.NamespacedName{Namespace: tenant, Name: name}, &corev1.ServiceAccount{})).
+				To(Equal(expected), "ServiceAccount %s", name)
+		}
+	})
+
+	It("only reports the orphans in dry-run mode", func() {
+		s.DryRun = true
+		Expect(s.Sweep(ctx)).To(Succeed())
+
+		for _, name := range []string{"bob", "carol", "erin"} {
+			Expect(exists(ctx, types.NamespacedName{Namespace: tenant, Name: name}, &corev1.ServiceAccount{})).
+				To(BeTrue(), "expected ServiceAccount %s not to be deleted in dry-run mode", name)
+		}
+		Expect(testutil.ToFloat64(orphanedObjects.WithLabelValues("Secret"))).To(BeEquivalentTo(3))
+		Expect(a.actions()).To(BeEmpty())
+		Expect(s.Recorder.(*record.FakeRecorder).Events).To(HaveLen(6), "expected an Event per orphaned object")
+	})
+})
@@ -18,45 +18,331 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
-	kimiov1alpha1 "github.com/filariow/kim/api/v1alpha1"
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/pkg/audit"
+	"github.com/filariow/kim/pkg/pattoken"
+)
+
+const (
+	UserNotFoundPersonalAccessTokenReason           = "UserNotFound"
+	UserWaitingForApprovalPersonalAccessTokenReason = "UserWaitingForApproval"
+	UserActivePersonalAccessTokenReason             = "UserActive"
+	UserSuspendedPersonalAccessTokenReason          = "UserSuspended"
+	UserBannedPersonalAccessTokenReason             = "UserBanned"
+	ExpiredPersonalAccessTokenReason                = "Expired"
+	RevokedByUserPersonalAccessTokenReason          = "RevokedByUser"
 )
 
 // PersonalAccessTokenReconciler reconciles a PersonalAccessToken object
 type PersonalAccessTokenReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Auditor records the issuance and revocation of tokens. If nil, they are not audited.
+	Auditor audit.Logger
+
+	// Plan makes the reconciliation of every PersonalAccessToken report the
+	// actions it would perform in the PersonalAccessToken's status and Events
+	// instead of performing them. The PersonalAccessTokens of the Users
+	// annotated with the PlanAnnotation are planned regardless.
+	Plan bool
 }
 
-//+kubebuilder:rbac:groups=kim.io,namespace=system,resources=personalaccesstokens,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=kim.io,namespace=system,resources=personalaccesstokens/status,verbs=get;update;patch
-//+kubebuilder:rbac:groups=kim.io,namespace=system,resources=personalaccesstokens/finalizers,verbs=update
+//+kubebuilder:rbac:groups=kim.io,resources=personalaccesstokens,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=kim.io,resources=personalaccesstokens/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=kim.io,resources=personalaccesstokens/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
-// Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the PersonalAccessToken object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
+// Reconcile aligns the phase of a PersonalAccessToken to the state of its User.
+// The token is issued by KIM the first time the PersonalAccessToken is Active
+// and stored in a Secret named as the PersonalAccessToken. The token is only
+// accepted while the PersonalAccessToken is Active, so that it works again
+// when a suspended User is reactivated. Revoked and expired tokens are deleted.
+// Once revoked, a PersonalAccessToken is never activated again.
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
 func (r *PersonalAccessTokenReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
+	l := log.FromContext(ctx).WithValues("namespace", req.Namespace, "personalaccesstoken", req.Name)
+	ctx = withCorrelationID(ctx)
+
+	// fetch personal access token
+	var p kimiov1beta1.PersonalAccessToken
+	if err := r.Get(ctx, req.NamespacedName, &p); err != nil {
+		if errors.IsNotFound(err) {
+			l.Info("personal access token has been deleted")
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	planned, err := r.planned(ctx, &p)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if planned {
+		return r.plan(ctx, &p)
+	}
+	return r.enforce(ctx, &p)
+}
+
+// planned returns true if the reconciliation of the PersonalAccessToken is to
+// be planned, because of the plan mode or of the annotation of its User
+func (r *PersonalAccessTokenReconciler) planned(ctx context.Context, p *kimiov1beta1.PersonalAccessToken) (bool, error) {
+	if r.Plan {
+		return true, nil
+	}
+	if p.Spec.User.Name == "" {
+		return false, nil
+	}
+
+	var u kimiov1beta1.User
+	if err := r.Get(ctx, types.NamespacedName{Namespace: p.Namespace, Name: p.Spec.User.Name}, &u); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	return isPlanned(&u), nil
+}
+
+// plan computes the actions the reconciliation of the PersonalAccessToken
+// would perform and, when they change, reports them in its status and in an
+// Event. Nothing else is written: the reconciliation runs against a
+// planClient, without Events nor audit records.
+func (r *PersonalAccessTokenReconciler) plan(ctx context.Context, p *kimiov1beta1.PersonalAccessToken) (ctrl.Result, error) {
+	c := newPlanClient(r.Client)
+	e := *r
+	e.Client = c
+	e.Recorder = discardRecorder{}
+	e.Auditor = nil
+	res, err := e.enforce(ctx, p.DeepCopy())
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if pl := c.plan(); !equality.Semantic.DeepEqual(p.Status.Plan, pl) {
+		r.Recorder.Event(p, corev1.EventTypeNormal, PlannedReason, planMessage(pl))
+		p.Status.Plan = pl
+		if err := r.Status().Update(ctx, p); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	// the plan changes at expiration
+	return res, nil
+}
+
+// enforce reconciles the PersonalAccessToken, performing the actions it needs
+func (r *PersonalAccessTokenReconciler) enforce(ctx context.Context, p *kimiov1beta1.PersonalAccessToken) (ctrl.Result, error) {
+	l := log.FromContext(ctx).WithValues("namespace", p.Namespace, "personalaccesstoken", p.Name)
+
+	phase, reason, requeueAfter, err := r.computePhase(ctx, p)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// the phase follows the state of the User, so the actions are attributed
+	// to who requested its last change of state
+	switch reason {
+	case UserActivePersonalAccessTokenReason, UserSuspendedPersonalAccessTokenReason,
+		UserBannedPersonalAccessTokenReason, UserWaitingForApprovalPersonalAccessTokenReason:
+		var u kimiov1beta1.User
+		if err := r.Get(ctx, types.NamespacedName{Namespace: p.Namespace, Name: p.Spec.User.Name}, &u); err != nil {
+			return ctrl.Result{}, client.IgnoreNotFound(err)
+		}
+		ctx = audit.WithRequester(ctx, u.LastStateChange().By)
+
+	// only the User revokes its PersonalAccessTokens from the self-service API
+	case RevokedByUserPersonalAccessTokenReason:
+		var u kimiov1beta1.User
+		if err := r.Get(ctx, types.NamespacedName{Namespace: p.Namespace, Name: p.Spec.User.Name}, &u); err != nil {
+			return ctrl.Result{}, client.IgnoreNotFound(err)
+		}
+		ctx = audit.WithRequester(ctx, u.Spec.Username)
+	}
+
+	switch phase {
+	case kimiov1beta1.ActivePersonalAccessTokenPhase:
+		l.Info("personal access token is active, ensure token is issued")
+		if err := r.ensureTokenIsIssued(ctx, p); err != nil {
+			l.Error(err, "error ensuring token is issued")
+			return ctrl.Result{}, err
+		}
+
+	case kimiov1beta1.RevokedPersonalAccessTokenPhase, kimiov1beta1.ExpiredPersonalAccessTokenPhase:
+		l.Info("personal access token is no more valid, ensure token Secret doesn't exist", "phase", phase, "reason", reason)
+		if err := r.ensureTokenSecretDoesntExist(ctx, p, reason); err != nil {
+			l.Error(err, "error ensuring token Secret doesn't exist")
+			return ctrl.Result{}, err
+		}
+		p.Status.TokenHash = ""
+
+	default:
+		l.Info("personal access token is not active", "phase", phase, "reason", reason)
+	}
 
-	// TODO(user): your logic here
+	if p.Status.Phase != phase || p.Status.Reason != reason {
+		r.Recorder.Eventf(p, corev1.EventTypeNormal, reason, "PersonalAccessToken moved from phase '%s' to '%s'", p.Status.Phase, phase)
+		auditLog(ctx, r.Auditor, audit.StateChangedAction, auditObject("PersonalAccessToken", p), string(p.Status.Phase), string(phase), reason)
+	}
 
-	return ctrl.Result{}, nil
+	p.Status.Phase = phase
+	p.Status.Reason = reason
+	p.Status.Plan = nil
+	p.Status.ObservedGeneration = p.Generation
+	if err := r.Status().Update(ctx, p); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// computePhase calculates the phase of the PersonalAccessToken from the
+// observed state of its User and its expiration
+func (r *PersonalAccessTokenReconciler) computePhase(ctx context.Context, p *kimiov1beta1.PersonalAccessToken) (kimiov1beta1.PersonalAccessTokenPhase, string, time.Duration, error) {
+	if p.IsRevoked() {
+		return kimiov1beta1.RevokedPersonalAccessTokenPhase, p.Status.Reason, 0, nil
+	}
+
+	if p.Spec.User.Name == "" {
+		return kimiov1beta1.PendingPersonalAccessTokenPhase, UserNotFoundPersonalAccessTokenReason, 0, nil
+	}
+
+	var u kimiov1beta1.User
+	if err := r.Get(ctx, types.NamespacedName{Namespace: p.Namespace, Name: p.Spec.User.Name}, &u); err != nil {
+		if errors.IsNotFound(err) {
+			return kimiov1beta1.PendingPersonalAccessTokenPhase, UserNotFoundPersonalAccessTokenReason, 0, nil
+		}
+		return "", "", 0, err
+	}
+
+	switch u.Status.State {
+	case kimiov1beta1.ActiveUserState:
+		if p.Spec.Expiration == nil {
+			return kimiov1beta1.ActivePersonalAccessTokenPhase, UserActivePersonalAccessTokenReason, 0, nil
+		}
+		if d := time.Until(p.Spec.Expiration.Time); d > 0 {
+			return kimiov1beta1.ActivePersonalAccessTokenPhase, UserActivePersonalAccessTokenReason, d, nil
+		}
+		return kimiov1beta1.ExpiredPersonalAccessTokenPhase, ExpiredPersonalAccessTokenReason, 0, nil
+
+	case kimiov1beta1.SuspendedUserState:
+		return kimiov1beta1.SuspendedPersonalAccessTokenPhase, UserSuspendedPersonalAccessTokenReason, 0, nil
+
+	case kimiov1beta1.BannedUserState:
+		return kimiov1beta1.RevokedPersonalAccessTokenPhase, UserBannedPersonalAccessTokenReason, 0, nil
+
+	default:
+		return kimiov1beta1.PendingPersonalAccessTokenPhase, UserWaitingForApprovalPersonalAccessTokenReason, 0, nil
+	}
+}
+
+func (r *PersonalAccessTokenReconciler) ensureTokenSecretDoesntExist(ctx context.Context, p *kimiov1beta1.PersonalAccessToken, reason string) error {
+	s := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: p.Namespace,
+			Name:      p.Name,
+		},
+	}
+
+	if err := r.Delete(ctx, &s); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	auditLog(ctx, r.Auditor, audit.TokenRevokedAction, auditObject("PersonalAccessToken", p), "", "", reason)
+	return nil
+}
+
+// ensureTokenIsIssued generates the token, if not already issued, and
+// records its digest in the status of the PersonalAccessToken
+func (r *PersonalAccessTokenReconciler) ensureTokenIsIssued(ctx context.Context, p *kimiov1beta1.PersonalAccessToken) error {
+	var s corev1.Secret
+	err := r.Get(ctx, types.NamespacedName{Namespace: p.Namespace, Name: p.Name}, &s)
+	switch {
+	case err == nil:
+		if !metav1.IsControlledBy(&s, p) {
+			return fmt.Errorf("secret %s/%s is not controlled by the personal access token", s.Namespace, s.Name)
+		}
+
+		t := string(s.Data[kimiov1beta1.PersonalAccessTokenSecretTokenKey])
+		if err := pattoken.Validate(t); err != nil {
+			return fmt.Errorf("secret %s/%s does not contain a valid token: %w", s.Namespace, s.Name, err)
+		}
+		p.Status.TokenHash = pattoken.Hash(t)
+		return ensureUserLabels(ctx, r.Client, &s, p.Namespace, p.Spec.User.Name)
+
+	case errors.IsNotFound(err):
+		t, err := pattoken.Generate()
+		if err != nil {
+			return err
+		}
+
+		s = corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: p.Namespace,
+				Name:      p.Name,
+				Labels:    userLabels(p.Namespace, p.Spec.User.Name),
+			},
+			Type: kimiov1beta1.PersonalAccessTokenSecretType,
+			Data: map[string][]byte{
+				kimiov1beta1.PersonalAccessTokenSecretTokenKey: []byte(t),
+			},
+		}
+		if err := controllerutil.SetControllerReference(p, &s, r.Scheme); err != nil {
+			return err
+		}
+		if err := r.Create(ctx, &s, client.FieldOwner(FieldManager)); err != nil {
+			return err
+		}
+		auditLog(ctx, r.Auditor, audit.TokenIssuedAction, auditObject("PersonalAccessToken", p), "", "", "")
+		p.Status.TokenHash = pattoken.Hash(t)
+		return nil
+
+	default:
+		return err
+	}
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *PersonalAccessTokenReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&kimiov1alpha1.PersonalAccessToken{}).
+		For(&kimiov1beta1.PersonalAccessToken{}).
+		Owns(&corev1.Secret{}).
+		Watches(
+			&source.Kind{Type: &kimiov1beta1.User{}},
+			handler.EnqueueRequestsFromMapFunc(r.mapUserToPersonalAccessTokens),
+		).
 		Complete(r)
 }
+
+// mapUserToPersonalAccessTokens enqueues all the PersonalAccessTokens of a User
+func (r *PersonalAccessTokenReconciler) mapUserToPersonalAccessTokens(o client.Object) []reconcile.Request {
+	var pp kimiov1beta1.PersonalAccessTokenList
+	if err := r.List(context.Background(), &pp,
+		client.InNamespace(o.GetNamespace()),
+		client.MatchingFields{PersonalAccessTokenUserIndex: o.GetName()},
+	); err != nil {
+		log.Log.Error(err, "error listing personal access tokens of user", "namespace", o.GetNamespace(), "user", o.GetName())
+		return nil
+	}
+
+	rr := make([]reconcile.Request, len(pp.Items))
+	for i, p := range pp.Items {
+		rr[i] = reconcile.Request{NamespacedName: types.NamespacedName{Namespace: p.Namespace, Name: p.Name}}
+	}
+	return rr
+}
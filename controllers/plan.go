@@ -0,0 +1,221 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+// PlannedReason is the reason of the Events reporting a new plan
+const PlannedReason = "Planned"
+
+// isPlanned returns true if the object is annotated to be planned
+func isPlanned(o metav1.Object) bool {
+	return o.GetAnnotations()[kimiov1beta1.PlanAnnotation] == "true"
+}
+
+// planClient records the changes a reconciliation would perform as planned
+// actions instead of performing them. Reads are served by the wrapped client,
+// so the objects the reconciliation would create are observed as not found.
+// Status changes are discarded.
+type planClient struct {
+	client.Client
+
+	actions []kimiov1beta1.PlannedAction
+}
+
+func newPlanClient(c client.Client) *planClient {
+	return &planClient{Client: c}
+}
+
+// plan returns the actions recorded so far
+func (c *planClient) plan() *kimiov1beta1.Plan {
+	return &kimiov1beta1.Plan{Actions: c.actions}
+}
+
+func (c *planClient) record(action string, obj client.Object) error {
+	gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+	if err != nil {
+		return err
+	}
+	c.actions = append(c.actions, kimiov1beta1.PlannedAction{
+		Action:    action,
+		Kind:      gvk.Kind,
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+	})
+	return nil
+}
+
+func (c *planClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	return c.record("Create", obj)
+}
+
+func (c *planClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return c.record("Update", obj)
+}
+
+// Patch plans the creation of the objects applied with server-side apply that
+// don't exist and the update of the existing ones the patch would change
+func (c *planClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() != types.ApplyPatchType {
+		return c.record("Update", obj)
+	}
+
+	o := obj.DeepCopyObject().(client.Object)
+	if err := c.Get(ctx, client.ObjectKeyFromObject(obj), o); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		return c.record("Create", obj)
+	}
+
+	changed, err := applyChanges(o, obj)
+	if err != nil || !changed {
+		return err
+	}
+	return c.record("Update", obj)
+}
+
+// Delete plans the deletion of existing objects. As the actual deletion, it
+// returns a NotFound error if the object doesn't exist.
+func (c *planClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	o := obj.DeepCopyObject().(client.Object)
+	if err := c.Get(ctx, client.ObjectKeyFromObject(obj), o); err != nil {
+		return err
+	}
+	return c.record("Delete", obj)
+}
+
+func (c *planClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) error {
+	return fmt.Errorf("deleting all %T is not supported in plan mode", obj)
+}
+
+func (c *planClient) Status() client.SubResourceWriter {
+	return discardWriter{}
+}
+
+// discardWriter discards the changes to a subresource
+type discardWriter struct{}
+
+func (discardWriter) Create(context.Context, client.Object, client.Object, ...client.SubResourceCreateOption) error {
+	return nil
+}
+
+func (discardWriter) Update(context.Context, client.Object, ...client.SubResourceUpdateOption) error {
+	return nil
+}
+
+func (discardWriter) Patch(context.Context, client.Object, client.Patch, ...client.SubResourcePatchOption) error {
+	return nil
+}
+
+// applyChanges returns true if applying the desired object would change the
+// existing one, that is if any field set in desired has a different value in
+// existing
+func applyChanges(existing, desired client.Object) (bool, error) {
+	e, err := runtime.DefaultUnstructuredConverter.ToUnstructured(existing)
+	if err != nil {
+		return false, err
+	}
+	d, err := runtime.DefaultUnstructuredConverter.ToUnstructured(desired)
+	if err != nil {
+		return false, err
+	}
+	// the fields managed by the API server are not applied
+	delete(d, "apiVersion")
+	delete(d, "kind")
+	if m, ok := d["metadata"].(map[string]interface{}); ok {
+		for _, f := range []string{"managedFields", "resourceVersion", "creationTimestamp"} {
+			delete(m, f)
+		}
+	}
+	return !contains(e, d), nil
+}
+
+// contains returns true if all the fields set in want have the same value in
+// have. The elements of lists are compared in order, as the API server may
+// default their fields.
+func contains(have, want interface{}) bool {
+	switch w := want.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		h, _ := have.(map[string]interface{})
+		for k, v := range w {
+			if !contains(h[k], v) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		h, _ := have.([]interface{})
+		if len(h) != len(w) {
+			return false
+		}
+		for i := range w {
+			if !contains(h[i], w[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return equality.Semantic.DeepEqual(have, want)
+	}
+}
+
+// planMessage describes the plan in an Event
+func planMessage(p *kimiov1beta1.Plan) string {
+	if len(p.Actions) == 0 {
+		return "No action planned"
+	}
+
+	aa := make([]string, 0, len(p.Actions))
+	for _, a := range p.Actions {
+		k := a.Name
+		if a.Namespace != "" {
+			k = a.Namespace + "/" + a.Name
+		}
+		aa = append(aa, fmt.Sprintf("%s %s %s", a.Action, a.Kind, k))
+	}
+	return "Planned " + strings.Join(aa, ", ")
+}
+
+// discardRecorder discards the Events of a planned reconciliation, as they
+// report actions not performed
+type discardRecorder struct{}
+
+var _ record.EventRecorder = discardRecorder{}
+
+func (discardRecorder) Event(runtime.Object, string, string, string) {}
+
+func (discardRecorder) Eventf(runtime.Object, string, string, string, ...interface{}) {}
+
+func (discardRecorder) AnnotatedEventf(runtime.Object, map[string]string, string, string, string, ...interface{}) {
+}
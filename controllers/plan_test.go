@@ -0,0 +1,158 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+func plannedActions(p *kimiov1beta1.Plan) []string {
+	if p == nil {
+		return nil
+	}
+	aa := []string{}
+	for _, a := range p.Actions {
+		aa = append(aa, a.Action+" "+a.Kind+" "+a.Name)
+	}
+	return aa
+}
+
+var _ = Describe("Plan mode", func() {
+	var (
+		ctx    context.Context
+		tenant string
+		key    types.NamespacedName
+	)
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+		tenant = createNamespace(ctx)
+		key = types.NamespacedName{Namespace: tenant, Name: "alice"}
+	})
+
+	It("plans the annotated User", func() {
+		r := newUserReconciler()
+		u := newUser(tenant, kimiov1beta1.ActiveUserState)
+		u.Annotations = map[string]string{kimiov1beta1.PlanAnnotation: "true"}
+		create(ctx, u)
+
+		u = reconcileUser(ctx, r, key)
+		Expect(plannedActions(u.Status.Plan)).To(Equal([]string{"Create ServiceAccount alice", "Create Secret alice"}))
+		Expect(u.Status.State).To(BeEmpty(), "expected the status to only report the plan")
+		Expect(u.Status.InitialGeneration).To(BeNil(), "expected the status to only report the plan")
+		Expect(exists(ctx, key, &corev1.ServiceAccount{})).To(BeFalse(), "expected nothing to be created")
+		Expect(exists(ctx, key, &corev1.Secret{})).To(BeFalse(), "expected nothing to be created")
+		events := r.Recorder.(*record.FakeRecorder).Events
+		Expect(events).To(Receive(HavePrefix("Normal Planned Planned Create ServiceAccount " + tenant + "/alice")))
+
+		By("reporting the plan once")
+		reconcileUser(ctx, r, key)
+		Expect(events).NotTo(Receive())
+
+		By("enforcing the plan once the annotation is removed")
+		u = reconcileUser(ctx, r, key)
+		delete(u.Annotations, kimiov1beta1.PlanAnnotation)
+		Expect(k8sClient.Update(ctx, u)).To(Succeed())
+		u = reconcileUser(ctx, r, key)
+		Expect(u.Status.Plan).To(BeNil())
+		Expect(u.Status.State).To(Equal(kimiov1beta1.ActiveUserState))
+		Expect(exists(ctx, key, &corev1.ServiceAccount{})).To(BeTrue(), "expected the ServiceAccount to be created")
+	})
+
+	It("omits the objects in sync", func() {
+		r := newHomeNamespaceUserReconciler(RetainHomeNamespaceRetentionPolicy)
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+		reconcileUser(ctx, r, key)
+
+		r.Plan = true
+		u := reconcileUser(ctx, r, key)
+		Expect(u.Status.Plan).NotTo(BeNil())
+		Expect(u.Status.Plan.Actions).To(BeEmpty())
+
+		setUserState(ctx, key, kimiov1beta1.SuspendedUserState)
+		u = reconcileUser(ctx, r, key)
+		Expect(plannedActions(u.Status.Plan)).To(Equal([]string{"Delete Secret alice", "Delete ServiceAccount alice", "Delete RoleBinding kim-home"}))
+		Expect(u.Status.State).To(Equal(kimiov1beta1.ActiveUserState), "expected the User not to be suspended")
+		Expect(exists(ctx, key, &corev1.ServiceAccount{})).To(BeTrue(), "expected the User not to be suspended")
+	})
+
+	It("plans the AccessGrants of an annotated User", func() {
+		r := newAccessGrantReconciler()
+		prod := createNamespace(ctx)
+		a := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+		u := newActiveUser(tenant)
+		u.Annotations = map[string]string{kimiov1beta1.PlanAnnotation: "true"}
+		create(ctx, u, newAccessGrant(tenant, prod, &a))
+
+		g, res := reconcileAccessGrant(ctx, r, types.NamespacedName{Namespace: tenant, Name: "incident"})
+		Expect(plannedActions(g.Status.Plan)).To(Equal([]string{"Update AccessGrant incident", "Create RoleBinding " + accessGrantBindingName(g)}))
+		Expect(g.Status.Phase).To(BeEmpty(), "expected nothing to be granted")
+		Expect(g.Finalizers).To(BeEmpty(), "expected nothing to be granted")
+		Expect(bindingExists(ctx, g)).To(BeFalse(), "expected nothing to be granted")
+		Expect(res.RequeueAfter).To(BeNumerically(">", 49*time.Minute), "expected the plan to be computed again at expiration")
+		Expect(res.RequeueAfter).To(BeNumerically("<=", 50*time.Minute), "expected the plan to be computed again at expiration")
+	})
+
+	It("plans the PersonalAccessTokens of an annotated User", func() {
+		r := &PersonalAccessTokenReconciler{Client: k8sClient, Scheme: scheme.Scheme, Recorder: record.NewFakeRecorder(100)}
+		u := newActiveUser(tenant)
+		u.Annotations = map[string]string{kimiov1beta1.PlanAnnotation: "true"}
+		pat := &kimiov1beta1.PersonalAccessToken{
+			ObjectMeta: metav1.ObjectMeta{Namespace: tenant, Name: "alice-1"},
+			Spec:       kimiov1beta1.PersonalAccessTokenSpec{User: kimiov1beta1.UserReference{Name: "alice"}},
+		}
+		create(ctx, u, pat)
+
+		patKey := types.NamespacedName{Namespace: tenant, Name: "alice-1"}
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: patKey})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(k8sClient.Get(ctx, patKey, pat)).To(Succeed())
+		Expect(plannedActions(pat.Status.Plan)).To(Equal([]string{"Create Secret alice-1"}))
+		Expect(pat.Status.Phase).To(BeEmpty(), "expected the status to only report the plan")
+		Expect(pat.Status.TokenHash).To(BeEmpty(), "expected no token to be issued")
+		Expect(exists(ctx, patKey, &corev1.Secret{})).To(BeFalse(), "expected no token to be issued")
+	})
+
+	It("plans the Invitations", func() {
+		r := newInvitationReconciler()
+		create(ctx, newActiveUser(tenant), newInvitation(tenant))
+		invKey := types.NamespacedName{Namespace: tenant, Name: "carol"}
+		i, _ := reconcileInvitation(ctx, r, invKey)
+
+		By("planning the deletion of the code of the redeemed Invitation")
+		i.Status.Phase = kimiov1beta1.RedeemedInvitationPhase
+		Expect(k8sClient.Status().Update(ctx, i)).To(Succeed())
+		r.Plan = true
+		i, _ = reconcileInvitation(ctx, r, invKey)
+		Expect(plannedActions(i.Status.Plan)).To(Equal([]string{"Delete Secret " + InvitationSecretName(i)}))
+		Expect(i.Status.CodeHash).NotTo(BeEmpty(), "expected the status to only report the plan")
+		Expect(exists(ctx, types.NamespacedName{Namespace: tenant, Name: InvitationSecretName(i)}, &corev1.Secret{})).To(BeTrue(), "expected the code not to be deleted")
+	})
+})
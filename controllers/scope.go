@@ -0,0 +1,58 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Scope is the set of namespaces KIM is granted access to. Deployed
+// namespaced, KIM is only bound to its role in the namespaces it watches, and
+// can't provision Namespaces, ClusterRoleBindings nor bindings in other
+// namespaces: that requires the cluster-wide RBAC of the config/cluster-wide
+// component. The zero Scope is cluster-wide.
+type Scope struct {
+	// Namespaces KIM is granted access to, all if empty
+	Namespaces []string
+}
+
+// ClusterWide returns true if KIM is granted access to the whole cluster
+func (s Scope) ClusterWide() bool {
+	return len(s.Namespaces) == 0
+}
+
+// Includes returns true if KIM is granted access to the namespace. The empty
+// namespace is the cluster scope.
+func (s Scope) Includes(namespace string) bool {
+	if s.ClusterWide() {
+		return true
+	}
+	for _, n := range s.Namespaces {
+		if n == namespace && n != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// listNamespaces returns the namespaces to list the objects of the scope in
+func (s Scope) listNamespaces() []string {
+	if s.ClusterWide() {
+		return []string{metav1.NamespaceAll}
+	}
+	return s.Namespaces
+}
@@ -17,20 +17,32 @@ limitations under the License.
 package controllers
 
 import (
+	"context"
+	"fmt"
 	"path/filepath"
 	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	kimiov1alpha1 "github.com/filariow/kim/api/v1alpha1"
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -65,11 +77,19 @@ var _ = BeforeSuite(func() {
 	err = kimiov1alpha1.AddToScheme(scheme.Scheme)
 	Expect(err).NotTo(HaveOccurred())
 
+	err = kimiov1beta1.AddToScheme(scheme.Scheme)
+	Expect(err).NotTo(HaveOccurred())
+
 	//+kubebuilder:scaffold:scheme
 
-	k8sClient, err = client.New(cfg, client.Options{Scheme: scheme.Scheme})
+	c, err := client.New(cfg, client.Options{Scheme: scheme.Scheme})
 	Expect(err).NotTo(HaveOccurred())
-	Expect(k8sClient).NotTo(BeNil())
+	Expect(c).NotTo(BeNil())
+
+	ic := &indexingClient{Client: c, indexes: map[schema.GroupVersionKind]map[string]client.IndexerFunc{}}
+	err = SetupFieldIndexes(context.TODO(), ic)
+	Expect(err).NotTo(HaveOccurred())
+	k8sClient = ic
 
 })
 
@@ -78,3 +98,139 @@ var _ = AfterSuite(func() {
 	err := testEnv.Stop()
 	Expect(err).NotTo(HaveOccurred())
 })
+
+// indexingClient resolves the field selectors on the controllers' field
+// indexes filtering the listed objects, as the Manager's cache does
+type indexingClient struct {
+	client.Client
+	indexes map[schema.GroupVersionKind]map[string]client.IndexerFunc
+}
+
+var _ client.FieldIndexer = &indexingClient{}
+
+func (c *indexingClient) IndexField(_ context.Context, obj client.Object, field string, f client.IndexerFunc) error {
+	gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+	if err != nil {
+		return err
+	}
+	if c.indexes[gvk] == nil {
+		c.indexes[gvk] = map[string]client.IndexerFunc{}
+	}
+	c.indexes[gvk][field] = f
+	return nil
+}
+
+func (c *indexingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	o := (&client.ListOptions{}).ApplyOptions(opts)
+	if o.FieldSelector == nil || o.FieldSelector.Empty() {
+		return c.Client.List(ctx, list, opts...)
+	}
+
+	gvk, err := apiutil.GVKForObject(list, c.Scheme())
+	if err != nil {
+		return err
+	}
+	gvk.Kind = gvk.Kind[:len(gvk.Kind)-len("List")]
+	rr := o.FieldSelector.Requirements()
+	f, ok := c.indexes[gvk][rr[0].Field]
+	if !ok {
+		return c.Client.List(ctx, list, opts...)
+	}
+	if len(rr) != 1 {
+		return fmt.Errorf("unsupported field selector %s", o.FieldSelector)
+	}
+
+	o.FieldSelector = nil
+	if err := c.Client.List(ctx, list, o); err != nil {
+		return err
+	}
+	ii, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	var matching []runtime.Object
+	for _, i := range ii {
+		for _, v := range f(i.(client.Object)) {
+			if v == rr[0].Value {
+				matching = append(matching, i)
+				break
+			}
+		}
+	}
+	return meta.SetList(list, matching)
+}
+
+// createNamespace creates a Namespace for the objects of a spec
+func createNamespace(ctx context.Context) string {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "test-"}}
+	ExpectWithOffset(1, k8sClient.Create(ctx, ns)).To(Succeed())
+	return ns.Name
+}
+
+// create creates the objects, together with the status of the KIM ones
+func create(ctx context.Context, oo ...client.Object) {
+	for _, o := range oo {
+		s := o.DeepCopyObject()
+		ExpectWithOffset(1, k8sClient.Create(ctx, o)).To(Succeed())
+
+		switch o := o.(type) {
+		case *kimiov1beta1.User:
+			o.Status = s.(*kimiov1beta1.User).Status
+		case *kimiov1beta1.AccessGrant:
+			o.Status = s.(*kimiov1beta1.AccessGrant).Status
+		case *kimiov1beta1.Invitation:
+			o.Status = s.(*kimiov1beta1.Invitation).Status
+		case *kimiov1beta1.PersonalAccessToken:
+			o.Status = s.(*kimiov1beta1.PersonalAccessToken).Status
+		default:
+			continue
+		}
+		ExpectWithOffset(1, k8sClient.Status().Update(ctx, o)).To(Succeed())
+	}
+}
+
+// exists returns true if the object exists and is not being deleted, as
+// Namespaces are never deleted in the test environment
+func exists(ctx context.Context, key types.NamespacedName, obj client.Object) bool {
+	err := k8sClient.Get(ctx, key, obj)
+	if errors.IsNotFound(err) {
+		return false
+	}
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	return obj.GetDeletionTimestamp().IsZero()
+}
+
+// namespacedClient returns a client with the RBAC KIM is granted when deployed
+// namespaced: any permission in the namespaces, and only the rules of
+// config/rbac/cluster_scoped_role.yaml cluster-wide
+func namespacedClient(ctx context.Context, namespaces ...string) client.Client {
+	name := "kim-namespaced-" + namespaces[0]
+	create(ctx,
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Rules: []rbacv1.PolicyRule{
+				{APIGroups: []string{"authentication.k8s.io"}, Resources: []string{"tokenreviews"}, Verbs: []string{"create"}},
+				{APIGroups: []string{"authorization.k8s.io"}, Resources: []string{"subjectaccessreviews"}, Verbs: []string{"create"}},
+				{APIGroups: []string{kimiov1beta1.GroupVersion.Group}, Resources: []string{"accessprofiles"}, Verbs: []string{"get", "list", "watch"}},
+			},
+		},
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: name},
+			Subjects:   []rbacv1.Subject{{APIGroup: rbacv1.GroupName, Kind: rbacv1.UserKind, Name: name}},
+		},
+	)
+	for _, ns := range namespaces {
+		create(ctx, &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "cluster-admin"},
+			Subjects:   []rbacv1.Subject{{APIGroup: rbacv1.GroupName, Kind: rbacv1.UserKind, Name: name}},
+		})
+	}
+
+	c := rest.CopyConfig(cfg)
+	c.Impersonate = rest.ImpersonationConfig{UserName: name}
+	cli, err := client.New(c, client.Options{Scheme: scheme.Scheme})
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	return &indexingClient{Client: cli, indexes: k8sClient.(*indexingClient).indexes}
+}
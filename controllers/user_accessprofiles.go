@@ -0,0 +1,182 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+const (
+	// AccessProfilesFinalizer ensures the RoleBindings granted by AccessProfiles are removed when the User is deleted
+	AccessProfilesFinalizer = "kim.io/access-profiles"
+)
+
+//+kubebuilder:rbac:groups=kim.io,resources=accessprofiles,verbs=get;list;watch
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles,verbs=bind
+
+// reconcileAccessProfiles materialises the RoleBindings granted to an Active
+// User by its AccessProfiles and garbage-collects the ones no more granted.
+// Users in any other state are granted no RoleBinding.
+func (r *UserReconciler) reconcileAccessProfiles(ctx context.Context, u *kimiov1beta1.User) error {
+	l := log.FromContext(ctx).WithValues("namespace", u.GetNamespace(), "user", u.GetName())
+
+	desired := map[types.NamespacedName]rbacv1.RoleBinding{}
+	if u.Spec.State == kimiov1beta1.ActiveUserState {
+		sub, err := r.ServiceAccount.Subject(u)
+		if err != nil {
+			return err
+		}
+		for _, pr := range u.Spec.Profiles {
+			var p kimiov1beta1.AccessProfile
+			if err := r.Get(ctx, types.NamespacedName{Name: pr.Name}, &p); err != nil {
+				if !errors.IsNotFound(err) {
+					return err
+				}
+				l.Info("access profile not found", "access-profile", pr.Name)
+				r.Recorder.Eventf(u, corev1.EventTypeWarning, "AccessProfileNotFound", "AccessProfile '%s' not found", pr.Name)
+				continue
+			}
+
+			for _, rb := range accessProfileRoleBindings(u, &p, sub) {
+				if !r.Scope.Includes(rb.Namespace) {
+					l.Info("access profile namespace is out of scope", "access-profile", pr.Name, "rolebinding-namespace", rb.Namespace)
+					r.Recorder.Eventf(u, corev1.EventTypeWarning, "AccessProfileOutOfScope",
+						"AccessProfile '%s' is not granted in namespace '%s', KIM is not granted access to it", pr.Name, rb.Namespace)
+					continue
+				}
+				desired[types.NamespacedName{Namespace: rb.Namespace, Name: rb.Name}] = rb
+			}
+		}
+	}
+
+	if len(desired) > 0 {
+		// the finalizer is added before granting anything outside the User's namespace
+		if err := r.updateFinalizers(ctx, u, func() bool {
+			return controllerutil.AddFinalizer(u, AccessProfilesFinalizer)
+		}); err != nil {
+			return err
+		}
+	}
+
+	ee := []error{}
+	for _, rb := range desired {
+		rb := rb
+		if err := apply(ctx, r.Client, &rb); err != nil {
+			l.Error(err, "error granting access profile", "access-profile", rb.Labels[AccessProfileLabel], "rolebinding-namespace", rb.Namespace)
+			ee = append(ee, err)
+		}
+	}
+
+	if err := r.deleteAccessProfileRoleBindings(ctx, u, func(rb *rbacv1.RoleBinding) bool {
+		_, ok := desired[types.NamespacedName{Namespace: rb.Namespace, Name: rb.Name}]
+		return !ok
+	}); err != nil {
+		ee = append(ee, err)
+	}
+	return utilerrors.NewAggregate(ee)
+}
+
+// finalizeAccessProfiles removes the RoleBindings granted to a deleted User
+func (r *UserReconciler) finalizeAccessProfiles(ctx context.Context, u *kimiov1beta1.User) error {
+	if !controllerutil.ContainsFinalizer(u, AccessProfilesFinalizer) {
+		return nil
+	}
+
+	if err := r.deleteAccessProfileRoleBindings(ctx, u, func(*rbacv1.RoleBinding) bool { return true }); err != nil {
+		return err
+	}
+	return r.updateFinalizers(ctx, u, func() bool {
+		return controllerutil.RemoveFinalizer(u, AccessProfilesFinalizer)
+	})
+}
+
+// deleteAccessProfileRoleBindings deletes the RoleBindings granted to the User
+// by AccessProfiles that match the filter
+func (r *UserReconciler) deleteAccessProfileRoleBindings(ctx context.Context, u *kimiov1beta1.User, filter func(*rbacv1.RoleBinding) bool) error {
+	ee := []error{}
+	for _, ns := range r.Scope.listNamespaces() {
+		var rbb rbacv1.RoleBindingList
+		if err := r.List(ctx, &rbb,
+			client.InNamespace(ns),
+			client.MatchingLabels(userLabels(u.Namespace, u.Name)),
+			client.HasLabels{AccessProfileLabel},
+		); err != nil {
+			ee = append(ee, err)
+			continue
+		}
+
+		for i := range rbb.Items {
+			rb := &rbb.Items[i]
+			if !filter(rb) {
+				continue
+			}
+			if err := r.Delete(ctx, rb); err != nil && !errors.IsNotFound(err) {
+				ee = append(ee, err)
+			}
+		}
+	}
+	return utilerrors.NewAggregate(ee)
+}
+
+// accessProfileRoleBindings returns the RoleBindings granting the AccessProfile to the User
+func accessProfileRoleBindings(u *kimiov1beta1.User, p *kimiov1beta1.AccessProfile, sub rbacv1.Subject) []rbacv1.RoleBinding {
+	rbb := []rbacv1.RoleBinding{}
+	for _, ns := range p.Spec.Namespaces {
+		for _, rr := range p.Spec.Roles {
+			ll := userLabels(u.Namespace, u.Name)
+			ll[AccessProfileLabel] = p.Name
+
+			rbb = append(rbb, rbacv1.RoleBinding{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: ns,
+					Name:      accessProfileRoleBindingName(u, p.Name, rr),
+					Labels:    ll,
+				},
+				RoleRef: rbacv1.RoleRef{
+					APIGroup: rbacv1.GroupName,
+					Kind:     rr.Kind,
+					Name:     rr.Name,
+				},
+				Subjects: []rbacv1.Subject{sub},
+			})
+		}
+	}
+	return rbb
+}
+
+// accessProfileRoleBindingName returns a name that is unique for the User,
+// the AccessProfile and the role. As the RoleRef of a RoleBinding is immutable,
+// the role is part of the name.
+func accessProfileRoleBindingName(u *kimiov1beta1.User, profile string, rr kimiov1beta1.AccessProfileRoleRef) string {
+	h := sha256.Sum256([]byte(strings.Join([]string{u.Namespace, u.Name, profile, rr.Kind, rr.Name}, "/")))
+	return "kim-" + profile + "-" + hex.EncodeToString(h[:])[:10]
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+func newAccessProfile(name string, namespaces ...string) *kimiov1beta1.AccessProfile {
+	return &kimiov1beta1.AccessProfile{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: kimiov1beta1.AccessProfileSpec{
+			Roles: []kimiov1beta1.AccessProfileRoleRef{
+				{Kind: "ClusterRole", Name: "edit"},
+				{Kind: "Role", Name: "debugger"},
+			},
+			Namespaces: namespaces,
+		},
+	}
+}
+
+func newUserWithProfiles(namespace string, state kimiov1beta1.UserState, profiles ...string) *kimiov1beta1.User {
+	u := newUser(namespace, state)
+	for _, p := range profiles {
+		u.Spec.Profiles = append(u.Spec.Profiles, kimiov1beta1.AccessProfileReference{Name: p})
+	}
+	return u
+}
+
+// listAccessProfileRoleBindings lists the RoleBindings granting the profiles of the Users in namespace
+func listAccessProfileRoleBindings(ctx context.Context, namespace string) []rbacv1.RoleBinding {
+	var rbb rbacv1.RoleBindingList
+	ExpectWithOffset(1, k8sClient.List(ctx, &rbb,
+		client.HasLabels{AccessProfileLabel},
+		client.MatchingLabels{UserNamespaceLabel: namespace},
+	)).To(Succeed())
+	return rbb.Items
+}
+
+var _ = Describe("Access profiles", func() {
+	var (
+		ctx      context.Context
+		tenant   string
+		key      types.NamespacedName
+		r        *UserReconciler
+		dev      string
+		staging  string
+		prod     string
+		profiles func(string) string
+	)
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+		tenant = createNamespace(ctx)
+		key = types.NamespacedName{Namespace: tenant, Name: "alice"}
+		r = newUserReconciler()
+		dev, staging, prod = createNamespace(ctx), createNamespace(ctx), createNamespace(ctx)
+
+		// AccessProfiles are cluster-scoped
+		profiles = func(name string) string { return tenant + "-" + name }
+		DeferCleanup(func() {
+			for _, n := range []string{"developer", "sre-oncall"} {
+				p := &kimiov1beta1.AccessProfile{ObjectMeta: metav1.ObjectMeta{Name: profiles(n)}}
+				Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, p))).To(Succeed())
+			}
+		})
+	})
+
+	It("are granted", func() {
+		create(ctx,
+			newAccessProfile(profiles("developer"), dev, staging),
+			newAccessProfile(profiles("sre-oncall"), prod),
+			newUserWithProfiles(tenant, kimiov1beta1.ActiveUserState, profiles("developer"), profiles("sre-oncall"), profiles("missing")),
+		)
+
+		u := reconcileUser(ctx, r, key)
+		Expect(u.Finalizers).To(ContainElement(AccessProfilesFinalizer))
+
+		rbb := listAccessProfileRoleBindings(ctx, tenant)
+		Expect(rbb).To(HaveLen(6))
+		for _, rb := range rbb {
+			Expect(rb.Labels).To(HaveKeyWithValue(UserNameLabel, "alice"))
+			Expect(rb.Subjects).To(ConsistOf(rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Namespace: tenant, Name: "alice"}))
+		}
+	})
+
+	It("are garbage collected", func() {
+		create(ctx,
+			newAccessProfile(profiles("developer"), dev, staging),
+			newUserWithProfiles(tenant, kimiov1beta1.ActiveUserState, profiles("developer")),
+		)
+		reconcileUser(ctx, r, key)
+
+		By("removing a namespace from the profile")
+		var p kimiov1beta1.AccessProfile
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: profiles("developer")}, &p)).To(Succeed())
+		p.Spec.Namespaces = []string{dev}
+		Expect(k8sClient.Update(ctx, &p)).To(Succeed())
+		reconcileUser(ctx, r, key)
+
+		rbb := listAccessProfileRoleBindings(ctx, tenant)
+		Expect(rbb).To(HaveLen(2))
+		for _, rb := range rbb {
+			Expect(rb.Namespace).To(Equal(dev))
+		}
+	})
+
+	It("are only granted in the namespaces KIM is granted access to", func() {
+		create(ctx,
+			newAccessProfile(profiles("developer"), dev, staging),
+			newUserWithProfiles(tenant, kimiov1beta1.ActiveUserState, profiles("developer")),
+		)
+		r.Client = namespacedClient(ctx, tenant, dev)
+		r.Scope = Scope{Namespaces: []string{tenant, dev}}
+
+		reconcileUser(ctx, r, key)
+		rbb := listAccessProfileRoleBindings(ctx, tenant)
+		Expect(rbb).To(HaveLen(2))
+		for _, rb := range rbb {
+			Expect(rb.Namespace).To(Equal(dev))
+		}
+
+		By("revoking them in scope only")
+		setUserState(ctx, key, kimiov1beta1.SuspendedUserState)
+		reconcileUser(ctx, r, key)
+		Expect(listAccessProfileRoleBindings(ctx, tenant)).To(BeEmpty())
+	})
+
+	for _, state := range []kimiov1beta1.UserState{
+		kimiov1beta1.WaitingForApprovalUserState,
+		kimiov1beta1.SuspendedUserState,
+		kimiov1beta1.BannedUserState,
+	} {
+		state := state
+
+		It("are revoked when the User is "+string(state), func() {
+			create(ctx,
+				newAccessProfile(profiles("developer"), dev),
+				newUserWithProfiles(tenant, kimiov1beta1.ActiveUserState, profiles("developer")),
+			)
+			reconcileUser(ctx, r, key)
+			Expect(listAccessProfileRoleBindings(ctx, tenant)).NotTo(BeEmpty())
+
+			setUserState(ctx, key, state)
+			reconcileUser(ctx, r, key)
+			Expect(listAccessProfileRoleBindings(ctx, tenant)).To(BeEmpty())
+		})
+	}
+
+	It("are revoked when the User is deleted", func() {
+		create(ctx,
+			newAccessProfile(profiles("developer"), dev),
+			newUserWithProfiles(tenant, kimiov1beta1.ActiveUserState, profiles("developer")),
+		)
+		u := reconcileUser(ctx, r, key)
+
+		Expect(k8sClient.Delete(ctx, u)).To(Succeed())
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(listAccessProfileRoleBindings(ctx, tenant)).To(BeEmpty())
+		Expect(exists(ctx, key, &kimiov1beta1.User{})).To(BeFalse(), "expected the User to be deleted")
+	})
+})
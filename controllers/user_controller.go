@@ -18,31 +18,76 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
-	kimiov1alpha1 "github.com/filariow/kim/api/v1alpha1"
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/pkg/audit"
 )
 
 // UserReconciler reconciles a User object
 type UserReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// HomeNamespace configures the provisioning of Users' home namespaces.
+	// If nil, home namespaces are not provisioned.
+	HomeNamespace *HomeNamespaceConfig
+
+	// ServiceAccount configures the ServiceAccount and token Secret
+	// provisioned for each User. If nil, they are named as the User.
+	ServiceAccount *ServiceAccountConfig
+
+	// Quotas limits the resources each User can hold
+	Quotas Quotas
+
+	// Auditor records the lifecycle actions performed on Users. If nil, they are not audited.
+	Auditor audit.Logger
+
+	// Inactivity suspends the Users not active for too long
+	Inactivity InactivityPolicy
+
+	// Bindings caches the RoleBindings provisioned for Users in any namespace,
+	// to restore them when modified or deleted. If nil, they are not watched.
+	Bindings cache.Cache
+
+	// Scope is the set of namespaces KIM is granted access to: nothing is
+	// provisioned outside of it
+	Scope Scope
+
+	// Plan makes the reconciliation of every User report the actions it would
+	// perform in the User's status and Events instead of performing them.
+	// Users annotated with the PlanAnnotation are planned regardless.
+	Plan bool
 }
 
-//+kubebuilder:rbac:groups="",namespace=system,resources=serviceaccounts,verbs=create;update;delete;get;list;watch
-//+kubebuilder:rbac:groups="",namespace=system,resources=secrets,verbs=create;update;delete;get;list;watch
-//+kubebuilder:rbac:groups=kim.io,namespace=system,resources=users,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=kim.io,namespace=system,resources=users/status,verbs=get;update;patch
-//+kubebuilder:rbac:groups=kim.io,namespace=system,resources=users/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=create;update;patch;delete;get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=create;update;patch;delete;get;list;watch
+//+kubebuilder:rbac:groups=kim.io,resources=users,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=kim.io,resources=users/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=kim.io,resources=users/finalizers,verbs=update
+//+kubebuilder:rbac:groups=kim.io,resources=personalaccesstokens,verbs=get;list;watch;update
+//+kubebuilder:rbac:groups=kim.io,resources=accessgrants,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -55,9 +100,10 @@ type UserReconciler struct {
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
 func (r *UserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	l := log.FromContext(ctx).WithValues("namespace", req.Namespace, "user", req.Name)
+	ctx = withCorrelationID(ctx)
 
 	// fetch user
-	var u kimiov1alpha1.User
+	var u kimiov1beta1.User
 	if err := r.Get(ctx, req.NamespacedName, &u); err != nil {
 		if errors.IsNotFound(err) {
 			l.Info("user has been deleted")
@@ -66,116 +112,411 @@ func (r *UserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.
 		return ctrl.Result{}, err
 	}
 
-	// initialize the user
-	nu := u.IsNewUser()
-	if nu {
-		u.Status.InitialGeneration = &u.ObjectMeta.Generation
+	if r.Plan || isPlanned(&u) {
+		return r.plan(ctx, &u)
+	}
+	return r.enforce(ctx, &u)
+}
+
+// plan computes the actions the reconciliation of the User would perform and
+// reports them in its status and, when they change, in an Event. Nothing else
+// is written: the reconciliation runs against a planClient, without Events nor
+// audit records. Plans are not requeued, they are computed again when the User
+// or the objects provisioned for it change.
+func (r *UserReconciler) plan(ctx context.Context, u *kimiov1beta1.User) (ctrl.Result, error) {
+	c := newPlanClient(r.Client)
+	p := *r
+	p.Client = c
+	p.Recorder = discardRecorder{}
+	p.Auditor = nil
+	if _, err := p.enforce(ctx, u.DeepCopy()); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	observed := u.Status.DeepCopy()
+	u.Status.Plan = c.plan()
+	if !equality.Semantic.DeepEqual(observed.Plan, u.Status.Plan) {
+		r.Recorder.Event(u, corev1.EventTypeNormal, PlannedReason, planMessage(u.Status.Plan))
+	}
+	return ctrl.Result{}, r.patchStatus(ctx, u, observed)
+}
+
+// enforce reconciles the User, performing the actions it needs
+func (r *UserReconciler) enforce(ctx context.Context, u *kimiov1beta1.User) (ctrl.Result, error) {
+	l := log.FromContext(ctx).WithValues("namespace", u.Namespace, "user", u.Name)
+	observed := u.Status.DeepCopy()
+
+	// clean up what has been provisioned outside of the user's namespace
+	if !u.DeletionTimestamp.IsZero() {
+		l.Info("user is being deleted, finalizing")
+		return ctrl.Result{}, r.finalize(ctx, u)
+	}
+
+	// restore the user at the end of a temporary suspension or ban
+	requeueAfter, err := r.liftExpiredRestriction(ctx, u)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// suspend the user after a long inactivity
+	if err := r.observeTokenActivity(ctx, u); err != nil {
+		return ctrl.Result{}, err
+	}
+	d, err := r.suspendInactiveUser(ctx, u)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	requeueAfter = earliest(requeueAfter, d)
+
+	// initialize the user, recording the generation it was first observed at
+	// even if the reconciliation fails
+	if u.Status.InitialGeneration == nil {
+		g := u.Generation
+		u.Status.InitialGeneration = &g
+		if err := r.patchStatus(ctx, u, observed); err != nil {
+			return ctrl.Result{}, err
+		}
+		observed = u.Status.DeepCopy()
+	}
+
+	d, err = r.reconcile(ctx, u, observed)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: earliest(requeueAfter, d)}, nil
+}
+
+// patchStatus writes the changes made to the status of the User since it was
+// observed, if any. The merge patch only carries the changed fields, so it
+// doesn't conflict with the concurrent changes to other fields, e.g. the last
+// activity recorded by the self-service API. Lists, as the conditions and the
+// history, are replaced as a whole: only the User controller writes them.
+func (r *UserReconciler) patchStatus(ctx context.Context, u *kimiov1beta1.User, observed *kimiov1beta1.UserStatus) error {
+	if equality.Semantic.DeepEqual(observed, &u.Status) {
+		return nil
+	}
+
+	o := u.DeepCopy()
+	o.Status = *observed
+	return r.Status().Patch(ctx, u, client.MergeFrom(o))
+}
+
+// earliest returns the shortest of two requeue delays, where zero means no requeue
+func earliest(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// liftExpiredRestriction restores to Active the User whose temporary suspension
+// or ban ended. It returns the time left to the end of the restriction, if any.
+func (r *UserReconciler) liftExpiredRestriction(ctx context.Context, u *kimiov1beta1.User) (time.Duration, error) {
+	until := u.RestrictedUntil()
+	if until == nil {
+		return 0, nil
+	}
+	if d := time.Until(until.Time); d > 0 {
+		return d, nil
 	}
 
-	return ctrl.Result{}, r.reconcile(ctx, &u)
+	from := u.Spec.State
+	st := u.Status.DeepCopy()
+	u.Spec.State = kimiov1beta1.ActiveUserState
+	u.Spec.SuspendedUntil = nil
+	u.Spec.BannedUntil = nil
+	u.Spec.ReasonCode = ""
+	if u.Annotations == nil {
+		u.Annotations = map[string]string{}
+	}
+	u.Annotations[kimiov1beta1.UserStateChangeReasonAnnotation] = fmt.Sprintf("%s until %s", from, until.UTC().Format(time.RFC3339))
+	if err := r.Update(ctx, u); err != nil {
+		return 0, err
+	}
+	u.Status = *st
+
+	r.Recorder.Eventf(u, corev1.EventTypeNormal, "RestrictionLifted",
+		"User restored from state '%s' to '%s', the restriction ended at %s", from, u.Spec.State, until.UTC().Format(time.RFC3339))
+	return 0, nil
 }
 
-func (r *UserReconciler) reconcile(ctx context.Context, u *kimiov1alpha1.User) error {
+// reconcile provisions what the User needs in its state and updates its
+// status. It returns when to check again the credentials of the User, if
+// they are not issued yet.
+func (r *UserReconciler) reconcile(ctx context.Context, u *kimiov1beta1.User, observed *kimiov1beta1.UserStatus) (time.Duration, error) {
 	l := log.FromContext(ctx).WithValues("namespace", u.GetNamespace(), "user", u.GetName())
+	// the objects follow the state of the User, so the actions are attributed
+	// to who requested its last change of state
+	ctx = audit.WithRequester(ctx, u.LastStateChange().By)
 
 	switch u.Spec.State {
-	case kimiov1alpha1.WaitingForApprovalUserState:
+	case kimiov1beta1.WaitingForApprovalUserState:
 		// Nothing to do if user Is WaitingForApproval
 		l.Info("user needs to be approved, ensure ServiceAccount and Secret don't exist")
-		if err := r.ensureServiceAccountDoesntExist(ctx, u); err != nil {
+		if err := r.reportConflict(u, r.ensureServiceAccountDoesntExist(ctx, u), credentialsConflictReasons...); err != nil {
 			l.Error(err, "error ensuring ServiceAccount and Secret doen't exist")
-			return err
+			return 0, err
 		}
 
-	case kimiov1alpha1.ActiveUserState:
+	case kimiov1beta1.ActiveUserState:
 		l.Info("user is active, ensure ServiceAccount and Secret exist")
 		// Create the ServiceAccount and Secret if they don't exist
-		if err := r.ensureServiceAccountAndSecretExist(ctx, u); err != nil {
+		if err := r.reportConflict(u, r.ensureServiceAccountAndSecretExist(ctx, u), credentialsConflictReasons...); err != nil {
 			l.Error(err, "error ensuring ServiceAccount and Secret exist")
-			return err
+			return 0, err
 		}
 
-	case kimiov1alpha1.SuspendedUserState:
+	case kimiov1beta1.SuspendedUserState:
 		// Delete the ServiceAccount
 		l.Info("user is suspended, ensure ServiceAccount and Secret don't exist")
-		if err := r.ensureServiceAccountDoesntExist(ctx, u); err != nil {
+		if err := r.reportConflict(u, r.ensureServiceAccountDoesntExist(ctx, u), credentialsConflictReasons...); err != nil {
 			l.Error(err, "error ensuring ServiceAccount and Secret doen't exist")
-			return err
+			return 0, err
 		}
 
-	case kimiov1alpha1.BannedUserState:
+	case kimiov1beta1.BannedUserState:
 		// Delete the ServiceAccount
 		l.Info("user is banned, ensure ServiceAccount and Secret don't exist")
-		if err := r.ensureServiceAccountDoesntExist(ctx, u); err != nil {
+		if err := r.reportConflict(u, r.ensureServiceAccountDoesntExist(ctx, u), credentialsConflictReasons...); err != nil {
 			l.Error(err, "error ensuring ServiceAccount and Secret doen't exist")
-			return err
+			return 0, err
 		}
 	}
 
+	// the User is ready once the token controller issued its credentials
+	requeueAfter, err := r.reconcileCredentials(ctx, u)
+	if err != nil {
+		l.Error(err, "error reconciling credentials")
+		return 0, err
+	}
+
+	// Home namespace follows the User's state
+	var homeErr error
+	if r.HomeNamespace != nil {
+		homeErr = r.reconcileHomeNamespace(ctx, u)
+	}
+	if err := r.reportConflict(u, homeErr, HomeNamespaceNotOwnedReason); err != nil {
+		l.Error(err, "error reconciling home namespace")
+		return 0, err
+	}
+
+	// the conflicting objects are not watched
+	if meta.IsStatusConditionTrue(u.Status.Conditions, ConflictCondition) {
+		requeueAfter = earliest(requeueAfter, conflictRecheckInterval)
+	}
+
+	// AccessProfiles are granted only while the User is Active
+	if err := r.reconcileAccessProfiles(ctx, u); err != nil {
+		l.Error(err, "error reconciling access profiles")
+		return 0, err
+	}
+
+	// Quotas usage is reported in status
+	if err := r.reconcileQuotas(ctx, u); err != nil {
+		l.Error(err, "error computing quotas usage")
+		return 0, err
+	}
+
+	// PersonalAccessTokens are deleted together with their User
+	if err := r.ensurePersonalAccessTokensAreOwned(ctx, u); err != nil {
+		l.Error(err, "error ensuring PersonalAccessTokens are owned by the User")
+		return 0, err
+	}
+
+	var t *kimiov1beta1.UserStateTransition
+	if u.Status.State != u.Spec.State {
+		t = recordStateChange(u)
+	}
+
 	u.Status.State = u.Spec.State
-	return r.Status().Update(ctx, u)
+	u.Status.ObservedGeneration = u.Generation
+	u.Status.Plan = nil
+	if err := r.patchStatus(ctx, u, observed); err != nil {
+		return 0, err
+	}
+
+	// the change of state is reported once recorded, not at each failed attempt
+	if t != nil {
+		r.reportStateChange(ctx, u, *t)
+	}
+	return requeueAfter, nil
+}
+
+// recordStateChange records the change of state of the User in its history,
+// attributing it to who requested it, and returns the recorded transition
+func recordStateChange(u *kimiov1beta1.User) *kimiov1beta1.UserStateTransition {
+	c := u.LastStateChange()
+	// the reason code classifies the reason provided by the requester
+	if code := u.Spec.ReasonCode; code != "" {
+		if c.Reason == "" {
+			c.Reason = code
+		} else {
+			c.Reason = code + ": " + c.Reason
+		}
+	}
+	at := metav1.Now()
+	if c.At != nil {
+		at = *c.At
+	}
+	t := kimiov1beta1.UserStateTransition{
+		From:      u.Status.State,
+		To:        u.Spec.State,
+		Timestamp: at,
+		Reason:    c.Reason,
+		Actor:     c.By,
+	}
+	appendStateTransition(u, t)
+	return &t
 }
 
-func (r *UserReconciler) ensureServiceAccountDoesntExist(ctx context.Context, user *kimiov1alpha1.User) error {
-	sa := corev1.ServiceAccount{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace: user.Namespace,
-			Name:      user.Name,
-		},
+// reportStateChange reports the change of state of the User in its Events and
+// audit records
+func (r *UserReconciler) reportStateChange(ctx context.Context, u *kimiov1beta1.User, t kimiov1beta1.UserStateTransition) {
+	by := t.Actor
+	if by == "" {
+		by = "unknown"
+	}
+	msg := fmt.Sprintf("User moved from state '%s' to '%s' by '%s'", t.From, t.To, by)
+	if t.Reason != "" {
+		msg += ": " + t.Reason
 	}
+	r.Recorder.Event(u, corev1.EventTypeNormal, "StateChanged", msg)
 
-	if err := r.Delete(ctx, &sa); err != nil && !errors.IsNotFound(err) {
-		return err
+	if r.Auditor != nil {
+		r.Auditor.Log(ctx, audit.Record{
+			Actor:  t.Actor,
+			Action: audit.StateChangedAction,
+			Target: auditObject("User", u),
+			Old:    string(t.From),
+			New:    string(t.To),
+			Reason: t.Reason,
+		})
 	}
-	return nil
 }
 
-func (r *UserReconciler) ensureServiceAccountAndSecretExist(ctx context.Context, user *kimiov1alpha1.User) error {
-	sa := corev1.ServiceAccount{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace: user.Namespace,
-			Name:      user.Name,
-		},
+// appendStateTransition appends t to the User's history, dropping the oldest
+// transitions beyond kimiov1beta1.UserStateHistoryLimit
+func appendStateTransition(u *kimiov1beta1.User, t kimiov1beta1.UserStateTransition) {
+	h := append(u.Status.History, t)
+	if d := len(h) - kimiov1beta1.UserStateHistoryLimit; d > 0 {
+		h = append([]kimiov1beta1.UserStateTransition(nil), h[d:]...)
 	}
-	if err := r.Create(ctx, &sa); err != nil && !errors.IsAlreadyExists(err) {
+	u.Status.History = h
+}
+
+// finalize cleans up what has been provisioned for the User outside of its namespace
+func (r *UserReconciler) finalize(ctx context.Context, u *kimiov1beta1.User) error {
+	if err := r.finalizeAccessProfiles(ctx, u); err != nil {
 		return err
 	}
+	return r.finalizeHomeNamespace(ctx, u)
+}
 
-	// reload the ServiceAccount for kubernetes assigned fields (UID, etc..)
-	sat := types.NamespacedName{Namespace: sa.Namespace, Name: sa.Name}
-	if err := r.Get(ctx, sat, &sa); err != nil {
+func (r *UserReconciler) ensurePersonalAccessTokensAreOwned(ctx context.Context, user *kimiov1beta1.User) error {
+	var pp kimiov1beta1.PersonalAccessTokenList
+	if err := r.List(ctx, &pp,
+		client.InNamespace(user.Namespace),
+		client.MatchingFields{PersonalAccessTokenUserIndex: user.Name},
+	); err != nil {
 		return err
 	}
 
-	s := corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      user.Name,
-			Namespace: user.Namespace,
-			Annotations: map[string]string{
-				corev1.ServiceAccountNameKey: sa.Name,
-			},
-		},
-		Type: corev1.SecretTypeServiceAccountToken,
-	}
-	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, &s, func() error {
-		s.ObjectMeta.Annotations[corev1.ServiceAccountNameKey] = sa.Name
-		s.OwnerReferences = []metav1.OwnerReference{
-			{
-				APIVersion: "v1",
-				Kind:       "ServiceAccount",
-				Name:       sa.Name,
-				UID:        sa.UID,
-			},
+	for i := range pp.Items {
+		p := &pp.Items[i]
+		if isOwnedBy(p, user) {
+			continue
 		}
-		return nil
-	})
 
-	return err
+		if err := controllerutil.SetOwnerReference(user, p, r.Scheme); err != nil {
+			return err
+		}
+		if err := r.Update(ctx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isOwnedBy returns true if owner is among the owners of obj
+func isOwnedBy(obj, owner metav1.Object) bool {
+	for _, o := range obj.GetOwnerReferences() {
+		if o.UID == owner.GetUID() {
+			return true
+		}
+	}
+	return false
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *UserReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&kimiov1alpha1.User{}).
-		Complete(r)
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&kimiov1beta1.User{}).
+		Watches(
+			&source.Kind{Type: &corev1.ServiceAccount{}},
+			handler.EnqueueRequestsFromMapFunc(r.mapUserObjectToUser),
+		).
+		Watches(
+			&source.Kind{Type: &corev1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.mapUserObjectToUser),
+		).
+		Watches(
+			&source.Kind{Type: &kimiov1beta1.PersonalAccessToken{}},
+			handler.EnqueueRequestsFromMapFunc(mapPersonalAccessTokenToUser),
+		).
+		Watches(
+			&source.Kind{Type: &kimiov1beta1.AccessGrant{}},
+			handler.EnqueueRequestsFromMapFunc(mapAccessGrantToUser),
+		).
+		Watches(
+			&source.Kind{Type: &kimiov1beta1.AccessProfile{}},
+			handler.EnqueueRequestsFromMapFunc(r.mapAccessProfileToUsers),
+		)
+	if r.Bindings != nil {
+		b = b.Watches(
+			source.NewKindWithCache(&rbacv1.RoleBinding{}, r.Bindings),
+			handler.EnqueueRequestsFromMapFunc(mapBindingToUser),
+		)
+	}
+	return b.Complete(r)
+}
+
+// mapAccessGrantToUser enqueues the User an AccessGrant grants access to
+func mapAccessGrantToUser(o client.Object) []reconcile.Request {
+	g, ok := o.(*kimiov1beta1.AccessGrant)
+	if !ok || g.Spec.User.Name == "" {
+		return nil
+	}
+
+	return []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Namespace: g.Namespace, Name: g.Spec.User.Name}},
+	}
+}
+
+// mapAccessProfileToUsers enqueues all the Users referencing an AccessProfile
+func (r *UserReconciler) mapAccessProfileToUsers(o client.Object) []reconcile.Request {
+	var uu kimiov1beta1.UserList
+	if err := r.List(context.Background(), &uu,
+		client.MatchingFields{UserAccessProfileIndex: o.GetName()},
+	); err != nil {
+		log.Log.Error(err, "error listing users of access profile", "access-profile", o.GetName())
+		return nil
+	}
+
+	rr := make([]reconcile.Request, len(uu.Items))
+	for i, u := range uu.Items {
+		rr[i] = reconcile.Request{NamespacedName: types.NamespacedName{Namespace: u.Namespace, Name: u.Name}}
+	}
+	return rr
+}
+
+// mapPersonalAccessTokenToUser enqueues the User owning a PersonalAccessToken
+func mapPersonalAccessTokenToUser(o client.Object) []reconcile.Request {
+	p, ok := o.(*kimiov1beta1.PersonalAccessToken)
+	if !ok || p.Spec.User.Name == "" {
+		return nil
+	}
+
+	return []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Namespace: p.Namespace, Name: p.Spec.User.Name}},
+	}
 }
@@ -0,0 +1,256 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+func newUserReconciler() *UserReconciler {
+	return &UserReconciler{
+		Client:   k8sClient,
+		Scheme:   scheme.Scheme,
+		Recorder: record.NewFakeRecorder(100),
+	}
+}
+
+func newUser(namespace string, state kimiov1beta1.UserState) *kimiov1beta1.User {
+	return &kimiov1beta1.User{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "alice"},
+		Spec:       kimiov1beta1.UserSpec{Email: "alice@kim.io", Username: "alice", State: state},
+	}
+}
+
+// reconcileUser reconciles the User and returns it
+func reconcileUser(ctx context.Context, r *UserReconciler, key types.NamespacedName) *kimiov1beta1.User {
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+	var u kimiov1beta1.User
+	ExpectWithOffset(1, k8sClient.Get(ctx, key, &u)).To(Succeed())
+	return &u
+}
+
+func setUserState(ctx context.Context, key types.NamespacedName, state kimiov1beta1.UserState) {
+	var u kimiov1beta1.User
+	ExpectWithOffset(1, k8sClient.Get(ctx, key, &u)).To(Succeed())
+	u.Spec.State = state
+	ExpectWithOffset(1, k8sClient.Update(ctx, &u)).To(Succeed())
+}
+
+var _ = Describe("UserReconciler", func() {
+	var (
+		ctx    context.Context
+		tenant string
+		key    types.NamespacedName
+		r      *UserReconciler
+	)
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+		tenant = createNamespace(ctx)
+		key = types.NamespacedName{Namespace: tenant, Name: "alice"}
+		r = newUserReconciler()
+	})
+
+	It("records the state transitions in the history", func() {
+		create(ctx, newUser(tenant, kimiov1beta1.WaitingForApprovalUserState))
+		reconcileUser(ctx, r, key)
+
+		u := reconcileUser(ctx, r, key)
+		u.Annotations = map[string]string{
+			kimiov1beta1.UserStateChangedByAnnotation:    "admin",
+			kimiov1beta1.UserStateChangedAtAnnotation:    "2023-05-04T10:00:00Z",
+			kimiov1beta1.UserStateChangeReasonAnnotation: "approved",
+		}
+		u.Spec.State = kimiov1beta1.ActiveUserState
+		Expect(k8sClient.Update(ctx, u)).To(Succeed())
+		u = reconcileUser(ctx, r, key)
+
+		h := u.Status.History
+		Expect(h).To(HaveLen(2))
+		Expect(h[0].From).To(BeEmpty())
+		Expect(h[0].To).To(Equal(kimiov1beta1.WaitingForApprovalUserState))
+		Expect(h[1].From).To(Equal(kimiov1beta1.WaitingForApprovalUserState))
+		Expect(h[1].To).To(Equal(kimiov1beta1.ActiveUserState))
+		Expect(h[1].Actor).To(Equal("admin"))
+		Expect(h[1].Reason).To(Equal("approved"))
+		Expect(h[1].Timestamp.UTC().Format(time.RFC3339)).To(Equal("2023-05-04T10:00:00Z"))
+	})
+
+	for _, state := range []kimiov1beta1.UserState{kimiov1beta1.SuspendedUserState, kimiov1beta1.BannedUserState} {
+		state := state
+
+		It("lifts a temporary restriction when the User is "+string(state), func() {
+			u := newUser(tenant, state)
+			u.Spec.ReasonCode = "PolicyViolation"
+			until := metav1.NewTime(time.Now().Add(time.Hour))
+			u.Spec.SuspendedUntil, u.Spec.BannedUntil = &until, &until
+			create(ctx, u)
+
+			res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.RequeueAfter).To(BeNumerically(">", 59*time.Minute), "requeue at the end of the restriction")
+			Expect(res.RequeueAfter).To(BeNumerically("<=", time.Hour), "requeue at the end of the restriction")
+			Expect(k8sClient.Get(ctx, key, u)).To(Succeed())
+			Expect(u.Status.State).To(Equal(state))
+			Expect(u.Status.History[0].Reason).To(Equal("PolicyViolation"))
+
+			// the restriction ends
+			until = metav1.NewTime(time.Now().Add(-time.Second))
+			u.Spec.SuspendedUntil, u.Spec.BannedUntil = &until, &until
+			Expect(k8sClient.Update(ctx, u)).To(Succeed())
+			u = reconcileUser(ctx, r, key)
+			Expect(u.Spec.State).To(Equal(kimiov1beta1.ActiveUserState))
+			Expect(u.Status.State).To(Equal(kimiov1beta1.ActiveUserState))
+			Expect(u.Spec.SuspendedUntil).To(BeNil())
+			Expect(u.Spec.BannedUntil).To(BeNil())
+			Expect(u.Spec.ReasonCode).To(BeEmpty())
+			Expect(exists(ctx, key, &corev1.ServiceAccount{})).To(BeTrue(), "expected the ServiceAccount to be provisioned")
+			Expect(u.Status.History).To(HaveLen(2))
+			Expect(u.Status.History[1].From).To(Equal(state))
+			Expect(u.Status.History[1].To).To(Equal(kimiov1beta1.ActiveUserState))
+		})
+	}
+
+	It("does not write an unchanged status", func() {
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+		u := reconcileUser(ctx, r, key)
+		Expect(u.Status.InitialGeneration).NotTo(BeNil())
+		Expect(u.Status.State).To(Equal(kimiov1beta1.ActiveUserState))
+
+		rv := u.ResourceVersion
+		u = reconcileUser(ctx, r, key)
+		Expect(u.ResourceVersion).To(Equal(rv))
+	})
+
+	It("patches the status despite concurrent changes", func() {
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+		rc := &racingClient{Client: r.Client}
+		r.Client = rc
+
+		u := reconcileUser(ctx, r, key)
+		Expect(rc.raced).To(BeTrue(), "expected the User to be changed concurrently")
+		Expect(u.Status.State).To(Equal(kimiov1beta1.ActiveUserState))
+		Expect(u.Status.LastActivity).NotTo(BeNil())
+	})
+
+	It("reports the change of state only once recorded", func() {
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+		a := &recordingAuditor{}
+		rec := record.NewFakeRecorder(100)
+		r.Auditor, r.Recorder = a, rec
+		r.Client = &failingStatusClient{Client: k8sClient}
+
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).To(HaveOccurred())
+		Expect(a.actions()).NotTo(ContainElement("StateChanged User"))
+		Expect(rec.Events).NotTo(Receive(ContainSubstring("StateChanged")))
+
+		By("reporting it once the status is patched")
+		r.Client = k8sClient
+		reconcileUser(ctx, r, key)
+		Expect(a.actions()).To(ContainElement("StateChanged User"))
+	})
+
+	It("records the initial generation when the reconciliation fails", func() {
+		// failing to record the state fails the reconciliation
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+		r.Client = &failingStatusClient{Client: k8sClient}
+
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).To(HaveOccurred())
+		var u kimiov1beta1.User
+		Expect(k8sClient.Get(ctx, key, &u)).To(Succeed())
+		Expect(u.Status.InitialGeneration).NotTo(BeNil())
+		Expect(u.Status.State).To(BeEmpty())
+	})
+})
+
+// racingClient records the activity of the User right after the reconciler
+// fetched it, as the self-service API does
+type racingClient struct {
+	client.Client
+	raced bool
+}
+
+func (c *racingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if err := c.Client.Get(ctx, key, obj, opts...); err != nil {
+		return err
+	}
+	u, ok := obj.(*kimiov1beta1.User)
+	if !ok || c.raced {
+		return nil
+	}
+	c.raced = true
+
+	p := u.DeepCopy()
+	p.Status.LastActivity = &metav1.Time{Time: time.Now().Truncate(time.Second)}
+	return c.Client.Status().Patch(ctx, p, client.MergeFrom(u))
+}
+
+// failingStatusClient fails the patches of the status recording the state of a User
+type failingStatusClient struct {
+	client.Client
+}
+
+func (c *failingStatusClient) Status() client.SubResourceWriter {
+	return failingStatusWriter{SubResourceWriter: c.Client.Status()}
+}
+
+type failingStatusWriter struct {
+	client.SubResourceWriter
+}
+
+func (w failingStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.SubResourcePatchOption) error {
+	if u, ok := obj.(*kimiov1beta1.User); ok && u.Status.State != "" {
+		return errors.New("status patch failed")
+	}
+	return w.SubResourceWriter.Patch(ctx, obj, patch, opts...)
+}
+
+func TestStateHistoryIsCapped(t *testing.T) {
+	u := newUser("tenant", kimiov1beta1.ActiveUserState)
+	for i := 0; i < kimiov1beta1.UserStateHistoryLimit+3; i++ {
+		appendStateTransition(u, kimiov1beta1.UserStateTransition{Reason: strconv.Itoa(i)})
+	}
+
+	h := u.Status.History
+	if len(h) != kimiov1beta1.UserStateHistoryLimit {
+		t.Fatalf("expected %d transitions, got %d", kimiov1beta1.UserStateHistoryLimit, len(h))
+	}
+	if h[0].Reason != "3" || h[len(h)-1].Reason != strconv.Itoa(kimiov1beta1.UserStateHistoryLimit+2) {
+		t.Fatalf("expected oldest transitions to be dropped, got %+v", h)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+const (
+	// ReadyCondition is True when the User is Active and its credentials are issued
+	ReadyCondition = "Ready"
+	// CredentialsIssuedReason reports the credentials of the User are issued
+	CredentialsIssuedReason = "CredentialsIssued"
+	// CredentialsPendingReason reports the token controller did not populate the User's Secret yet
+	CredentialsPendingReason = "CredentialsPending"
+	// NotActiveReason reports the User is not Active, so it has no credentials
+	NotActiveReason = "NotActive"
+
+	// credentialsMinBackoff and credentialsMaxBackoff bound the wait between
+	// two checks of the credentials not issued yet
+	credentialsMinBackoff = time.Second
+	credentialsMaxBackoff = 5 * time.Minute
+)
+
+// reconcileCredentials references in the status the Secret holding the
+// credentials of the Active User, once the token controller populated it with
+// the token and the CA certificate, and reports whether the User is ready.
+// While the credentials are not issued, it returns when to check them again.
+func (r *UserReconciler) reconcileCredentials(ctx context.Context, u *kimiov1beta1.User) (time.Duration, error) {
+	ready := metav1.Condition{
+		Type:               ReadyCondition,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: u.Generation,
+	}
+	defer func() { meta.SetStatusCondition(&u.Status.Conditions, ready) }()
+
+	switch {
+	case u.Spec.State != kimiov1beta1.ActiveUserState:
+		u.Status.CredentialsSecretRef = nil
+		ready.Reason = NotActiveReason
+		ready.Message = fmt.Sprintf("User is %s", u.Spec.State)
+		return 0, nil
+
+	case hasCredentialsConflict(u):
+		u.Status.CredentialsSecretRef = nil
+		ready.Reason = ConflictCondition
+		ready.Message = "The credentials of the User are not managed by KIM"
+		return 0, nil
+	}
+
+	k, err := r.serviceAccountKey(u)
+	if err != nil {
+		return 0, err
+	}
+	var s corev1.Secret
+	if err := r.Get(ctx, k, &s); err != nil && !errors.IsNotFound(err) {
+		return 0, err
+	}
+	if len(s.Data[corev1.ServiceAccountTokenKey]) == 0 || len(s.Data[corev1.ServiceAccountRootCAKey]) == 0 {
+		u.Status.CredentialsSecretRef = nil
+		ready.Reason = CredentialsPendingReason
+		ready.Message = fmt.Sprintf("Waiting for the token and CA certificate to be populated in Secret %s", k.Name)
+		return credentialsBackoff(&s), nil
+	}
+
+	if u.Status.CredentialsSecretRef == nil {
+		r.Recorder.Eventf(u, corev1.EventTypeNormal, CredentialsIssuedReason, "Credentials issued in Secret '%s'", s.Name)
+	}
+	u.Status.CredentialsSecretRef = &corev1.LocalObjectReference{Name: s.Name}
+	ready.Status = metav1.ConditionTrue
+	ready.Reason = CredentialsIssuedReason
+	ready.Message = fmt.Sprintf("Credentials issued in Secret %s", s.Name)
+	return 0, nil
+}
+
+// credentialsBackoff returns when to check again the credentials in the
+// Secret. The wait doubles at each check, as it is as long as the Secret's age.
+func credentialsBackoff(s *corev1.Secret) time.Duration {
+	d := time.Since(s.CreationTimestamp.Time)
+	switch {
+	case s.CreationTimestamp.IsZero() || d < credentialsMinBackoff:
+		return credentialsMinBackoff
+	case d > credentialsMaxBackoff:
+		return credentialsMaxBackoff
+	default:
+		return d
+	}
+}
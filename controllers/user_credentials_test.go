@@ -0,0 +1,99 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+// issueCredentials populates the token Secret as the token controller would
+func issueCredentials(ctx context.Context, key types.NamespacedName) {
+	var s corev1.Secret
+	ExpectWithOffset(1, k8sClient.Get(ctx, key, &s)).To(Succeed())
+	s.Data = map[string][]byte{
+		corev1.ServiceAccountTokenKey:  []byte("token"),
+		corev1.ServiceAccountRootCAKey: []byte("ca"),
+	}
+	ExpectWithOffset(1, k8sClient.Update(ctx, &s)).To(Succeed())
+}
+
+var _ = Describe("Credentials", func() {
+	var (
+		ctx    context.Context
+		tenant string
+		key    types.NamespacedName
+		r      *UserReconciler
+	)
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+		tenant = createNamespace(ctx)
+		key = types.NamespacedName{Namespace: tenant, Name: "alice"}
+		r = newUserReconciler()
+	})
+
+	It("keep the User not Ready until they are issued", func() {
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+
+		res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		var u kimiov1beta1.User
+		Expect(k8sClient.Get(ctx, key, &u)).To(Succeed())
+		c := meta.FindStatusCondition(u.Status.Conditions, ReadyCondition)
+		Expect(c).NotTo(BeNil())
+		Expect(c.Status).To(Equal(metav1.ConditionFalse))
+		Expect(c.Reason).To(Equal(CredentialsPendingReason))
+		Expect(u.Status.CredentialsSecretRef).To(BeNil())
+		Expect(res.RequeueAfter).To(BeNumerically(">=", credentialsMinBackoff), "expected the credentials to be checked again")
+		Expect(res.RequeueAfter).To(BeNumerically("<=", credentialsMaxBackoff), "expected the credentials to be checked again")
+
+		issueCredentials(ctx, key)
+		res, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(k8sClient.Get(ctx, key, &u)).To(Succeed())
+		Expect(meta.IsStatusConditionTrue(u.Status.Conditions, ReadyCondition)).To(BeTrue())
+		Expect(u.Status.CredentialsSecretRef).NotTo(BeNil())
+		Expect(u.Status.CredentialsSecretRef.Name).To(Equal("alice"))
+		Expect(res.RequeueAfter).To(BeZero())
+	})
+
+	It("are not referenced while the User is Suspended", func() {
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+		reconcileUser(ctx, r, key)
+		issueCredentials(ctx, key)
+		Expect(reconcileUser(ctx, r, key).Status.CredentialsSecretRef).NotTo(BeNil())
+
+		setUserState(ctx, key, kimiov1beta1.SuspendedUserState)
+		u := reconcileUser(ctx, r, key)
+		c := meta.FindStatusCondition(u.Status.Conditions, ReadyCondition)
+		Expect(c).NotTo(BeNil())
+		Expect(c.Status).To(Equal(metav1.ConditionFalse))
+		Expect(c.Reason).To(Equal(NotActiveReason))
+		Expect(u.Status.CredentialsSecretRef).To(BeNil())
+	})
+})
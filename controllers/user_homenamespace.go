@@ -0,0 +1,343 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/pkg/audit"
+)
+
+type HomeNamespaceRetentionPolicy string
+
+const (
+	// RetainHomeNamespaceRetentionPolicy revokes the User's access to the home namespace on suspension or ban
+	RetainHomeNamespaceRetentionPolicy HomeNamespaceRetentionPolicy = "Retain"
+	// DeleteHomeNamespaceRetentionPolicy deletes the home namespace on suspension or ban
+	DeleteHomeNamespaceRetentionPolicy HomeNamespaceRetentionPolicy = "Delete"
+
+	// HomeNamespaceFinalizer ensures the home namespace is cleaned up when the User is deleted
+	HomeNamespaceFinalizer = "kim.io/home-namespace"
+
+	homeNamespaceObjectsName = "kim-home"
+)
+
+// HomeNamespaceConfig configures the provisioning of Users' home namespaces
+type HomeNamespaceConfig struct {
+	// NameTemplate is executed with the User to build the name of the home namespace
+	NameTemplate *template.Template
+	// ClusterRole is granted to the User in the home namespace
+	ClusterRole string
+	// ResourceQuota, if set, is applied to the home namespace
+	ResourceQuota *corev1.ResourceQuotaSpec
+	// LimitRange, if set, is applied to the home namespace
+	LimitRange *corev1.LimitRangeSpec
+	// RetentionPolicy defines what happens to the home namespace on suspension or ban
+	RetentionPolicy HomeNamespaceRetentionPolicy
+}
+
+// NewHomeNamespaceConfig builds a HomeNamespaceConfig. The resourcesFile, if
+// not empty, is a YAML file containing a ResourceQuota and/or a LimitRange
+// whose specs are applied to every home namespace.
+func NewHomeNamespaceConfig(nameTemplate, clusterRole, resourcesFile string, retentionPolicy HomeNamespaceRetentionPolicy) (*HomeNamespaceConfig, error) {
+	t, err := template.New("home-namespace").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid home namespace name template: %w", err)
+	}
+
+	switch retentionPolicy {
+	case RetainHomeNamespaceRetentionPolicy, DeleteHomeNamespaceRetentionPolicy:
+	default:
+		return nil, fmt.Errorf("invalid home namespace retention policy %q, expected one of %s, %s",
+			retentionPolicy, RetainHomeNamespaceRetentionPolicy, DeleteHomeNamespaceRetentionPolicy)
+	}
+
+	if clusterRole == "" {
+		return nil, fmt.Errorf("home namespace cluster role can not be empty")
+	}
+
+	c := HomeNamespaceConfig{
+		NameTemplate:    t,
+		ClusterRole:     clusterRole,
+		RetentionPolicy: retentionPolicy,
+	}
+	if resourcesFile != "" {
+		if err := c.loadResources(resourcesFile); err != nil {
+			return nil, fmt.Errorf("error loading home namespace resources from %s: %w", resourcesFile, err)
+		}
+	}
+	return &c, nil
+}
+
+func (c *HomeNamespaceConfig) loadResources(file string) error {
+	d, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range strings.Split(string(d), "\n---") {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+
+		var tm metav1.TypeMeta
+		if err := yaml.Unmarshal([]byte(doc), &tm); err != nil {
+			return err
+		}
+
+		switch tm.Kind {
+		case "ResourceQuota":
+			var rq corev1.ResourceQuota
+			if err := yaml.UnmarshalStrict([]byte(doc), &rq); err != nil {
+				return err
+			}
+			c.ResourceQuota = &rq.Spec
+		case "LimitRange":
+			var lr corev1.LimitRange
+			if err := yaml.UnmarshalStrict([]byte(doc), &lr); err != nil {
+				return err
+			}
+			c.LimitRange = &lr.Spec
+		default:
+			return fmt.Errorf("unsupported kind %q, expected ResourceQuota or LimitRange", tm.Kind)
+		}
+	}
+	return nil
+}
+
+// NamespaceName returns the name of the home namespace of the User
+func (c *HomeNamespaceConfig) NamespaceName(u *kimiov1beta1.User) (string, error) {
+	var b bytes.Buffer
+	if err := c.NameTemplate.Execute(&b, templateData(u)); err != nil {
+		return "", err
+	}
+
+	n := b.String()
+	if ee := validation.IsDNS1123Label(n); len(ee) > 0 {
+		return "", fmt.Errorf("invalid home namespace name %q: %s", n, strings.Join(ee, ", "))
+	}
+	return n, nil
+}
+
+// templateData returns the fields of the User the name templates are executed with
+func templateData(u *kimiov1beta1.User) interface{} {
+	return struct {
+		Name      string
+		Namespace string
+		Username  string
+	}{
+		Name:      u.Name,
+		Namespace: u.Namespace,
+		Username:  u.Spec.Username,
+	}
+}
+
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=resourcequotas;limitranges,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles,verbs=bind
+
+// reconcileHomeNamespace aligns the home namespace to the state of the User
+func (r *UserReconciler) reconcileHomeNamespace(ctx context.Context, u *kimiov1beta1.User) error {
+	l := log.FromContext(ctx).WithValues("namespace", u.GetNamespace(), "user", u.GetName())
+
+	if u.Spec.State == kimiov1beta1.ActiveUserState {
+		l.Info("user is active, ensure home namespace exists")
+		return r.ensureHomeNamespaceExists(ctx, u)
+	}
+
+	if u.Status.HomeNamespace == "" {
+		return nil
+	}
+
+	switch r.HomeNamespace.RetentionPolicy {
+	case DeleteHomeNamespaceRetentionPolicy:
+		l.Info("user is not active, ensure home namespace doesn't exist", "home-namespace", u.Status.HomeNamespace)
+		if err := r.ensureHomeNamespaceDoesntExist(ctx, u); err != nil {
+			return err
+		}
+		u.Status.HomeNamespace = ""
+		return nil
+
+	default:
+		l.Info("user is not active, ensure access to home namespace is revoked", "home-namespace", u.Status.HomeNamespace)
+		return r.ensureHomeNamespaceAccessIsRevoked(ctx, u)
+	}
+}
+
+// finalizeHomeNamespace cleans up the home namespace of a deleted User
+func (r *UserReconciler) finalizeHomeNamespace(ctx context.Context, u *kimiov1beta1.User) error {
+	if u.Status.HomeNamespace != "" {
+		if r.HomeNamespace != nil && r.HomeNamespace.RetentionPolicy == DeleteHomeNamespaceRetentionPolicy {
+			if err := r.ensureHomeNamespaceDoesntExist(ctx, u); err != nil {
+				return err
+			}
+		} else if err := r.ensureHomeNamespaceAccessIsRevoked(ctx, u); err != nil {
+			return err
+		}
+	}
+
+	return r.updateFinalizers(ctx, u, func() bool {
+		return controllerutil.RemoveFinalizer(u, HomeNamespaceFinalizer)
+	})
+}
+
+func (r *UserReconciler) ensureHomeNamespaceExists(ctx context.Context, u *kimiov1beta1.User) error {
+	n, err := r.HomeNamespace.NamespaceName(u)
+	if err != nil {
+		return err
+	}
+
+	// the finalizer is added before provisioning anything outside the User's namespace
+	if err := r.updateFinalizers(ctx, u, func() bool {
+		return controllerutil.AddFinalizer(u, HomeNamespaceFinalizer)
+	}); err != nil {
+		return err
+	}
+
+	ns := corev1.Namespace{}
+	switch err := r.Get(ctx, types.NamespacedName{Name: n}, &ns); {
+	case errors.IsNotFound(err):
+		c, err := CountNamespaces(ctx, r.Client, types.NamespacedName{Namespace: u.Namespace, Name: u.Name})
+		if err != nil {
+			return err
+		}
+		if QuotaExceeded(c, r.Quotas.Namespaces) {
+			r.Recorder.Eventf(u, corev1.EventTypeWarning, "QuotaExceeded",
+				"Home namespace '%s' not provisioned, quota of %d namespaces exceeded", n, r.Quotas.Namespaces)
+			return nil
+		}
+
+		ns = corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   n,
+				Labels: userLabels(u.Namespace, u.Name),
+			},
+		}
+		if err := apply(ctx, r.Client, &ns); err != nil {
+			return err
+		}
+		r.Recorder.Eventf(u, corev1.EventTypeNormal, "HomeNamespaceCreated", "Home namespace '%s' created", n)
+		auditLog(ctx, r.Auditor, audit.CreatedAction, auditObject("Namespace", &ns), "", "", "HomeNamespace")
+	case err != nil:
+		return err
+	case ns.Labels[UserNameLabel] != u.Name || ns.Labels[UserNamespaceLabel] != u.Namespace:
+		return &conflictError{reason: HomeNamespaceNotOwnedReason, kind: "Namespace", key: types.NamespacedName{Name: n}}
+	}
+	u.Status.HomeNamespace = n
+
+	if q := r.HomeNamespace.ResourceQuota; q != nil {
+		rq := corev1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{Namespace: n, Name: homeNamespaceObjectsName, Labels: userLabels(u.Namespace, u.Name)},
+			Spec:       *q.DeepCopy(),
+		}
+		if err := apply(ctx, r.Client, &rq); err != nil {
+			return err
+		}
+	}
+
+	if lr := r.HomeNamespace.LimitRange; lr != nil {
+		l := corev1.LimitRange{
+			ObjectMeta: metav1.ObjectMeta{Namespace: n, Name: homeNamespaceObjectsName, Labels: userLabels(u.Namespace, u.Name)},
+			Spec:       *lr.DeepCopy(),
+		}
+		if err := apply(ctx, r.Client, &l); err != nil {
+			return err
+		}
+	}
+
+	sub, err := r.ServiceAccount.Subject(u)
+	if err != nil {
+		return err
+	}
+	rb := rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Namespace: n, Name: homeNamespaceObjectsName, Labels: userLabels(u.Namespace, u.Name)},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     r.HomeNamespace.ClusterRole,
+		},
+		Subjects: []rbacv1.Subject{sub},
+	}
+	return apply(ctx, r.Client, &rb)
+}
+
+func (r *UserReconciler) ensureHomeNamespaceAccessIsRevoked(ctx context.Context, u *kimiov1beta1.User) error {
+	rb := rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: u.Status.HomeNamespace,
+			Name:      homeNamespaceObjectsName,
+		},
+	}
+
+	if err := r.Delete(ctx, &rb); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (r *UserReconciler) ensureHomeNamespaceDoesntExist(ctx context.Context, u *kimiov1beta1.User) error {
+	var ns corev1.Namespace
+	if err := r.Get(ctx, types.NamespacedName{Name: u.Status.HomeNamespace}, &ns); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	// never delete a namespace not provisioned for the User
+	if ns.Labels[UserNameLabel] != u.Name || ns.Labels[UserNamespaceLabel] != u.Namespace {
+		return nil
+	}
+
+	if err := r.Delete(ctx, &ns); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	r.Recorder.Eventf(u, corev1.EventTypeNormal, "HomeNamespaceDeleted", "Home namespace '%s' deleted", ns.Name)
+	auditLog(ctx, r.Auditor, audit.DeletedAction, auditObject("Namespace", &ns), "", "", "HomeNamespace")
+	return nil
+}
+
+// updateFinalizers applies the changes performed by mutate to the User's
+// finalizers, preserving the in-memory status of the User
+func (r *UserReconciler) updateFinalizers(ctx context.Context, u *kimiov1beta1.User, mutate func() bool) error {
+	o := u.DeepCopy()
+	if !mutate() {
+		return nil
+	}
+
+	st := u.Status.DeepCopy()
+	if err := r.Patch(ctx, u, client.MergeFrom(o)); err != nil {
+		return err
+	}
+	u.Status = *st
+	return nil
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+const homeNamespaceResources = `apiVersion: v1
+kind: ResourceQuota
+metadata:
+  name: quota
+spec:
+  hard:
+    pods: "10"
+---
+apiVersion: v1
+kind: LimitRange
+metadata:
+  name: limits
+spec:
+  limits:
+  - type: Container
+    default:
+      cpu: 500m
+`
+
+// newHomeNamespaceUserReconciler returns a UserReconciler provisioning the
+// home-<namespace>-<name> home namespace
+func newHomeNamespaceUserReconciler(policy HomeNamespaceRetentionPolicy) *UserReconciler {
+	f := filepath.Join(GinkgoT().TempDir(), "resources.yaml")
+	ExpectWithOffset(1, os.WriteFile(f, []byte(homeNamespaceResources), 0o600)).To(Succeed())
+	c, err := NewHomeNamespaceConfig("home-{{ .Namespace }}-{{ .Name }}", "admin", f, policy)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+	r := newUserReconciler()
+	r.HomeNamespace = c
+	return r
+}
+
+var _ = Describe("Home namespace", func() {
+	var (
+		ctx    context.Context
+		tenant string
+		home   string
+		key    types.NamespacedName
+	)
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+		tenant = createNamespace(ctx)
+		home = "home-" + tenant + "-alice"
+		key = types.NamespacedName{Namespace: tenant, Name: "alice"}
+	})
+
+	It("is provisioned", func() {
+		r := newHomeNamespaceUserReconciler(RetainHomeNamespaceRetentionPolicy)
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+
+		u := reconcileUser(ctx, r, key)
+		Expect(u.Status.HomeNamespace).To(Equal(home))
+		Expect(u.Finalizers).To(ContainElement(HomeNamespaceFinalizer))
+
+		var ns corev1.Namespace
+		Expect(exists(ctx, types.NamespacedName{Name: home}, &ns)).To(BeTrue(), "expected the home namespace to exist")
+		Expect(ns.Labels).To(HaveKeyWithValue(UserNameLabel, "alice"))
+		Expect(ns.Labels).To(HaveKeyWithValue(UserNamespaceLabel, tenant))
+
+		k := types.NamespacedName{Namespace: home, Name: homeNamespaceObjectsName}
+		var rb rbacv1.RoleBinding
+		Expect(exists(ctx, k, &rb)).To(BeTrue(), "expected the RoleBinding to exist")
+		Expect(rb.RoleRef.Name).To(Equal("admin"))
+		Expect(rb.Subjects).To(HaveLen(1))
+		Expect(rb.Subjects[0].Namespace).To(Equal(tenant))
+		Expect(rb.Subjects[0].Name).To(Equal("alice"))
+
+		var rq corev1.ResourceQuota
+		Expect(exists(ctx, k, &rq)).To(BeTrue(), "expected the ResourceQuota to exist")
+		q := rq.Spec.Hard[corev1.ResourcePods]
+		Expect(q.String()).To(Equal("10"))
+		Expect(exists(ctx, k, &corev1.LimitRange{})).To(BeTrue(), "expected the LimitRange to exist")
+	})
+
+	It("is not adopted, the conflict is reported", func() {
+		r := newHomeNamespaceUserReconciler(DeleteHomeNamespaceRetentionPolicy)
+		rec := record.NewFakeRecorder(100)
+		r.Recorder = rec
+		create(ctx,
+			newUser(tenant, kimiov1beta1.ActiveUserState),
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: home}},
+		)
+
+		res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.RequeueAfter).To(BeNumerically("<=", conflictRecheckInterval))
+		var u kimiov1beta1.User
+		Expect(k8sClient.Get(ctx, key, &u)).To(Succeed())
+		Expect(u.Status.HomeNamespace).To(BeEmpty())
+		c := meta.FindStatusCondition(u.Status.Conditions, ConflictCondition)
+		Expect(c).NotTo(BeNil())
+		Expect(c.Status).To(Equal(metav1.ConditionTrue))
+		Expect(c.Reason).To(Equal(HomeNamespaceNotOwnedReason))
+		Expect(rec.Events).To(Receive(ContainSubstring("Conflict")))
+
+		var ns corev1.Namespace
+		Expect(exists(ctx, types.NamespacedName{Name: home}, &ns)).To(BeTrue())
+		Expect(ns.Labels).NotTo(HaveKey(UserNameLabel), "expected the Namespace to be left untouched")
+
+		By("reporting the conflict once")
+		reconcileUser(ctx, r, key)
+		Expect(rec.Events).NotTo(Receive(ContainSubstring("Conflict")))
+
+		By("provisioning the home namespace once labelled for the User")
+		ns.Labels = userLabels(tenant, "alice")
+		Expect(k8sClient.Update(ctx, &ns)).To(Succeed())
+		u = *reconcileUser(ctx, r, key)
+		Expect(u.Status.HomeNamespace).To(Equal(home))
+		Expect(meta.FindStatusCondition(u.Status.Conditions, ConflictCondition)).To(BeNil())
+	})
+
+	for _, state := range []kimiov1beta1.UserState{kimiov1beta1.SuspendedUserState, kimiov1beta1.BannedUserState} {
+		state := state
+
+		It("is retained with the Retain policy when the User is "+string(state), func() {
+			r := newHomeNamespaceUserReconciler(RetainHomeNamespaceRetentionPolicy)
+			create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+			reconcileUser(ctx, r, key)
+
+			setUserState(ctx, key, state)
+			u := reconcileUser(ctx, r, key)
+			Expect(u.Status.HomeNamespace).To(Equal(home))
+			Expect(exists(ctx, types.NamespacedName{Name: home}, &corev1.Namespace{})).To(BeTrue(), "expected the home namespace to be retained")
+			k := types.NamespacedName{Namespace: home, Name: homeNamespaceObjectsName}
+			Expect(exists(ctx, k, &rbacv1.RoleBinding{})).To(BeFalse(), "expected the access to the home namespace to be revoked")
+
+			setUserState(ctx, key, kimiov1beta1.ActiveUserState)
+			reconcileUser(ctx, r, key)
+			Expect(exists(ctx, k, &rbacv1.RoleBinding{})).To(BeTrue(), "expected the access to the home namespace to be restored")
+		})
+
+		It("is deleted with the Delete policy when the User is "+string(state), func() {
+			r := newHomeNamespaceUserReconciler(DeleteHomeNamespaceRetentionPolicy)
+			create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+			reconcileUser(ctx, r, key)
+
+			setUserState(ctx, key, state)
+			u := reconcileUser(ctx, r, key)
+			Expect(u.Status.HomeNamespace).To(BeEmpty())
+			Expect(exists(ctx, types.NamespacedName{Name: home}, &corev1.Namespace{})).To(BeFalse(), "expected the home namespace to be deleted")
+		})
+	}
+
+	It("is deleted together with the User", func() {
+		r := newHomeNamespaceUserReconciler(DeleteHomeNamespaceRetentionPolicy)
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+		u := reconcileUser(ctx, r, key)
+
+		Expect(k8sClient.Delete(ctx, u)).To(Succeed())
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(exists(ctx, types.NamespacedName{Name: home}, &corev1.Namespace{})).To(BeFalse(), "expected the home namespace to be deleted")
+		Expect(exists(ctx, key, &kimiov1beta1.User{})).To(BeFalse(), "expected the User to be deleted")
+	})
+
+})
+
+func TestNewHomeNamespaceConfig(t *testing.T) {
+	if _, err := NewHomeNamespaceConfig("home-{{ .Name }}", "admin", "", "Forget"); err == nil {
+		t.Fatal("expected invalid retention policy to be refused")
+	}
+	if _, err := NewHomeNamespaceConfig("home-{{ .Name", "admin", "", RetainHomeNamespaceRetentionPolicy); err == nil {
+		t.Fatal("expected invalid template to be refused")
+	}
+
+	c, err := NewHomeNamespaceConfig("Home_{{ .Name }}", "admin", "", RetainHomeNamespaceRetentionPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.NamespaceName(newUser("tenant", kimiov1beta1.ActiveUserState)); err == nil {
+		t.Fatal("expected invalid namespace name to be refused")
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+const (
+	// InactivityWarningCondition is True while an Active User is about to be suspended for inactivity
+	InactivityWarningCondition = "InactivityWarning"
+	// InactivityReasonCode is the reason code of the Users suspended for inactivity
+	InactivityReasonCode = "Inactivity"
+
+	// LegacyTokenLastUsedLabel is set by the API server on the token Secrets,
+	// with the date they were last used at, with the LegacyServiceAccountTokenTracking
+	// feature enabled, i.e. by default since Kubernetes 1.27
+	LegacyTokenLastUsedLabel  = "kubernetes.io/legacy-token-last-used"
+	legacyTokenLastUsedLayout = "2006-01-02"
+)
+
+// InactivityPolicy suspends the Users not active for too long
+type InactivityPolicy struct {
+	// SuspendAfter is the inactivity period Active Users are suspended after.
+	// If zero, Users are never suspended for inactivity.
+	SuspendAfter time.Duration
+	// WarningPeriod is how long before the suspension Users are warned
+	WarningPeriod time.Duration
+}
+
+// lastActivity returns the last time the User was active, or became Active
+func lastActivity(u *kimiov1beta1.User) time.Time {
+	la := u.CreationTimestamp.Time
+	if a := u.Status.LastActivity; a != nil && a.After(la) {
+		la = a.Time
+	}
+	for _, t := range u.Status.History {
+		if t.To == kimiov1beta1.ActiveUserState && t.Timestamp.After(la) {
+			la = t.Timestamp.Time
+		}
+	}
+	return la
+}
+
+// observeTokenActivity records as the last activity of the User the date its
+// token was last used at, as tracked by the API server in the token Secret.
+// Without it, the requests authenticated by the API server with the token,
+// e.g. with kubectl, are not seen by KIM.
+func (r *UserReconciler) observeTokenActivity(ctx context.Context, u *kimiov1beta1.User) error {
+	if u.Spec.State != kimiov1beta1.ActiveUserState || hasCredentialsConflict(u) {
+		return nil
+	}
+
+	k, err := r.serviceAccountKey(u)
+	if err != nil {
+		return err
+	}
+	var s corev1.Secret
+	if err := r.Get(ctx, k, &s); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	v, ok := s.Labels[LegacyTokenLastUsedLabel]
+	if !ok || !hasUserLabels(&s, u) {
+		return nil
+	}
+	t, err := time.ParseInLocation(legacyTokenLastUsedLayout, v, time.UTC)
+	if err != nil {
+		log.FromContext(ctx).Info("ignoring the invalid token last used date", "secret", k.Name, "date", v)
+		return nil
+	}
+	if a := u.Status.LastActivity; a == nil || t.After(a.Time) {
+		u.Status.LastActivity = &metav1.Time{Time: t}
+	}
+	return nil
+}
+
+// suspendInactiveUser suspends the Active User not active for longer than the
+// policy allows, warning it during the warning period. It returns the time
+// left to the next deadline, if any.
+func (r *UserReconciler) suspendInactiveUser(ctx context.Context, u *kimiov1beta1.User) (time.Duration, error) {
+	p := r.Inactivity
+	if p.SuspendAfter <= 0 || u.Spec.State != kimiov1beta1.ActiveUserState || u.Labels[InactivityExemptLabel] == "true" {
+		meta.RemoveStatusCondition(&u.Status.Conditions, InactivityWarningCondition)
+		return 0, nil
+	}
+
+	la := lastActivity(u)
+	suspendAt := la.Add(p.SuspendAfter)
+	warnAt := suspendAt.Add(-p.WarningPeriod)
+	now := time.Now()
+
+	switch {
+	case !now.Before(suspendAt):
+		st := u.Status.DeepCopy()
+		u.Spec.State = kimiov1beta1.SuspendedUserState
+		u.Spec.ReasonCode = InactivityReasonCode
+		if u.Annotations == nil {
+			u.Annotations = map[string]string{}
+		}
+		u.Annotations[kimiov1beta1.UserStateChangeReasonAnnotation] = fmt.Sprintf("inactive since %s", la.UTC().Format(time.RFC3339))
+		if err := r.Update(ctx, u); err != nil {
+			return 0, err
+		}
+		u.Status = *st
+		meta.RemoveStatusCondition(&u.Status.Conditions, InactivityWarningCondition)
+
+		r.Recorder.Eventf(u, corev1.EventTypeNormal, "SuspendedForInactivity",
+			"User suspended, inactive since %s", la.UTC().Format(time.RFC3339))
+		return 0, nil
+
+	case !now.Before(warnAt):
+		if !meta.IsStatusConditionTrue(u.Status.Conditions, InactivityWarningCondition) {
+			r.Recorder.Eventf(u, corev1.EventTypeWarning, "InactivityWarning",
+				"User inactive since %s will be suspended at %s", la.UTC().Format(time.RFC3339), suspendAt.UTC().Format(time.RFC3339))
+		}
+		meta.SetStatusCondition(&u.Status.Conditions, metav1.Condition{
+			Type:               InactivityWarningCondition,
+			Status:             metav1.ConditionTrue,
+			ObservedGeneration: u.Generation,
+			Reason:             "Inactive",
+			Message:            fmt.Sprintf("Inactive since %s, will be suspended at %s", la.UTC().Format(time.RFC3339), suspendAt.UTC().Format(time.RFC3339)),
+		})
+		return suspendAt.Sub(now), nil
+
+	default:
+		meta.RemoveStatusCondition(&u.Status.Conditions, InactivityWarningCondition)
+		return warnAt.Sub(now), nil
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+var _ = Describe("Inactivity", func() {
+	var (
+		ctx    context.Context
+		tenant string
+		key    types.NamespacedName
+		r      *UserReconciler
+	)
+
+	// Users are created active, policies are shortened to simulate inactivity
+	reconcileInactiveUser := func(p InactivityPolicy) (*kimiov1beta1.User, ctrl.Result) {
+		r.Inactivity = p
+		res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+		var u kimiov1beta1.User
+		ExpectWithOffset(1, k8sClient.Get(ctx, key, &u)).To(Succeed())
+		return &u, res
+	}
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+		tenant = createNamespace(ctx)
+		key = types.NamespacedName{Namespace: tenant, Name: "alice"}
+		r = newUserReconciler()
+	})
+
+	It("keeps active Users Active", func() {
+		p := InactivityPolicy{SuspendAfter: 30 * 24 * time.Hour, WarningPeriod: 7 * 24 * time.Hour}
+		create(ctx, newActiveUser(tenant))
+		reconcileInactiveUser(p)
+		issueCredentials(ctx, key)
+
+		u, res := reconcileInactiveUser(p)
+		Expect(u.Status.State).To(Equal(kimiov1beta1.ActiveUserState))
+		Expect(meta.FindStatusCondition(u.Status.Conditions, InactivityWarningCondition)).To(BeNil())
+		exp := p.SuspendAfter - p.WarningPeriod
+		Expect(res.RequeueAfter).To(BeNumerically(">", exp-time.Minute), "requeue at the warning")
+		Expect(res.RequeueAfter).To(BeNumerically("<=", exp), "requeue at the warning")
+	})
+
+	It("warns Users close to the suspension", func() {
+		p := InactivityPolicy{SuspendAfter: time.Hour, WarningPeriod: 2 * time.Hour}
+		create(ctx, newActiveUser(tenant))
+		reconcileInactiveUser(p)
+		issueCredentials(ctx, key)
+
+		u, res := reconcileInactiveUser(p)
+		Expect(u.Status.State).To(Equal(kimiov1beta1.ActiveUserState))
+		Expect(meta.IsStatusConditionTrue(u.Status.Conditions, InactivityWarningCondition)).To(BeTrue())
+		Expect(res.RequeueAfter).To(BeNumerically(">", time.Hour-time.Minute), "requeue at the suspension")
+		Expect(res.RequeueAfter).To(BeNumerically("<=", time.Hour), "requeue at the suspension")
+	})
+
+	It("suspends inactive Users", func() {
+		p := InactivityPolicy{SuspendAfter: time.Nanosecond}
+		create(ctx, newActiveUser(tenant))
+
+		u, _ := reconcileInactiveUser(p)
+		Expect(u.Spec.State).To(Equal(kimiov1beta1.SuspendedUserState))
+		Expect(u.Status.State).To(Equal(kimiov1beta1.SuspendedUserState))
+		Expect(u.Status.History).To(HaveLen(1))
+		Expect(u.Status.History[0].Reason).To(HavePrefix(InactivityReasonCode))
+	})
+
+	It("records the last use of the ServiceAccount token", func() {
+		p := InactivityPolicy{SuspendAfter: 30 * 24 * time.Hour, WarningPeriod: 7 * 24 * time.Hour}
+		create(ctx, newActiveUser(tenant))
+		reconcileInactiveUser(p)
+		issueCredentials(ctx, key)
+
+		var s corev1.Secret
+		Expect(k8sClient.Get(ctx, key, &s)).To(Succeed())
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		s.Labels[LegacyTokenLastUsedLabel] = today.Format("2006-01-02")
+		Expect(k8sClient.Update(ctx, &s)).To(Succeed())
+
+		u, _ := reconcileInactiveUser(p)
+		Expect(u.Status.LastActivity).NotTo(BeNil())
+		Expect(u.Status.LastActivity.Time).To(BeTemporally("==", today))
+	})
+
+	It("suspends inactive Users whose token Secret is not labelled with its last use", func() {
+		create(ctx, newActiveUser(tenant))
+		reconcileInactiveUser(InactivityPolicy{SuspendAfter: 30 * 24 * time.Hour})
+		issueCredentials(ctx, key)
+
+		var s corev1.Secret
+		Expect(k8sClient.Get(ctx, key, &s)).To(Succeed())
+		Expect(s.Labels).NotTo(HaveKey(LegacyTokenLastUsedLabel))
+
+		u, _ := reconcileInactiveUser(InactivityPolicy{SuspendAfter: time.Nanosecond})
+		Expect(u.Status.LastActivity).To(BeNil())
+		Expect(u.Status.State).To(Equal(kimiov1beta1.SuspendedUserState))
+		Expect(u.Status.History[len(u.Status.History)-1].Reason).To(HavePrefix(InactivityReasonCode))
+	})
+
+	It("does not suspend exempt Users", func() {
+		p := InactivityPolicy{SuspendAfter: time.Nanosecond}
+		u := newActiveUser(tenant)
+		u.Labels = map[string]string{InactivityExemptLabel: "true"}
+		create(ctx, u)
+		reconcileInactiveUser(p)
+		issueCredentials(ctx, key)
+
+		u, res := reconcileInactiveUser(p)
+		Expect(u.Status.State).To(Equal(kimiov1beta1.ActiveUserState))
+		Expect(res.RequeueAfter).To(BeZero())
+	})
+})
+
+func TestLastActivity(t *testing.T) {
+	created := time.Now().Add(-60 * 24 * time.Hour).Truncate(time.Second)
+	active := created.Add(time.Hour)
+	reactivated := created.Add(2 * time.Hour)
+
+	u := newUser("tenant", kimiov1beta1.ActiveUserState)
+	u.CreationTimestamp = metav1.NewTime(created)
+	if la := lastActivity(u); !la.Equal(created) {
+		t.Fatalf("expected the creation time, got %s", la)
+	}
+
+	u.Status.LastActivity = &metav1.Time{Time: active}
+	if la := lastActivity(u); !la.Equal(active) {
+		t.Fatalf("expected the last activity, got %s", la)
+	}
+
+	u.Status.History = []kimiov1beta1.UserStateTransition{
+		{From: kimiov1beta1.SuspendedUserState, To: kimiov1beta1.ActiveUserState, Timestamp: metav1.NewTime(reactivated)},
+	}
+	if la := lastActivity(u); !la.Equal(reactivated) {
+		t.Fatalf("expected the reactivation time, got %s", la)
+	}
+}
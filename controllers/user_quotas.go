@@ -0,0 +1,132 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+// Quotas limits the resources each User can hold. Zero means unlimited.
+type Quotas struct {
+	// PersonalAccessTokens is the maximum number of PersonalAccessTokens not expired nor revoked
+	PersonalAccessTokens int32
+	// AccessGrants is the maximum number of AccessGrants not expired
+	AccessGrants int32
+	// Namespaces is the maximum number of namespaces provisioned for the User
+	Namespaces int32
+}
+
+// CountPersonalAccessTokens returns the number of PersonalAccessTokens of the
+// User counting against its quota
+func CountPersonalAccessTokens(ctx context.Context, c client.Reader, user types.NamespacedName) (int32, error) {
+	var pp kimiov1beta1.PersonalAccessTokenList
+	if err := c.List(ctx, &pp,
+		client.InNamespace(user.Namespace),
+		client.MatchingFields{PersonalAccessTokenUserIndex: user.Name},
+	); err != nil {
+		return 0, err
+	}
+
+	n := int32(0)
+	for _, p := range pp.Items {
+		switch p.Status.Phase {
+		case kimiov1beta1.ExpiredPersonalAccessTokenPhase, kimiov1beta1.RevokedPersonalAccessTokenPhase:
+		default:
+			if p.DeletionTimestamp.IsZero() {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// CountAccessGrants returns the number of AccessGrants of the User counting
+// against its quota
+func CountAccessGrants(ctx context.Context, c client.Reader, user types.NamespacedName) (int32, error) {
+	var gg kimiov1beta1.AccessGrantList
+	if err := c.List(ctx, &gg,
+		client.InNamespace(user.Namespace),
+		client.MatchingFields{AccessGrantUserIndex: user.Name},
+	); err != nil {
+		return 0, err
+	}
+
+	n := int32(0)
+	for _, g := range gg.Items {
+		if !g.IsExpired() && g.DeletionTimestamp.IsZero() {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// CountNamespaces returns the number of namespaces provisioned for the User
+func CountNamespaces(ctx context.Context, c client.Reader, user types.NamespacedName) (int32, error) {
+	var nn corev1.NamespaceList
+	if err := c.List(ctx, &nn, client.MatchingLabels(userLabels(user.Namespace, user.Name))); err != nil {
+		return 0, err
+	}
+	return int32(len(nn.Items)), nil
+}
+
+// reconcileQuotas reports the usage of the User's quotas in its status
+func (r *UserReconciler) reconcileQuotas(ctx context.Context, u *kimiov1beta1.User) error {
+	k := types.NamespacedName{Namespace: u.Namespace, Name: u.Name}
+
+	pats, err := CountPersonalAccessTokens(ctx, r.Client, k)
+	if err != nil {
+		return err
+	}
+	ags, err := CountAccessGrants(ctx, r.Client, k)
+	if err != nil {
+		return err
+	}
+	// Namespaces are only provisioned, and can only be listed, cluster-wide
+	nss := int32(0)
+	if r.Scope.ClusterWide() {
+		nss, err = CountNamespaces(ctx, r.Client, k)
+		if err != nil {
+			return err
+		}
+	}
+
+	u.Status.Quotas = &kimiov1beta1.UserQuotasStatus{
+		PersonalAccessTokens: quotaStatus(pats, r.Quotas.PersonalAccessTokens),
+		AccessGrants:         quotaStatus(ags, r.Quotas.AccessGrants),
+		Namespaces:           quotaStatus(nss, r.Quotas.Namespaces),
+	}
+	return nil
+}
+
+func quotaStatus(used, limit int32) kimiov1beta1.QuotaStatus {
+	s := kimiov1beta1.QuotaStatus{Used: used}
+	if limit > 0 {
+		s.Limit = &limit
+	}
+	return s
+}
+
+// QuotaExceeded returns true if holding one more resource exceeds the limit
+func QuotaExceeded(used, limit int32) bool {
+	return limit > 0 && used >= limit
+}
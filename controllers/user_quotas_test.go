@@ -0,0 +1,108 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+var _ = Describe("Quotas", func() {
+	var (
+		ctx    context.Context
+		tenant string
+		key    types.NamespacedName
+	)
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+		tenant = createNamespace(ctx)
+		key = types.NamespacedName{Namespace: tenant, Name: "alice"}
+	})
+
+	It("usage is reported", func() {
+		pat := func(name string, phase kimiov1beta1.PersonalAccessTokenPhase) *kimiov1beta1.PersonalAccessToken {
+			return &kimiov1beta1.PersonalAccessToken{
+				ObjectMeta: metav1.ObjectMeta{Namespace: tenant, Name: name},
+				Spec:       kimiov1beta1.PersonalAccessTokenSpec{User: kimiov1beta1.UserReference{Name: "alice"}},
+				Status:     kimiov1beta1.PersonalAccessTokenStatus{Phase: phase},
+			}
+		}
+		create(ctx,
+			newUser(tenant, kimiov1beta1.ActiveUserState),
+			pat("active", kimiov1beta1.ActivePersonalAccessTokenPhase),
+			pat("suspended", kimiov1beta1.SuspendedPersonalAccessTokenPhase),
+			pat("revoked", kimiov1beta1.RevokedPersonalAccessTokenPhase),
+			newAccessGrant(tenant, "prod", nil),
+		)
+		r := newUserReconciler()
+		r.Quotas = Quotas{PersonalAccessTokens: 5}
+
+		u := reconcileUser(ctx, r, key)
+		q := u.Status.Quotas
+		Expect(q).NotTo(BeNil(), "expected the quotas to be reported")
+		Expect(q.PersonalAccessTokens.Used).To(BeEquivalentTo(2))
+		Expect(q.PersonalAccessTokens.Limit).To(HaveValue(BeEquivalentTo(5)))
+		Expect(q.AccessGrants.Used).To(BeEquivalentTo(1))
+		Expect(q.AccessGrants.Limit).To(BeNil())
+		Expect(q.Namespaces.Used).To(BeZero())
+		Expect(q.Namespaces.Limit).To(BeNil())
+	})
+
+	It("does not count the Namespaces unless KIM is cluster-wide", func() {
+		create(ctx,
+			newUser(tenant, kimiov1beta1.ActiveUserState),
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   tenant + "-playground",
+				Labels: userLabels(tenant, "alice"),
+			}},
+		)
+		r := newUserReconciler()
+		r.Client = namespacedClient(ctx, tenant)
+		r.Scope = Scope{Namespaces: []string{tenant}}
+		r.Quotas = Quotas{Namespaces: 1}
+
+		u := reconcileUser(ctx, r, key)
+		Expect(u.Status.Quotas.Namespaces.Used).To(BeZero())
+	})
+
+	It("is respected provisioning the home namespace", func() {
+		create(ctx,
+			newUser(tenant, kimiov1beta1.ActiveUserState),
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   tenant + "-playground",
+				Labels: userLabels(tenant, "alice"),
+			}},
+		)
+		r := newHomeNamespaceUserReconciler(RetainHomeNamespaceRetentionPolicy)
+		r.Quotas = Quotas{Namespaces: 1}
+
+		u := reconcileUser(ctx, r, key)
+		Expect(u.Status.HomeNamespace).To(BeEmpty(), "expected the home namespace not to be provisioned")
+		Expect(exists(ctx, types.NamespacedName{Name: "home-" + tenant + "-alice"}, &corev1.Namespace{})).To(BeFalse())
+		Expect(u.Status.Quotas.Namespaces.Used).To(BeEquivalentTo(1))
+		Expect(u.Status.Quotas.Namespaces.Limit).To(HaveValue(BeEquivalentTo(1)))
+	})
+})
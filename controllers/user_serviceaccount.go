@@ -0,0 +1,416 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	stderrors "errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/pkg/audit"
+)
+
+const (
+	// ConflictCondition is True while an object KIM provisions for the User
+	// already exists and is not managed by KIM
+	ConflictCondition = "Conflict"
+	// ServiceAccountNotOwnedReason reports a ServiceAccount named as the User not provisioned for it
+	ServiceAccountNotOwnedReason = "ServiceAccountNotOwned"
+	// SecretNotOwnedReason reports a Secret named as the User not owned by its ServiceAccount
+	SecretNotOwnedReason = "SecretNotOwned"
+	// HomeNamespaceNotOwnedReason reports a Namespace named as the home namespace of the User not provisioned for it
+	HomeNamespaceNotOwnedReason = "HomeNamespaceNotOwned"
+
+	// conflictRecheckInterval is the time between two checks of the objects
+	// conflicting with the User's ones: they are not labelled, so not watched
+	conflictRecheckInterval = 5 * time.Minute
+
+	// DefaultServiceAccountNameTemplate names the ServiceAccount and token Secret of a User as the User
+	DefaultServiceAccountNameTemplate = "{{ .Name }}"
+)
+
+// ServiceAccountConfig configures the ServiceAccount and token Secret
+// provisioned for each User. A nil ServiceAccountConfig names them as the User
+// and provisions Secrets of type kubernetes.io/service-account-token.
+type ServiceAccountConfig struct {
+	// NameTemplate is executed with the User to build the name of its
+	// ServiceAccount and token Secret
+	NameTemplate *template.Template
+	// SecretType is the type of the token Secrets. The token controller of
+	// Kubernetes only populates the kubernetes.io/service-account-token ones.
+	SecretType corev1.SecretType
+}
+
+// NewServiceAccountConfig builds a ServiceAccountConfig, defaulting the name
+// template and the Secret type if empty
+func NewServiceAccountConfig(nameTemplate string, secretType corev1.SecretType) (*ServiceAccountConfig, error) {
+	if nameTemplate == "" {
+		nameTemplate = DefaultServiceAccountNameTemplate
+	}
+	t, err := template.New("service-account").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service account name template: %w", err)
+	}
+
+	if secretType == "" {
+		secretType = corev1.SecretTypeServiceAccountToken
+	}
+	return &ServiceAccountConfig{NameTemplate: t, SecretType: secretType}, nil
+}
+
+// Name returns the name of the ServiceAccount and token Secret of the User
+func (c *ServiceAccountConfig) Name(u *kimiov1beta1.User) (string, error) {
+	if c == nil {
+		return u.Name, nil
+	}
+
+	var b bytes.Buffer
+	if err := c.NameTemplate.Execute(&b, templateData(u)); err != nil {
+		return "", err
+	}
+
+	n := b.String()
+	if ee := validation.IsDNS1123Subdomain(n); len(ee) > 0 {
+		return "", fmt.Errorf("invalid service account name %q: %s", n, strings.Join(ee, ", "))
+	}
+	return n, nil
+}
+
+// Subject returns the subject binding roles to the ServiceAccount of the User
+func (c *ServiceAccountConfig) Subject(u *kimiov1beta1.User) (rbacv1.Subject, error) {
+	n, err := c.Name(u)
+	if err != nil {
+		return rbacv1.Subject{}, err
+	}
+	return rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Namespace: u.Namespace, Name: n}, nil
+}
+
+// TokenSecretType returns the type of the token Secrets
+func (c *ServiceAccountConfig) TokenSecretType() corev1.SecretType {
+	if c == nil {
+		return corev1.SecretTypeServiceAccountToken
+	}
+	return c.SecretType
+}
+
+// serviceAccountKey returns the key of the ServiceAccount and token Secret of the User
+func (r *UserReconciler) serviceAccountKey(u *kimiov1beta1.User) (types.NamespacedName, error) {
+	n, err := r.ServiceAccount.Name(u)
+	if err != nil {
+		return types.NamespacedName{}, err
+	}
+	return types.NamespacedName{Namespace: u.Namespace, Name: n}, nil
+}
+
+// conflictError reports an object KIM would provision for a User that already
+// exists and is not managed by KIM
+type conflictError struct {
+	reason string
+	kind   string
+	key    types.NamespacedName
+}
+
+func (e *conflictError) Error() string {
+	return fmt.Sprintf("%s %s already exists and is not managed by KIM", e.kind, e.key)
+}
+
+var (
+	// credentialsConflictReasons are the reasons of the conflicts on the
+	// ServiceAccount and token Secret of the User
+	credentialsConflictReasons = []string{ServiceAccountNotOwnedReason, SecretNotOwnedReason}
+	// conflictReasons are the reasons of the conflicts, in the order the
+	// reconciliation finds them
+	conflictReasons = append(credentialsConflictReasons, HomeNamespaceNotOwnedReason)
+)
+
+// reportConflict sets the Conflict condition of the User if err is a
+// conflictError and removes it if err is nil, as long as it reports a conflict
+// of one of the reasons the caller checks for. The condition reports a
+// conflict at a time, the first the reconciliation finds: the others are
+// reported once it is solved. Other errors are returned.
+func (r *UserReconciler) reportConflict(u *kimiov1beta1.User, err error, reasons ...string) error {
+	var ce *conflictError
+	c := meta.FindStatusCondition(u.Status.Conditions, ConflictCondition)
+	checked := c != nil && hasReason(reasons, c.Reason)
+	switch {
+	case err == nil:
+		if checked {
+			meta.RemoveStatusCondition(&u.Status.Conditions, ConflictCondition)
+		}
+		return nil
+	case !stderrors.As(err, &ce):
+		return err
+	case c != nil && c.Status == metav1.ConditionTrue && !checked && conflictOrder(c.Reason) < conflictOrder(ce.reason):
+		return nil
+	}
+
+	if c == nil || c.Status != metav1.ConditionTrue || c.Message != ce.Error() {
+		r.Recorder.Eventf(u, corev1.EventTypeWarning, "Conflict",
+			"%s, it is left untouched: delete it or label it for the User to let KIM adopt it", ce)
+	}
+	meta.SetStatusCondition(&u.Status.Conditions, metav1.Condition{
+		Type:               ConflictCondition,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: u.Generation,
+		Reason:             ce.reason,
+		Message:            ce.Error(),
+	})
+	return nil
+}
+
+// hasCredentialsConflict returns true if the ServiceAccount or token Secret
+// of the User are not managed by KIM
+func hasCredentialsConflict(u *kimiov1beta1.User) bool {
+	c := meta.FindStatusCondition(u.Status.Conditions, ConflictCondition)
+	return c != nil && c.Status == metav1.ConditionTrue && hasReason(credentialsConflictReasons, c.Reason)
+}
+
+// conflictOrder returns the position of the reason in conflictReasons
+func conflictOrder(reason string) int {
+	for i, r := range conflictReasons {
+		if r == reason {
+			return i
+		}
+	}
+	return len(conflictReasons)
+}
+
+func hasReason(reasons []string, reason string) bool {
+	for _, r := range reasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureServiceAccountDoesntExist deletes the ServiceAccount and Secret
+// provisioned for the User. Objects named as the User's but not provisioned
+// for it are never deleted and are reported as a conflict.
+func (r *UserReconciler) ensureServiceAccountDoesntExist(ctx context.Context, user *kimiov1beta1.User) error {
+	k, err := r.serviceAccountKey(user)
+	if err != nil {
+		return err
+	}
+	var sa corev1.ServiceAccount
+	if err := r.Get(ctx, k, &sa); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	managed, err := r.adoptServiceAccount(ctx, user, &sa)
+	if err != nil {
+		return err
+	}
+	if !managed {
+		return &conflictError{reason: ServiceAccountNotOwnedReason, kind: "ServiceAccount", key: k}
+	}
+
+	// the Secret would be garbage collected together with the ServiceAccount,
+	// it is deleted explicitly so that its deletion is audited
+	var conflict error
+	var s corev1.Secret
+	switch err := r.Get(ctx, k, &s); {
+	case err == nil && isOwnedBy(&s, &sa):
+		if err := r.Delete(ctx, &s); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		auditLog(ctx, r.Auditor, audit.DeletedAction, auditObject("Secret", &s), "", "", string(user.Spec.State))
+	case err == nil:
+		conflict = &conflictError{reason: SecretNotOwnedReason, kind: "Secret", key: k}
+	case !errors.IsNotFound(err):
+		return err
+	}
+
+	if err := r.Delete(ctx, &sa); err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		return conflict
+	}
+	auditLog(ctx, r.Auditor, audit.DeletedAction, auditObject("ServiceAccount", &sa), "", "", string(user.Spec.State))
+	return conflict
+}
+
+// ensureServiceAccountAndSecretExist provisions the ServiceAccount of the User
+// and its token Secret. Objects named as the User's but not provisioned for it
+// are never updated and are reported as a conflict.
+func (r *UserReconciler) ensureServiceAccountAndSecretExist(ctx context.Context, user *kimiov1beta1.User) error {
+	k, err := r.serviceAccountKey(user)
+	if err != nil {
+		return err
+	}
+	var sa corev1.ServiceAccount
+	switch err := r.Get(ctx, k, &sa); {
+	case errors.IsNotFound(err):
+		if err := r.applyServiceAccount(ctx, user, &sa); err != nil {
+			return err
+		}
+		auditLog(ctx, r.Auditor, audit.CreatedAction, auditObject("ServiceAccount", &sa), "", "", string(user.Spec.State))
+	case err != nil:
+		return err
+	default:
+		managed, err := r.adoptServiceAccount(ctx, user, &sa)
+		if err != nil {
+			return err
+		}
+		if !managed {
+			return &conflictError{reason: ServiceAccountNotOwnedReason, kind: "ServiceAccount", key: k}
+		}
+	}
+
+	var s corev1.Secret
+	switch err := r.Get(ctx, k, &s); {
+	case errors.IsNotFound(err):
+		if err := r.applySecret(ctx, user, &sa, &s); err != nil {
+			return err
+		}
+		auditLog(ctx, r.Auditor, audit.CreatedAction, auditObject("Secret", &s), "", "", string(user.Spec.State))
+		return nil
+	case err != nil:
+		return err
+	case !isOwnedBy(&s, &sa):
+		return &conflictError{reason: SecretNotOwnedReason, kind: "Secret", key: k}
+	case s.Type != r.ServiceAccount.TokenSecretType():
+		// the type of a Secret is immutable, the Secret is provisioned again
+		if err := r.Delete(ctx, &s); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		auditLog(ctx, r.Auditor, audit.DeletedAction, auditObject("Secret", &s), string(s.Type), string(r.ServiceAccount.TokenSecretType()), "SecretTypeChanged")
+		if err := r.applySecret(ctx, user, &sa, &s); err != nil {
+			return err
+		}
+		auditLog(ctx, r.Auditor, audit.CreatedAction, auditObject("Secret", &s), "", "", string(user.Spec.State))
+		return nil
+	case hasUserLabels(&s, user) && s.Annotations[corev1.ServiceAccountNameKey] == sa.Name:
+		return nil
+	default:
+		// restore the labels, also of the Secrets provisioned by previous versions of KIM
+		return r.applySecret(ctx, user, &sa, &s)
+	}
+}
+
+// applyServiceAccount applies the ServiceAccount of the User, labelled for it
+// and controlled by it, storing the result in sa
+func (r *UserReconciler) applyServiceAccount(ctx context.Context, user *kimiov1beta1.User, sa *corev1.ServiceAccount) error {
+	n, err := r.ServiceAccount.Name(user)
+	if err != nil {
+		return err
+	}
+	*sa = corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: user.Namespace,
+			Name:      n,
+			Labels:    userLabels(user.Namespace, user.Name),
+		},
+	}
+	if err := controllerutil.SetControllerReference(user, sa, r.Scheme); err != nil {
+		return err
+	}
+	return apply(ctx, r.Client, sa)
+}
+
+// applySecret applies the token Secret of the ServiceAccount of the User,
+// storing the result in s
+func (r *UserReconciler) applySecret(ctx context.Context, user *kimiov1beta1.User, sa *corev1.ServiceAccount, s *corev1.Secret) error {
+	*s = corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sa.Name,
+			Namespace: user.Namespace,
+			Labels:    userLabels(user.Namespace, user.Name),
+			Annotations: map[string]string{
+				corev1.ServiceAccountNameKey: sa.Name,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "v1",
+					Kind:       "ServiceAccount",
+					Name:       sa.Name,
+					UID:        sa.UID,
+				},
+			},
+		},
+		Type: r.ServiceAccount.TokenSecretType(),
+	}
+	return apply(ctx, r.Client, s)
+}
+
+// adoptServiceAccount returns true if the ServiceAccount is provisioned for
+// the User, restoring its labels if they were removed. ServiceAccounts not
+// controlled by any object are adopted if they are labelled for the User or if
+// they were provisioned by a previous version of KIM, that did not label nor
+// own them.
+func (r *UserReconciler) adoptServiceAccount(ctx context.Context, user *kimiov1beta1.User, sa *corev1.ServiceAccount) (bool, error) {
+	adopted := !metav1.IsControlledBy(sa, user)
+	switch {
+	case !adopted && hasUserLabels(sa, user):
+		return true, nil
+	case !adopted:
+	case metav1.GetControllerOf(sa) != nil:
+		return false, nil
+	case !hasUserLabels(sa, user):
+		s, err := legacyTokenSecret(ctx, r.Client, sa)
+		if err != nil || s == nil {
+			return false, err
+		}
+	}
+
+	if err := r.applyServiceAccount(ctx, user, sa); err != nil {
+		return false, err
+	}
+	if adopted {
+		r.Recorder.Eventf(user, corev1.EventTypeNormal, "ServiceAccountAdopted",
+			"ServiceAccount '%s' adopted", sa.Name)
+	}
+	return true, nil
+}
+
+// legacyTokenSecret returns the token Secret previous versions of KIM
+// provisioned together with the ServiceAccount: named as the ServiceAccount
+// and owned by it. It returns nil if the ServiceAccount has none.
+func legacyTokenSecret(ctx context.Context, c client.Reader, sa *corev1.ServiceAccount) (*corev1.Secret, error) {
+	var s corev1.Secret
+	if err := c.Get(ctx, types.NamespacedName{Namespace: sa.Namespace, Name: sa.Name}, &s); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	if s.Type != corev1.SecretTypeServiceAccountToken ||
+		s.Annotations[corev1.ServiceAccountNameKey] != sa.Name ||
+		!isOwnedBy(&s, sa) {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+// hasUserLabels returns true if the object is labelled as provisioned for the User
+func hasUserLabels(obj metav1.Object, u *kimiov1beta1.User) bool {
+	l := obj.GetLabels()
+	return l[UserNameLabel] == u.Name && l[UserNamespaceLabel] == u.Namespace
+}
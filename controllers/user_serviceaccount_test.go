@@ -0,0 +1,182 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+var _ = Describe("ServiceAccount", func() {
+	var (
+		ctx    context.Context
+		tenant string
+		key    types.NamespacedName
+		r      *UserReconciler
+	)
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+		tenant = createNamespace(ctx)
+		key = types.NamespacedName{Namespace: tenant, Name: "alice"}
+		r = newUserReconciler()
+	})
+
+	It("is owned by the User", func() {
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+		u := reconcileUser(ctx, r, key)
+
+		var sa corev1.ServiceAccount
+		Expect(exists(ctx, key, &sa)).To(BeTrue(), "expected the ServiceAccount to be created")
+		Expect(metav1.IsControlledBy(&sa, u)).To(BeTrue(), "expected the ServiceAccount to be controlled by the User")
+		Expect(hasUserLabels(&sa, u)).To(BeTrue(), "expected the ServiceAccount to be labelled")
+		var s corev1.Secret
+		Expect(exists(ctx, key, &s)).To(BeTrue(), "expected the Secret to be created")
+		Expect(isOwnedBy(&s, &sa)).To(BeTrue(), "expected the Secret to be owned by the ServiceAccount")
+		Expect(hasUserLabels(&s, u)).To(BeTrue(), "expected the Secret to be labelled")
+		Expect(meta.FindStatusCondition(u.Status.Conditions, ConflictCondition)).To(BeNil())
+	})
+
+	It("is not adopted when not owned", func() {
+		sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: tenant, Name: "alice"}}
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState), sa)
+
+		u := reconcileUser(ctx, r, key)
+		c := meta.FindStatusCondition(u.Status.Conditions, ConflictCondition)
+		Expect(c).NotTo(BeNil())
+		Expect(c.Status).To(Equal(metav1.ConditionTrue))
+		Expect(c.Reason).To(Equal(ServiceAccountNotOwnedReason))
+		Expect(u.Status.State).To(Equal(kimiov1beta1.ActiveUserState))
+		Expect(exists(ctx, key, &corev1.Secret{})).To(BeFalse(), "expected no Secret for an unowned ServiceAccount")
+		Expect(exists(ctx, key, sa)).To(BeTrue())
+		Expect(sa.OwnerReferences).To(BeEmpty())
+		Expect(sa.Labels).To(BeEmpty())
+
+		By("not deleting an unowned ServiceAccount")
+		setUserState(ctx, key, kimiov1beta1.BannedUserState)
+		u = reconcileUser(ctx, r, key)
+		Expect(exists(ctx, key, &corev1.ServiceAccount{})).To(BeTrue(), "expected the unowned ServiceAccount not to be deleted")
+		Expect(meta.IsStatusConditionTrue(u.Status.Conditions, ConflictCondition)).To(BeTrue())
+
+		By("clearing the conflict once the ServiceAccount is removed")
+		Expect(k8sClient.Delete(ctx, sa)).To(Succeed())
+		u = reconcileUser(ctx, r, key)
+		Expect(meta.FindStatusCondition(u.Status.Conditions, ConflictCondition)).To(BeNil())
+	})
+
+	It("does not overwrite an unowned Secret", func() {
+		s := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: tenant, Name: "alice"},
+			Data:       map[string][]byte{"password": []byte("secret")},
+		}
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState), s)
+		u := reconcileUser(ctx, r, key)
+
+		c := meta.FindStatusCondition(u.Status.Conditions, ConflictCondition)
+		Expect(c).NotTo(BeNil())
+		Expect(c.Reason).To(Equal(SecretNotOwnedReason))
+		Expect(exists(ctx, key, s)).To(BeTrue())
+		Expect(s.Type).NotTo(Equal(corev1.SecretTypeServiceAccountToken))
+		Expect(s.OwnerReferences).To(BeEmpty())
+
+		By("not deleting the Secret together with the ServiceAccount")
+		setUserState(ctx, key, kimiov1beta1.SuspendedUserState)
+		reconcileUser(ctx, r, key)
+		Expect(exists(ctx, key, &corev1.ServiceAccount{})).To(BeFalse(), "expected the ServiceAccount to be deleted")
+		Expect(exists(ctx, key, &corev1.Secret{})).To(BeTrue(), "expected the unowned Secret not to be deleted")
+	})
+
+	It("is adopted when labelled", func() {
+		sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+			Namespace: tenant,
+			Name:      "alice",
+			Labels:    userLabels(tenant, "alice"),
+		}}
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState), sa)
+		u := reconcileUser(ctx, r, key)
+
+		Expect(meta.FindStatusCondition(u.Status.Conditions, ConflictCondition)).To(BeNil())
+		Expect(exists(ctx, key, sa)).To(BeTrue())
+		Expect(metav1.IsControlledBy(sa, u)).To(BeTrue(), "expected the ServiceAccount to be adopted")
+		Expect(hasUserLabels(sa, u)).To(BeTrue())
+		var s corev1.Secret
+		Expect(exists(ctx, key, &s)).To(BeTrue())
+		Expect(hasUserLabels(&s, u)).To(BeTrue(), "expected the Secret to be labelled")
+	})
+
+	It("is adopted when provisioned by a previous version", func() {
+		// previous versions of KIM did not label nor own the ServiceAccount
+		sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: tenant, Name: "alice"}}
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState), sa)
+		create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:       tenant,
+				Name:            "alice",
+				Annotations:     map[string]string{corev1.ServiceAccountNameKey: "alice"},
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: "v1", Kind: "ServiceAccount", Name: "alice", UID: sa.UID}},
+			},
+			Type: corev1.SecretTypeServiceAccountToken,
+		})
+		u := reconcileUser(ctx, r, key)
+
+		Expect(meta.FindStatusCondition(u.Status.Conditions, ConflictCondition)).To(BeNil())
+		Expect(exists(ctx, key, sa)).To(BeTrue())
+		Expect(metav1.IsControlledBy(sa, u)).To(BeTrue(), "expected the ServiceAccount to be adopted")
+		Expect(hasUserLabels(sa, u)).To(BeTrue())
+		var s corev1.Secret
+		Expect(exists(ctx, key, &s)).To(BeTrue())
+		Expect(hasUserLabels(&s, u)).To(BeTrue(), "expected the Secret to be labelled")
+	})
+
+	It("is named after the template with the configured Secret type", func() {
+		var err error
+		r.ServiceAccount, err = NewServiceAccountConfig("kim-{{ .Name }}", "example.com/token")
+		Expect(err).NotTo(HaveOccurred())
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+		u := reconcileUser(ctx, r, key)
+
+		k := types.NamespacedName{Namespace: tenant, Name: "kim-alice"}
+		var sa corev1.ServiceAccount
+		Expect(exists(ctx, k, &sa)).To(BeTrue(), "expected the ServiceAccount to be named after the template")
+		Expect(metav1.IsControlledBy(&sa, u)).To(BeTrue())
+		var s corev1.Secret
+		Expect(exists(ctx, k, &s)).To(BeTrue(), "expected the Secret to be named after the template")
+		Expect(s.Type).To(Equal(corev1.SecretType("example.com/token")))
+		Expect(exists(ctx, key, &corev1.ServiceAccount{})).To(BeFalse(), "expected no ServiceAccount named as the User")
+
+		By("provisioning the Secret again when its type changes")
+		r.ServiceAccount.SecretType = corev1.SecretTypeServiceAccountToken
+		reconcileUser(ctx, r, key)
+		Expect(exists(ctx, k, &s)).To(BeTrue())
+		Expect(s.Type).To(Equal(corev1.SecretTypeServiceAccountToken))
+		Expect(isOwnedBy(&s, &sa)).To(BeTrue())
+
+		By("deleting the objects named after the template")
+		setUserState(ctx, key, kimiov1beta1.SuspendedUserState)
+		reconcileUser(ctx, r, key)
+		Expect(exists(ctx, k, &corev1.ServiceAccount{})).To(BeFalse(), "expected the ServiceAccount to be deleted")
+	})
+})
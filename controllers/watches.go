@@ -0,0 +1,180 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+// NewBindingsCache returns a cache of the RoleBindings and ClusterRoleBindings
+// provisioned for Users, in any namespace of the scope, and adds it to the
+// manager. The manager's cache is restricted to the watched namespaces, while
+// bindings are provisioned in home namespaces and in the namespaces of
+// AccessProfiles and AccessGrants. ClusterRoleBindings are only cached when
+// the scope is cluster-wide.
+func NewBindingsCache(mgr ctrl.Manager, scope Scope) (cache.Cache, error) {
+	s, err := userObjectSelector()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := cache.Options{
+		Scheme: mgr.GetScheme(),
+		Mapper: mgr.GetRESTMapper(),
+		SelectorsByObject: cache.SelectorsByObject{
+			&rbacv1.RoleBinding{}: s,
+		},
+	}
+	newCache := cache.New
+	switch {
+	case scope.ClusterWide():
+		opts.SelectorsByObject[&rbacv1.ClusterRoleBinding{}] = s
+	case len(scope.Namespaces) == 1:
+		opts.Namespace = scope.Namespaces[0]
+	default:
+		newCache = cache.MultiNamespacedCacheBuilder(scope.Namespaces)
+	}
+
+	c, err := newCache(mgr.GetConfig(), opts)
+	if err != nil {
+		return nil, err
+	}
+	return c, mgr.Add(c)
+}
+
+// WithUserObjectsSelector restricts the ServiceAccounts and Secrets cached by
+// the caches newCache builds to the ones provisioned for Users, so that the
+// manager doesn't cache every ServiceAccount and Secret of the cluster. A nil
+// newCache builds a cache.New. The unlabelled ServiceAccounts and Secrets are
+// not cached, so they are to be read from the API server.
+func WithUserObjectsSelector(newCache cache.NewCacheFunc) cache.NewCacheFunc {
+	if newCache == nil {
+		newCache = cache.New
+	}
+	return func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+		s, err := userObjectSelector()
+		if err != nil {
+			return nil, err
+		}
+		if opts.SelectorsByObject == nil {
+			opts.SelectorsByObject = cache.SelectorsByObject{}
+		}
+		opts.SelectorsByObject[&corev1.ServiceAccount{}] = s
+		opts.SelectorsByObject[&corev1.Secret{}] = s
+		return newCache(config, opts)
+	}
+}
+
+// userObjectSelector selects the objects labelled as provisioned for a User
+func userObjectSelector() (cache.ObjectSelector, error) {
+	r, err := labels.NewRequirement(UserNameLabel, selection.Exists, nil)
+	if err != nil {
+		return cache.ObjectSelector{}, err
+	}
+	return cache.ObjectSelector{Label: labels.NewSelector().Add(*r)}, nil
+}
+
+// userOf returns the key of the User an object is provisioned for, as per its labels
+func userOf(o client.Object) (types.NamespacedName, bool) {
+	n, ns := o.GetLabels()[UserNameLabel], o.GetLabels()[UserNamespaceLabel]
+	return types.NamespacedName{Namespace: ns, Name: n}, n != "" && ns != ""
+}
+
+// mapUserObjectToUser enqueues the User a ServiceAccount or Secret is
+// provisioned for. As only the labelled objects are watched, removing their
+// labels is observed as a deletion of an object without labels: ServiceAccounts
+// are then mapped to the User controlling them and Secrets to the User of the
+// ServiceAccount owning them.
+func (r *UserReconciler) mapUserObjectToUser(o client.Object) []reconcile.Request {
+	if k, ok := userOf(o); ok {
+		return []reconcile.Request{{NamespacedName: k}}
+	}
+
+	if _, ok := o.(*corev1.Secret); ok {
+		var sa corev1.ServiceAccount
+		if !r.ownerServiceAccount(o, &sa) {
+			return nil
+		}
+		o = &sa
+		if k, ok := userOf(o); ok {
+			return []reconcile.Request{{NamespacedName: k}}
+		}
+	}
+
+	ref := metav1.GetControllerOf(o)
+	if ref == nil || ref.APIVersion != kimiov1beta1.GroupVersion.String() || ref.Kind != "User" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: o.GetNamespace(), Name: ref.Name}}}
+}
+
+// ownerServiceAccount fetches the ServiceAccount owning the Secret into sa,
+// returning false if there is none
+func (r *UserReconciler) ownerServiceAccount(s client.Object, sa *corev1.ServiceAccount) bool {
+	for _, ref := range s.GetOwnerReferences() {
+		if ref.APIVersion != "v1" || ref.Kind != "ServiceAccount" {
+			continue
+		}
+		k := types.NamespacedName{Namespace: s.GetNamespace(), Name: ref.Name}
+		if err := r.Get(context.Background(), k, sa); err != nil {
+			if !errors.IsNotFound(err) {
+				log.Log.Error(err, "error fetching service account", "namespace", k.Namespace, "serviceaccount", k.Name)
+			}
+			return false
+		}
+		return sa.UID == ref.UID
+	}
+	return false
+}
+
+// mapBindingToUser enqueues the User a RoleBinding is provisioned for by the
+// User controller. Bindings of AccessGrants are reconciled by their AccessGrant.
+func mapBindingToUser(o client.Object) []reconcile.Request {
+	if _, ok := o.GetLabels()[AccessGrantLabel]; ok {
+		return nil
+	}
+	if k, ok := userOf(o); ok {
+		return []reconcile.Request{{NamespacedName: k}}
+	}
+	return nil
+}
+
+// mapBindingToAccessGrant enqueues the AccessGrant a binding is provisioned for
+func mapBindingToAccessGrant(o client.Object) []reconcile.Request {
+	g := o.GetLabels()[AccessGrantLabel]
+	k, ok := userOf(o)
+	if g == "" || !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: k.Namespace, Name: g}}}
+}
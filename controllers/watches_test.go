@@ -0,0 +1,167 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+var _ = Describe("Watches", func() {
+	var (
+		ctx    context.Context
+		tenant string
+		key    types.NamespacedName
+		r      *UserReconciler
+	)
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+		tenant = createNamespace(ctx)
+		key = types.NamespacedName{Namespace: tenant, Name: "alice"}
+		r = newUserReconciler()
+		create(ctx, newUser(tenant, kimiov1beta1.ActiveUserState))
+	})
+
+	It("map the provisioned objects to their owner", func() {
+		labelled := func(o client.Object, extra map[string]string) client.Object {
+			ll := userLabels(tenant, "alice")
+			for k, v := range extra {
+				ll[k] = v
+			}
+			o.SetLabels(ll)
+			return o
+		}
+		alice := []reconcile.Request{{NamespacedName: key}}
+		controller := true
+
+		for _, tc := range []struct {
+			name     string
+			mapFunc  func(client.Object) []reconcile.Request
+			obj      client.Object
+			expected []reconcile.Request
+		}{
+			{
+				name:     "labelled ServiceAccount",
+				mapFunc:  r.mapUserObjectToUser,
+				obj:      labelled(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: tenant, Name: "other"}}, nil),
+				expected: alice,
+			},
+			{
+				name:    "unlabelled Secret named as a User",
+				mapFunc: r.mapUserObjectToUser,
+				obj:     &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: tenant, Name: "alice"}},
+			},
+			{
+				name:    "unlabelled ServiceAccount controlled by a User",
+				mapFunc: r.mapUserObjectToUser,
+				obj: &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+					Namespace: tenant,
+					Name:      "other",
+					OwnerReferences: []metav1.OwnerReference{{
+						APIVersion: kimiov1beta1.GroupVersion.String(),
+						Kind:       "User",
+						Name:       "alice",
+						UID:        "alice-uid",
+						Controller: &controller,
+					}},
+				}},
+				expected: alice,
+			},
+			{
+				name:    "ServiceAccount of no User",
+				mapFunc: r.mapUserObjectToUser,
+				obj:     &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: tenant, Name: "default"}},
+			},
+			{
+				name:     "home namespace RoleBinding",
+				mapFunc:  mapBindingToUser,
+				obj:      labelled(&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Namespace: "home-alice", Name: "kim-home"}}, nil),
+				expected: alice,
+			},
+			{
+				name:    "AccessGrant RoleBinding to User",
+				mapFunc: mapBindingToUser,
+				obj:     labelled(&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Namespace: "team", Name: "kim-grant"}}, map[string]string{AccessGrantLabel: "debug"}),
+			},
+			{
+				name:    "AccessGrant ClusterRoleBinding",
+				mapFunc: mapBindingToAccessGrant,
+				obj:     labelled(&rbacv1.ClusterRoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "kim-grant"}}, map[string]string{AccessGrantLabel: "debug"}),
+				expected: []reconcile.Request{
+					{NamespacedName: types.NamespacedName{Namespace: tenant, Name: "debug"}},
+				},
+			},
+			{
+				name:    "home namespace RoleBinding to AccessGrant",
+				mapFunc: mapBindingToAccessGrant,
+				obj:     labelled(&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Namespace: "home-alice", Name: "kim-home"}}, nil),
+			},
+		} {
+			Expect(tc.mapFunc(tc.obj)).To(Equal(tc.expected), tc.name)
+		}
+	})
+
+	It("restore a deleted ServiceAccount", func() {
+		reconcileUser(ctx, r, key)
+
+		var sa corev1.ServiceAccount
+		var s corev1.Secret
+		Expect(exists(ctx, key, &sa)).To(BeTrue(), "expected the ServiceAccount to be created")
+		Expect(exists(ctx, key, &s)).To(BeTrue(), "expected the Secret to be created")
+		for _, o := range []client.Object{&s, &sa} {
+			Expect(k8sClient.Delete(ctx, o)).To(Succeed())
+		}
+
+		By("reconciling the User when the ServiceAccount is deleted")
+		Expect(r.mapUserObjectToUser(&sa)).To(Equal([]reconcile.Request{{NamespacedName: key}}))
+		reconcileUser(ctx, r, key)
+		Expect(exists(ctx, key, &corev1.ServiceAccount{})).To(BeTrue(), "expected the ServiceAccount to be restored")
+		Expect(exists(ctx, key, &corev1.Secret{})).To(BeTrue(), "expected the Secret to be restored")
+	})
+
+	It("restore the removed labels of the ServiceAccount", func() {
+		u := reconcileUser(ctx, r, key)
+
+		var sa corev1.ServiceAccount
+		var s corev1.Secret
+		Expect(exists(ctx, key, &sa)).To(BeTrue())
+		Expect(exists(ctx, key, &s)).To(BeTrue())
+		for _, o := range []client.Object{&sa, &s} {
+			o.SetLabels(nil)
+			Expect(k8sClient.Update(ctx, o)).To(Succeed())
+		}
+
+		By("reconciling the User when the labels are removed")
+		Expect(r.mapUserObjectToUser(&sa)).To(Equal([]reconcile.Request{{NamespacedName: key}}))
+		Expect(r.mapUserObjectToUser(&s)).To(Equal([]reconcile.Request{{NamespacedName: key}}))
+		reconcileUser(ctx, r, key)
+		Expect(exists(ctx, key, &sa)).To(BeTrue())
+		Expect(hasUserLabels(&sa, u)).To(BeTrue(), "expected the labels to be restored")
+	})
+})
@@ -17,28 +17,46 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	componentconfigv1alpha1 "k8s.io/component-base/config/v1alpha1"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	cfg "sigs.k8s.io/controller-runtime/pkg/config/v1alpha1"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	kimconfigv1alpha1 "github.com/filariow/kim/api/config/v1alpha1"
 	kimiov1alpha1 "github.com/filariow/kim/api/v1alpha1"
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
 	"github.com/filariow/kim/controllers"
+	"github.com/filariow/kim/pkg/activity"
+	"github.com/filariow/kim/pkg/audit"
+	"github.com/filariow/kim/pkg/quota"
+	"github.com/filariow/kim/pkg/selfservice"
 	//+kubebuilder:scaffold:imports
 )
 
 const (
 	EnvWatchNamespace = "WATCH_NAMESPACE"
+	EnvEnableWebhooks = "ENABLE_WEBHOOKS"
 )
 
 var (
@@ -50,25 +68,103 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(kimiov1alpha1.AddToScheme(scheme))
+	utilruntime.Must(kimiov1beta1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
 func main() {
-	wn, ok := os.LookupEnv(EnvWatchNamespace)
-	if !ok {
-		setupLog.Error(
-			fmt.Errorf("expected Environment Variable %s not found", EnvWatchNamespace),
-			"error defining controller's scope",
-		)
-		os.Exit(1)
+	os.Exit(run())
+}
+
+// run sets up and runs the manager, returning the exit code. Deferred
+// functions, e.g. closing the audit sink, run before exiting.
+func run() int {
+	leaderElect := false
+	webhookPort := 9443
+	c := kimconfigv1alpha1.KIMConfig{
+		ControllerManagerConfigurationSpec: cfg.ControllerManagerConfigurationSpec{
+			LeaderElection: &componentconfigv1alpha1.LeaderElectionConfiguration{
+				LeaderElect:  &leaderElect,
+				ResourceName: "49cd215b.kim.io",
+			},
+			Webhook: cfg.ControllerWebhook{Port: &webhookPort},
+		},
 	}
 
-	var metricsAddr string
-	var enableLeaderElection bool
-	var probeAddr string
-	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
-	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
-	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
+	var configFile string
+	flag.StringVar(&configFile, "config", "",
+		"The path to a KIMConfig configuration file. Flags set on the command line take precedence over it.")
+	flag.StringVar(&c.Metrics.BindAddress, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
+	flag.StringVar(&c.Health.HealthProbeBindAddress, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.StringVar(&c.SelfService.BindAddress, "self-service-bind-address", "0",
+		"The address the self-service API binds to. Set it to 0 to disable the self-service API.")
+	flag.StringVar(&c.SelfService.CertDir, "self-service-cert-dir", "",
+		"The directory containing the tls.crt and tls.key files used by the self-service API. "+
+			"Required when the self-service API is enabled, unless --self-service-insecure is set.")
+	flag.BoolVar(&c.SelfService.Insecure, "self-service-insecure", false,
+		"Serve the self-service API over plain HTTP when no certificate is set, exposing the tokens it issues. Only for development.")
+	flag.DurationVar(&c.PersonalAccessTokens.DefaultLifetime.Duration, "pat-default-lifetime", 30*24*time.Hour,
+		"The lifetime of PersonalAccessTokens created through the self-service API without an explicit one.")
+	flag.DurationVar(&c.PersonalAccessTokens.MaxLifetime.Duration, "pat-max-lifetime", 90*24*time.Hour,
+		"The maximum lifetime of PersonalAccessTokens created through the self-service API. Set it to 0 for no limit.")
+	flag.StringVar(&c.ServiceAccounts.NameTemplate, "service-account-name-template", controllers.DefaultServiceAccountNameTemplate,
+		"The Go template used to build the name of the ServiceAccount and token Secret of each User (e.g. 'kim-{{ .Name }}'). "+
+			"Available fields are .Name, .Namespace and .Username. The objects named after a previous template are "+
+			"reported and deleted by the orphan sweeper.")
+	flag.StringVar(&c.ServiceAccounts.SecretType, "service-account-secret-type", string(corev1.SecretTypeServiceAccountToken),
+		"The type of the token Secrets of Users' ServiceAccounts. Kubernetes only populates the "+
+			"kubernetes.io/service-account-token ones, Secrets of other types must be populated by another controller.")
+	flag.StringVar(&c.HomeNamespaces.NameTemplate, "home-namespace-name-template", "",
+		"The Go template used to build the name of Users' home namespace (e.g. 'home-{{ .Name }}'). "+
+			"Available fields are .Name, .Namespace and .Username. If empty, home namespaces are not provisioned.")
+	flag.StringVar(&c.HomeNamespaces.ClusterRole, "home-namespace-cluster-role", "admin",
+		"The ClusterRole granted to Users in their home namespace.")
+	flag.StringVar(&c.HomeNamespaces.ResourcesFile, "home-namespace-resources", "",
+		"The path to a YAML file containing the ResourceQuota and/or LimitRange applied to home namespaces.")
+	flag.StringVar(&c.HomeNamespaces.RetentionPolicy, "home-namespace-retention-policy",
+		string(controllers.RetainHomeNamespaceRetentionPolicy),
+		"What happens to the home namespace when its User is suspended, banned or deleted. "+
+			"Retain revokes the User's access, Delete deletes the namespace.")
+	flag.Var(newInt32Value(&c.Quotas.MaxPersonalAccessTokens), "quota-max-personal-access-tokens",
+		"The maximum number of PersonalAccessTokens not expired nor revoked each User can hold. Set it to 0 for no limit.")
+	flag.Var(newInt32Value(&c.Quotas.MaxAccessGrants), "quota-max-access-grants",
+		"The maximum number of AccessGrants not expired each User can hold. Set it to 0 for no limit.")
+	flag.Var(newInt32Value(&c.Quotas.MaxNamespaces), "quota-max-namespaces",
+		"The maximum number of namespaces provisioned for each User. Set it to 0 for no limit.")
+	c.AccessGrants.GrantableRoles = []kimconfigv1alpha1.GrantableRole{{Kind: "ClusterRole", Name: "view"}}
+	flag.Var((*grantableRolesValue)(&c.AccessGrants.GrantableRoles), "access-grant-grantable-roles",
+		"The comma-separated list of the only roles AccessGrants can grant, as Kind/Name (e.g. 'ClusterRole/view,Role/deployer').")
+	flag.BoolVar(&c.AccessGrants.AllowClusterScope, "access-grant-allow-cluster-scope", false,
+		"Allow AccessGrants to grant ClusterRoles cluster-wide, with an empty scope.")
+	flag.DurationVar(&c.Invitations.Lifetime.Duration, "invitation-lifetime", controllers.DefaultInvitationLifetime,
+		"The lifetime of Invitations without an explicit expiration.")
+	flag.BoolVar(&c.Invitations.AutoApprove, "invitation-auto-approve", false,
+		"Activate the Users created by redeeming an Invitation, instead of waiting for approval.")
+	flag.DurationVar(&c.Inactivity.SuspendAfter.Duration, "inactivity-suspend-after", 0,
+		"The inactivity period Active Users are suspended after (e.g. 2160h). Set it to 0 to never suspend Users for inactivity. "+
+			"The use of the ServiceAccount tokens is only seen with the LegacyServiceAccountTokenTracking feature of Kubernetes enabled.")
+	flag.DurationVar(&c.Inactivity.WarningPeriod.Duration, "inactivity-warning-period", 7*24*time.Hour,
+		"How long before being suspended for inactivity Users are warned.")
+	flag.DurationVar(&c.Inactivity.ActivityGranularity.Duration, "activity-granularity", activity.DefaultGranularity,
+		"The minimum time between two updates of a User's last activity.")
+	flag.StringVar(&c.Audit.Sink, "audit-sink", "",
+		"Where audit records are written: 'stdout', a rotated file (e.g. 'file:///var/log/kim/audit.log') "+
+			"or an HTTP collector (e.g. 'https://collector/audit'). If empty, audit is disabled.")
+	flag.Int64Var(&c.Audit.FileMaxSize, "audit-file-max-size", 100<<20,
+		"The size in bytes the audit file is rotated at.")
+	flag.IntVar(&c.Audit.FileMaxBackups, "audit-file-max-backups", 5,
+		"The number of rotated audit files retained.")
+	flag.DurationVar(&c.OrphanSweeper.Interval.Duration, "orphan-sweep-interval", controllers.DefaultOrphanSweepInterval,
+		"The time between two sweeps of the ServiceAccounts and token Secrets of Users that are gone or not Active. "+
+			"Set it to 0 to disable the sweep.")
+	flag.BoolVar(&c.OrphanSweeper.DryRun, "orphan-sweep-dry-run", true,
+		"Report the orphaned ServiceAccounts and token Secrets as metrics and Events without deleting them. "+
+			"Set it to false to delete them.")
+	flag.BoolVar(&c.Plan, "plan", false,
+		"Report the actions the controllers would perform in the status and Events of Users, AccessGrants, "+
+			"PersonalAccessTokens and Invitations, "+
+			"without performing them. Orphaned objects are only reported.")
+	flag.BoolVar(c.LeaderElection.LeaderElect, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	opts := zap.Options{
@@ -79,14 +175,113 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:                 scheme,
-		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
-		Namespace:              wn,
-		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "49cd215b.kim.io",
+	if configFile != "" {
+		if err := loadConfig(configFile, &c); err != nil {
+			setupLog.Error(err, "invalid configuration")
+			return 1
+		}
+	}
+	if os.Getenv(EnvEnableWebhooks) == "false" {
+		disabled := false
+		c.Features.Webhooks = &disabled
+	}
+	if err := c.Validate(); err != nil {
+		setupLog.Error(err, "invalid configuration")
+		return 1
+	}
+
+	wn, ok := os.LookupEnv(EnvWatchNamespace)
+	if !ok && configFile == "" {
+		setupLog.Error(
+			fmt.Errorf("expected Environment Variable %s not found", EnvWatchNamespace),
+			"error defining controller's scope",
+		)
+		return 1
+	}
+	// KIM is bound to its role in the namespaces of WATCH_NAMESPACE, unless
+	// the config/cluster-wide component binds it cluster-wide and empties it
+	scope := controllers.Scope{Namespaces: splitNamespaces(wn)}
+	watched := scope.Namespaces
+	if scope.ClusterWide() {
+		watched = splitNamespaces(strings.Join(c.WatchNamespaces, ","))
+	}
+	ns, newCache := watchNamespaces(watched)
+	if len(watched) == 0 {
+		setupLog.Info("watching all namespaces")
+	} else {
+		setupLog.Info("watching namespaces", "namespaces", watched)
+	}
+
+	serviceAccount, err := controllers.NewServiceAccountConfig(c.ServiceAccounts.NameTemplate, corev1.SecretType(c.ServiceAccounts.SecretType))
+	if err != nil {
+		setupLog.Error(err, "invalid configuration")
+		return 1
+	}
+
+	var homeNamespace *controllers.HomeNamespaceConfig
+	if c.HomeNamespacesEnabled() {
+		if !scope.ClusterWide() {
+			setupLog.Error(
+				fmt.Errorf("home namespaces require the cluster-wide RBAC, unset %s", EnvWatchNamespace),
+				"invalid configuration",
+			)
+			return 1
+		}
+		var err error
+		homeNamespace, err = controllers.NewHomeNamespaceConfig(
+			c.HomeNamespaces.NameTemplate,
+			c.HomeNamespaces.ClusterRole,
+			c.HomeNamespaces.ResourcesFile,
+			controllers.HomeNamespaceRetentionPolicy(c.HomeNamespaces.RetentionPolicy),
+		)
+		if err != nil {
+			setupLog.Error(err, "invalid configuration")
+			return 1
+		}
+	}
+
+	auditor := audit.Discard
+	if c.AuditEnabled() {
+		s, err := audit.NewSink(c.Audit.Sink, audit.FileOptions{
+			MaxSize:    c.Audit.FileMaxSize,
+			MaxBackups: c.Audit.FileMaxBackups,
+		}, ctrl.Log.WithName("audit"))
+		if err != nil {
+			setupLog.Error(err, "invalid configuration")
+			return 1
+		}
+		defer s.Close()
+		auditor = audit.NewJSONLogger(s, ctrl.Log.WithName("audit"))
+	}
+
+	var inactivity controllers.InactivityPolicy
+	if c.InactivitySuspensionEnabled() {
+		inactivity = controllers.InactivityPolicy{
+			SuspendAfter:  c.Inactivity.SuspendAfter.Duration,
+			WarningPeriod: c.Inactivity.WarningPeriod.Duration,
+		}
+	}
+	quotas := controllers.Quotas{
+		PersonalAccessTokens: c.Quotas.MaxPersonalAccessTokens,
+		AccessGrants:         c.Quotas.MaxAccessGrants,
+		Namespaces:           c.Quotas.MaxNamespaces,
+	}
+
+	mgrOpts, err := ctrl.Options{
+		Scheme:    scheme,
+		Namespace: ns,
+		NewCache:  controllers.WithUserObjectsSelector(newCache),
+		// objects provisioned outside of the watched namespace are not cached,
+		// nor the unlabelled ServiceAccounts and Secrets KIM checks for conflicts
+		ClientDisableCacheFor: []client.Object{
+			&corev1.ServiceAccount{},
+			&corev1.Secret{},
+			&corev1.Namespace{},
+			&corev1.ResourceQuota{},
+			&corev1.LimitRange{},
+			&rbacv1.RoleBinding{},
+			&rbacv1.ClusterRoleBinding{},
+		},
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -98,40 +293,278 @@ func main() {
 		// if you are doing or is intended to do any operation such as perform cleanups
 		// after the manager stops then its usage might be unsafe.
 		// LeaderElectionReleaseOnCancel: true,
-	})
+	}.AndFrom(&c)
+	if err != nil {
+		setupLog.Error(err, "invalid configuration")
+		return 1
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), mgrOpts)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
-		os.Exit(1)
+		return 1
+	}
+
+	if err = controllers.SetupFieldIndexes(context.Background(), mgr.GetFieldIndexer()); err != nil {
+		setupLog.Error(err, "unable to set up field indexes")
+		return 1
+	}
+
+	accessGrantPolicy := newAccessGrantPolicy(c.AccessGrants)
+	bindings, err := controllers.NewBindingsCache(mgr, scope)
+	if err != nil {
+		setupLog.Error(err, "unable to set up bindings cache")
+		return 1
+	}
+
+	tracker := &activity.Tracker{
+		Client:      mgr.GetClient(),
+		Log:         ctrl.Log.WithName("activity"),
+		Granularity: c.Inactivity.ActivityGranularity.Duration,
 	}
 
 	if err = (&controllers.UserReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:         mgr.GetClient(),
+		Scheme:         mgr.GetScheme(),
+		Recorder:       mgr.GetEventRecorderFor("user-controller"),
+		HomeNamespace:  homeNamespace,
+		ServiceAccount: serviceAccount,
+		Quotas:         quotas,
+		Auditor:        audit.WithActor(auditor, "user-controller"),
+		Inactivity:     inactivity,
+		Bindings:       bindings,
+		Scope:          scope,
+		Plan:           c.Plan,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "User")
-		os.Exit(1)
+		return 1
 	}
 	if err = (&controllers.PersonalAccessTokenReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("personalaccesstoken-controller"),
+		Auditor:  audit.WithActor(auditor, "personalaccesstoken-controller"),
+		Plan:     c.Plan,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "PersonalAccessToken")
-		os.Exit(1)
+		return 1
+	}
+	if err = (&controllers.AccessGrantReconciler{
+		Client:         mgr.GetClient(),
+		Scheme:         mgr.GetScheme(),
+		Recorder:       mgr.GetEventRecorderFor("accessgrant-controller"),
+		Auditor:        audit.WithActor(auditor, "accessgrant-controller"),
+		Bindings:       bindings,
+		Policy:         &accessGrantPolicy,
+		ServiceAccount: serviceAccount,
+		Scope:          scope,
+		Plan:           c.Plan,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "AccessGrant")
+		return 1
+	}
+	if c.InvitationsEnabled() {
+		if err = (&controllers.InvitationReconciler{
+			Client:   mgr.GetClient(),
+			Scheme:   mgr.GetScheme(),
+			Recorder: mgr.GetEventRecorderFor("invitation-controller"),
+			Auditor:  audit.WithActor(auditor, "invitation-controller"),
+			Lifetime: c.Invitations.Lifetime.Duration,
+			Plan:     c.Plan,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Invitation")
+			return 1
+		}
+	}
+	if c.WebhooksEnabled() {
+		if err = (&kimiov1beta1.User{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "User")
+			return 1
+		}
+		if err = (&kimiov1beta1.PersonalAccessToken{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "PersonalAccessToken")
+			return 1
+		}
+		if err = (&kimiov1beta1.AccessGrant{}).SetupWebhookWithManager(mgr, accessGrantPolicy); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "AccessGrant")
+			return 1
+		}
+		if err = (&kimiov1beta1.Invitation{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Invitation")
+			return 1
+		}
+		mgr.GetWebhookServer().Register(quota.Path, &webhook.Admission{Handler: &quota.Validator{
+			Client: mgr.GetClient(),
+			Quotas: quotas,
+			Log:    ctrl.Log.WithName("quota"),
+		}})
 	}
 	//+kubebuilder:scaffold:builder
 
+	if c.SelfServiceEnabled() {
+		if err := mgr.Add(&selfservice.Server{
+			Client:        mgr.GetClient(),
+			Authenticator: &selfservice.TokenReviewAuthenticator{Client: mgr.GetClient()},
+			Policy: selfservice.Policy{
+				DefaultLifetime: c.PersonalAccessTokens.DefaultLifetime.Duration,
+				MaxLifetime:     c.PersonalAccessTokens.MaxLifetime.Duration,
+			},
+			Invitations: selfservice.InvitationPolicy{
+				AutoApprove: c.Invitations.AutoApprove,
+				Disabled:    !c.InvitationsEnabled(),
+			},
+			Log:         ctrl.Log.WithName("self-service"),
+			Activity:    tracker,
+			BindAddress: c.SelfService.BindAddress,
+			CertDir:     c.SelfService.CertDir,
+			Insecure:    c.SelfService.Insecure,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up self-service server")
+			return 1
+		}
+	}
+
+	if c.OrphanSweeperEnabled() {
+		if err := mgr.Add(&controllers.OrphanSweeper{
+			Client:         mgr.GetClient(),
+			Recorder:       mgr.GetEventRecorderFor("orphan-sweeper"),
+			Log:            ctrl.Log.WithName("orphan-sweeper"),
+			Auditor:        audit.WithActor(auditor, "orphan-sweeper"),
+			Interval:       c.OrphanSweeper.Interval.Duration,
+			DryRun:         c.OrphanSweeper.DryRun || c.Plan,
+			Scope:          scope,
+			ServiceAccount: serviceAccount,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up orphan sweeper")
+			return 1
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
-		os.Exit(1)
+		return 1
 	}
 	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up ready check")
-		os.Exit(1)
+		return 1
 	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "problem running manager")
-		os.Exit(1)
+		return 1
+	}
+	return 0
+}
+
+// loadConfig loads the configuration file into c, preserving the values of
+// the flags set on the command line
+func loadConfig(path string, c *kimconfigv1alpha1.KIMConfig) error {
+	set := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "config" && !strings.HasPrefix(f.Name, "zap-") {
+			set[f.Name] = f.Value.String()
+		}
+	})
+
+	if err := kimconfigv1alpha1.Load(path, c); err != nil {
+		return err
+	}
+	for n, v := range set {
+		if err := flag.Set(n, v); err != nil {
+			return fmt.Errorf("error applying flag %s: %w", n, err)
+		}
+	}
+	return nil
+}
+
+// splitNamespaces parses the comma-separated list of namespaces to watch,
+// dropping empty entries and duplicates. An empty list means all namespaces.
+func splitNamespaces(value string) []string {
+	nn := []string{}
+	seen := map[string]struct{}{}
+	for _, n := range strings.Split(value, ",") {
+		n = strings.TrimSpace(n)
+		if _, ok := seen[n]; ok || n == "" {
+			continue
+		}
+		seen[n] = struct{}{}
+		nn = append(nn, n)
+	}
+	return nn
+}
+
+// watchNamespaces returns the namespace to set in the Manager's options if at
+// most one namespace is provided, otherwise a multi-namespace cache builder.
+func watchNamespaces(nn []string) (string, cache.NewCacheFunc) {
+	switch len(nn) {
+	case 0:
+		return "", nil
+	case 1:
+		return nn[0], nil
+	default:
+		return "", cache.MultiNamespacedCacheBuilder(nn)
+	}
+}
+
+// int32Value is a flag.Value for non-negative int32 flags
+type int32Value int32
+
+func newInt32Value(p *int32) *int32Value {
+	return (*int32Value)(p)
+}
+
+func (i *int32Value) Set(s string) error {
+	v, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("must not be negative")
+	}
+	*i = int32Value(v)
+	return nil
+}
+
+func (i *int32Value) String() string {
+	return strconv.Itoa(int(*i))
+}
+
+// grantableRolesValue is a flag.Value for comma-separated lists of Kind/Name roles
+type grantableRolesValue []kimconfigv1alpha1.GrantableRole
+
+func (v *grantableRolesValue) Set(s string) error {
+	rr := []kimconfigv1alpha1.GrantableRole{}
+	for _, r := range strings.Split(s, ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		k, n, ok := strings.Cut(r, "/")
+		if !ok {
+			return fmt.Errorf("expected Kind/Name, got %q", r)
+		}
+		rr = append(rr, kimconfigv1alpha1.GrantableRole{Kind: k, Name: n})
+	}
+	*v = rr
+	return nil
+}
+
+func (v *grantableRolesValue) String() string {
+	if v == nil {
+		return ""
+	}
+	rr := make([]string, len(*v))
+	for i, r := range *v {
+		rr[i] = r.Kind + "/" + r.Name
+	}
+	return strings.Join(rr, ",")
+}
+
+// newAccessGrantPolicy returns the policy restricting what AccessGrants grant
+func newAccessGrantPolicy(c kimconfigv1alpha1.AccessGrantsConfig) kimiov1beta1.AccessGrantPolicy {
+	p := kimiov1beta1.AccessGrantPolicy{AllowClusterScope: c.AllowClusterScope}
+	for _, r := range c.GrantableRoles {
+		p.GrantableRoles = append(p.GrantableRoles, kimiov1beta1.AccessProfileRoleRef{Kind: r.Kind, Name: r.Name})
 	}
+	return p
 }
@@ -0,0 +1,74 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package activity records the last activity of Users in their status.
+//
+// Activity is observed wherever KIM authenticates a User, i.e. the requests to
+// the self-service API. The use of the ServiceAccount tokens, authenticated by
+// the API server, is recorded by the User controller from the token Secrets. To limit
+// the writes to the API server, the last activity is only updated when the
+// recorded one is older than the Tracker's granularity.
+package activity
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+// DefaultGranularity is the granularity of Trackers without an explicit one
+const DefaultGranularity = time.Hour
+
+// Tracker records the last activity of Users
+type Tracker struct {
+	Client client.Client
+	Log    logr.Logger
+
+	// Granularity is the minimum time between two updates of a User's last activity
+	Granularity time.Duration
+}
+
+// Observe records the User was active now. Errors are logged, as tracking
+// the activity must not fail the request being served.
+// A nil Tracker does not record anything.
+func (t *Tracker) Observe(ctx context.Context, u *kimiov1beta1.User) {
+	if t == nil {
+		return
+	}
+
+	now := time.Now()
+	if la := u.Status.LastActivity; la != nil && now.Sub(la.Time) < t.granularity() {
+		return
+	}
+
+	p := u.DeepCopy()
+	p.Status.LastActivity = &metav1.Time{Time: now.Truncate(time.Second)}
+	if err := t.Client.Status().Patch(ctx, p, client.MergeFrom(u)); err != nil {
+		t.Log.Error(err, "error recording user activity", "namespace", u.Namespace, "user", u.Name)
+	}
+}
+
+func (t *Tracker) granularity() time.Duration {
+	if t.Granularity > 0 {
+		return t.Granularity
+	}
+	return DefaultGranularity
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package activity
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+func TestObserve(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := kimiov1beta1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	u := &kimiov1beta1.User{ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: "alice"}}
+	c := fake.NewClientBuilder().WithScheme(s).WithObjects(u).Build()
+	tr := &Tracker{Client: c, Log: log.Log}
+
+	get := func() *kimiov1beta1.User {
+		var u kimiov1beta1.User
+		if err := c.Get(context.TODO(), types.NamespacedName{Namespace: "tenant", Name: "alice"}, &u); err != nil {
+			t.Fatal(err)
+		}
+		return &u
+	}
+
+	tr.Observe(context.TODO(), get())
+	first := get().Status.LastActivity
+	if first == nil {
+		t.Fatal("expected activity to be recorded")
+	}
+
+	// activity within the granularity is not recorded
+	u = get()
+	old := metav1.NewTime(time.Now().Add(-time.Minute).Truncate(time.Second))
+	u.Status.LastActivity = &old
+	if err := c.Status().Update(context.TODO(), u); err != nil {
+		t.Fatal(err)
+	}
+	tr.Observe(context.TODO(), get())
+	if la := get().Status.LastActivity; !la.Equal(&old) {
+		t.Fatalf("expected activity not to be updated, got %s", la)
+	}
+
+	// older activity is updated
+	old = metav1.NewTime(time.Now().Add(-2 * DefaultGranularity))
+	u = get()
+	u.Status.LastActivity = &old
+	if err := c.Status().Update(context.TODO(), u); err != nil {
+		t.Fatal(err)
+	}
+	tr.Observe(context.TODO(), get())
+	if la := get().Status.LastActivity; !la.After(old.Time) {
+		t.Fatalf("expected activity to be updated, got %s", la)
+	}
+
+	// a nil tracker does nothing
+	var nt *Tracker
+	nt.Observe(context.TODO(), &kimiov1beta1.User{})
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit writes the lifecycle actions performed by KIM's reconcilers as
+// structured JSON records, one per line, to a configurable sink.
+//
+// Records of the same reconciliation share a correlation id, carried by the
+// context with WithCorrelationID, and are attributed to who requested the
+// actions, carried by the context with WithRequester, if known.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Action is the kind of action a Record reports
+type Action string
+
+const (
+	// StateChangedAction reports the change of the state or phase of an object
+	StateChangedAction Action = "StateChanged"
+	// CreatedAction reports the creation of an object
+	CreatedAction Action = "Created"
+	// DeletedAction reports the deletion of an object
+	DeletedAction Action = "Deleted"
+	// TokenIssuedAction reports the issuance of a Personal Access Token
+	TokenIssuedAction Action = "TokenIssued"
+	// TokenRevokedAction reports the deletion of a Personal Access Token no more valid
+	TokenRevokedAction Action = "TokenRevoked"
+)
+
+// Object identifies the target of a Record
+type Object struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// Record is a single audit record
+type Record struct {
+	Time          time.Time `json:"time"`
+	CorrelationID string    `json:"correlationId,omitempty"`
+	// Actor is who performed the action
+	Actor  string `json:"actor"`
+	Action Action `json:"action"`
+	Target Object `json:"target"`
+	// Old and New are the values before and after the action, if any
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+	// Reason is the reason of the action, if any
+	Reason string `json:"reason,omitempty"`
+}
+
+// Logger writes audit records
+type Logger interface {
+	Log(ctx context.Context, r Record)
+}
+
+// Discard is a Logger discarding all the records
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Log(context.Context, Record) {}
+
+// JSONLogger writes each record as a JSON line to its sink. Errors are
+// reported to Errors, so that a failing sink does not stop the reconcilers;
+// the HTTPSink does not block them either, as it sends records in background.
+type JSONLogger struct {
+	mu     sync.Mutex
+	sink   io.Writer
+	errors logr.Logger
+}
+
+// NewJSONLogger returns a JSONLogger writing to sink
+func NewJSONLogger(sink io.Writer, errors logr.Logger) *JSONLogger {
+	return &JSONLogger{sink: sink, errors: errors}
+}
+
+// Log completes the record with the time and the correlation id from ctx and writes it
+func (l *JSONLogger) Log(ctx context.Context, r Record) {
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+	if r.CorrelationID == "" {
+		r.CorrelationID = CorrelationID(ctx)
+	}
+	if r.Actor == "" {
+		r.Actor = Requester(ctx)
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		l.errors.Error(err, "error encoding audit record", "record", r)
+		return
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.sink.Write(b); err != nil {
+		l.errors.Error(err, "error writing audit record", "record", string(b))
+	}
+}
+
+// WithActor returns a Logger setting the actor of records that don't have one,
+// nor a requester in their context
+func WithActor(l Logger, actor string) Logger {
+	return actorLogger{Logger: l, actor: actor}
+}
+
+type actorLogger struct {
+	Logger
+	actor string
+}
+
+func (l actorLogger) Log(ctx context.Context, r Record) {
+	if r.Actor == "" {
+		r.Actor = Requester(ctx)
+	}
+	if r.Actor == "" {
+		r.Actor = l.actor
+	}
+	l.Logger.Log(ctx, r)
+}
+
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a copy of ctx carrying the correlation id
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the correlation id carried by ctx, if any
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+type requesterKey struct{}
+
+// WithRequester returns a copy of ctx carrying who requested the actions
+// performed with it, e.g. who changed the state of a User, the actor of the
+// records without one. An empty requester leaves ctx unchanged.
+func WithRequester(ctx context.Context, requester string) context.Context {
+	if requester == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requesterKey{}, requester)
+}
+
+// Requester returns the requester carried by ctx, if any
+func Requester(ctx context.Context) string {
+	r, _ := ctx.Value(requesterKey{}).(string)
+	return r
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var b bytes.Buffer
+	l := WithActor(NewJSONLogger(&b, log.Log), "user-controller")
+
+	ctx := WithCorrelationID(context.TODO(), "42")
+	l.Log(ctx, Record{
+		Action: StateChangedAction,
+		Target: Object{Kind: "User", Namespace: "tenant", Name: "alice"},
+		Old:    "Active",
+		New:    "Banned",
+	})
+	l.Log(ctx, Record{Actor: "bob", Action: DeletedAction, Target: Object{Kind: "ServiceAccount", Namespace: "tenant", Name: "alice"}})
+	l.Log(WithRequester(ctx, "carol"), Record{Action: DeletedAction, Target: Object{Kind: "Secret", Namespace: "tenant", Name: "alice"}})
+
+	d := json.NewDecoder(&b)
+	var r Record
+	if err := d.Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Actor != "user-controller" || r.CorrelationID != "42" || r.Time.IsZero() {
+		t.Fatalf("expected record to be completed, got %+v", r)
+	}
+	if r.Old != "Active" || r.New != "Banned" || r.Target.Name != "alice" {
+		t.Fatalf("unexpected record %+v", r)
+	}
+
+	if err := d.Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Actor != "bob" {
+		t.Fatalf("expected explicit actor to be kept, got %s", r.Actor)
+	}
+	if err := d.Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Actor != "carol" {
+		t.Fatalf("expected the requester to be the actor, got %s", r.Actor)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// FileOptions configures the rotation of file sinks
+type FileOptions struct {
+	// MaxSize is the size in bytes a file is rotated at
+	MaxSize int64
+	// MaxBackups is the number of rotated files retained
+	MaxBackups int
+}
+
+// NewSink returns the sink described by spec:
+//
+//	stdout                    the standard output
+//	file:///var/log/kim.log   a file, rotated as defined by opts
+//	https://collector/audit   an HTTP collector, each record is POSTed
+//
+// The errors of the sinks writing in background are reported to log.
+func NewSink(spec string, opts FileOptions, log logr.Logger) (io.WriteCloser, error) {
+	if spec == "stdout" {
+		return nopCloser{os.Stdout}, nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit sink %q: %w", spec, err)
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid audit sink %q: path is required", spec)
+		}
+		return NewRotatingFile(u.Path, opts)
+	case "http", "https":
+		return NewHTTPSink(spec, &http.Client{Timeout: 10 * time.Second}, log), nil
+	default:
+		return nil, fmt.Errorf("invalid audit sink %q: expected stdout, file:// or http(s)://", spec)
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// RotatingFile is a file sink that, once it exceeds MaxSize, is renamed
+// with the .1 suffix, shifting the older backups, and opened again
+type RotatingFile struct {
+	path string
+	opts FileOptions
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewRotatingFile opens, or creates, the file at path
+func NewRotatingFile(path string, opts FileOptions) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f := &RotatingFile{path: path, opts: opts}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would exceed MaxSize
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.opts.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.opts.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	if f.opts.MaxBackups <= 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return f.open()
+	}
+
+	for i := f.opts.MaxBackups - 1; i > 0; i-- {
+		if err := os.Rename(f.backup(i), f.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.path, f.backup(1)); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *RotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
+
+// Close closes the file
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+const (
+	// httpSinkBufferSize is the number of records an HTTPSink buffers
+	httpSinkBufferSize = 1024
+	// httpSinkMaxAttempts is the number of times an HTTPSink sends a record before dropping it
+	httpSinkMaxAttempts = 5
+	// httpSinkRetryBackoff is the wait before the first retry, doubled at each retry
+	httpSinkRetryBackoff = time.Second
+)
+
+var droppedRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kim_audit_records_dropped_total",
+	Help: "Number of audit records dropped by the HTTP sink, because its buffer was full, it was closed or the collector kept failing",
+}, []string{"reason"})
+
+func init() {
+	metrics.Registry.MustRegister(droppedRecords)
+}
+
+// HTTPSink POSTs each write, a single record, to an HTTP collector. Writes
+// are buffered and sent by a background goroutine, that retries the failed
+// ones with an exponential backoff, so that a slow or failing collector does
+// not slow down the reconcilers. The dropped records, because the buffer is
+// full or the collector keeps failing, are counted by the
+// kim_audit_records_dropped_total metric.
+type HTTPSink struct {
+	url    string
+	client *http.Client
+	log    logr.Logger
+
+	maxAttempts int
+	backoff     time.Duration
+
+	mu      sync.Mutex
+	closed  bool
+	records chan []byte
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewHTTPSink returns an HTTPSink POSTing to url, reporting the records it
+// fails to send to log
+func NewHTTPSink(url string, client *http.Client, log logr.Logger) *HTTPSink {
+	return newHTTPSink(url, client, log, httpSinkBufferSize, httpSinkMaxAttempts, httpSinkRetryBackoff)
+}
+
+func newHTTPSink(url string, client *http.Client, log logr.Logger, bufferSize, maxAttempts int, backoff time.Duration) *HTTPSink {
+	s := &HTTPSink{
+		url:         url,
+		client:      client,
+		log:         log,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		records:     make(chan []byte, bufferSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Write queues p to be sent to the collector, failing if the buffer is full
+func (s *HTTPSink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		droppedRecords.WithLabelValues("Closed").Inc()
+		return 0, errors.New("audit sink closed, record dropped")
+	}
+	select {
+	case s.records <- append([]byte(nil), p...):
+		return len(p), nil
+	default:
+		droppedRecords.WithLabelValues("BufferFull").Inc()
+		return 0, errors.New("audit sink buffer full, record dropped")
+	}
+}
+
+func (s *HTTPSink) run() {
+	defer close(s.done)
+	for p := range s.records {
+		s.send(p)
+	}
+}
+
+// send POSTs p to the collector, retrying until it is accepted or the
+// attempts are exhausted. Once the sink is closed, failed records are not
+// retried, so that closing it is not delayed by a failing collector.
+func (s *HTTPSink) send(p []byte) {
+	backoff := s.backoff
+	for attempt := 1; ; attempt++ {
+		err := s.post(p)
+		if err == nil {
+			return
+		}
+		if attempt >= s.maxAttempts {
+			droppedRecords.WithLabelValues("SendFailed").Inc()
+			s.log.Error(err, "error sending audit record, dropping it", "record", string(p), "attempts", attempt)
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-s.stop:
+			droppedRecords.WithLabelValues("SendFailed").Inc()
+			s.log.Error(err, "error sending audit record on close, dropping it", "record", string(p), "attempts", attempt)
+			return
+		}
+	}
+}
+
+// post sends p to the collector, failing on non 2xx responses
+func (s *HTTPSink) post(p []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(bytes.TrimSuffix(p, []byte("\n"))))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit collector answered %s", strings.TrimSpace(resp.Status))
+	}
+	return nil
+}
+
+// Close stops accepting writes and returns once the buffered records are sent
+func (s *HTTPSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.records)
+		close(s.stop)
+	}
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
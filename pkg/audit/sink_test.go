@@ -0,0 +1,159 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestRotatingFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "audit.log")
+	f, err := NewRotatingFile(p, FileOptions{MaxSize: 10, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, l := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(l)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, expected := range map[string]string{
+		p:        "fourth\n",
+		p + ".1": "third\n",
+		p + ".2": "second\n",
+	} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != expected {
+			t.Fatalf("expected %s to contain %q, got %q", name, expected, b)
+		}
+	}
+	if _, err := os.Stat(p + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 backups, got %v", err)
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	failures := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		received = append(received, string(b))
+	}))
+	defer srv.Close()
+
+	s := newHTTPSink(srv.URL, srv.Client(), log.Log, 10, 3, time.Millisecond)
+	for _, r := range []string{"{\"first\":true}\n", "{\"second\":true}\n"} {
+		if _, err := s.Write([]byte(r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first record is sent at the third attempt
+	sent := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), received...)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(sent()) < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if r := sent(); len(r) != 2 || r[0] != `{"first":true}` || r[1] != `{"second":true}` {
+		t.Fatalf("expected the records to be posted in order, got %q", r)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("{}\n")); err == nil {
+		t.Fatal("expected an error writing to a closed sink")
+	}
+}
+
+func TestHTTPSinkDropsRecords(t *testing.T) {
+	posted := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	full := testutil.ToFloat64(droppedRecords.WithLabelValues("BufferFull"))
+	failed := testutil.ToFloat64(droppedRecords.WithLabelValues("SendFailed"))
+
+	s := newHTTPSink(srv.URL, srv.Client(), log.Log, 1, 1, time.Millisecond)
+	if _, err := s.Write([]byte("{}\n")); err != nil {
+		t.Fatal(err)
+	}
+	// the first record is being sent, the second one fills the buffer
+	<-posted
+	if _, err := s.Write([]byte("{}\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("{}\n")); err == nil {
+		t.Fatal("expected an error writing to a full buffer")
+	}
+
+	go func() {
+		for range posted {
+		}
+	}()
+	close(release)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(posted)
+
+	if d := testutil.ToFloat64(droppedRecords.WithLabelValues("BufferFull")) - full; d != 1 {
+		t.Errorf("expected 1 record dropped for the full buffer, got %v", d)
+	}
+	if d := testutil.ToFloat64(droppedRecords.WithLabelValues("SendFailed")) - failed; d != 2 {
+		t.Errorf("expected 2 records dropped for the failing collector, got %v", d)
+	}
+}
+
+func TestNewSinkRefusesUnknownSinks(t *testing.T) {
+	for _, spec := range []string{"stderr", "ftp://collector", "file://"} {
+		if _, err := NewSink(spec, FileOptions{}, log.Log); err == nil {
+			t.Fatalf("expected error for %q", spec)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bulk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+// Export returns the records of the Users in the namespace, sorted by name
+func Export(ctx context.Context, c client.Reader, namespace string) ([]Record, error) {
+	var uu kimiov1beta1.UserList
+	if err := c.List(ctx, &uu, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	var pp kimiov1beta1.PersonalAccessTokenList
+	if err := c.List(ctx, &pp, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+
+	tokens := map[string][]kimiov1beta1.PersonalAccessToken{}
+	for _, p := range pp.Items {
+		tokens[p.Spec.User.Name] = append(tokens[p.Spec.User.Name], p)
+	}
+
+	rr := make([]Record, len(uu.Items))
+	for i := range uu.Items {
+		rr[i] = NewRecord(&uu.Items[i], tokens[uu.Items[i].Name])
+	}
+	sort.Slice(rr, func(i, j int) bool { return rr[i].Name < rr[j].Name })
+	return rr, nil
+}
+
+// Action is what an import does with a record
+type Action string
+
+const (
+	CreateAction    Action = "Create"
+	UpdateAction    Action = "Update"
+	UnchangedAction Action = "Unchanged"
+	ErrorAction     Action = "Error"
+)
+
+// Result is the outcome of the import of a record
+type Result struct {
+	// Row is the row of the record, numbered from 1
+	Row    int
+	Name   string
+	Action Action
+	// Diff lists the changed fields, as 'column: "old" -> "new"'
+	Diff []string
+	Err  error
+}
+
+// Import creates or updates the Users of the records in the namespace.
+// Records are imported independently: a failure is reported in the Result of
+// the record and does not stop the import. Nil records, i.e. malformed rows,
+// are skipped. In dry run mode, changes are validated by the API server but
+// not persisted.
+func Import(ctx context.Context, c client.Client, namespace string, rr []*Record, dryRun bool) []Result {
+	var res []Result
+	seen := map[string]int{}
+	for i, rec := range rr {
+		if rec == nil {
+			continue
+		}
+
+		r := Result{Row: i + 1, Name: rec.Name}
+		if j, ok := seen[rec.Name]; ok {
+			r.Action, r.Err = ErrorAction, fmt.Errorf("user %s already defined at row %d", rec.Name, j)
+		} else {
+			seen[rec.Name] = r.Row
+			r.Action, r.Diff, r.Err = importRecord(ctx, c, namespace, rec, dryRun)
+		}
+		if r.Err != nil {
+			r.Action = ErrorAction
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+func importRecord(ctx context.Context, c client.Client, namespace string, rec *Record, dryRun bool) (Action, []string, error) {
+	if err := validate(rec); err != nil {
+		return ErrorAction, nil, err
+	}
+
+	var oo []client.CreateOption
+	var uo []client.UpdateOption
+	if dryRun {
+		oo = append(oo, client.DryRunAll)
+		uo = append(uo, client.DryRunAll)
+	}
+
+	var u kimiov1beta1.User
+	err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: rec.Name}, &u)
+	switch {
+	case kerrors.IsNotFound(err):
+		u = kimiov1beta1.User{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: rec.Name}}
+		if err := rec.applyTo(&u); err != nil {
+			return ErrorAction, nil, err
+		}
+		d := diff(&kimiov1beta1.User{}, &u)
+		if err := c.Create(ctx, &u, oo...); err != nil {
+			return ErrorAction, d, err
+		}
+		return CreateAction, d, nil
+
+	case err != nil:
+		return ErrorAction, nil, err
+
+	default:
+		old := u.DeepCopy()
+		if err := rec.applyTo(&u); err != nil {
+			return ErrorAction, nil, err
+		}
+		d := diff(old, &u)
+		if len(d) == 0 {
+			return UnchangedAction, nil, nil
+		}
+		if err := c.Update(ctx, &u, uo...); err != nil {
+			return ErrorAction, d, err
+		}
+		return UpdateAction, d, nil
+	}
+}
+
+// diff lists the columns whose value changes from old to new
+func diff(old, new *kimiov1beta1.User) []string {
+	or, nr := NewRecord(old, nil), NewRecord(new, nil)
+	ov, nv := or.values(), nr.values()
+
+	var d []string
+	for _, c := range Columns {
+		if c == "name" || c == "personalAccessTokens" || ov[c] == nv[c] {
+			continue
+		}
+		d = append(d, fmt.Sprintf("%s: %q -> %q", c, ov[c], nv[c]))
+	}
+	return d
+}
+
+var reasonCodeRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+
+// validate checks the record before sending it to the API server, so that
+// errors are reported with the name of the column
+func validate(rec *Record) error {
+	var ee []error
+	if vv := validation.IsDNS1123Subdomain(rec.Name); len(vv) > 0 {
+		ee = append(ee, fmt.Errorf("invalid name %q: %s", rec.Name, strings.Join(vv, ", ")))
+	}
+	if rec.Username == "" {
+		ee = append(ee, errors.New("username is required"))
+	}
+	if _, err := mail.ParseAddress(rec.Email); err != nil {
+		ee = append(ee, fmt.Errorf("invalid email %q: %w", rec.Email, err))
+	}
+	if rec.SecondaryMail != "" {
+		if _, err := mail.ParseAddress(rec.SecondaryMail); err != nil {
+			ee = append(ee, fmt.Errorf("invalid secondaryMail %q: %w", rec.SecondaryMail, err))
+		}
+	}
+	switch kimiov1beta1.UserState(rec.State) {
+	case "", kimiov1beta1.WaitingForApprovalUserState, kimiov1beta1.ActiveUserState,
+		kimiov1beta1.SuspendedUserState, kimiov1beta1.BannedUserState:
+	default:
+		ee = append(ee, fmt.Errorf("invalid state %q", rec.State))
+	}
+	if rec.ReasonCode != "" && !reasonCodeRegexp.MatchString(rec.ReasonCode) {
+		ee = append(ee, fmt.Errorf("invalid reasonCode %q", rec.ReasonCode))
+	}
+	for c, v := range map[string]string{
+		"expiration":     rec.Expiration,
+		"suspendedUntil": rec.SuspendedUntil,
+		"bannedUntil":    rec.BannedUntil,
+	} {
+		if _, err := parseTime(c, v); err != nil {
+			ee = append(ee, err)
+		}
+	}
+	return joinErrors(ee)
+}
+
+// joinErrors joins the errors in a single one, nil if there are none
+func joinErrors(ee []error) error {
+	if len(ee) == 0 {
+		return nil
+	}
+	ss := make([]string, len(ee))
+	for i, e := range ee {
+		ss[i] = e.Error()
+	}
+	sort.Strings(ss)
+	return errors.New(strings.Join(ss, "; "))
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bulk
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+func newFakeClient(t *testing.T, oo ...client.Object) client.Client {
+	s := runtime.NewScheme()
+	if err := kimiov1beta1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	return fake.NewClientBuilder().WithScheme(s).WithObjects(oo...).Build()
+}
+
+func newUser(name string) *kimiov1beta1.User {
+	company := "ACME"
+	return &kimiov1beta1.User{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: name},
+		Spec: kimiov1beta1.UserSpec{
+			Username: name,
+			Email:    name + "@example.com",
+			State:    kimiov1beta1.ActiveUserState,
+			Company:  &company,
+			Profiles: []kimiov1beta1.AccessProfileReference{{Name: "dev"}, {Name: "ops"}},
+		},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	p := &kimiov1beta1.PersonalAccessToken{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: "alice-ci"},
+		Spec:       kimiov1beta1.PersonalAccessTokenSpec{User: kimiov1beta1.UserReference{Name: "alice"}},
+	}
+	c := newFakeClient(t, newUser("bob"), newUser("alice"), p)
+
+	rr, err := Export(context.TODO(), c, "tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rr) != 2 || rr[0].Name != "alice" || rr[1].Name != "bob" {
+		t.Fatalf("expected alice and bob, got %v", rr)
+	}
+	if len(rr[0].PersonalAccessTokens) != 1 || rr[0].PersonalAccessTokens[0].Name != "alice-ci" {
+		t.Fatalf("expected alice's token to be exported, got %v", rr[0].PersonalAccessTokens)
+	}
+
+	for _, f := range []Format{CSVFormat, YAMLFormat, JSONFormat} {
+		t.Run(string(f), func(t *testing.T) {
+			var b bytes.Buffer
+			if err := Write(&b, f, rr); err != nil {
+				t.Fatal(err)
+			}
+			got, ee, err := Read(&b, f)
+			if err != nil || len(ee) != 0 {
+				t.Fatalf("unexpected errors: %v, %v", err, ee)
+			}
+			if len(got) != len(rr) {
+				t.Fatalf("expected %d records, got %d", len(rr), len(got))
+			}
+			for i := range got {
+				// tokens are not read from CSV documents
+				exp := rr[i]
+				if f == CSVFormat {
+					exp.PersonalAccessTokens = nil
+				}
+				g := *got[i]
+				g.columns = nil
+				if !reflect.DeepEqual(g, exp) {
+					t.Errorf("expected record %v, got %v", exp, g)
+				}
+			}
+		})
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	d := `name,username,email,profiles
+alice,alice,alice@example.com,dev; ops
+bob,bob
+carol,carol,carol@example.com,
+`
+	rr, ee, err := Read(strings.NewReader(d), CSVFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rr) != 3 || rr[0] == nil || rr[1] != nil || rr[2] == nil {
+		t.Fatalf("expected the second row to be malformed, got %v", rr)
+	}
+	if len(ee) != 1 || ee[0].Row != 2 {
+		t.Fatalf("expected an error at row 2, got %v", ee)
+	}
+	if !reflect.DeepEqual(rr[0].Profiles, []string{"dev", "ops"}) {
+		t.Errorf("expected profiles dev and ops, got %v", rr[0].Profiles)
+	}
+
+	for _, d := range []string{
+		"name,username\nalice,alice\n",
+		"name,username,email,role\nalice,alice,alice@example.com,admin\n",
+	} {
+		if _, _, err := Read(strings.NewReader(d), CSVFormat); err == nil {
+			t.Errorf("expected an error reading %q", d)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	c := newFakeClient(t, newUser("alice"), newUser("bob"))
+
+	alice := NewRecord(newUser("alice"), nil)
+	bob := NewRecord(newUser("bob"), nil)
+	bob.Company = "Initech"
+	bob.State = ""
+	carol := NewRecord(newUser("carol"), nil)
+	invalid := Record{Name: "Dave", Username: "dave", Email: "dave", State: "Unknown"}
+
+	rr := []*Record{&alice, &bob, nil, &carol, &invalid, &alice}
+	for _, dryRun := range []bool{true, false} {
+		res := Import(context.TODO(), c, "tenant", rr, dryRun)
+
+		exp := []struct {
+			row    int
+			action Action
+		}{
+			{1, UnchangedAction},
+			{2, UpdateAction},
+			{4, CreateAction},
+			{5, ErrorAction},
+			{6, ErrorAction},
+		}
+		if len(res) != len(exp) {
+			t.Fatalf("expected %d results, got %v", len(exp), res)
+		}
+		for i, e := range exp {
+			if res[i].Row != e.row || res[i].Action != e.action {
+				t.Errorf("expected row %d to be %s, got %+v", e.row, e.action, res[i])
+			}
+		}
+		if d := res[1].Diff; len(d) != 1 || d[0] != `company: "ACME" -> "Initech"` {
+			t.Errorf("unexpected diff for bob: %v", d)
+		}
+
+		var u kimiov1beta1.User
+		err := c.Get(context.TODO(), types.NamespacedName{Namespace: "tenant", Name: "carol"}, &u)
+		if dryRun != (err != nil) {
+			t.Errorf("expected carol to be created only when not in dry run, got %v", err)
+		}
+		if err := c.Get(context.TODO(), types.NamespacedName{Namespace: "tenant", Name: "bob"}, &u); err != nil {
+			t.Fatal(err)
+		}
+		if dryRun == (*u.Spec.Company == "Initech") {
+			t.Errorf("expected bob to be updated only when not in dry run, got %s", *u.Spec.Company)
+		}
+		if u.Spec.State != kimiov1beta1.ActiveUserState {
+			t.Errorf("expected bob's state to be kept, got %s", u.Spec.State)
+		}
+	}
+}
+
+func TestImportPartial(t *testing.T) {
+	for f, d := range map[Format]string{
+		CSVFormat: `name,username,email,company
+alice,alice,alice@example.com,Initech
+bob,bob,bob@example.com,
+`,
+		YAMLFormat: `users:
+- name: alice
+  username: alice
+  email: alice@example.com
+  company: Initech
+- name: bob
+  username: bob
+  email: bob@example.com
+  company: ""
+`,
+	} {
+		t.Run(string(f), func(t *testing.T) {
+			c := newFakeClient(t, newUser("alice"), newUser("bob"))
+			rr, ee, err := Read(strings.NewReader(d), f)
+			if err != nil || len(ee) != 0 {
+				t.Fatalf("unexpected errors: %v, %v", err, ee)
+			}
+			res := Import(context.TODO(), c, "tenant", rr, false)
+			if len(res) != 2 || res[0].Action != UpdateAction || res[1].Action != UpdateAction {
+				t.Fatalf("expected alice and bob to be updated, got %+v", res)
+			}
+			if d := res[0].Diff; len(d) != 1 || d[0] != `company: "ACME" -> "Initech"` {
+				t.Errorf("unexpected diff for alice: %v", d)
+			}
+			if d := res[1].Diff; len(d) != 1 || d[0] != `company: "ACME" -> ""` {
+				t.Errorf("unexpected diff for bob: %v", d)
+			}
+
+			var u kimiov1beta1.User
+			if err := c.Get(context.TODO(), types.NamespacedName{Namespace: "tenant", Name: "alice"}, &u); err != nil {
+				t.Fatal(err)
+			}
+			if len(u.Spec.Profiles) != 2 {
+				t.Errorf("expected the profiles missing from the document to be kept, got %v", u.Spec.Profiles)
+			}
+			if err := c.Get(context.TODO(), types.NamespacedName{Namespace: "tenant", Name: "bob"}, &u); err != nil {
+				t.Fatal(err)
+			}
+			if u.Spec.Company != nil {
+				t.Errorf("expected bob's company to be cleared, got %s", *u.Spec.Company)
+			}
+		})
+	}
+}
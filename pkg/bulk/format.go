@@ -0,0 +1,200 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bulk
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Write writes the records to w in the given format
+func Write(w io.Writer, f Format, rr []Record) error {
+	switch f {
+	case CSVFormat:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(Columns); err != nil {
+			return err
+		}
+		for i := range rr {
+			vv := rr[i].values()
+			row := make([]string, len(Columns))
+			for j, c := range Columns {
+				row[j] = vv[c]
+			}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+
+	case YAMLFormat:
+		b, err := yaml.Marshal(Document{Users: rr})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+
+	case JSONFormat:
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(Document{Users: rr})
+
+	default:
+		return fmt.Errorf("unsupported format %q, expected one of csv, yaml, json", f)
+	}
+}
+
+// RowError is an error in a row of a document. Rows are numbered from 1,
+// excluding the CSV header.
+type RowError struct {
+	Row int
+	Err error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("row %d: %v", e.Row, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// Read reads the records from r in the given format. Malformed rows are
+// reported as RowErrors and their record is nil, an error is returned only
+// when the document can not be read at all.
+func Read(r io.Reader, f Format) ([]*Record, []*RowError, error) {
+	switch f {
+	case CSVFormat:
+		return readCSV(r)
+
+	case YAMLFormat, JSONFormat:
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		var d Document
+		if err := yaml.UnmarshalStrict(b, &d); err != nil {
+			return nil, nil, err
+		}
+		// the fields set in each record, to tell the empty ones from the unset ones
+		var fd struct {
+			Users []map[string]interface{} `json:"users"`
+		}
+		if err := yaml.Unmarshal(b, &fd); err != nil {
+			return nil, nil, err
+		}
+		rr := make([]*Record, len(d.Users))
+		for i := range d.Users {
+			rr[i] = &d.Users[i]
+			rr[i].columns = map[string]bool{}
+			for c := range fd.Users[i] {
+				rr[i].columns[c] = true
+			}
+		}
+		return rr, nil, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unsupported format %q, expected one of csv, yaml, json", f)
+	}
+}
+
+func readCSV(r io.Reader) ([]*Record, []*RowError, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	h, err := cr.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading header: %w", err)
+	}
+	idx := map[string]int{}
+	for i, c := range h {
+		idx[strings.TrimSpace(c)] = i
+	}
+	for _, c := range []string{"name", "username", "email"} {
+		if _, ok := idx[c]; !ok {
+			return nil, nil, fmt.Errorf("missing required column %q", c)
+		}
+	}
+	known := map[string]bool{}
+	for _, c := range Columns {
+		known[c] = true
+	}
+	columns := map[string]bool{}
+	for c := range idx {
+		if !known[c] {
+			return nil, nil, fmt.Errorf("unknown column %q", c)
+		}
+		columns[c] = true
+	}
+
+	var rr []*Record
+	var ee []*RowError
+	for n := 1; ; n++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return rr, ee, nil
+		}
+		if err != nil {
+			rr = append(rr, nil)
+			ee = append(ee, &RowError{Row: n, Err: err})
+			continue
+		}
+		if len(row) != len(h) {
+			rr = append(rr, nil)
+			ee = append(ee, &RowError{Row: n, Err: fmt.Errorf("expected %d columns, got %d", len(h), len(row))})
+			continue
+		}
+
+		get := func(c string) string {
+			if i, ok := idx[c]; ok {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		rec := &Record{
+			Name:           get("name"),
+			Username:       get("username"),
+			Email:          get("email"),
+			State:          get("state"),
+			Expiration:     get("expiration"),
+			DisplayName:    get("displayName"),
+			GivenName:      get("givenName"),
+			FamilyName:     get("familyName"),
+			Company:        get("company"),
+			SecondaryMail:  get("secondaryMail"),
+			SuspendedUntil: get("suspendedUntil"),
+			BannedUntil:    get("bannedUntil"),
+			ReasonCode:     get("reasonCode"),
+			columns:        columns,
+		}
+		if p := get("profiles"); p != "" {
+			for _, s := range strings.Split(p, listSeparator) {
+				if s = strings.TrimSpace(s); s != "" {
+					rec.Profiles = append(rec.Profiles, s)
+				}
+			}
+		}
+		rr = append(rr, rec)
+	}
+}
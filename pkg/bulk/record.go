@@ -0,0 +1,254 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bulk exports and imports Users as CSV, YAML or JSON documents.
+//
+// Each User is a Record, whose fields map one to one to the UserSpec fields.
+// The CSV columns are listed, in order, by Columns. The Personal Access Tokens
+// of the Users are exported for reference, but ignored on import. Imports only
+// update the fields in the CSV header or set in the YAML or JSON record.
+package bulk
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+)
+
+// Format is the format of a document
+type Format string
+
+const (
+	CSVFormat  Format = "csv"
+	YAMLFormat Format = "yaml"
+	JSONFormat Format = "json"
+)
+
+// listSeparator separates the items of list columns in CSV documents
+const listSeparator = ";"
+
+// Columns are the CSV columns, in order
+var Columns = []string{
+	"name",
+	"username",
+	"email",
+	"state",
+	"expiration",
+	"displayName",
+	"givenName",
+	"familyName",
+	"company",
+	"secondaryMail",
+	"profiles",
+	"suspendedUntil",
+	"bannedUntil",
+	"reasonCode",
+	"personalAccessTokens",
+}
+
+// Record is a User in an exported document
+type Record struct {
+	Name           string   `json:"name"`
+	Username       string   `json:"username"`
+	Email          string   `json:"email"`
+	State          string   `json:"state,omitempty"`
+	Expiration     string   `json:"expiration,omitempty"`
+	DisplayName    string   `json:"displayName,omitempty"`
+	GivenName      string   `json:"givenName,omitempty"`
+	FamilyName     string   `json:"familyName,omitempty"`
+	Company        string   `json:"company,omitempty"`
+	SecondaryMail  string   `json:"secondaryMail,omitempty"`
+	Profiles       []string `json:"profiles,omitempty"`
+	SuspendedUntil string   `json:"suspendedUntil,omitempty"`
+	BannedUntil    string   `json:"bannedUntil,omitempty"`
+	ReasonCode     string   `json:"reasonCode,omitempty"`
+
+	// PersonalAccessTokens are exported for reference and ignored on import
+	PersonalAccessTokens []PersonalAccessTokenRecord `json:"personalAccessTokens,omitempty"`
+
+	// columns are the columns set in the document the record was read from,
+	// the only ones applied on import. Nil means all of them.
+	columns map[string]bool
+}
+
+// PersonalAccessTokenRecord is the metadata of a PersonalAccessToken in an exported document
+type PersonalAccessTokenRecord struct {
+	Name       string `json:"name"`
+	Phase      string `json:"phase,omitempty"`
+	Expiration string `json:"expiration,omitempty"`
+}
+
+// String returns the CSV representation of the PersonalAccessToken, i.e. name:phase:expiration
+func (p PersonalAccessTokenRecord) String() string {
+	return strings.Join([]string{p.Name, p.Phase, p.Expiration}, ":")
+}
+
+// Document is the content of a YAML or JSON document
+type Document struct {
+	Users []Record `json:"users"`
+}
+
+// values returns the values of the record by column
+func (r *Record) values() map[string]string {
+	pp := make([]string, len(r.PersonalAccessTokens))
+	for i, p := range r.PersonalAccessTokens {
+		pp[i] = p.String()
+	}
+	return map[string]string{
+		"name":                 r.Name,
+		"username":             r.Username,
+		"email":                r.Email,
+		"state":                r.State,
+		"expiration":           r.Expiration,
+		"displayName":          r.DisplayName,
+		"givenName":            r.GivenName,
+		"familyName":           r.FamilyName,
+		"company":              r.Company,
+		"secondaryMail":        r.SecondaryMail,
+		"profiles":             strings.Join(r.Profiles, listSeparator),
+		"suspendedUntil":       r.SuspendedUntil,
+		"bannedUntil":          r.BannedUntil,
+		"reasonCode":           r.ReasonCode,
+		"personalAccessTokens": strings.Join(pp, listSeparator),
+	}
+}
+
+// NewRecord returns the record of the User and its PersonalAccessTokens
+func NewRecord(u *kimiov1beta1.User, pp []kimiov1beta1.PersonalAccessToken) Record {
+	r := Record{
+		Name:           u.Name,
+		Username:       u.Spec.Username,
+		Email:          u.Spec.Email,
+		State:          string(u.Spec.State),
+		Expiration:     formatTime(u.Spec.Expiration),
+		DisplayName:    deref(u.Spec.DisplayName),
+		GivenName:      deref(u.Spec.GivenName),
+		FamilyName:     deref(u.Spec.FamilyName),
+		Company:        deref(u.Spec.Company),
+		SecondaryMail:  deref(u.Spec.SecondaryMail),
+		SuspendedUntil: formatTime(u.Spec.SuspendedUntil),
+		BannedUntil:    formatTime(u.Spec.BannedUntil),
+		ReasonCode:     u.Spec.ReasonCode,
+	}
+	for _, p := range u.Spec.Profiles {
+		r.Profiles = append(r.Profiles, p.Name)
+	}
+	for _, p := range pp {
+		r.PersonalAccessTokens = append(r.PersonalAccessTokens, PersonalAccessTokenRecord{
+			Name:       p.Name,
+			Phase:      string(p.Status.Phase),
+			Expiration: formatTime(p.Spec.Expiration),
+		})
+	}
+	sort.Slice(r.PersonalAccessTokens, func(i, j int) bool {
+		return r.PersonalAccessTokens[i].Name < r.PersonalAccessTokens[j].Name
+	})
+	return r
+}
+
+// has returns whether the column is set in the record
+func (r *Record) has(column string) bool {
+	return r.columns == nil || r.columns[column]
+}
+
+// applyTo sets the spec of the User from the columns set in the record, the
+// others are kept. An empty state keeps the one of the User, so that updates
+// never reset the state to the default.
+func (r *Record) applyTo(u *kimiov1beta1.User) error {
+	var err error
+	u.Spec.Username = r.Username
+	u.Spec.Email = r.Email
+	if r.State != "" {
+		u.Spec.State = kimiov1beta1.UserState(r.State)
+	}
+	if r.has("expiration") {
+		if u.Spec.Expiration, err = parseTime("expiration", r.Expiration); err != nil {
+			return err
+		}
+	}
+	for c, f := range map[string]struct {
+		dst **string
+		v   string
+	}{
+		"displayName":   {&u.Spec.DisplayName, r.DisplayName},
+		"givenName":     {&u.Spec.GivenName, r.GivenName},
+		"familyName":    {&u.Spec.FamilyName, r.FamilyName},
+		"company":       {&u.Spec.Company, r.Company},
+		"secondaryMail": {&u.Spec.SecondaryMail, r.SecondaryMail},
+	} {
+		if r.has(c) {
+			*f.dst = ref(f.v)
+		}
+	}
+	if r.has("profiles") {
+		u.Spec.Profiles = nil
+		for _, p := range r.Profiles {
+			u.Spec.Profiles = append(u.Spec.Profiles, kimiov1beta1.AccessProfileReference{Name: p})
+		}
+	}
+	if r.has("suspendedUntil") {
+		if u.Spec.SuspendedUntil, err = parseTime("suspendedUntil", r.SuspendedUntil); err != nil {
+			return err
+		}
+	}
+	if r.has("bannedUntil") {
+		if u.Spec.BannedUntil, err = parseTime("bannedUntil", r.BannedUntil); err != nil {
+			return err
+		}
+	}
+	if r.has("reasonCode") {
+		u.Spec.ReasonCode = r.ReasonCode
+	}
+	return nil
+}
+
+func formatTime(t *metav1.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func parseTime(column, v string) (*metav1.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q, expected RFC 3339 format: %w", column, v, err)
+	}
+	mt := metav1.NewTime(t)
+	return &mt, nil
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func ref(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
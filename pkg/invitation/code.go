@@ -0,0 +1,53 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package invitation defines the format of the single-use codes of the
+// Invitations issued by KIM.
+//
+// Codes are made of the fixed Prefix followed by random characters. Only
+// their digest is stored in the Invitation's status, so that they can be
+// looked up on redemption.
+package invitation
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+const (
+	// Prefix is the fixed prefix of every code
+	Prefix = "kim_inv_"
+
+	// randomBytes is the number of random bytes of a code
+	randomBytes = 24
+)
+
+// GenerateCode returns a new random invitation code
+func GenerateCode() (string, error) {
+	b := make([]byte, randomBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return Prefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashCode returns the SHA-256 digest of the code, hex encoded
+func HashCode(code string) string {
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
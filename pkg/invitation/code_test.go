@@ -0,0 +1,46 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package invitation
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateCode(t *testing.T) {
+	c1, err := GenerateCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := GenerateCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(c1, Prefix) {
+		t.Fatalf("expected code %s to have prefix %s", c1, Prefix)
+	}
+	if c1 == c2 {
+		t.Fatal("expected codes to be different")
+	}
+	if HashCode(c1) == HashCode(c2) {
+		t.Fatal("expected digests to be different")
+	}
+	if HashCode(c1) != HashCode(c1) {
+		t.Fatal("expected digest to be stable")
+	}
+}
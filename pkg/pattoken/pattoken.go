@@ -0,0 +1,135 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pattoken defines the format of the Personal Access Tokens issued by KIM.
+//
+// A token is made of the fixed Prefix, followed by a random part and by a
+// checksum of prefix and random part, all encoded in base62:
+//
+//	kim_pat_<30 random characters><6 checksum characters>
+//
+// The checksum allows to tell apart KIM tokens from random strings without any
+// lookup, so that secret scanning tools can detect and verify leaked tokens offline.
+// The package depends only on the standard library to be easily imported by such tools.
+package pattoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Prefix is the fixed prefix of every token
+	Prefix = "kim_pat_"
+
+	// RandomLength is the number of random characters of a token
+	RandomLength = 30
+	// ChecksumLength is the number of checksum characters of a token
+	ChecksumLength = 6
+	// Length is the total length of a token
+	Length = len(Prefix) + RandomLength + ChecksumLength
+
+	alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+var (
+	// ErrMalformed is returned for strings not matching the token format
+	ErrMalformed = errors.New("malformed personal access token")
+	// ErrInvalidChecksum is returned for tokens whose checksum does not match
+	ErrInvalidChecksum = errors.New("invalid personal access token checksum")
+
+	// Pattern matches candidate tokens in a text. Candidates need to be verified with Validate.
+	Pattern = regexp.MustCompile(`\b` + Prefix + `[0-9A-Za-z]{` + strconv.Itoa(RandomLength+ChecksumLength) + `}\b`)
+)
+
+// Generate returns a new random token
+func Generate() (string, error) {
+	var sb strings.Builder
+	sb.Grow(Length)
+	sb.WriteString(Prefix)
+
+	base := big.NewInt(int64(len(alphabet)))
+	for i := 0; i < RandomLength; i++ {
+		n, err := rand.Int(rand.Reader, base)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(alphabet[n.Int64()])
+	}
+
+	sb.WriteString(checksum(sb.String()))
+	return sb.String(), nil
+}
+
+// Validate checks the token has the expected format and a valid checksum
+func Validate(token string) error {
+	if len(token) != Length || !strings.HasPrefix(token, Prefix) {
+		return ErrMalformed
+	}
+	for i := len(Prefix); i < Length; i++ {
+		if strings.IndexByte(alphabet, token[i]) < 0 {
+			return ErrMalformed
+		}
+	}
+
+	body, sum := token[:Length-ChecksumLength], token[Length-ChecksumLength:]
+	if checksum(body) != sum {
+		return ErrInvalidChecksum
+	}
+	return nil
+}
+
+// IsValid returns true if the token has the expected format and a valid checksum
+func IsValid(token string) bool {
+	return Validate(token) == nil
+}
+
+// Find returns the valid tokens contained in text
+func Find(text string) []string {
+	tt := []string{}
+	for _, c := range Pattern.FindAllString(text, -1) {
+		if IsValid(c) {
+			tt = append(tt, c)
+		}
+	}
+	return tt
+}
+
+// Hash returns the hex encoded SHA-256 digest of the token, used to store
+// and look up tokens without keeping them in plaintext
+func Hash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// checksum returns the base62 encoded CRC32 of s, left padded to ChecksumLength
+func checksum(s string) string {
+	c := crc32.ChecksumIEEE([]byte(s))
+
+	b := []byte(strings.Repeat(string(alphabet[0]), ChecksumLength))
+	for i := ChecksumLength - 1; i >= 0 && c > 0; i-- {
+		b[i] = alphabet[c%uint32(len(alphabet))]
+		c /= uint32(len(alphabet))
+	}
+	return string(b)
+}
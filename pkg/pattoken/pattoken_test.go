@@ -0,0 +1,87 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pattoken
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestGeneratedTokensAreValid(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		tk, err := Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tk) != Length || !strings.HasPrefix(tk, Prefix) {
+			t.Fatalf("unexpected token format: %s", tk)
+		}
+		if err := Validate(tk); err != nil {
+			t.Fatalf("expected generated token %s to be valid: %v", tk, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tk, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// change one character of the random part
+	r := []byte(tk)
+	if r[len(Prefix)] == 'a' {
+		r[len(Prefix)] = 'b'
+	} else {
+		r[len(Prefix)] = 'a'
+	}
+
+	tt := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{name: "valid", token: tk},
+		{name: "empty", token: "", err: ErrMalformed},
+		{name: "wrong prefix", token: "ghp_" + tk[len(Prefix):] + "abcd", err: ErrMalformed},
+		{name: "truncated", token: tk[:Length-1], err: ErrMalformed},
+		{name: "invalid character", token: tk[:Length-1] + "-", err: ErrMalformed},
+		{name: "tampered", token: string(r), err: ErrInvalidChecksum},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := Validate(tc.token); !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestFind(t *testing.T) {
+	tk, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := Prefix + strings.Repeat("a", RandomLength+ChecksumLength)
+
+	text := "export KIM_TOKEN=" + tk + "\nexport OTHER=" + fake + "\n"
+	ff := Find(text)
+	if len(ff) != 1 || ff[0] != tk {
+		t.Fatalf("expected to find only %s, found %v", tk, ff)
+	}
+}
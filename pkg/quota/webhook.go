@@ -0,0 +1,110 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package quota implements the admission webhook enforcing the per-User
+// quotas on the resources managed by KIM.
+//
+// Resources are counted from the manager's cache, so that concurrent
+// requests may exceed a quota by a few units.
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/controllers"
+)
+
+// Path is the path the webhook is served at
+const Path = "/validate-kim-io-quota"
+
+//+kubebuilder:webhook:path=/validate-kim-io-quota,mutating=false,failurePolicy=fail,sideEffects=None,groups=kim.io,resources=personalaccesstokens,verbs=create,versions=v1beta1,name=vpersonalaccesstokenquota.kim.io,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/validate-kim-io-quota,mutating=false,failurePolicy=fail,sideEffects=None,groups=kim.io,resources=accessgrants,verbs=create,versions=v1beta1,name=vaccessgrantquota.kim.io,admissionReviewVersions=v1
+
+// Validator denies the creation of resources exceeding the quotas of their User
+type Validator struct {
+	Client client.Reader
+	Quotas controllers.Quotas
+	Log    logr.Logger
+}
+
+var _ admission.Handler = &Validator{}
+
+// Handle validates the creation of PersonalAccessTokens and AccessGrants
+func (v *Validator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1.Create {
+		return admission.Allowed("")
+	}
+
+	switch req.Kind.Kind {
+	case "PersonalAccessToken":
+		var p kimiov1beta1.PersonalAccessToken
+		if err := json.Unmarshal(req.Object.Raw, &p); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		return v.check(ctx, "PersonalAccessTokens", namespace(req, &p), p.Spec.User.Name,
+			v.Quotas.PersonalAccessTokens, controllers.CountPersonalAccessTokens)
+
+	case "AccessGrant":
+		var g kimiov1beta1.AccessGrant
+		if err := json.Unmarshal(req.Object.Raw, &g); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		return v.check(ctx, "AccessGrants", namespace(req, &g), g.Spec.User.Name,
+			v.Quotas.AccessGrants, controllers.CountAccessGrants)
+
+	default:
+		return admission.Allowed("")
+	}
+}
+
+type counter func(context.Context, client.Reader, types.NamespacedName) (int32, error)
+
+func (v *Validator) check(ctx context.Context, resource, namespace, user string, limit int32, count counter) admission.Response {
+	if limit <= 0 || user == "" {
+		return admission.Allowed("")
+	}
+
+	k := types.NamespacedName{Namespace: namespace, Name: user}
+	used, err := count(ctx, v.Client, k)
+	if err != nil {
+		v.Log.Error(err, "error counting resources", "resource", resource, "namespace", k.Namespace, "user", k.Name)
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	if controllers.QuotaExceeded(used, limit) {
+		return admission.Denied(fmt.Sprintf("quota exceeded: user %s already holds %d of %d %s", user, used, limit, resource))
+	}
+	return admission.Allowed("")
+}
+
+// namespace returns the namespace of the object, that is not set in the
+// object when it is defaulted from the request
+func namespace(req admission.Request, o client.Object) string {
+	if ns := o.GetNamespace(); ns != "" {
+		return ns
+	}
+	return req.Namespace
+}
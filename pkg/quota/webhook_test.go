@@ -0,0 +1,123 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	kimiov1alpha1 "github.com/filariow/kim/api/v1alpha1"
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/controllers"
+)
+
+func newPersonalAccessToken(name string, phase kimiov1beta1.PersonalAccessTokenPhase) *kimiov1beta1.PersonalAccessToken {
+	return &kimiov1beta1.PersonalAccessToken{
+		TypeMeta:   metav1.TypeMeta{APIVersion: kimiov1beta1.GroupVersion.String(), Kind: "PersonalAccessToken"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: name},
+		Spec:       kimiov1beta1.PersonalAccessTokenSpec{User: kimiov1beta1.UserReference{Name: "alice"}},
+		Status:     kimiov1beta1.PersonalAccessTokenStatus{Phase: phase},
+	}
+}
+
+func newAccessGrant(name string, phase kimiov1beta1.AccessGrantPhase) *kimiov1beta1.AccessGrant {
+	return &kimiov1beta1.AccessGrant{
+		TypeMeta:   metav1.TypeMeta{APIVersion: kimiov1beta1.GroupVersion.String(), Kind: "AccessGrant"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: name},
+		Spec: kimiov1beta1.AccessGrantSpec{
+			User:     kimiov1beta1.UserReference{Name: "alice"},
+			Role:     kimiov1beta1.AccessProfileRoleRef{Kind: "ClusterRole", Name: "admin"},
+			Duration: metav1.Duration{Duration: time.Hour},
+		},
+		Status: kimiov1beta1.AccessGrantStatus{Phase: phase},
+	}
+}
+
+func admissionRequest(t *testing.T, o client.Object) admission.Request {
+	t.Helper()
+
+	b, err := json.Marshal(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gvk := o.GetObjectKind().GroupVersionKind()
+	return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		Kind:      metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+		Namespace: o.GetNamespace(),
+		Object:    runtime.RawExtension{Raw: b},
+	}}
+}
+
+func TestValidator(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := kimiov1alpha1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := kimiov1beta1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().
+		WithScheme(s).
+		WithObjects(
+			newPersonalAccessToken("active", kimiov1beta1.ActivePersonalAccessTokenPhase),
+			newPersonalAccessToken("revoked", kimiov1beta1.RevokedPersonalAccessTokenPhase),
+			newAccessGrant("active", kimiov1beta1.ActiveAccessGrantPhase),
+			newAccessGrant("expired", kimiov1beta1.ExpiredAccessGrantPhase),
+		).
+		WithIndex(&kimiov1beta1.PersonalAccessToken{}, controllers.PersonalAccessTokenUserIndex, func(o client.Object) []string {
+			return []string{o.(*kimiov1beta1.PersonalAccessToken).Spec.User.Name}
+		}).
+		WithIndex(&kimiov1beta1.AccessGrant{}, controllers.AccessGrantUserIndex, func(o client.Object) []string {
+			return []string{o.(*kimiov1beta1.AccessGrant).Spec.User.Name}
+		}).
+		Build()
+
+	tt := []struct {
+		name    string
+		quotas  controllers.Quotas
+		object  client.Object
+		allowed bool
+	}{
+		{name: "unlimited personal access tokens", object: newPersonalAccessToken("new", ""), allowed: true},
+		{name: "personal access tokens within quota", quotas: controllers.Quotas{PersonalAccessTokens: 2}, object: newPersonalAccessToken("new", ""), allowed: true},
+		{name: "personal access tokens exceeding quota", quotas: controllers.Quotas{PersonalAccessTokens: 1}, object: newPersonalAccessToken("new", "")},
+		{name: "unlimited access grants", object: newAccessGrant("new", ""), allowed: true},
+		{name: "access grants within quota", quotas: controllers.Quotas{AccessGrants: 2}, object: newAccessGrant("new", ""), allowed: true},
+		{name: "access grants exceeding quota", quotas: controllers.Quotas{AccessGrants: 1}, object: newAccessGrant("new", "")},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			v := &Validator{Client: c, Quotas: tc.quotas, Log: log.Log}
+
+			res := v.Handle(context.TODO(), admissionRequest(t, tc.object))
+			if res.Allowed != tc.allowed {
+				t.Fatalf("expected allowed to be %v, got %+v", tc.allowed, res.Result)
+			}
+		})
+	}
+}
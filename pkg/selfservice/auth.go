@@ -0,0 +1,174 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package selfservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/controllers"
+)
+
+const serviceAccountUsernamePrefix = "system:serviceaccount:"
+
+var (
+	errUnauthenticated = errors.New("unauthenticated")
+	errUserNotActive   = errors.New("user is not active")
+)
+
+// Authenticator validates a bearer token and returns the identity it belongs to
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (*authenticationv1.UserInfo, error)
+}
+
+// TokenReviewAuthenticator authenticates tokens with the TokenReview API
+type TokenReviewAuthenticator struct {
+	Client client.Client
+}
+
+//+kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+
+// Authenticate validates the token through a TokenReview
+func (a *TokenReviewAuthenticator) Authenticate(ctx context.Context, token string) (*authenticationv1.UserInfo, error) {
+	tr := authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}
+	if err := a.Client.Create(ctx, &tr); err != nil {
+		return nil, err
+	}
+
+	if !tr.Status.Authenticated {
+		return nil, errUnauthenticated
+	}
+	return &tr.Status.User, nil
+}
+
+type contextKey struct{}
+
+// userFromContext returns the authenticated User stored in the context
+func userFromContext(ctx context.Context) *kimiov1beta1.User {
+	u, _ := ctx.Value(contextKey{}).(*kimiov1beta1.User)
+	return u
+}
+
+// authenticated wraps the handler so that it is only invoked for requests
+// performed by Active Users
+func (s *Server) authenticated(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.authenticate(r)
+		switch {
+		case err == nil:
+			h(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, u)))
+		case errors.Is(err, errUnauthenticated):
+			writeError(w, http.StatusUnauthorized, err)
+		case errors.Is(err, errUserNotActive):
+			writeError(w, http.StatusForbidden, err)
+		default:
+			s.Log.Error(err, "error authenticating request")
+			writeError(w, http.StatusInternalServerError, errors.New("error authenticating request"))
+		}
+	})
+}
+
+// authenticate returns the Active User performing the request with the token
+// of the ServiceAccount KIM provides to it
+func (s *Server) authenticate(r *http.Request) (*kimiov1beta1.User, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil, errUnauthenticated
+	}
+	t := strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	if t == "" {
+		return nil, errUnauthenticated
+	}
+
+	ui, err := s.Authenticator.Authenticate(r.Context(), t)
+	if err != nil {
+		return nil, err
+	}
+	u, err := s.userOfServiceAccount(r.Context(), ui.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Status.State != kimiov1beta1.ActiveUserState {
+		return nil, errUserNotActive
+	}
+	s.Activity.Observe(r.Context(), u)
+	return u, nil
+}
+
+// userOfServiceAccount returns the User the ServiceAccount identified by the
+// username is provisioned for. Only the ServiceAccounts provisioned by KIM,
+// labelled for a User and controlled by it, identify Users.
+func (s *Server) userOfServiceAccount(ctx context.Context, username string) (*kimiov1beta1.User, error) {
+	key, err := serviceAccountKeyFromUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	var sa corev1.ServiceAccount
+	if err := s.Client.Get(ctx, key, &sa); err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil, errUnauthenticated
+		}
+		return nil, err
+	}
+	n := sa.Labels[controllers.UserNameLabel]
+	ref := metav1.GetControllerOf(&sa)
+	if n == "" || sa.Labels[controllers.UserNamespaceLabel] != sa.Namespace ||
+		ref == nil || ref.Kind != "User" || ref.Name != n {
+		return nil, fmt.Errorf("%w: ServiceAccount %s is not provisioned by KIM", errUnauthenticated, key)
+	}
+
+	var u kimiov1beta1.User
+	if err := s.Client.Get(ctx, types.NamespacedName{Namespace: sa.Namespace, Name: n}, &u); err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil, errUnauthenticated
+		}
+		return nil, err
+	}
+	if u.UID != ref.UID {
+		return nil, fmt.Errorf("%w: ServiceAccount %s is not provisioned for User %s", errUnauthenticated, key, n)
+	}
+	return &u, nil
+}
+
+// serviceAccountKeyFromUsername returns the key of the ServiceAccount
+// identified by the username
+func serviceAccountKeyFromUsername(username string) (types.NamespacedName, error) {
+	if !strings.HasPrefix(username, serviceAccountUsernamePrefix) {
+		return types.NamespacedName{}, fmt.Errorf("%w: %s is not a ServiceAccount", errUnauthenticated, username)
+	}
+
+	nn := strings.Split(strings.TrimPrefix(username, serviceAccountUsernamePrefix), ":")
+	if len(nn) != 2 || nn[0] == "" || nn[1] == "" {
+		return types.NamespacedName{}, fmt.Errorf("%w: invalid ServiceAccount username %s", errUnauthenticated, username)
+	}
+	return types.NamespacedName{Namespace: nn[0], Name: nn[1]}, nil
+}
@@ -0,0 +1,339 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package selfservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/controllers"
+)
+
+const (
+	personalAccessTokensPath = "/api/v1/personalaccesstokens"
+
+	defaultTokenTimeout = 30 * time.Second
+	tokenPollInterval   = 500 * time.Millisecond
+)
+
+// PersonalAccessToken is the representation of a PersonalAccessToken returned by the API
+type PersonalAccessToken struct {
+	Name              string       `json:"name"`
+	CreationTimestamp metav1.Time  `json:"creationTimestamp"`
+	Expiration        *metav1.Time `json:"expiration,omitempty"`
+	Phase             string       `json:"phase,omitempty"`
+	Reason            string       `json:"reason,omitempty"`
+	// Token is the plaintext token, only returned on creation
+	Token string `json:"token,omitempty"`
+}
+
+// CreatePersonalAccessTokenRequest is the body of a creation request
+type CreatePersonalAccessTokenRequest struct {
+	// Name of the PersonalAccessToken, if empty it is generated from the User's name
+	Name string `json:"name,omitempty"`
+	// Lifetime of the PersonalAccessToken, if empty the policy's default is used
+	Lifetime *metav1.Duration `json:"lifetime,omitempty"`
+}
+
+// PersonalAccessTokenList is the response of a list request
+type PersonalAccessTokenList struct {
+	Items []PersonalAccessToken `json:"items"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// handlePersonalAccessTokens serves the collection of the caller's PersonalAccessTokens
+func (s *Server) handlePersonalAccessTokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listPersonalAccessTokens(w, r)
+	case http.MethodPost:
+		s.createPersonalAccessToken(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handlePersonalAccessToken serves a single PersonalAccessToken of the caller
+func (s *Server) handlePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	n := strings.TrimPrefix(r.URL.Path, personalAccessTokensPath+"/")
+	if n == "" || strings.Contains(n, "/") {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.getPersonalAccessToken(w, r, n)
+	case http.MethodDelete:
+		s.revokePersonalAccessToken(w, r, n)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *Server) listPersonalAccessTokens(w http.ResponseWriter, r *http.Request) {
+	u := userFromContext(r.Context())
+
+	pp, err := s.userPersonalAccessTokens(r.Context(), u)
+	if err != nil {
+		s.Log.Error(err, "error listing personal access tokens", "namespace", u.Namespace, "user", u.Name)
+		writeError(w, http.StatusInternalServerError, errors.New("error listing personal access tokens"))
+		return
+	}
+
+	l := PersonalAccessTokenList{Items: make([]PersonalAccessToken, len(pp))}
+	for i := range pp {
+		l.Items[i] = toPersonalAccessToken(&pp[i])
+	}
+	writeJSON(w, http.StatusOK, l)
+}
+
+func (s *Server) getPersonalAccessToken(w http.ResponseWriter, r *http.Request, name string) {
+	u := userFromContext(r.Context())
+
+	p, err := s.userPersonalAccessToken(r.Context(), u, name)
+	if err != nil {
+		s.writeLookupError(w, err, name)
+		return
+	}
+	writeJSON(w, http.StatusOK, toPersonalAccessToken(p))
+}
+
+func (s *Server) createPersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	u := userFromContext(r.Context())
+	l := s.Log.WithValues("namespace", u.Namespace, "user", u.Name)
+
+	var cr CreatePersonalAccessTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&cr); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	lt, err := s.lifetime(cr.Lifetime)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if cr.Name != "" {
+		if ee := validation.IsDNS1123Subdomain(cr.Name); len(ee) > 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid name %s: %s", cr.Name, strings.Join(ee, ", ")))
+			return
+		}
+	}
+
+	exp := metav1.NewTime(time.Now().Add(lt))
+	p := kimiov1beta1.PersonalAccessToken{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: u.Namespace,
+			Name:      cr.Name,
+		},
+		Spec: kimiov1beta1.PersonalAccessTokenSpec{
+			User:       kimiov1beta1.UserReference{Name: u.Name},
+			Expiration: &exp,
+		},
+	}
+	if cr.Name == "" {
+		p.GenerateName = u.Name + "-"
+	}
+	if err := controllerutil.SetOwnerReference(u, &p, s.Client.Scheme()); err != nil {
+		l.Error(err, "error setting owner of personal access token")
+		writeError(w, http.StatusInternalServerError, errors.New("error creating personal access token"))
+		return
+	}
+
+	if err := s.Client.Create(r.Context(), &p); err != nil {
+		if kerrors.IsAlreadyExists(err) {
+			writeError(w, http.StatusConflict, fmt.Errorf("personal access token %s already exists", cr.Name))
+			return
+		}
+		if kerrors.IsForbidden(err) {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		l.Error(err, "error creating personal access token")
+		writeError(w, http.StatusInternalServerError, errors.New("error creating personal access token"))
+		return
+	}
+
+	t, err := s.waitForToken(r.Context(), &p)
+	if err != nil {
+		l.Error(err, "token not issued, deleting personal access token", "personalaccesstoken", p.Name)
+		if err := s.Client.Delete(context.Background(), &p); err != nil && !kerrors.IsNotFound(err) {
+			l.Error(err, "error deleting personal access token", "personalaccesstoken", p.Name)
+		}
+		writeError(w, http.StatusServiceUnavailable, errors.New("token not issued in time, retry later"))
+		return
+	}
+
+	rp := toPersonalAccessToken(&p)
+	rp.Token = t
+	writeJSON(w, http.StatusCreated, rp)
+}
+
+func (s *Server) revokePersonalAccessToken(w http.ResponseWriter, r *http.Request, name string) {
+	u := userFromContext(r.Context())
+
+	p, err := s.userPersonalAccessToken(r.Context(), u, name)
+	if err != nil {
+		s.writeLookupError(w, err, name)
+		return
+	}
+
+	// the PersonalAccessToken is kept as a record, the controller deletes its
+	// token and audits the revocation
+	if !p.IsRevoked() {
+		p.Status.Phase = kimiov1beta1.RevokedPersonalAccessTokenPhase
+		p.Status.Reason = controllers.RevokedByUserPersonalAccessTokenReason
+		if err := s.Client.Status().Update(r.Context(), p); err != nil {
+			s.Log.Error(err, "error revoking personal access token", "namespace", u.Namespace, "user", u.Name, "personalaccesstoken", name)
+			writeError(w, http.StatusInternalServerError, errors.New("error revoking personal access token"))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lifetime applies the policy to the requested lifetime
+func (s *Server) lifetime(requested *metav1.Duration) (time.Duration, error) {
+	if requested == nil {
+		return s.Policy.DefaultLifetime, nil
+	}
+
+	lt := requested.Duration
+	if lt <= 0 {
+		return 0, fmt.Errorf("lifetime must be positive, got %s", lt)
+	}
+	if s.Policy.MaxLifetime > 0 && lt > s.Policy.MaxLifetime {
+		return 0, fmt.Errorf("lifetime %s exceeds the maximum allowed of %s", lt, s.Policy.MaxLifetime)
+	}
+	return lt, nil
+}
+
+// waitForToken waits for the token of the PersonalAccessToken to be issued
+func (s *Server) waitForToken(ctx context.Context, p *kimiov1beta1.PersonalAccessToken) (string, error) {
+	key := types.NamespacedName{Namespace: p.Namespace, Name: p.Name}
+	return s.waitForSecretData(ctx, p, key, kimiov1beta1.PersonalAccessTokenSecretTokenKey)
+}
+
+// waitForSecretData waits for the Secret owned by owner to contain the data key
+func (s *Server) waitForSecretData(ctx context.Context, owner metav1.Object, key types.NamespacedName, dataKey string) (string, error) {
+	to := s.TokenTimeout
+	if to == 0 {
+		to = defaultTokenTimeout
+	}
+
+	var t string
+	err := wait.PollImmediateWithContext(ctx, tokenPollInterval, to, func(ctx context.Context) (bool, error) {
+		var sec corev1.Secret
+		if err := s.Client.Get(ctx, key, &sec); err != nil {
+			return false, client.IgnoreNotFound(err)
+		}
+		if !isOwnedBy(&sec, owner) {
+			return false, fmt.Errorf("secret %s is not owned by %s", key, owner.GetName())
+		}
+
+		t = string(sec.Data[dataKey])
+		return t != "", nil
+	})
+	return t, err
+}
+
+// userPersonalAccessTokens lists the PersonalAccessTokens of the User
+func (s *Server) userPersonalAccessTokens(ctx context.Context, u *kimiov1beta1.User) ([]kimiov1beta1.PersonalAccessToken, error) {
+	var pp kimiov1beta1.PersonalAccessTokenList
+	if err := s.Client.List(ctx, &pp,
+		client.InNamespace(u.Namespace),
+		client.MatchingFields{controllers.PersonalAccessTokenUserIndex: u.Name},
+	); err != nil {
+		return nil, err
+	}
+	return pp.Items, nil
+}
+
+// userPersonalAccessToken fetches a PersonalAccessToken of the User.
+// PersonalAccessTokens of other Users are reported as not found.
+func (s *Server) userPersonalAccessToken(ctx context.Context, u *kimiov1beta1.User, name string) (*kimiov1beta1.PersonalAccessToken, error) {
+	var p kimiov1beta1.PersonalAccessToken
+	if err := s.Client.Get(ctx, types.NamespacedName{Namespace: u.Namespace, Name: name}, &p); err != nil {
+		return nil, err
+	}
+
+	if p.Spec.User.Name != u.Name {
+		return nil, kerrors.NewNotFound(kimiov1beta1.GroupVersion.WithResource("personalaccesstokens").GroupResource(), name)
+	}
+	return &p, nil
+}
+
+func (s *Server) writeLookupError(w http.ResponseWriter, err error, name string) {
+	if kerrors.IsNotFound(err) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("personal access token %s not found", name))
+		return
+	}
+	s.Log.Error(err, "error fetching personal access token", "personalaccesstoken", name)
+	writeError(w, http.StatusInternalServerError, errors.New("error fetching personal access token"))
+}
+
+func toPersonalAccessToken(p *kimiov1beta1.PersonalAccessToken) PersonalAccessToken {
+	return PersonalAccessToken{
+		Name:              p.Name,
+		CreationTimestamp: p.CreationTimestamp,
+		Expiration:        p.Spec.Expiration,
+		Phase:             string(p.Status.Phase),
+		Reason:            p.Status.Reason,
+	}
+}
+
+func isOwnedBy(obj, owner metav1.Object) bool {
+	for _, o := range obj.GetOwnerReferences() {
+		if o.UID == owner.GetUID() {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, errorResponse{Error: err.Error()})
+}
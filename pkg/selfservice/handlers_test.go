@@ -0,0 +1,267 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package selfservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kimiov1alpha1 "github.com/filariow/kim/api/v1alpha1"
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/controllers"
+)
+
+const testNamespace = "tenant"
+
+// staticAuthenticator maps tokens to ServiceAccount names
+type staticAuthenticator map[string]string
+
+func (a staticAuthenticator) Authenticate(_ context.Context, token string) (*authenticationv1.UserInfo, error) {
+	sa, ok := a[token]
+	if !ok {
+		return nil, errUnauthenticated
+	}
+	return &authenticationv1.UserInfo{Username: serviceAccountUsernamePrefix + testNamespace + ":" + sa}, nil
+}
+
+func newUser(name string, state kimiov1beta1.UserState) *kimiov1beta1.User {
+	return &kimiov1beta1.User{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name, UID: types.UID(name)},
+		Spec:       kimiov1beta1.UserSpec{Username: name, Email: name + "@kim.io", State: state},
+		Status:     kimiov1beta1.UserStatus{State: state},
+	}
+}
+
+func newPersonalAccessToken(name, user string) *kimiov1beta1.PersonalAccessToken {
+	return &kimiov1beta1.PersonalAccessToken{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name},
+		Spec:       kimiov1beta1.PersonalAccessTokenSpec{User: kimiov1beta1.UserReference{Name: user}},
+	}
+}
+
+// newServiceAccount returns the ServiceAccount KIM provisions for the User
+func newServiceAccount(u *kimiov1beta1.User) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: u.Namespace,
+			Name:      u.Name,
+			Labels: map[string]string{
+				controllers.UserNameLabel:      u.Name,
+				controllers.UserNamespaceLabel: u.Namespace,
+			},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(u, kimiov1beta1.GroupVersion.WithKind("User"))},
+		},
+	}
+}
+
+// newTestServer returns a Server whose client holds the objects and the
+// ServiceAccounts KIM provisions for the Users among them
+func newTestServer(t *testing.T, objs ...client.Object) (*Server, client.Client) {
+	t.Helper()
+
+	for _, o := range objs {
+		if u, ok := o.(*kimiov1beta1.User); ok {
+			objs = append(objs, newServiceAccount(u))
+		}
+	}
+
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := kimiov1beta1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := kimiov1alpha1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().
+		WithScheme(s).
+		WithObjects(objs...).
+		WithIndex(&kimiov1beta1.PersonalAccessToken{}, controllers.PersonalAccessTokenUserIndex, func(o client.Object) []string {
+			return []string{o.(*kimiov1beta1.PersonalAccessToken).Spec.User.Name}
+		}).
+		WithIndex(&kimiov1beta1.Invitation{}, controllers.InvitationInviterIndex, func(o client.Object) []string {
+			return []string{o.(*kimiov1beta1.Invitation).Spec.Inviter.Name}
+		}).
+		WithIndex(&kimiov1beta1.Invitation{}, controllers.InvitationCodeHashIndex, func(o client.Object) []string {
+			return []string{o.(*kimiov1beta1.Invitation).Status.CodeHash}
+		}).
+		Build()
+
+	return &Server{
+		Client:        c,
+		Authenticator: staticAuthenticator{"alice-token": "alice", "bob-token": "bob", "dave-token": "dave"},
+		Policy:        Policy{DefaultLifetime: time.Hour, MaxLifetime: 24 * time.Hour},
+		Log:           log.Log,
+		TokenTimeout:  time.Second,
+	}, c
+}
+
+func doRequest(s *Server, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestRequestsAreAuthenticated(t *testing.T) {
+	s, c := newTestServer(t,
+		newUser("alice", kimiov1beta1.ActiveUserState),
+		newUser("bob", kimiov1beta1.SuspendedUserState),
+	)
+	// dave's ServiceAccount is not provisioned by KIM
+	dave := newUser("dave", kimiov1beta1.ActiveUserState)
+	for _, o := range []client.Object{dave, &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "dave"}}} {
+		if err := c.Create(context.TODO(), o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tt := []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{name: "missing token", token: "", code: http.StatusUnauthorized},
+		{name: "invalid token", token: "invalid", code: http.StatusUnauthorized},
+		{name: "suspended user", token: "bob-token", code: http.StatusForbidden},
+		{name: "ServiceAccount not provisioned by KIM", token: "dave-token", code: http.StatusUnauthorized},
+		{name: "active user", token: "alice-token", code: http.StatusOK},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := doRequest(s, http.MethodGet, personalAccessTokensPath, tc.token, ""); w.Code != tc.code {
+				t.Fatalf("expected status %d, got %d: %s", tc.code, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServerRequiresCertificate(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.BindAddress = "127.0.0.1:0"
+
+	if err := s.Start(context.TODO()); err == nil {
+		t.Fatal("expected the server not to start without a certificate")
+	}
+}
+
+func TestListReturnsOnlyOwnPersonalAccessTokens(t *testing.T) {
+	s, _ := newTestServer(t,
+		newUser("alice", kimiov1beta1.ActiveUserState),
+		newPersonalAccessToken("alice-1", "alice"),
+		newPersonalAccessToken("bob-1", "bob"),
+	)
+
+	w := doRequest(s, http.MethodGet, personalAccessTokensPath, "alice-token", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var l PersonalAccessTokenList
+	if err := json.NewDecoder(w.Body).Decode(&l); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || l.Items[0].Name != "alice-1" || l.Items[0].Token != "" {
+		t.Fatalf("unexpected personal access tokens: %+v", l.Items)
+	}
+}
+
+func TestRevokeOnlyOwnPersonalAccessTokens(t *testing.T) {
+	s, c := newTestServer(t,
+		newUser("alice", kimiov1beta1.ActiveUserState),
+		newPersonalAccessToken("alice-1", "alice"),
+		newPersonalAccessToken("bob-1", "bob"),
+	)
+
+	if w := doRequest(s, http.MethodDelete, personalAccessTokensPath+"/bob-1", "alice-token", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(s, http.MethodDelete, personalAccessTokensPath+"/alice-1", "alice-token", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var p kimiov1beta1.PersonalAccessToken
+	if err := c.Get(context.TODO(), types.NamespacedName{Namespace: testNamespace, Name: "bob-1"}, &p); err != nil {
+		t.Fatalf("expected bob's personal access token to exist: %v", err)
+	}
+	if p.IsRevoked() {
+		t.Fatal("expected bob's personal access token not to be revoked")
+	}
+	if err := c.Get(context.TODO(), types.NamespacedName{Namespace: testNamespace, Name: "alice-1"}, &p); err != nil {
+		t.Fatalf("expected alice's personal access token to be kept: %v", err)
+	}
+	if !p.IsRevoked() || p.Status.Reason != controllers.RevokedByUserPersonalAccessTokenReason {
+		t.Fatalf("expected alice's personal access token to be revoked, got phase %q reason %q", p.Status.Phase, p.Status.Reason)
+	}
+}
+
+func TestCreateEnforcesPolicy(t *testing.T) {
+	s, _ := newTestServer(t, newUser("alice", kimiov1beta1.ActiveUserState))
+
+	tt := []struct {
+		name string
+		body string
+	}{
+		{name: "lifetime above maximum", body: `{"lifetime":"48h"}`},
+		{name: "negative lifetime", body: `{"lifetime":"-1h"}`},
+		{name: "invalid name", body: `{"name":"Not_Valid"}`},
+		{name: "invalid body", body: `{`},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := doRequest(s, http.MethodPost, personalAccessTokensPath, "alice-token", tc.body); w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCreateCleansUpWhenTokenIsNotIssued(t *testing.T) {
+	s, c := newTestServer(t, newUser("alice", kimiov1beta1.ActiveUserState))
+
+	w := doRequest(s, http.MethodPost, personalAccessTokensPath, "alice-token", `{"name":"alice-1","lifetime":"1h"}`)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var p kimiov1beta1.PersonalAccessToken
+	err := c.Get(context.TODO(), types.NamespacedName{Namespace: testNamespace, Name: "alice-1"}, &p)
+	if !kerrors.IsNotFound(err) {
+		t.Fatalf("expected personal access token to be deleted, got %v", err)
+	}
+}
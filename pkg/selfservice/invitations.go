@@ -0,0 +1,337 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package selfservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/controllers"
+	"github.com/filariow/kim/pkg/invitation"
+)
+
+const (
+	invitationsPath      = "/api/v1/invitations"
+	redeemInvitationPath = "/api/v1/invitations/redeem"
+)
+
+// Invitation is the representation of an Invitation returned by the API
+type Invitation struct {
+	Name              string       `json:"name"`
+	CreationTimestamp metav1.Time  `json:"creationTimestamp"`
+	Email             string       `json:"email"`
+	Profiles          []string     `json:"profiles,omitempty"`
+	ExpiresAt         *metav1.Time `json:"expiresAt,omitempty"`
+	Phase             string       `json:"phase,omitempty"`
+	User              string       `json:"user,omitempty"`
+	// Code is the plaintext invitation code, only returned on creation
+	Code string `json:"code,omitempty"`
+}
+
+// CreateInvitationRequest is the body of a creation request
+type CreateInvitationRequest struct {
+	// Email of the invited collaborator
+	Email string `json:"email"`
+	// Profiles granted to the invited collaborator
+	Profiles []string `json:"profiles,omitempty"`
+}
+
+// InvitationList is the response of a list request
+type InvitationList struct {
+	Items []Invitation `json:"items"`
+}
+
+// RedeemInvitationRequest is the body of a redemption request
+type RedeemInvitationRequest struct {
+	// Code of the Invitation
+	Code string `json:"code"`
+	// Username of the User to create, also used as its name
+	Username string `json:"username"`
+}
+
+// RedeemInvitationResponse is the response of a redemption request
+type RedeemInvitationResponse struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	State     string `json:"state"`
+}
+
+// handleInvitations serves the collection of the caller's Invitations
+func (s *Server) handleInvitations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listInvitations(w, r)
+	case http.MethodPost:
+		s.createInvitation(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *Server) listInvitations(w http.ResponseWriter, r *http.Request) {
+	u := userFromContext(r.Context())
+
+	var ii kimiov1beta1.InvitationList
+	if err := s.Client.List(r.Context(), &ii,
+		client.InNamespace(u.Namespace),
+		client.MatchingFields{controllers.InvitationInviterIndex: u.Name},
+	); err != nil {
+		s.Log.Error(err, "error listing invitations", "namespace", u.Namespace, "user", u.Name)
+		writeError(w, http.StatusInternalServerError, errors.New("error listing invitations"))
+		return
+	}
+
+	l := InvitationList{Items: make([]Invitation, 0, len(ii.Items))}
+	for i := range ii.Items {
+		l.Items = append(l.Items, toInvitation(&ii.Items[i]))
+	}
+	writeJSON(w, http.StatusOK, l)
+}
+
+func (s *Server) createInvitation(w http.ResponseWriter, r *http.Request) {
+	u := userFromContext(r.Context())
+	l := s.Log.WithValues("namespace", u.Namespace, "user", u.Name)
+
+	var cr CreateInvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&cr); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if _, err := mail.ParseAddress(cr.Email); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid email %q: %w", cr.Email, err))
+		return
+	}
+
+	i := kimiov1beta1.Invitation{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:    u.Namespace,
+			GenerateName: u.Name + "-",
+		},
+		Spec: kimiov1beta1.InvitationSpec{
+			Inviter: kimiov1beta1.UserReference{Name: u.Name},
+			Email:   cr.Email,
+		},
+	}
+	// the admission webhook refuses the profiles not granted to the inviter
+	for _, p := range cr.Profiles {
+		i.Spec.Profiles = append(i.Spec.Profiles, kimiov1beta1.AccessProfileReference{Name: p})
+	}
+	if err := controllerutil.SetOwnerReference(u, &i, s.Client.Scheme()); err != nil {
+		l.Error(err, "error setting owner of invitation")
+		writeError(w, http.StatusInternalServerError, errors.New("error creating invitation"))
+		return
+	}
+
+	if err := s.Client.Create(r.Context(), &i); err != nil {
+		if kerrors.IsForbidden(err) {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		l.Error(err, "error creating invitation")
+		writeError(w, http.StatusInternalServerError, errors.New("error creating invitation"))
+		return
+	}
+
+	key := types.NamespacedName{Namespace: i.Namespace, Name: controllers.InvitationSecretName(&i)}
+	c, err := s.waitForSecretData(r.Context(), &i, key, kimiov1beta1.InvitationSecretCodeKey)
+	if err != nil {
+		l.Error(err, "code not issued, deleting invitation", "invitation", i.Name)
+		if err := s.Client.Delete(context.Background(), &i); err != nil && !kerrors.IsNotFound(err) {
+			l.Error(err, "error deleting invitation", "invitation", i.Name)
+		}
+		writeError(w, http.StatusServiceUnavailable, errors.New("code not issued in time, retry later"))
+		return
+	}
+
+	ri := toInvitation(&i)
+	ri.Code = c
+	writeJSON(w, http.StatusCreated, ri)
+}
+
+// handleRedeemInvitation creates the User invited by the Invitation matching the code.
+// The Invitation is marked as redeemed before creating the User, so that
+// concurrent requests with the same code fail on conflict.
+func (s *Server) handleRedeemInvitation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	var rr RedeemInvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&rr); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if ee := validation.IsDNS1123Subdomain(rr.Username); len(ee) > 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid username %s: %s", rr.Username, strings.Join(ee, ", ")))
+		return
+	}
+
+	i, err := s.issuedInvitation(r.Context(), rr.Code)
+	if err != nil {
+		if errors.Is(err, errInvitationNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		s.Log.Error(err, "error looking up invitation")
+		writeError(w, http.StatusInternalServerError, errors.New("error redeeming invitation"))
+		return
+	}
+	l := s.Log.WithValues("namespace", i.Namespace, "invitation", i.Name)
+
+	// claim the invitation
+	now := metav1.Now()
+	i.Status.Phase = kimiov1beta1.RedeemedInvitationPhase
+	i.Status.Reason = controllers.RedeemedInvitationReason
+	i.Status.RedeemedAt = &now
+	i.Status.User = &kimiov1beta1.UserReference{Name: rr.Username}
+	if err := s.Client.Status().Update(r.Context(), i); err != nil {
+		if kerrors.IsConflict(err) {
+			writeError(w, http.StatusConflict, errors.New("invitation is being redeemed"))
+			return
+		}
+		l.Error(err, "error claiming invitation")
+		writeError(w, http.StatusInternalServerError, errors.New("error redeeming invitation"))
+		return
+	}
+
+	u := kimiov1beta1.User{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: i.Namespace,
+			Name:      rr.Username,
+			Annotations: map[string]string{
+				kimiov1beta1.UserInvitedByAnnotation:  i.Spec.Inviter.Name,
+				kimiov1beta1.UserInvitationAnnotation: i.Name,
+			},
+		},
+		Spec: kimiov1beta1.UserSpec{
+			Email:    i.Spec.Email,
+			Username: rr.Username,
+			State:    kimiov1beta1.WaitingForApprovalUserState,
+		},
+	}
+	if s.Invitations.AutoApprove {
+		u.Spec.State = kimiov1beta1.ActiveUserState
+	}
+	for _, p := range i.Spec.Profiles {
+		u.Spec.Profiles = append(u.Spec.Profiles, kimiov1beta1.AccessProfileReference{Name: p.Name})
+	}
+
+	if err := s.Client.Create(r.Context(), &u); err != nil {
+		// release the invitation, so that it can be redeemed again
+		i.Status.Phase = kimiov1beta1.IssuedInvitationPhase
+		i.Status.Reason = controllers.IssuedInvitationReason
+		i.Status.RedeemedAt = nil
+		i.Status.User = nil
+		if rerr := s.Client.Status().Update(context.Background(), i); rerr != nil {
+			l.Error(rerr, "error releasing invitation")
+		}
+
+		if kerrors.IsAlreadyExists(err) {
+			writeError(w, http.StatusConflict, fmt.Errorf("username %s is not available", rr.Username))
+			return
+		}
+		l.Error(err, "error creating user")
+		writeError(w, http.StatusInternalServerError, errors.New("error redeeming invitation"))
+		return
+	}
+
+	l.Info("invitation redeemed", "user", u.Name, "state", u.Spec.State)
+	writeJSON(w, http.StatusCreated, RedeemInvitationResponse{
+		Namespace: u.Namespace,
+		Name:      u.Name,
+		State:     string(u.Spec.State),
+	})
+}
+
+var errInvitationNotFound = errors.New("invitation not found")
+
+// issuedInvitation returns the redeemable Invitation matching the code.
+// Unknown, redeemed and expired codes, as well as codes of Invitations whose
+// inviter is no more Active or no more holds the profiles, are all reported
+// as not found.
+func (s *Server) issuedInvitation(ctx context.Context, code string) (*kimiov1beta1.Invitation, error) {
+	if !strings.HasPrefix(code, invitation.Prefix) {
+		return nil, errInvitationNotFound
+	}
+
+	var ii kimiov1beta1.InvitationList
+	if err := s.Client.List(ctx, &ii,
+		client.MatchingFields{controllers.InvitationCodeHashIndex: invitation.HashCode(code)},
+	); err != nil {
+		return nil, err
+	}
+	if len(ii.Items) != 1 {
+		return nil, errInvitationNotFound
+	}
+
+	i := &ii.Items[0]
+	if i.Status.Phase != kimiov1beta1.IssuedInvitationPhase ||
+		i.Status.ExpiresAt == nil || !time.Now().Before(i.Status.ExpiresAt.Time) {
+		return nil, errInvitationNotFound
+	}
+
+	var u kimiov1beta1.User
+	if err := s.Client.Get(ctx, types.NamespacedName{Namespace: i.Namespace, Name: i.Spec.Inviter.Name}, &u); err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil, errInvitationNotFound
+		}
+		return nil, err
+	}
+	if u.Status.State != kimiov1beta1.ActiveUserState {
+		return nil, errInvitationNotFound
+	}
+	for _, p := range i.Spec.Profiles {
+		if !u.HasProfile(p.Name) {
+			return nil, errInvitationNotFound
+		}
+	}
+	return i, nil
+}
+
+func toInvitation(i *kimiov1beta1.Invitation) Invitation {
+	ri := Invitation{
+		Name:              i.Name,
+		CreationTimestamp: i.CreationTimestamp,
+		Email:             i.Spec.Email,
+		ExpiresAt:         i.Status.ExpiresAt,
+		Phase:             string(i.Status.Phase),
+	}
+	for _, p := range i.Spec.Profiles {
+		ri.Profiles = append(ri.Profiles, p.Name)
+	}
+	if i.Status.User != nil {
+		ri.User = i.Status.User.Name
+	}
+	return ri
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package selfservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kimiov1beta1 "github.com/filariow/kim/api/v1beta1"
+	"github.com/filariow/kim/pkg/invitation"
+)
+
+func newInvitation(t *testing.T, name, inviter string, phase kimiov1beta1.InvitationPhase, expiresAt time.Time) (*kimiov1beta1.Invitation, string) {
+	t.Helper()
+
+	c, err := invitation.GenerateCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := metav1.NewTime(expiresAt)
+	return &kimiov1beta1.Invitation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name},
+		Spec: kimiov1beta1.InvitationSpec{
+			Inviter:  kimiov1beta1.UserReference{Name: inviter},
+			Email:    "carol@kim.io",
+			Profiles: []kimiov1beta1.AccessProfileReference{{Name: "developer"}},
+		},
+		Status: kimiov1beta1.InvitationStatus{
+			Phase:     phase,
+			CodeHash:  invitation.HashCode(c),
+			ExpiresAt: &exp,
+		},
+	}, c
+}
+
+// newInviter returns a User holding the profile its Invitations grant
+func newInviter(name string, state kimiov1beta1.UserState) *kimiov1beta1.User {
+	u := newUser(name, state)
+	u.Spec.Profiles = []kimiov1beta1.AccessProfileReference{{Name: "developer"}}
+	return u
+}
+
+func TestCreateInvitationValidatesEmail(t *testing.T) {
+	s, _ := newTestServer(t, newUser("alice", kimiov1beta1.ActiveUserState))
+
+	w := doRequest(s, http.MethodPost, invitationsPath, "alice-token", `{"email":"not-an-email"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestInvitationsCanBeDisabled(t *testing.T) {
+	s, _ := newTestServer(t, newUser("alice", kimiov1beta1.ActiveUserState))
+	s.Invitations.Disabled = true
+
+	for _, p := range []string{invitationsPath, redeemInvitationPath} {
+		w := doRequest(s, http.MethodPost, p, "alice-token", `{}`)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 for %s, got %d: %s", p, w.Code, w.Body.String())
+		}
+	}
+}
+
+// forbiddingClient refuses the creation of Invitations, as the admission webhook does
+type forbiddingClient struct {
+	client.Client
+}
+
+func (c forbiddingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if _, ok := obj.(*kimiov1beta1.Invitation); ok {
+		return kerrors.NewForbidden(kimiov1beta1.GroupVersion.WithResource("invitations").GroupResource(), "",
+			errors.New("profile admin is not granted to alice"))
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestCreateInvitationReportsRefusal(t *testing.T) {
+	s, c := newTestServer(t, newUser("alice", kimiov1beta1.ActiveUserState))
+	s.Client = forbiddingClient{Client: c}
+
+	w := doRequest(s, http.MethodPost, invitationsPath, "alice-token", `{"email":"carol@kim.io","profiles":["admin"]}`)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestListInvitationsReturnsOnlyCallerInvitations(t *testing.T) {
+	aliceInvitation, _ := newInvitation(t, "alice-1", "alice", kimiov1beta1.IssuedInvitationPhase, time.Now().Add(time.Hour))
+	bobInvitation, _ := newInvitation(t, "bob-1", "bob", kimiov1beta1.IssuedInvitationPhase, time.Now().Add(time.Hour))
+	s, _ := newTestServer(t,
+		newUser("alice", kimiov1beta1.ActiveUserState),
+		aliceInvitation,
+		bobInvitation,
+	)
+
+	w := doRequest(s, http.MethodGet, invitationsPath, "alice-token", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var l InvitationList
+	if err := json.NewDecoder(w.Body).Decode(&l); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || l.Items[0].Name != "alice-1" || l.Items[0].Code != "" {
+		t.Fatalf("expected only alice-1 without code, got %+v", l.Items)
+	}
+}
+
+func TestRedeemInvitation(t *testing.T) {
+	for _, autoApprove := range []bool{false, true} {
+		i, code := newInvitation(t, "alice-1", "alice", kimiov1beta1.IssuedInvitationPhase, time.Now().Add(time.Hour))
+		s, c := newTestServer(t, newInviter("alice", kimiov1beta1.ActiveUserState), i)
+		s.Invitations.AutoApprove = autoApprove
+
+		w := doRequest(s, http.MethodPost, redeemInvitationPath, "", `{"code":"`+code+`","username":"carol"}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var u kimiov1beta1.User
+		if err := c.Get(context.TODO(), types.NamespacedName{Namespace: testNamespace, Name: "carol"}, &u); err != nil {
+			t.Fatal(err)
+		}
+		expectedState := kimiov1beta1.WaitingForApprovalUserState
+		if autoApprove {
+			expectedState = kimiov1beta1.ActiveUserState
+		}
+		if u.Spec.State != expectedState {
+			t.Fatalf("expected state %s, got %s", expectedState, u.Spec.State)
+		}
+		if u.Spec.Email != "carol@kim.io" || len(u.Spec.Profiles) != 1 || u.Spec.Profiles[0].Name != "developer" {
+			t.Fatalf("unexpected user spec %+v", u.Spec)
+		}
+		if u.Annotations[kimiov1beta1.UserInvitedByAnnotation] != "alice" || u.Annotations[kimiov1beta1.UserInvitationAnnotation] != "alice-1" {
+			t.Fatalf("unexpected annotations %v", u.Annotations)
+		}
+
+		if err := c.Get(context.TODO(), types.NamespacedName{Namespace: testNamespace, Name: "alice-1"}, i); err != nil {
+			t.Fatal(err)
+		}
+		if i.Status.Phase != kimiov1beta1.RedeemedInvitationPhase || i.Status.User == nil || i.Status.User.Name != "carol" {
+			t.Fatalf("expected invitation to be redeemed by carol, got %+v", i.Status)
+		}
+
+		// codes are single-use
+		w = doRequest(s, http.MethodPost, redeemInvitationPath, "", `{"code":"`+code+`","username":"dave"}`)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status 404 on second redemption, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRedeemInvitationRefusesInvalidCodes(t *testing.T) {
+	expired, expiredCode := newInvitation(t, "expired", "alice", kimiov1beta1.IssuedInvitationPhase, time.Now().Add(-time.Hour))
+	pending, pendingCode := newInvitation(t, "pending", "bob", kimiov1beta1.IssuedInvitationPhase, time.Now().Add(time.Hour))
+	issued, issuedCode := newInvitation(t, "issued", "alice", kimiov1beta1.IssuedInvitationPhase, time.Now().Add(time.Hour))
+	revoked, revokedCode := newInvitation(t, "revoked", "dave", kimiov1beta1.IssuedInvitationPhase, time.Now().Add(time.Hour))
+	unknownCode, err := invitation.GenerateCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestServer(t,
+		newInviter("alice", kimiov1beta1.ActiveUserState),
+		newInviter("bob", kimiov1beta1.SuspendedUserState),
+		newUser("dave", kimiov1beta1.ActiveUserState),
+		expired, pending, issued, revoked,
+	)
+
+	tt := []struct {
+		name     string
+		code     string
+		username string
+		status   int
+	}{
+		{name: "malformed code", code: "not-a-code", username: "carol", status: http.StatusNotFound},
+		{name: "unknown code", code: unknownCode, username: "carol", status: http.StatusNotFound},
+		{name: "expired invitation", code: expiredCode, username: "carol", status: http.StatusNotFound},
+		{name: "inviter not active", code: pendingCode, username: "carol", status: http.StatusNotFound},
+		{name: "profile no more granted to inviter", code: revokedCode, username: "carol", status: http.StatusNotFound},
+		{name: "invalid username", code: issuedCode, username: "Not_Valid", status: http.StatusBadRequest},
+		{name: "username taken", code: issuedCode, username: "bob", status: http.StatusConflict},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			w := doRequest(s, http.MethodPost, redeemInvitationPath, "", `{"code":"`+tc.code+`","username":"`+tc.username+`"}`)
+			if w.Code != tc.status {
+				t.Fatalf("expected status %d, got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// the invitation is released when the User can not be created
+	w := doRequest(s, http.MethodPost, redeemInvitationPath, "", `{"code":"`+issuedCode+`","username":"carol"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+}
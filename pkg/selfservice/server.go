@@ -0,0 +1,135 @@
+/*
+Copyright 2023 Francesco Ilario.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package selfservice implements an HTTP API that allows Users to manage
+// their own PersonalAccessTokens and Invitations. Callers authenticate with
+// the token of the ServiceAccount KIM provides to them, except invitees
+// redeeming an Invitation, who authenticate with the invitation code.
+package selfservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/filariow/kim/pkg/activity"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+// Policy constraints the PersonalAccessTokens Users can create
+type Policy struct {
+	// DefaultLifetime is the lifetime of PersonalAccessTokens created without an explicit one
+	DefaultLifetime time.Duration
+	// MaxLifetime is the maximum lifetime of a PersonalAccessToken, 0 means unlimited
+	MaxLifetime time.Duration
+}
+
+// InvitationPolicy configures the Users created redeeming Invitations
+type InvitationPolicy struct {
+	// AutoApprove creates Active Users, otherwise they wait for approval
+	AutoApprove bool
+	// Disabled does not serve the invitation endpoints
+	Disabled bool
+}
+
+// Server serves the self-service API.
+// It implements the controller-runtime's manager.Runnable interface.
+type Server struct {
+	Client        client.Client
+	Authenticator Authenticator
+	Policy        Policy
+	Invitations   InvitationPolicy
+	Log           logr.Logger
+
+	// Activity records the activity of the authenticated Users
+	Activity *activity.Tracker
+
+	// BindAddress is the address the server binds to
+	BindAddress string
+	// CertDir contains the tls.crt and tls.key files used to serve over TLS
+	CertDir string
+	// Insecure serves over plain HTTP when CertDir is not set, otherwise the
+	// server refuses to start without it
+	Insecure bool
+	// TokenTimeout is the maximum time to wait for a new token to be issued
+	TokenTimeout time.Duration
+}
+
+// Start runs the server until the context is cancelled
+func (s *Server) Start(ctx context.Context) error {
+	if s.CertDir == "" && !s.Insecure {
+		return errors.New("a certificate is required to serve the self-service API, unless it is insecure")
+	}
+
+	srv := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+
+	ln, err := net.Listen("tcp", s.BindAddress)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", s.BindAddress, err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		s.Log.Info("starting self-service server", "address", s.BindAddress, "tls", s.CertDir != "")
+		if s.CertDir != "" {
+			errc <- srv.ServeTLS(ln, filepath.Join(s.CertDir, "tls.crt"), filepath.Join(s.CertDir, "tls.key"))
+			return
+		}
+		errc <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		sctx, cf := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cf()
+		if err := srv.Shutdown(sctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}
+}
+
+// NeedLeaderElection returns false as every replica can serve requests
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+// Handler returns the http.Handler serving the self-service API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(personalAccessTokensPath, s.authenticated(s.handlePersonalAccessTokens))
+	mux.Handle(personalAccessTokensPath+"/", s.authenticated(s.handlePersonalAccessToken))
+	if !s.Invitations.Disabled {
+		mux.Handle(invitationsPath, s.authenticated(s.handleInvitations))
+		// invitees are not Users yet, the code authenticates the request
+		mux.HandleFunc(redeemInvitationPath, s.handleRedeemInvitation)
+	}
+	return mux
+}
@@ -0,0 +1,43 @@
+Feature: API Versions
+
+    Scenario: A v1alpha1 User is served as v1beta1
+        Given KIM is deployed
+        When Resource is created:
+        """
+            apiVersion: kim.io/v1alpha1
+            kind: User
+            metadata:
+                name: test-user
+            spec:
+                username: alias-name
+                email: test@test.ts
+                state: Active
+        """
+        Then Resource exists:
+        """
+            apiVersion: kim.io/v1beta1
+            kind: User
+            metadata:
+                name: test-user
+        """
+        And State of user test-user is Active
+
+    Scenario: A v1alpha1 PersonalAccessToken is served as v1beta1
+        Given KIM is deployed
+        When Resource is created:
+        """
+            apiVersion: kim.io/v1alpha1
+            kind: PersonalAccessToken
+            metadata:
+                name: test-pat
+            spec:
+                deadline:
+                    seconds: 1893456000
+        """
+        Then Resource exists:
+        """
+            apiVersion: kim.io/v1beta1
+            kind: PersonalAccessToken
+            metadata:
+                name: test-pat
+        """
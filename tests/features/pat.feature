@@ -1,7 +1,209 @@
 Feature: Personal Access Token
 
     Scenario: A Personal Access Token is created
-        
+        Given KIM is deployed
+        And   Resource is created:
+        """
+            apiVersion: kim.io/v1beta1
+            kind: User
+            metadata:
+                name: test-user
+            spec:
+                username: alias-name
+                email: test@test.ts
+                state: Active
+        """
+        And   State of user test-user is Active
+        When  Resource is created:
+        """
+            apiVersion: kim.io/v1beta1
+            kind: PersonalAccessToken
+            metadata:
+                name: test-pat
+            spec:
+                user:
+                    name: test-user
+        """
+        Then  Phase of personal access token test-pat is Active
+        And   Resource exists:
+        """
+            apiVersion: v1
+            kind: Secret
+            metadata:
+                name: test-pat
+        """
+
     Scenario: A Personal Access Token is deleted
-    
+
     Scenario: A Personal Access Token expires
+        Given KIM is deployed
+        And   Resource is created:
+        """
+            apiVersion: kim.io/v1beta1
+            kind: User
+            metadata:
+                name: test-user
+            spec:
+                username: alias-name
+                email: test@test.ts
+                state: Active
+        """
+        And   State of user test-user is Active
+        When  Resource is created:
+        """
+            apiVersion: kim.io/v1beta1
+            kind: PersonalAccessToken
+            metadata:
+                name: test-pat
+            spec:
+                user:
+                    name: test-user
+                expiration: "2020-01-01T00:00:00Z"
+        """
+        Then  Phase of personal access token test-pat is Expired
+        And   Resource doesn't exist:
+        """
+            apiVersion: v1
+            kind: Secret
+            metadata:
+                name: test-pat
+        """
+
+    Scenario: A Personal Access Token of a User waiting for approval is pending
+        Given KIM is deployed
+        And   Resource is created:
+        """
+            apiVersion: kim.io/v1beta1
+            kind: User
+            metadata:
+                name: test-user
+            spec:
+                username: alias-name
+                email: test@test.ts
+                state: WaitingForApproval
+        """
+        When  Resource is created:
+        """
+            apiVersion: kim.io/v1beta1
+            kind: PersonalAccessToken
+            metadata:
+                name: test-pat
+            spec:
+                user:
+                    name: test-user
+        """
+        Then  Phase of personal access token test-pat is Pending
+
+    Scenario: A Personal Access Token is suspended with its User
+        Given KIM is deployed
+        And   Resource is created:
+        """
+            apiVersion: kim.io/v1beta1
+            kind: User
+            metadata:
+                name: test-user
+            spec:
+                username: alias-name
+                email: test@test.ts
+                state: Active
+        """
+        And   State of user test-user is Active
+        And   Resource is created:
+        """
+            apiVersion: kim.io/v1beta1
+            kind: PersonalAccessToken
+            metadata:
+                name: test-pat
+            spec:
+                user:
+                    name: test-user
+        """
+        And   Phase of personal access token test-pat is Active
+        When  Resource is updated:
+        """
+            apiVersion: kim.io/v1beta1
+            kind: User
+            metadata:
+                name: test-user
+            spec:
+                username: alias-name
+                email: test@test.ts
+                state: Suspended
+        """
+        Then  Phase of personal access token test-pat is Suspended
+        And   Resource exists:
+        """
+            apiVersion: v1
+            kind: Secret
+            metadata:
+                name: test-pat
+        """
+        When  Resource is updated:
+        """
+            apiVersion: kim.io/v1beta1
+            kind: User
+            metadata:
+                name: test-user
+            spec:
+                username: alias-name
+                email: test@test.ts
+                state: Active
+        """
+        Then  Phase of personal access token test-pat is Active
+
+    Scenario: A Personal Access Token is revoked when its User is banned
+        Given KIM is deployed
+        And   Resource is created:
+        """
+            apiVersion: kim.io/v1beta1
+            kind: User
+            metadata:
+                name: test-user
+            spec:
+                username: alias-name
+                email: test@test.ts
+                state: Active
+        """
+        And   State of user test-user is Active
+        And   Resource is created:
+        """
+            apiVersion: kim.io/v1beta1
+            kind: PersonalAccessToken
+            metadata:
+                name: test-pat
+            spec:
+                user:
+                    name: test-user
+        """
+        And   Phase of personal access token test-pat is Active
+        When  Resource is updated:
+        """
+            apiVersion: kim.io/v1beta1
+            kind: User
+            metadata:
+                name: test-user
+            spec:
+                username: alias-name
+                email: test@test.ts
+                state: Banned
+        """
+        Then  Phase of personal access token test-pat is Revoked
+        And   Resource doesn't exist:
+        """
+            apiVersion: v1
+            kind: Secret
+            metadata:
+                name: test-pat
+        """
+        When  Resource is updated:
+        """
+            apiVersion: kim.io/v1beta1
+            kind: User
+            metadata:
+                name: test-user
+            spec:
+                username: alias-name
+                email: test@test.ts
+                state: Active
+        """
+        Then  Phase of personal access token test-pat is Revoked
@@ -0,0 +1,58 @@
+package pats
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/filariow/kim/tests/pkg/kube"
+	"github.com/filariow/kim/tests/pkg/poll"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type PersonalAccessTokens struct {
+	*kube.Kubernetes
+}
+
+func (p *PersonalAccessTokens) PersonalAccessTokenPhaseIs(ctx context.Context, name, phase string) error {
+	gvk := schema.GroupVersionKind{
+		Group:   "kim.io",
+		Version: "v1beta1",
+		Kind:    "PersonalAccessToken",
+	}
+	cli, err := p.Kubernetes.BuildNamespacedClientForResource(ctx, gvk, "")
+	if err != nil {
+		return err
+	}
+
+	lctx, cf := context.WithTimeout(ctx, 2*time.Minute)
+	defer cf()
+
+	return poll.Do(lctx, time.Second, func(ictx context.Context) error {
+		r, err := cli.Get(ictx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		s, ok := r.Object["status"]
+		if !ok {
+			return fmt.Errorf("status not found for personal access token %s", name)
+		}
+
+		ss, ok := s.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("personal access token %s does not have a valid status: %v", name, s)
+		}
+
+		ph, ok := ss["phase"]
+		if !ok {
+			return fmt.Errorf("phase not found in status of personal access token %s: %v", name, s)
+		}
+
+		if ph != phase {
+			return fmt.Errorf("personal access token %s has phase %s, wanted %s", name, ph, phase)
+		}
+		return nil
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/cucumber/godog"
 	"github.com/cucumber/godog/colors"
 	"github.com/filariow/kim/tests/pkg/kube"
+	"github.com/filariow/kim/tests/pkg/pats"
 	"github.com/filariow/kim/tests/pkg/users"
 	cp "github.com/otiai10/copy"
 )
@@ -67,6 +68,9 @@ func InitializeScenario(ctx *godog.ScenarioContext) {
 	u := users.Users{Kubernetes: k}
 	ctx.Step(`^State of user ([\w]+[\w-]*) is (\w+)$`, u.UserStateIs)
 
+	p := pats.PersonalAccessTokens{Kubernetes: k}
+	ctx.Step(`^Phase of personal access token ([\w]+[\w-]*) is (\w+)$`, p.PersonalAccessTokenPhaseIs)
+
 	// set and create the ContextNamespace
 	ctx.Before(buildHookPrepareScenarioNamespace(k))
 